@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/parquet"
+	"pmm-dump/pkg/transferer"
+	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// convertOptions are options of the dump written by convert and merge commands
+type convertOptions struct {
+	output           string
+	stdout           bool
+	format           string
+	revision         native.Revision
+	compression      dump.Compression
+	compressionLevel int
+	recipients       []age.Recipient
+	workersCount     int
+}
+
+// convertDump rewrites VictoriaMetrics chunks of the dump into the requested format. QAN chunks are copied as is.
+// Meta is read before the chunks, so piped dumps are not supported
+func convertDump(ctx context.Context, dumpPath string, identities []age.Identity, opts convertOptions, dumpLog *dump.LogBuffer) error {
+	piped, err := checkPiped()
+	if err != nil {
+		return errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if piped {
+		return errors.New("piped dump is not supported, please, specify path to dump file")
+	}
+	if dumpPath == "" {
+		return errors.New("please, specify path to dump file")
+	}
+
+	dumpParts, err := dump.ListParts(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to find dump parts")
+	}
+	for _, dumpPart := range dumpParts {
+		if !opts.stdout && path.Clean(dumpPart) == path.Clean(opts.output) {
+			return errors.New("converted dump can't be written over the source dump")
+		}
+	}
+	meta, err := transferer.ReadMetaFromDump(dumpParts[0], false, identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to read meta")
+	}
+	meta.VMDataFormat = opts.format
+	meta.Part = 0
+
+	extension := opts.compression.Extension()
+	if len(opts.recipients) != 0 {
+		extension += dump.EncryptedExtension
+	}
+	file, err := createFile(opts.output, opts.stdout, extension)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer file.Close()
+
+	t := transferer.NewRewriter(file, opts.workersCount)
+	t.SetIdentities(identities)
+	t.SetCompression(opts.compression, opts.compressionLevel)
+	t.SetEncryption(opts.recipients, false)
+
+	err = t.Rewrite(ctx, dumpParts, *meta, dumpLog, func(c *dump.Chunk) (*dump.Chunk, error) {
+		if c.Source != dump.VictoriaMetrics {
+			return c, nil
+		}
+		metrics, format, err := victoriametrics.DecodeChunk(c.Content)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug().Msgf("Converting chunk %s from %s to %s format", c.Filename, format, opts.format)
+		if c.Content, err = victoriametrics.EncodeChunk(metrics, opts.format, opts.revision); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Converted VictoriaMetrics chunks to %s format", opts.format)
+	return nil
+}
+
+// convertToOpenMetrics writes samples of VictoriaMetrics chunks in JSON format as OpenMetrics text. Chunks are streamed one by one,
+// so the dump could be piped and isn't loaded into memory as a whole
+func convertToOpenMetrics(dumpPath string, identities []age.Identity, opts convertOptions) error {
+	piped, err := checkPiped()
+	if err != nil {
+		return errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if dumpPath == "" && !piped {
+		return errors.New("please, specify path to dump file")
+	}
+
+	dumpParts := []string{dumpPath}
+	if !piped {
+		if dumpParts, err = dump.ListParts(dumpPath); err != nil {
+			return errors.Wrap(err, "failed to find dump parts")
+		}
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if !opts.stdout {
+		if err := os.MkdirAll(path.Dir(opts.output), 0777); err != nil {
+			return errors.Wrap(err, "failed to create folders for the output file")
+		}
+		if out, err = os.Create(opts.output); err != nil {
+			return errors.Wrapf(err, "failed to create %s", opts.output)
+		}
+		defer out.Close()
+	}
+
+	w := victoriametrics.NewOpenMetricsWriter(out)
+	samples := 0
+	for _, dumpPart := range dumpParts {
+		file, err := getFile(dumpPart, piped)
+		if err != nil {
+			return errors.Wrap(err, "failed to get file")
+		}
+		var writeErr error
+		err = transferer.ReadVMMetrics(file, func(m victoriametrics.Metric) {
+			if writeErr == nil {
+				writeErr = w.Write(m)
+				samples += len(m.Values)
+			}
+		}, identities...)
+		file.Close()
+		if errors.Is(err, transferer.ErrNativeFormat) {
+			return errors.New("VictoriaMetrics data is in native format, convert the dump with `--to json` first")
+		}
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	log.Info().Msgf("Written %d samples in OpenMetrics format", samples)
+	return nil
+}
+
+// convertToParquet writes VictoriaMetrics samples of the dump to metrics.parquet and every QAN chunk to a separate file in qan folder
+// of the output directory. Chunks are streamed one by one, so only a single chunk is kept in memory
+func convertToParquet(dumpPath string, identities []age.Identity, opts convertOptions) error {
+	piped, err := checkPiped()
+	if err != nil {
+		return errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if piped {
+		return errors.New("piped dump is not supported, please, specify path to dump file")
+	}
+	if dumpPath == "" {
+		return errors.New("please, specify path to dump file")
+	}
+
+	dumpParts, err := dump.ListParts(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to find dump parts")
+	}
+	meta, err := transferer.ReadMetaFromDump(dumpParts[0], false, identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to read meta")
+	}
+
+	qanDir := path.Join(opts.output, "qan")
+	if err := os.MkdirAll(qanDir, 0777); err != nil {
+		return errors.Wrap(err, "failed to create output directory")
+	}
+	metricsFile, err := os.Create(path.Join(opts.output, "metrics.parquet"))
+	if err != nil {
+		return errors.Wrap(err, "failed to create metrics file")
+	}
+	defer metricsFile.Close()
+	mw, err := parquet.NewMetricsWriter(metricsFile)
+	if err != nil {
+		return err
+	}
+
+	vmChunks, qanChunks, qanRows := 0, 0, 0
+	for _, dumpPart := range dumpParts {
+		err = transferer.ReadDumpChunks(dumpPart, func(c *dump.Chunk) error {
+			switch c.Source {
+			case dump.VictoriaMetrics:
+				metrics, _, err := victoriametrics.DecodeChunk(c.Content)
+				if err != nil {
+					return errors.Wrapf(err, "failed to decode chunk %s", c.Filename)
+				}
+				if err = mw.WriteChunk(metrics); err != nil {
+					return errors.Wrapf(err, "failed to write chunk %s", c.Filename)
+				}
+				vmChunks++
+			case dump.ClickHouse:
+				if len(meta.ClickHouseColumns) == 0 {
+					if qanChunks == 0 {
+						log.Warn().Msgf("Skipping QAN chunks: %v", transferer.ErrNoClickHouseColumns)
+					}
+					qanChunks++
+					return nil
+				}
+				filename := path.Join(qanDir, strings.TrimSuffix(c.Filename, path.Ext(c.Filename))+".parquet")
+				file, err := os.Create(filename)
+				if err != nil {
+					return errors.Wrapf(err, "failed to create %s", filename)
+				}
+				defer file.Close()
+				rows, err := parquet.WriteQAN(file, meta.ClickHouseColumns, c.Content)
+				if err != nil {
+					return errors.Wrapf(err, "failed to write chunk %s", c.Filename)
+				}
+				qanChunks++
+				qanRows += rows
+			}
+			return nil
+		}, identities...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", dumpPart)
+		}
+	}
+	if err = mw.Close(); err != nil {
+		return err
+	}
+	log.Info().Msgf("Written %d VictoriaMetrics chunks and %d QAN rows of %d chunks in Parquet format to %s", vmChunks, qanRows, qanChunks, opts.output)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"pmm-dump/pkg/transferer"
+)
+
+func printDiffReport(w io.Writer, report *transferer.DiffReport, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tA\tB")
+	fmt.Fprintf(tw, "Series\t%d\t%d\n", report.SeriesA, report.SeriesB)
+	fmt.Fprintf(tw, "Samples\t%d\t%d\n", report.SamplesA, report.SamplesB)
+	fmt.Fprintf(tw, "QAN rows\t%d\t%d\n", report.RowsA, report.RowsB)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if report.Equal() {
+		fmt.Fprintln(w, "\nNo differences found")
+		return nil
+	}
+	fmt.Fprintf(w, "\nMissing samples: %d (%.4f%%)\n", report.MissingSamples, report.Loss*100)
+
+	printRanges := func(title string, ranges []transferer.TimeRange) {
+		if len(ranges) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, r := range ranges {
+			fmt.Fprintf(w, "\t- %s - %s (%v)\n", formatTime(r.Start), formatTime(r.End), r.End.Sub(r.Start))
+		}
+	}
+	printRanges("Time covered only in A", report.CoverageOnlyInA)
+	printRanges("Time covered only in B", report.CoverageOnlyInB)
+
+	printSeries := func(title string, series []string) {
+		if len(series) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s (%d):\n", title, len(series))
+		for _, s := range series {
+			fmt.Fprintf(w, "\t- %s\n", s)
+		}
+	}
+	printSeries("Series only in A", report.SeriesOnlyInA)
+	printSeries("Series only in B", report.SeriesOnlyInB)
+
+	if len(report.Metrics) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(tw, "METRIC\tSERIES A\tSERIES B\tSAMPLES A\tSAMPLES B")
+		for _, m := range report.Metrics {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", m.Name, m.SeriesA, m.SeriesB, m.SamplesA, m.SamplesB)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(report.Services) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(tw, "SERVICE\tROWS A\tROWS B")
+		for _, s := range report.Services {
+			service := s.Service
+			if service == "" {
+				service = "(unknown)"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", service, s.RowsA, s.RowsB)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
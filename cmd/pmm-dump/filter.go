@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io"
+	"path"
+	"time"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/clickhouse/tsv"
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/filter"
+	"pmm-dump/pkg/transferer"
+	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// filterOptions select data of the dump kept by filter command
+type filterOptions struct {
+	selectors  []string
+	where      string
+	start, end *time.Time
+}
+
+// filterDump writes series and QAN rows of the dump matching the filter into a new dump. VictoriaMetrics chunks outside
+// of the time window are dropped without decoding, the rest are decoded, so they should be in JSON format
+func filterDump(ctx context.Context, dumpPath string, identities []age.Identity, opts convertOptions, fopts filterOptions, dumpLog *dump.LogBuffer) error {
+	piped, err := checkPiped()
+	if err != nil {
+		return errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if piped {
+		return errors.New("piped dump is not supported, please, specify path to dump file")
+	}
+	if dumpPath == "" {
+		return errors.New("please, specify path to dump file")
+	}
+
+	dumpParts, err := dump.ListParts(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to find dump parts")
+	}
+	for _, dumpPart := range dumpParts {
+		if !opts.stdout && path.Clean(dumpPart) == path.Clean(opts.output) {
+			return errors.New("filtered dump can't be written over the source dump")
+		}
+	}
+	meta, err := transferer.ReadMetaFromDump(dumpParts[0], false, identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to read meta")
+	}
+	meta.Part = 0
+
+	var seriesFilter *filter.SeriesFilter
+	if len(fopts.selectors) != 0 || fopts.start != nil || fopts.end != nil {
+		if seriesFilter, err = filter.NewSeriesFilter(fopts.selectors, fopts.start, fopts.end); err != nil {
+			return errors.Wrap(err, "invalid series filter")
+		}
+	}
+	// Dumps without QAN data could be filtered by instances even if their meta doesn't contain ClickHouse columns
+	var rowFilter *filter.RowFilter
+	var qanErr error
+	switch {
+	case fopts.where == "" && fopts.start == nil && fopts.end == nil:
+	case len(meta.ClickHouseColumns) == 0:
+		qanErr = errors.Wrap(transferer.ErrNoClickHouseColumns, "QAN rows can't be filtered")
+	default:
+		if rowFilter, err = filter.NewRowFilter(meta.ClickHouseColumns, fopts.where, fopts.start, fopts.end); err != nil {
+			return errors.Wrap(err, "invalid QAN filter")
+		}
+	}
+
+	extension := opts.compression.Extension()
+	if len(opts.recipients) != 0 {
+		extension += dump.EncryptedExtension
+	}
+	file, err := createFile(opts.output, opts.stdout, extension)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer file.Close()
+
+	t := transferer.NewRewriter(file, opts.workersCount)
+	t.SetIdentities(identities)
+	t.SetCompression(opts.compression, opts.compressionLevel)
+	t.SetEncryption(opts.recipients, false)
+
+	err = t.Rewrite(ctx, dumpParts, *meta, dumpLog, func(c *dump.Chunk) (*dump.Chunk, error) {
+		switch {
+		case c.Source == dump.VictoriaMetrics && seriesFilter != nil:
+			return filterVMChunk(c, seriesFilter)
+		case c.Source == dump.ClickHouse && qanErr != nil:
+			return nil, qanErr
+		case c.Source == dump.ClickHouse && rowFilter != nil:
+			return filterQANChunk(c, rowFilter)
+		}
+		return c, nil
+	})
+	if errors.Is(err, transferer.ErrNativeFormat) {
+		return errors.New("VictoriaMetrics data is in native format, convert the dump with `pmm-dump convert --to json` first")
+	}
+	return err
+}
+
+// filterVMChunk returns the chunk with the series matching the filter or nil if there are no such series
+func filterVMChunk(c *dump.Chunk, f *filter.SeriesFilter) (*dump.Chunk, error) {
+	if !f.Overlaps(c.Start, c.End) {
+		return nil, nil
+	}
+	metrics, format, err := victoriametrics.DecodeChunk(c.Content)
+	if err != nil {
+		return nil, err
+	}
+	if format == victoriametrics.FormatNative {
+		return nil, transferer.ErrNativeFormat
+	}
+	metrics = f.Filter(metrics)
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	if c.Content, err = victoriametrics.EncodeChunk(metrics, victoriametrics.FormatJSON, native.RevisionUnknown); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// filterQANChunk returns the chunk with the rows matching the filter or nil if there are no such rows
+func filterQANChunk(c *dump.Chunk, f *filter.RowFilter) (*dump.Chunk, error) {
+	r := csv.NewReader(bytes.NewReader(c.Content))
+	r.Comma = '\t'
+	buf := new(bytes.Buffer)
+	w := tsv.NewWriter(buf)
+	rows := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read TSV")
+		}
+		ok, err := f.Match(record)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if err = w.Write(record); err != nil {
+			return nil, err
+		}
+		rows++
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, nil
+	}
+	c.Content = buf.Bytes()
+	c.RowsLen = rows
+	return c, nil
+}
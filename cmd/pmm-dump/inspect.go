@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"pmm-dump/pkg/transferer"
+)
+
+func printInspectReport(w io.Writer, report *transferer.InspectReport, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	if report.Meta != nil {
+		fmt.Fprintf(w, "PMM Version: %v\n", report.Meta.PMMServerVersion)
+		if report.Meta.VMDataFormat != "" {
+			fmt.Fprintf(w, "VictoriaMetrics data format: %v\n", report.Meta.VMDataFormat)
+		}
+	}
+	if report.Parts > 1 {
+		fmt.Fprintf(w, "Parts: %d\n", report.Parts)
+	}
+
+	for _, s := range report.Sources {
+		fmt.Fprintf(w, "\nSource: %s\n", s.Source)
+		fmt.Fprintf(w, "Chunks: %d\n", len(s.Chunks))
+		fmt.Fprintf(w, "Size: %v (%v)\n", ByteCountDecimal(s.Size), ByteCountBinary(s.Size))
+		if s.Start != nil && s.End != nil {
+			fmt.Fprintf(w, "Time range: %s - %s (%v)\n", formatTime(*s.Start), formatTime(*s.End), s.End.Sub(*s.Start))
+		}
+		if len(s.Gaps) > 0 {
+			fmt.Fprintf(w, "Gaps:\n")
+			for _, g := range s.Gaps {
+				fmt.Fprintf(w, "\t- %s - %s (%v)\n", formatTime(g.Start), formatTime(g.End), g.End.Sub(g.Start))
+			}
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		switch s.Source {
+		case "vm":
+			if s.NativeRevision != "" {
+				fmt.Fprintf(w, "Native revision: %s\n", s.NativeRevision)
+			}
+			fmt.Fprintf(w, "Series: %d\n", s.Series)
+			fmt.Fprintf(w, "Samples: %d\n\n", s.Samples)
+			fmt.Fprintln(tw, "CHUNK\tSTART\tEND\tSIZE\tSERIES\tSAMPLES")
+			for _, c := range s.Chunks {
+				var start, end string
+				if c.Start != nil && c.End != nil {
+					start, end = formatTime(*c.Start), formatTime(*c.End)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", c.Filename, start, end, ByteCountBinary(c.Size), c.Series, c.Samples)
+			}
+			if len(s.Metrics) > 0 {
+				fmt.Fprintln(tw, "\nMETRIC\tSERIES\tSAMPLES")
+				for _, m := range s.Metrics {
+					fmt.Fprintf(tw, "%s\t%d\t%d\n", m.Name, m.Series, m.Samples)
+				}
+			}
+		case "ch":
+			fmt.Fprintf(w, "Rows: %d\n", s.Rows)
+			fmt.Fprintf(w, "Columns: %d\n\n", s.Columns)
+			fmt.Fprintln(tw, "CHUNK\tSIZE\tROWS")
+			for _, c := range s.Chunks {
+				fmt.Fprintf(tw, "%s\t%s\t%d\n", c.Filename, ByteCountBinary(c.Size), c.Rows)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -1,21 +1,31 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"pmm-dump/pkg/dump"
 	"pmm-dump/pkg/grafana"
+	"pmm-dump/pkg/parquet"
+	"pmm-dump/pkg/promql"
+	"pmm-dump/pkg/qan"
+	"pmm-dump/pkg/retry"
+	"pmm-dump/pkg/timerange"
 	"pmm-dump/pkg/transferer"
 	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
 )
 
 var (
@@ -48,17 +58,30 @@ func main() {
 
 		dumpPath = cli.Flag("dump-path", "Path to dump file").Short('d').String()
 
-		workersCount = cli.Flag("workers", "Set the number of reading workers").Int()
+		decryptIdentity   = cli.Flag("decrypt-identity", "Path to the age identity file with the secret key to decrypt the dump").String()
+		decryptPassphrase = cli.Flag("decrypt-passphrase", "Passphrase to decrypt the dump").Envar("PMM_DUMP_DECRYPT_PASSPHRASE").String()
+
+		workersCount = cli.Flag("workers", "Set the number of reading workers. Export also uses it for the number of compression workers").Int()
+
+		retryAttempts = cli.Flag("retry-attempts", "Number of attempts to read or write a chunk on connection errors and 502, 503, 504 responses. "+
+			"Export and import only, 1 disables retries").Default(strconv.Itoa(retry.DefaultMaxAttempts)).Int()
+		retryBackoff    = cli.Flag("retry-backoff", "Delay before the first retry of a chunk, it's doubled for every next one").Default(retry.DefaultBackoff.String()).Duration()
+		retryMaxBackoff = cli.Flag("retry-max-backoff", "Max delay between retries of a chunk").Default(retry.DefaultMaxBackoff.String()).Duration()
 
 		vmNativeData = cli.Flag("vm-native-data", "Use VictoriaMetrics' native export format. Reduces dump size, but can be incompatible between PMM versions").Bool()
 		// export command options
 		exportCmd = cli.Command("export", "Export PMM Server metrics to dump file."+
-			"By default only the 4 last hours are exported, but it can be configured via start-ts/end-ts options")
+			"By default only the 4 last hours are exported, but it can be configured via start-ts/end-ts, last or around/window options")
 
 		start = exportCmd.Flag("start-ts",
-			"Start date-time to filter exported metrics, ex. "+time.RFC3339).String()
+			"Start date-time to filter exported metrics: RFC3339, date-time without timezone or Unix epoch seconds/millis, ex. "+time.RFC3339).String()
 		end = exportCmd.Flag("end-ts",
-			"End date-time to filter exported metrics, ex. "+time.RFC3339).String()
+			"End date-time to filter exported metrics: RFC3339, date-time without timezone or Unix epoch seconds/millis, ex. "+time.RFC3339).String()
+		last     = exportCmd.Flag("last", "Duration of the exported time range ending at end-ts or now, ex. 6h").Duration()
+		around   = exportCmd.Flag("around", "Middle date-time of the exported time range of the window duration, ex. 2024-05-01T10:00Z").String()
+		window   = exportCmd.Flag("window", "Duration of the exported time range around the around date-time, ex. 2h").Duration()
+		timezone = exportCmd.Flag("timezone", "Timezone of the date-times without timezone, ex. Europe/Berlin. "+
+			"By default PMM timezone is used or UTC if it isn't set").String()
 
 		tsSelector = exportCmd.Flag("ts-selector", "Time series selector to pass to VM").String()
 		where      = exportCmd.Flag("where", "ClickHouse only. WHERE statement").Short('w').String()
@@ -68,7 +91,10 @@ func main() {
 
 		chunkTimeRange = exportCmd.Flag("chunk-time-range", "Time range to be fit into a single chunk (core metrics). "+
 			"5 minutes by default, example '45s', '5m', '1h'").Default("5m").Duration()
-		chunkRows = exportCmd.Flag("chunk-rows", "Amount of rows to fit into a single chunk (qan metrics)").Default("1000").Int()
+		chunkRows     = exportCmd.Flag("chunk-rows", "Amount of rows to fit into a single chunk (qan metrics)").Default("1000").Int()
+		chunkAdaptive = exportCmd.Flag("chunk-adaptive", "Adapt chunk time range of core metrics: split chunks, which time out or exceed chunk-target-size, "+
+			"and grow it while chunks are small. chunk-time-range is the initial value").Bool()
+		chunkTargetSize = exportCmd.Flag("chunk-target-size", "Max size of the core metrics chunk for chunk-adaptive, ex. 16MiB").Default("16MiB").Bytes()
 
 		ignoreLoad = exportCmd.Flag("ignore-load", "Disable checking for load threshold values").Bool()
 		maxLoad    = exportCmd.Flag("max-load", "Max load threshold values. For the CPU value is overall regardless cores count: 0-100%").
@@ -76,18 +102,136 @@ func main() {
 		criticalLoad = exportCmd.Flag("critical-load", "Critical load threshold values. For the CPU value is overall regardless cores count: 0-100%").
 				Default(fmt.Sprintf("%v=90,%v=90,%v=30", transferer.ThresholdCPU, transferer.ThresholdRAM, transferer.ThresholdMYRAM)).String()
 
+		compression = exportCmd.Flag("compression", "Compression of the dump file: gzip, zstd or none").
+				Default(dump.GzipCompression.String()).
+				Enum(dump.GzipCompression.String(), dump.ZstdCompression.String(), dump.NoCompression.String())
+		compressionLevel = exportCmd.Flag("compression-level", "Compression level: 1-9 for gzip, 1-22 for zstd. "+
+			"By default best compression is used for gzip and default level for zstd").Int()
+
+		encryptRecipients = exportCmd.Flag("encrypt-recipient", "age public key (age1...) to encrypt the dump for. "+
+			"Use multiple times to encrypt for multiple recipients").Strings()
+		encryptPassphrase = exportCmd.Flag("encrypt-passphrase", "Passphrase to encrypt the dump").Envar("PMM_DUMP_ENCRYPT_PASSPHRASE").String()
+		encryptClearMeta  = exportCmd.Flag("encrypt-clear-meta", "Keep meta of the encrypted dump readable without the key").Bool()
+
 		stdout = exportCmd.Flag("stdout", "Redirect output to STDOUT").Bool()
+		resume = exportCmd.Flag("resume", "Keep a journal of exported chunks next to the dump file and resume interrupted export from it. "+
+			"Requires dump-path to be a file").Bool()
+		splitSize = exportCmd.Flag("split-size", "Split the dump into parts of the given size, ex. 2GiB. "+
+			"Parts are named dump.part001.tar.gz, dump.part002.tar.gz, ...").Bytes()
+		sinceDump = exportCmd.Flag("since-dump", "Path to the previous dump. Only the data exported after it is written into the new dump. "+
+			"Encrypted previous dump is decrypted with decrypt-identity or decrypt-passphrase").String()
 
 		exportServicesInfo = exportCmd.Flag("export-services-info", "Export overview info about all the services, that are being monitored").Bool()
 		// import command options
 		importCmd = cli.Command("import", "Import PMM Server metrics from dump file")
 
 		vmContentLimit = importCmd.Flag("vm-content-limit", "Limit the chunk content size for VictoriaMetrics (in bytes). Doesn't work with native format").Default("0").Uint64()
+		importResume   = importCmd.Flag("resume", "Keep a state of imported chunks next to the dump file and skip them on the next run").Bool()
+
+		ignoreNativeRevision = importCmd.Flag("ignore-vm-native-revision", "Import native dump even if its format revision doesn't match "+
+			"VictoriaMetrics version of PMM").Bool()
 
 		// show meta command options
 		showMetaCmd  = cli.Command("show-meta", "Shows metadata from the specified dump file")
 		prettifyMeta = showMetaCmd.Flag("prettify", "Print meta in human readable format").Default("true").Bool()
 
+		// verify command options
+		verifyCmd = cli.Command("verify", "Verifies integrity of the specified dump file without connecting to PMM")
+
+		// inspect command options
+		inspectCmd    = cli.Command("inspect", "Lists chunks of the specified dump file with their time coverage, series and rows").Alias("ls")
+		inspectFormat = inspectCmd.Flag("format", "Output format: table or json").Default("table").Enum("table", "json")
+
+		// diff command options
+		diffCmd    = cli.Command("diff", "Compares series, samples, time coverage and QAN rows of two dump files without connecting to PMM")
+		diffA      = diffCmd.Arg("a", "Path to the first dump file").Required().String()
+		diffB      = diffCmd.Arg("b", "Path to the second dump file").Required().String()
+		diffFormat = diffCmd.Flag("format", "Output format: table or json").Default("table").Enum("table", "json")
+
+		// serve command options
+		serveCmd    = cli.Command("serve", "Serves metrics of the dump file via read only Prometheus-compatible query API")
+		serveListen = serveCmd.Flag("listen", "Address to listen on").Default(":9090").String()
+
+		// query command options
+		queryCmd   = cli.Command("query", "Evaluates PromQL/MetricsQL expression against metrics of the dump file")
+		queryExpr  = queryCmd.Arg("expr", "PromQL/MetricsQL expression").Required().String()
+		queryStart = queryCmd.Flag("start",
+			"Start date-time of the range query, ex. "+time.RFC3339+". The dump start is used if only end is set").String()
+		queryEnd = queryCmd.Flag("end",
+			"End date-time of the range query, ex. "+time.RFC3339+". The dump end is used if only start is set").String()
+		queryStep   = queryCmd.Flag("step", "Step of the range query").Default("1m").Duration()
+		queryFormat = queryCmd.Flag("format", "Output format: table, csv or json").Default("table").Enum("table", "csv", "json")
+
+		// qan-report command options
+		qanReportCmd   = cli.Command("qan-report", "Ranks QAN queries of the dump file by total time, count, rows examined or lock time")
+		qanReportStart = qanReportCmd.Flag("start",
+			"Start date-time of the report window, ex. "+time.RFC3339+". The whole dump is used by default").String()
+		qanReportEnd = qanReportCmd.Flag("end",
+			"End date-time of the report window, ex. "+time.RFC3339+". The whole dump is used by default").String()
+		qanReportSortBy = qanReportCmd.Flag("sort-by", "Metric to rank queries by: "+strings.Join(qan.SortKeys, ", ")).Default("time").Enum(qan.SortKeys...)
+		qanReportLimit  = qanReportCmd.Flag("limit", "Amount of top queries to print. All the queries are printed if it's 0").Default("10").Int()
+		qanReportFormat = qanReportCmd.Flag("format", "Output format: table or json").Default("table").Enum("table", "json")
+
+		// report command options
+		reportCmd    = cli.Command("report", "Generates self-contained HTML report with meta, coverage, key graphs and top QAN queries of the dump file")
+		reportOutput = reportCmd.Flag("output", "Path to the HTML report").Short('o').Default("report.html").String()
+		reportTopQAN = reportCmd.Flag("qan-limit", "Amount of top QAN queries in the report").Default("10").Int()
+
+		// convert command options
+		convertCmd = cli.Command("convert", "Rewrites VictoriaMetrics chunks of the dump file between JSON and native formats into a new dump file "+
+			"or writes them as OpenMetrics text or Parquet files")
+		convertTo = convertCmd.Flag("to", "Format of VictoriaMetrics chunks: json, native, openmetrics or parquet. "+
+			"OpenMetrics text or Parquet files of VictoriaMetrics and QAN data are written instead of the dump").
+			Required().Enum("json", "native", "openmetrics", "parquet")
+		convertRevision = convertCmd.Flag("vm-native-revision", "Revision of the native format: v1 for VictoriaMetrics < 1.82.0 or v2 for later versions").
+				Default("v2").Enum("v1", "v2")
+		convertOutput      = convertCmd.Flag("output", "Path to the converted dump file, OpenMetrics text file or Parquet output directory").Short('o').String()
+		convertStdout      = convertCmd.Flag("stdout", "Write the converted dump or OpenMetrics text to STDOUT").Bool()
+		convertCompression = convertCmd.Flag("compression", "Compression of the converted dump file: gzip, zstd or none").
+					Default(dump.GzipCompression.String()).
+					Enum(dump.GzipCompression.String(), dump.ZstdCompression.String(), dump.NoCompression.String())
+		convertCompressionLevel = convertCmd.Flag("compression-level", "Compression level: 1-9 for gzip, 1-22 for zstd. "+
+			"By default best compression is used for gzip and default level for zstd").Int()
+		convertRecipients = convertCmd.Flag("encrypt-recipient", "age public key (age1...) to encrypt the converted dump for. "+
+			"Use multiple times to encrypt for multiple recipients").Strings()
+		convertPassphrase = convertCmd.Flag("encrypt-passphrase", "Passphrase to encrypt the converted dump").Envar("PMM_DUMP_ENCRYPT_PASSPHRASE").String()
+
+		// merge command options
+		mergeCmd   = cli.Command("merge", "Merges dump files of adjacent periods or different services into a new dump file")
+		mergePaths = mergeCmd.Arg("dumps", "Paths to the dump files to merge").Required().Strings()
+		mergeTo    = mergeCmd.Flag("to", "Convert VictoriaMetrics chunks to the format: json or native. "+
+			"Required if the dumps have VictoriaMetrics data in different formats").Enum("json", "native")
+		mergeRevision = mergeCmd.Flag("vm-native-revision", "Revision of the native format: v1 for VictoriaMetrics < 1.82.0 or v2 for later versions").
+				Default("v2").Enum("v1", "v2")
+		mergeOutput      = mergeCmd.Flag("output", "Path to the merged dump file").Short('o').String()
+		mergeStdout      = mergeCmd.Flag("stdout", "Write the merged dump to STDOUT").Bool()
+		mergeCompression = mergeCmd.Flag("compression", "Compression of the merged dump file: gzip, zstd or none").
+					Default(dump.GzipCompression.String()).
+					Enum(dump.GzipCompression.String(), dump.ZstdCompression.String(), dump.NoCompression.String())
+		mergeCompressionLevel = mergeCmd.Flag("compression-level", "Compression level: 1-9 for gzip, 1-22 for zstd. "+
+			"By default best compression is used for gzip and default level for zstd").Int()
+		mergeRecipients = mergeCmd.Flag("encrypt-recipient", "age public key (age1...) to encrypt the merged dump for. "+
+			"Use multiple times to encrypt for multiple recipients").Strings()
+		mergePassphrase = mergeCmd.Flag("encrypt-passphrase", "Passphrase to encrypt the merged dump").Envar("PMM_DUMP_ENCRYPT_PASSPHRASE").String()
+
+		// filter command options
+		filterCmd         = cli.Command("filter", "Writes series and QAN rows of the dump file matching the filters into a new dump file")
+		filterStart       = filterCmd.Flag("start-ts", "Start date-time to filter metrics of the dump, ex. "+time.RFC3339).String()
+		filterEnd         = filterCmd.Flag("end-ts", "End date-time to filter metrics of the dump, ex. "+time.RFC3339).String()
+		filterTSSelector  = filterCmd.Flag("ts-selector", "Time series selector to filter VictoriaMetrics series, ex. {service_name=\"mysql-1\"}").String()
+		filterWhere       = filterCmd.Flag("where", "WHERE statement to filter QAN rows, ex. service_name='mysql-1'").Short('w').String()
+		filterInstances   = filterCmd.Flag("instance", "Service name to filter instances. Use multiple times to filter by multiple instances").Strings()
+		filterOutput      = filterCmd.Flag("output", "Path to the filtered dump file").Short('o').String()
+		filterStdout      = filterCmd.Flag("stdout", "Write the filtered dump to STDOUT").Bool()
+		filterCompression = filterCmd.Flag("compression", "Compression of the filtered dump file: gzip, zstd or none").
+					Default(dump.GzipCompression.String()).
+					Enum(dump.GzipCompression.String(), dump.ZstdCompression.String(), dump.NoCompression.String())
+		filterCompressionLevel = filterCmd.Flag("compression-level", "Compression level: 1-9 for gzip, 1-22 for zstd. "+
+			"By default best compression is used for gzip and default level for zstd").Int()
+		filterRecipients = filterCmd.Flag("encrypt-recipient", "age public key (age1...) to encrypt the filtered dump for. "+
+			"Use multiple times to encrypt for multiple recipients").Strings()
+		filterPassphrase = filterCmd.Flag("encrypt-passphrase", "Passphrase to encrypt the filtered dump").Envar("PMM_DUMP_ENCRYPT_PASSPHRASE").String()
+
 		// version command options
 		versionCmd = cli.Command("version", "Shows tool version of the binary")
 	)
@@ -125,7 +269,7 @@ func main() {
 		parseURL(pmmURL, pmmHost, pmmPort, pmmUser, pmmPassword)
 		auth(pmmURL, pmmUser, pmmPassword, &grafanaC)
 
-		dumpLog := new(bytes.Buffer)
+		dumpLog := new(dump.LogBuffer)
 
 		hasLevel := log.Logger.GetLevel()
 
@@ -180,66 +324,189 @@ func main() {
 			}
 		}
 
-		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, pmmConfig.ClickHouseURL, *where)
+		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, pmmConfig.ClickHouseURL, *where, false)
 		if ok {
 			sources = append(sources, chSource)
 		}
 
-		var startTime, endTime time.Time
+		meta, err := composeMeta(*pmmURL, grafanaC, *exportServicesInfo, cli, *vmNativeData)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to compose meta")
+		}
+		if chSource != nil {
+			meta.ClickHouseColumns = chSource.Columns()
+		}
+
+		dumpCompression, err := dump.ParseCompression(*compression)
+		if err != nil {
+			log.Fatal().Msgf("Invalid compression: %v", err)
+		}
+		if err = dumpCompression.ValidateLevel(*compressionLevel); err != nil {
+			log.Fatal().Msgf("Invalid compression level: %v", err)
+		}
 
-		if *end != "" {
-			endTime, err = time.ParseInLocation(time.RFC3339, *end, time.UTC)
+		recipients, err := dump.ParseRecipients(*encryptRecipients, *encryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid encryption options: %v", err)
+		}
+		if len(recipients) == 0 && *encryptClearMeta {
+			log.Fatal().Msg("`--encrypt-clear-meta` requires `--encrypt-recipient` or `--encrypt-passphrase`")
+		}
+		if len(recipients) != 0 && *resume {
+			log.Fatal().Msg("`--resume` is not supported for encrypted dump")
+		}
+		dumpExtension := dumpCompression.Extension()
+		if len(recipients) != 0 {
+			dumpExtension += dump.EncryptedExtension
+		}
+
+		tzName := *timezone
+		if tzName == "" && meta.PMMTimezone != nil {
+			tzName = *meta.PMMTimezone
+		}
+		loc, err := timerange.LoadLocation(tzName)
+		if err != nil {
+			log.Fatal().Msgf("Invalid timezone: %v", err)
+		}
+		timeRange, err := timerange.Options{
+			Start:  *start,
+			End:    *end,
+			Last:   *last,
+			Around: *around,
+			Window: *window,
+		}.Resolve(time.Now(), loc)
+		if err != nil {
+			log.Fatal().Msgf("Invalid time range: %v", err)
+		}
+		startTime, endTime := timeRange.Start, timeRange.End
+
+		var journal *transferer.Journal
+		if *resume {
+			if *chunkAdaptive {
+				log.Fatal().Msg("`--chunk-adaptive` is not supported with `--resume`")
+			}
+			if *stdout {
+				log.Fatal().Msg("`--resume` is not supported with `--stdout`")
+			}
+			if !isFilePath(*dumpPath) {
+				log.Fatal().Msg("`--resume` requires `--dump-path` to be a path to the dump file")
+			}
+
+			journal, err = transferer.OpenJournal(*dumpPath, meta.Arguments, startTime, endTime)
 			if err != nil {
-				log.Fatal().Msgf("Error parsing end date-time: %v", err)
+				log.Fatal().Err(err).Msg("Failed to open journal")
 			}
-		} else {
-			endTime = time.Now().UTC()
+			startTime, endTime = journal.Start(), journal.End()
 		}
 
-		if *start != "" {
-			startTime, err = time.ParseInLocation(time.RFC3339, *start, time.UTC)
+		vmStart, qanStart := startTime, startTime
+		if *sinceDump != "" {
+			parent, err := readParentDump(*sinceDump, *decryptIdentity, *decryptPassphrase)
 			if err != nil {
-				log.Fatal().Msgf("Error parsing start date-time: %v", err)
+				log.Fatal().Msgf("Failed to read previous dump: %v", err)
 			}
-		} else {
-			startTime = endTime.Add(-1 * time.Hour * 4)
+			meta.Parent = parent
+			vmStart = incrementalStart(startTime, timeRange.StartSet, parent.VMEnd)
+			qanStart = incrementalStart(startTime, timeRange.StartSet, parent.QANEnd)
+		}
+		exportStart := vmStart
+		if *dumpQAN && (!*dumpCore || qanStart.Before(vmStart)) {
+			exportStart = qanStart
 		}
+		meta.Start, meta.End = &exportStart, &endTime
 
-		if startTime.After(endTime) {
-			log.Fatal().Msg("Invalid time range: start > end")
+		if *splitSize != 0 {
+			if *splitSize < minSplitSize {
+				log.Fatal().Msg("`--split-size` should be at least 1MiB")
+			}
+			if *stdout {
+				log.Fatal().Msg("`--split-size` is not supported with `--stdout`")
+			}
+			if *resume {
+				log.Fatal().Msg("`--split-size` is not supported with `--resume`")
+			}
 		}
 
-		file, err := createFile(*dumpPath, *stdout)
+		var file io.ReadWriteCloser
+		var createPart transferer.PartCreator
+		switch {
+		case journal != nil:
+			file, err = openFileForResume(*dumpPath, journal.Offset())
+		case *splitSize != 0:
+			createPart, err = partCreator(*dumpPath, dumpExtension)
+		default:
+			file, err = createFile(*dumpPath, *stdout, dumpExtension)
+		}
 		if err != nil {
 			log.Fatal().Msgf("Failed to create file: %v", err)
 		}
-		defer file.Close()
+		if file != nil {
+			defer file.Close()
+		}
 
 		t, err := transferer.New(file, sources, *workersCount)
 		if err != nil {
 			log.Fatal().Msgf("Failed to setup export: %v", err)
 		}
+		t.SetCompression(dumpCompression, *compressionLevel)
+		t.SetEncryption(recipients, *encryptClearMeta)
+		t.SetRetryPolicy(retryPolicy(*retryAttempts, *retryBackoff, *retryMaxBackoff))
+		if createPart != nil {
+			t.SetSplit(int64(*splitSize), createPart)
+		}
 
 		var chunks []dump.ChunkMeta
 
+		planCore := false
 		if *dumpCore {
-			chunks = append(chunks, victoriametrics.SplitTimeRangeIntoChunks(startTime, endTime, *chunkTimeRange)...)
+			if vmStart.Before(endTime) {
+				if *chunkAdaptive {
+					planCore = true
+				} else {
+					chunks = append(chunks, victoriametrics.SplitTimeRangeIntoChunks(vmStart, endTime, *chunkTimeRange)...)
+				}
+			} else {
+				log.Info().Msg("No new core metrics since the previous dump")
+			}
 		}
 
 		if *dumpQAN {
-			chChunks, err := chSource.SplitIntoChunks(startTime, endTime, *chunkRows)
-			if err != nil {
-				log.Fatal().Msgf("Failed to create clickhouse chunks: %s", err.Error())
+			if qanStart.Before(endTime) {
+				var chChunks []dump.ChunkMeta
+				planned := false
+				if journal != nil {
+					chChunks, planned = journal.QANChunks()
+				}
+				if !planned {
+					chChunks, err = chSource.SplitIntoChunks(qanStart, endTime, *chunkRows)
+					if err != nil {
+						log.Fatal().Msgf("Failed to create clickhouse chunks: %s", err.Error())
+					}
+					if journal != nil {
+						if err = journal.SetQANChunks(chChunks); err != nil {
+							log.Fatal().Err(err).Msg("Failed to record clickhouse chunks in journal")
+						}
+					}
+				}
+				chunks = append(chunks, chChunks...)
+			} else {
+				log.Info().Msg("No new QAN metrics since the previous dump")
 			}
-			chunks = append(chunks, chChunks...)
 		}
 
-		meta, err := composeMeta(*pmmURL, grafanaC, *exportServicesInfo, cli, *vmNativeData)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to compose meta")
+		var pool transferer.ChunkPool
+		if planCore {
+			pool, err = victoriametrics.NewChunkPlanner(vmStart, endTime, victoriametrics.PlannerConfig{
+				TimeRange:     *chunkTimeRange,
+				MinTimeRange:  victoriametrics.MinAdaptiveChunkTimeRange,
+				MaxTimeRange:  victoriametrics.MaxAdaptiveChunkTimeRange,
+				TargetSize:    int64(*chunkTargetSize),
+				TargetLatency: victoriametrics.DefaultAdaptiveChunkLatency,
+				InFlight:      t.WorkersCount(),
+			}, chunks)
+		} else {
+			pool, err = dump.NewChunkPool(chunks)
 		}
-
-		pool, err := dump.NewChunkPool(chunks)
 		if err != nil {
 			log.Fatal().Msgf("Failed to generate chunk pool: %v", err)
 		}
@@ -254,7 +521,7 @@ func main() {
 
 		lc := transferer.NewLoadChecker(ctx, grafanaC, pmmConfig.VictoriaMetricsURL, thresholds)
 
-		if err = t.Export(ctx, lc, *meta, pool, dumpLog); err != nil {
+		if err = t.Export(ctx, lc, *meta, pool, dumpLog, journal); err != nil {
 			log.Fatal().Msgf("Failed to export: %v", err)
 		}
 	case importCmd.FullCommand():
@@ -282,6 +549,13 @@ func main() {
 			log.Fatal().Err(err).Msg("Failed to check if a program is piped")
 		}
 
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+
+		dumpParts := []string{*dumpPath}
+		var partInfos []*transferer.DumpInfo
 		if piped {
 			if *vmNativeData {
 				log.Warn().Msgf("Cannot read meta file during import in a pipeline. Using VictoriaMetrics' native export format because `--vm-native-data` was provided")
@@ -289,9 +563,26 @@ func main() {
 				log.Warn().Msgf("Cannot read meta file during import in a pipeline. Using VictoriaMetrics' JSON export format")
 			}
 		} else {
-			dumpMeta, err := transferer.ReadMetaFromDump(*dumpPath, false)
+			dumpParts, err = dump.ListParts(*dumpPath)
 			if err != nil {
-				log.Warn().Msgf("Can't show meta: %v", err)
+				log.Fatal().Msgf("Failed to find dump parts: %v", err)
+			}
+			if len(dumpParts) > 1 {
+				log.Info().Msgf("Found %d dump parts", len(dumpParts))
+			}
+
+			// Meta and manifest of every part are read before any chunk is imported, so missing chunks are found beforehand
+			for _, dumpPart := range dumpParts {
+				info, err := readDumpInfo(dumpPart, identities)
+				if err != nil {
+					log.Fatal().Err(err).Msgf("Failed to read manifest of %s", dumpPart)
+				}
+				partInfos = append(partInfos, info)
+			}
+
+			dumpMeta := partInfos[0].Meta
+			if dumpMeta == nil {
+				log.Warn().Msgf("Can't show meta: meta file is not found in %s", dumpParts[0])
 				*vmNativeData = true
 			} else {
 				switch dumpMeta.VMDataFormat {
@@ -318,7 +609,7 @@ func main() {
 			sources = append(sources, vmSource)
 		}
 
-		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, pmmConfig.ClickHouseURL, *where)
+		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, pmmConfig.ClickHouseURL, *where, *importResume)
 		if ok {
 			sources = append(sources, chSource)
 		}
@@ -327,15 +618,8 @@ func main() {
 			log.Fatal().Msg("Please, specify path to dump file")
 		}
 
-		file, err := getFile(*dumpPath, piped)
-		if err != nil {
-			log.Fatal().Msgf("Failed to get file: %v", err)
-		}
-		defer file.Close()
-
-		t, err := transferer.New(file, sources, *workersCount)
-		if err != nil {
-			log.Fatal().Msgf("Failed to setup import: %v", err)
+		if *importResume && piped {
+			log.Fatal().Msg("`--resume` is not supported when the dump is read from a pipeline")
 		}
 
 		meta, err := composeMeta(*pmmURL, grafanaC, *exportServicesInfo, cli, *vmNativeData)
@@ -343,14 +627,74 @@ func main() {
 			log.Fatal().Err(err).Msg("Failed to compose meta")
 		}
 
-		if err = t.Import(ctx, *meta); err != nil {
-			var additionalInfo string
-			if victoriametrics.ErrIsRequestEntityTooLarge(err) {
-				additionalInfo = ". Consider to use \"vm-content-limit\" option. Also, you can decrease \"chunk-time-range\" or \"chunk-rows\" values. " +
-					"If you use nginx or Apache HTTP Server, consider increasing the maximum size of the client " +
-					"request body in their configuration"
+		nativeRevision := native.RevisionUnknown
+		if vmSource != nil && *vmNativeData && !*ignoreNativeRevision {
+			nativeRevision = targetNativeRevision(grafanaC, *pmmURL, vmSource)
+		}
+		revisionHint := fmt.Sprintf(". Convert the dump with `pmm-dump convert --to native --vm-native-revision %s` or `--to json`, "+
+			"or use `--ignore-vm-native-revision` to import it anyway", nativeRevisionFlag(nativeRevision))
+
+		// Revision of the dump file is checked before any chunk is imported. Piped dump is checked by import
+		// on its first VictoriaMetrics chunk, so ClickHouse chunks preceding it could be already imported
+		for i, info := range partInfos {
+			if err := transferer.CheckNativeRevision(info.NativeRevision, nativeRevision); err != nil {
+				log.Fatal().Msgf("Failed to import %s: %v%s", dumpParts[i], err, revisionHint)
+			}
+			if info.NativeRevision != native.RevisionUnknown {
+				log.Debug().Msgf("Native format revision of %s is %s", dumpParts[i], info.NativeRevision)
 			}
-			log.Fatal().Msgf("Failed to import: %v%s", err, additionalInfo)
+		}
+
+		for i, dumpPart := range dumpParts {
+			file, err := getFile(dumpPart, piped)
+			if err != nil {
+				log.Fatal().Msgf("Failed to get file: %v", err)
+			}
+
+			var partMeta *dump.Meta
+			var manifest *dump.Manifest
+			if piped {
+				log.Warn().Msg("Dump is read from a pipeline: chunks are checked against the manifest only after they are imported")
+			} else {
+				partMeta, manifest = partInfos[i].Meta, partInfos[i].Manifest
+			}
+
+			var state *transferer.ImportState
+			if *importResume {
+				checksum, err := transferer.DumpChecksum(partMeta, manifest)
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to identify the dump for import state")
+				}
+				state, err = transferer.OpenImportState(dumpPart, *pmmURL, checksum)
+				if err != nil {
+					log.Fatal().Err(err).Msg("Failed to open import state")
+				}
+			}
+
+			t, err := transferer.New(file, sources, *workersCount)
+			if err != nil {
+				log.Fatal().Msgf("Failed to setup import: %v", err)
+			}
+			t.SetIdentities(identities)
+			t.SetManifest(manifest)
+			if piped {
+				t.SetNativeRevision(nativeRevision)
+			}
+			t.SetRetryPolicy(retryPolicy(*retryAttempts, *retryBackoff, *retryMaxBackoff))
+
+			if err = t.Import(ctx, *meta, state); err != nil {
+				var additionalInfo string
+				if errors.Is(err, transferer.ErrIncompatibleNativeRevision) {
+					additionalInfo = revisionHint
+				}
+				if victoriametrics.ErrIsRequestEntityTooLarge(err) {
+					additionalInfo = ". Consider to use \"vm-content-limit\" option. Also, you can decrease \"chunk-time-range\" or \"chunk-rows\" values. " +
+						"If you use nginx or Apache HTTP Server, consider increasing the maximum size of the client " +
+						"request body in their configuration"
+				}
+				log.Fatal().Msgf("Failed to import: %v%s", err, additionalInfo)
+			}
+			file.Close()
 		}
 	case showMetaCmd.FullCommand():
 		piped, err := checkPiped()
@@ -361,15 +705,44 @@ func main() {
 			log.Fatal().Msg("Please, specify path to dump file")
 		}
 
-		meta, err := transferer.ReadMetaFromDump(*dumpPath, piped)
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
 		if err != nil {
-			log.Fatal().Msgf("Can't show meta: %v", err)
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+
+		dumpParts := []string{*dumpPath}
+		if !piped {
+			if dumpParts, err = dump.ListParts(*dumpPath); err != nil {
+				log.Fatal().Msgf("Failed to find dump parts: %v", err)
+			}
+		}
+
+		var meta *dump.Meta
+		for _, dumpPart := range dumpParts {
+			partMeta, err := readDumpPartMeta(dumpPart, piped, identities)
+			if err != nil {
+				log.Fatal().Msgf("Can't show meta: %v", err)
+			}
+			if meta == nil {
+				meta = partMeta
+			} else if partMeta.MaxChunkSize > meta.MaxChunkSize {
+				meta.MaxChunkSize = partMeta.MaxChunkSize
+			}
+		}
+		if len(dumpParts) > 1 {
+			meta.Part = 0
+			log.Info().Msgf("Dump consists of %d parts", len(dumpParts))
 		}
 
 		if *prettifyMeta {
 			fmt.Printf("Build: %v\n", meta.Version.GitCommit)
 			fmt.Printf("PMM Version: %v\n", meta.PMMServerVersion)
 			fmt.Printf("Max Chunk Size: %v (%v)\n", ByteCountDecimal(meta.MaxChunkSize), ByteCountBinary(meta.MaxChunkSize))
+			if len(dumpParts) > 1 {
+				fmt.Printf("Parts: %d\n", len(dumpParts))
+			} else if meta.Part != 0 {
+				fmt.Printf("Part: %d\n", meta.Part)
+			}
 			if meta.PMMTimezone != nil {
 				fmt.Printf("PMM Timezone: %s\n", *meta.PMMTimezone)
 			}
@@ -383,6 +756,33 @@ func main() {
 					fmt.Printf("\t  Agents ID: %v\n", s.AgentsIDs)
 				}
 			}
+			if meta.Start != nil && meta.End != nil {
+				fmt.Printf("Time range: %s - %s\n", formatTime(*meta.Start), formatTime(*meta.End))
+			}
+			if meta.Parent != nil {
+				fmt.Printf("Previous dump: %s\n", meta.Parent.Filename)
+				if meta.Parent.VMEnd != nil {
+					fmt.Printf("\tCore metrics end: %s\n", formatTime(*meta.Parent.VMEnd))
+				}
+				if meta.Parent.QANEnd != nil {
+					fmt.Printf("\tQAN metrics end: %s\n", formatTime(*meta.Parent.QANEnd))
+				}
+			}
+			if meta.Retries != nil {
+				fmt.Printf("Chunk retries: %d, recovered chunks: %d, failed chunks: %d\n", meta.Retries.Retries, meta.Retries.Recovered, meta.Retries.Failed)
+			}
+			if len(meta.MergedDumps) > 0 {
+				fmt.Printf("Merged dumps:\n")
+				for _, d := range meta.MergedDumps {
+					fmt.Printf("\t- Filename: %s\n", d.Filename)
+					if d.Parent != "" {
+						fmt.Printf("\t  Previous dump: %s\n", d.Parent)
+					}
+					fmt.Printf("\t  PMM Version: %s\n", d.PMMServerVersion)
+					fmt.Printf("\t  VictoriaMetrics data format: %s\n", d.VMDataFormat)
+					fmt.Printf("\t  Arguments: %s\n", d.Arguments)
+				}
+			}
 		} else {
 			jsonMeta, err := json.MarshalIndent(meta, "", "\t")
 			if err != nil {
@@ -391,6 +791,382 @@ func main() {
 
 			fmt.Printf("%v\n", string(jsonMeta))
 		}
+	case inspectCmd.FullCommand():
+		piped, err := checkPiped()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to check if a program is piped")
+		}
+		if *dumpPath == "" && piped == false {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+
+		dumpParts := []string{*dumpPath}
+		if !piped {
+			if dumpParts, err = dump.ListParts(*dumpPath); err != nil {
+				log.Fatal().Msgf("Failed to find dump parts: %v", err)
+			}
+		}
+
+		inspector := transferer.NewInspector(identities...)
+		for _, dumpPart := range dumpParts {
+			file, err := getFile(dumpPart, piped)
+			if err != nil {
+				log.Fatal().Msgf("Failed to get file: %v", err)
+			}
+			err = inspector.Add(file)
+			file.Close()
+			if err != nil {
+				log.Fatal().Msgf("Failed to inspect %s: %v", dumpPart, err)
+			}
+		}
+
+		if err = printInspectReport(os.Stdout, inspector.Report(), *inspectFormat); err != nil {
+			log.Fatal().Msgf("Failed to print report: %v", err)
+		}
+	case diffCmd.FullCommand():
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+
+		aParts, err := dump.ListParts(*diffA)
+		if err != nil {
+			log.Fatal().Msgf("Failed to find dump parts: %v", err)
+		}
+		bParts, err := dump.ListParts(*diffB)
+		if err != nil {
+			log.Fatal().Msgf("Failed to find dump parts: %v", err)
+		}
+
+		report, err := transferer.Diff(aParts, bParts, identities...)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compare dumps: %v", err)
+		}
+		if err = printDiffReport(os.Stdout, report, *diffFormat); err != nil {
+			log.Fatal().Msgf("Failed to print report: %v", err)
+		}
+		if !report.Equal() {
+			log.Fatal().Msg("Dumps are different")
+		}
+	case serveCmd.FullCommand():
+		storage, err := loadDumpMetrics(*dumpPath, *decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Failed to load dump: %v", err)
+		}
+
+		log.Info().Msgf("Serving Prometheus API on %s", *serveListen)
+		if err := http.ListenAndServe(*serveListen, promql.NewHandler(promql.NewEngine(storage))); err != nil {
+			log.Fatal().Msgf("Failed to serve: %v", err)
+		}
+	case queryCmd.FullCommand():
+		if *queryStep <= 0 {
+			log.Fatal().Msg("Step should be positive")
+		}
+		storage, err := loadDumpMetrics(*dumpPath, *decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Failed to load dump: %v", err)
+		}
+
+		// Instant query is evaluated at the end of the dump unless the time range is set
+		minTime, maxTime := storage.TimeRange()
+		instant := *queryStart == "" && *queryEnd == ""
+		startTime, endTime := time.UnixMilli(maxTime), time.UnixMilli(maxTime)
+		if !instant {
+			startTime, endTime = time.UnixMilli(minTime), time.UnixMilli(maxTime)
+			if *queryStart != "" {
+				if startTime, err = time.ParseInLocation(time.RFC3339, *queryStart, time.UTC); err != nil {
+					log.Fatal().Msgf("Error parsing start date-time: %v", err)
+				}
+			}
+			if *queryEnd != "" {
+				if endTime, err = time.ParseInLocation(time.RFC3339, *queryEnd, time.UTC); err != nil {
+					log.Fatal().Msgf("Error parsing end date-time: %v", err)
+				}
+			}
+			if startTime.After(endTime) {
+				log.Fatal().Msg("Invalid time range: start > end")
+			}
+		}
+
+		result, err := promql.NewEngine(storage).Query(*queryExpr, startTime.UnixMilli(), endTime.UnixMilli(), queryStep.Milliseconds())
+		if err != nil {
+			log.Fatal().Msgf("Failed to evaluate query: %v", err)
+		}
+		if err = printQueryResult(os.Stdout, result, instant, *queryFormat); err != nil {
+			log.Fatal().Msgf("Failed to print result: %v", err)
+		}
+	case qanReportCmd.FullCommand():
+		if *qanReportLimit < 0 {
+			log.Fatal().Msg("Limit should not be negative")
+		}
+		var start, end *time.Time
+		for _, v := range []struct {
+			value string
+			time  **time.Time
+			name  string
+		}{{*qanReportStart, &start, "start"}, {*qanReportEnd, &end, "end"}} {
+			if v.value == "" {
+				continue
+			}
+			t, err := time.ParseInLocation(time.RFC3339, v.value, time.UTC)
+			if err != nil {
+				log.Fatal().Msgf("Error parsing %s date-time: %v", v.name, err)
+			}
+			*v.time = &t
+		}
+		if start != nil && end != nil && start.After(*end) {
+			log.Fatal().Msg("Invalid time range: start > end")
+		}
+
+		aggregator, err := loadDumpQAN(*dumpPath, *decryptIdentity, *decryptPassphrase, start, end)
+		if err != nil {
+			log.Fatal().Msgf("Failed to load dump: %v", err)
+		}
+		if aggregator == nil {
+			log.Fatal().Msg("Dump doesn't contain QAN data")
+		}
+		report, err := aggregator.Report(*qanReportSortBy, *qanReportLimit)
+		if err != nil {
+			log.Fatal().Msgf("Failed to make report: %v", err)
+		}
+		if err = printQANReport(os.Stdout, report, *qanReportFormat); err != nil {
+			log.Fatal().Msgf("Failed to print report: %v", err)
+		}
+	case reportCmd.FullCommand():
+		if err := generateReport(*dumpPath, *decryptIdentity, *decryptPassphrase, *reportOutput, *reportTopQAN); err != nil {
+			log.Fatal().Msgf("Failed to generate report: %v", err)
+		}
+		log.Info().Msgf("Report is written to %s", *reportOutput)
+	case convertCmd.FullCommand():
+		dumpLog := new(dump.LogBuffer)
+		log.Logger = log.Logger.Output(zerolog.MultiLevelWriter(logConsoleWriter, dumpLog))
+
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+		dumpCompression, err := dump.ParseCompression(*convertCompression)
+		if err != nil {
+			log.Fatal().Msgf("Invalid compression: %v", err)
+		}
+		if err = dumpCompression.ValidateLevel(*convertCompressionLevel); err != nil {
+			log.Fatal().Msgf("Invalid compression level: %v", err)
+		}
+		recipients, err := dump.ParseRecipients(*convertRecipients, *convertPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid encryption options: %v", err)
+		}
+		revision := native.RevisionV2
+		if *convertRevision == nativeRevisionFlag(native.RevisionV1) {
+			revision = native.RevisionV1
+		}
+
+		if (*convertOutput == "") == !*convertStdout {
+			log.Fatal().Msg("Please, specify either `--output` or `--stdout`")
+		}
+
+		opts := convertOptions{
+			output:           *convertOutput,
+			stdout:           *convertStdout,
+			format:           *convertTo,
+			revision:         revision,
+			compression:      dumpCompression,
+			compressionLevel: *convertCompressionLevel,
+			recipients:       recipients,
+			workersCount:     *workersCount,
+		}
+		switch opts.format {
+		case victoriametrics.FormatOpenMetrics:
+			err = convertToOpenMetrics(*dumpPath, identities, opts)
+		case parquet.Format:
+			if opts.stdout {
+				log.Fatal().Msg("Parquet files can't be written to STDOUT, please, specify output directory with `--output`")
+			}
+			err = convertToParquet(*dumpPath, identities, opts)
+		default:
+			err = convertDump(ctx, *dumpPath, identities, opts, dumpLog)
+		}
+		if err != nil {
+			log.Fatal().Msgf("Failed to convert dump: %v", err)
+		}
+	case mergeCmd.FullCommand():
+		dumpLog := new(dump.LogBuffer)
+		log.Logger = log.Logger.Output(zerolog.MultiLevelWriter(logConsoleWriter, dumpLog))
+
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+		dumpCompression, err := dump.ParseCompression(*mergeCompression)
+		if err != nil {
+			log.Fatal().Msgf("Invalid compression: %v", err)
+		}
+		if err = dumpCompression.ValidateLevel(*mergeCompressionLevel); err != nil {
+			log.Fatal().Msgf("Invalid compression level: %v", err)
+		}
+		recipients, err := dump.ParseRecipients(*mergeRecipients, *mergePassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid encryption options: %v", err)
+		}
+		revision := native.RevisionV2
+		if *mergeRevision == nativeRevisionFlag(native.RevisionV1) {
+			revision = native.RevisionV1
+		}
+		if (*mergeOutput == "") == !*mergeStdout {
+			log.Fatal().Msg("Please, specify either `--output` or `--stdout`")
+		}
+		arguments, err := commandArguments(cli)
+		if err != nil {
+			log.Fatal().Msgf("Failed to parse arguments: %v", err)
+		}
+
+		opts := convertOptions{
+			output:           *mergeOutput,
+			stdout:           *mergeStdout,
+			format:           *mergeTo,
+			revision:         revision,
+			compression:      dumpCompression,
+			compressionLevel: *mergeCompressionLevel,
+			recipients:       recipients,
+			workersCount:     *workersCount,
+		}
+		if err = mergeDumps(ctx, *mergePaths, identities, opts, arguments, dumpLog); err != nil {
+			log.Fatal().Msgf("Failed to merge dumps: %v", err)
+		}
+	case filterCmd.FullCommand():
+		dumpLog := new(dump.LogBuffer)
+		log.Logger = log.Logger.Output(zerolog.MultiLevelWriter(logConsoleWriter, dumpLog))
+
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+		dumpCompression, err := dump.ParseCompression(*filterCompression)
+		if err != nil {
+			log.Fatal().Msgf("Invalid compression: %v", err)
+		}
+		if err = dumpCompression.ValidateLevel(*filterCompressionLevel); err != nil {
+			log.Fatal().Msgf("Invalid compression level: %v", err)
+		}
+		recipients, err := dump.ParseRecipients(*filterRecipients, *filterPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid encryption options: %v", err)
+		}
+		if (*filterOutput == "") == !*filterStdout {
+			log.Fatal().Msg("Please, specify either `--output` or `--stdout`")
+		}
+
+		fopts := filterOptions{where: *filterWhere}
+		if *filterStart != "" {
+			startTime, err := time.ParseInLocation(time.RFC3339, *filterStart, time.UTC)
+			if err != nil {
+				log.Fatal().Msgf("Error parsing start date-time: %v", err)
+			}
+			fopts.start = &startTime
+		}
+		if *filterEnd != "" {
+			endTime, err := time.ParseInLocation(time.RFC3339, *filterEnd, time.UTC)
+			if err != nil {
+				log.Fatal().Msgf("Error parsing end date-time: %v", err)
+			}
+			fopts.end = &endTime
+		}
+		if fopts.start != nil && fopts.end != nil && fopts.start.After(*fopts.end) {
+			log.Fatal().Msg("Invalid time range: start > end")
+		}
+		if *filterTSSelector != "" {
+			fopts.selectors = []string{*filterTSSelector}
+		} else {
+			for _, serviceName := range *filterInstances {
+				fopts.selectors = append(fopts.selectors, fmt.Sprintf(`{service_name="%s"}`, serviceName))
+			}
+		}
+		if fopts.where == "" && len(*filterInstances) > 0 {
+			names := make([]string, 0, len(*filterInstances))
+			for _, serviceName := range *filterInstances {
+				names = append(names, fmt.Sprintf("'%s'", strings.ReplaceAll(serviceName, "'", "\\'")))
+			}
+			fopts.where = fmt.Sprintf("service_name IN (%s)", strings.Join(names, ", "))
+		}
+
+		opts := convertOptions{
+			output:           *filterOutput,
+			stdout:           *filterStdout,
+			compression:      dumpCompression,
+			compressionLevel: *filterCompressionLevel,
+			recipients:       recipients,
+			workersCount:     *workersCount,
+		}
+		if err = filterDump(ctx, *dumpPath, identities, opts, fopts, dumpLog); err != nil {
+			log.Fatal().Msgf("Failed to filter dump: %v", err)
+		}
+	case verifyCmd.FullCommand():
+		piped, err := checkPiped()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to check if a program is piped")
+		}
+		if *dumpPath == "" && piped == false {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		identities, err := dump.ParseIdentities(*decryptIdentity, *decryptPassphrase)
+		if err != nil {
+			log.Fatal().Msgf("Invalid decryption options: %v", err)
+		}
+
+		dumpParts := []string{*dumpPath}
+		if !piped {
+			if dumpParts, err = dump.ListParts(*dumpPath); err != nil {
+				log.Fatal().Msgf("Failed to find dump parts: %v", err)
+			}
+		}
+
+		problems := 0
+		for _, dumpPart := range dumpParts {
+			file, err := getFile(dumpPart, piped)
+			if err != nil {
+				log.Fatal().Msgf("Failed to get file: %v", err)
+			}
+			report := transferer.Verify(file, identities...)
+			file.Close()
+
+			if len(dumpParts) > 1 {
+				fmt.Printf("Part: %s\n", dumpPart)
+			}
+			fmt.Printf("VictoriaMetrics chunks: %d\n", report.VMChunks)
+			if report.VMDataFormat != "" {
+				fmt.Printf("VictoriaMetrics data format: %s\n", report.VMDataFormat)
+			}
+			if report.VMNativeRevision != native.RevisionUnknown {
+				fmt.Printf("VictoriaMetrics native revision: %s\n", report.VMNativeRevision)
+			}
+			fmt.Printf("ClickHouse chunks: %d\n", report.CHChunks)
+			if report.CHColumns != 0 {
+				fmt.Printf("ClickHouse columns: %d\n", report.CHColumns)
+			}
+			fmt.Printf("Max Chunk Size: %v (%v)\n", ByteCountDecimal(report.MaxChunkSize), ByteCountBinary(report.MaxChunkSize))
+			if report.ManifestChunks != 0 {
+				fmt.Printf("Manifest chunks: %d\n", report.ManifestChunks)
+			}
+
+			if len(report.Problems) > 0 {
+				fmt.Printf("Problems:\n")
+				for _, p := range report.Problems {
+					fmt.Printf("\t- %s\n", p)
+				}
+				problems += len(report.Problems)
+			}
+		}
+		if problems > 0 {
+			log.Fatal().Msgf("Dump verification failed: found %d problems", problems)
+		}
+
+		log.Info().Msg("Dump is valid")
 	case versionCmd.FullCommand():
 		fmt.Printf("Version: %v, Build: %v\n", GitVersion, GitCommit)
 	default:
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/transferer"
+)
+
+// mergeDumps writes union of the chunks of the dumps into a new dump. VictoriaMetrics chunks are converted to the format of the options
+// if it's set, otherwise all the dumps should have VictoriaMetrics data in the same format
+func mergeDumps(ctx context.Context, dumpPaths []string, identities []age.Identity, opts convertOptions, arguments string, dumpLog *dump.LogBuffer) error {
+	piped, err := checkPiped()
+	if err != nil {
+		return errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if piped {
+		return errors.New("piped dump is not supported, please, specify paths to dump files")
+	}
+	if len(dumpPaths) < 2 {
+		return errors.New("please, specify at least two dumps to merge")
+	}
+
+	dumps := make([][]string, 0, len(dumpPaths))
+	metas := make([]dump.Meta, 0, len(dumpPaths))
+	for _, dumpPath := range dumpPaths {
+		dumpParts, err := dump.ListParts(dumpPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find parts of %s", dumpPath)
+		}
+		for _, dumpPart := range dumpParts {
+			if !opts.stdout && path.Clean(dumpPart) == path.Clean(opts.output) {
+				return errors.New("merged dump can't be written over the source dump")
+			}
+		}
+		meta, err := transferer.ReadMetaFromDump(dumpParts[0], false, identities...)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read meta of %s", dumpPath)
+		}
+		dumps = append(dumps, dumpParts)
+		metas = append(metas, *meta)
+	}
+
+	meta, err := transferer.MergeMeta(metas, dumpPaths, opts.format)
+	if errors.Is(err, transferer.ErrMixedVMDataFormat) {
+		return mixedFormatError(err)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to merge meta")
+	}
+	meta.Version = dump.PMMDumpVersion{
+		GitBranch: GitBranch,
+		GitCommit: GitCommit,
+	}
+	meta.Arguments = arguments
+
+	extension := opts.compression.Extension()
+	if len(opts.recipients) != 0 {
+		extension += dump.EncryptedExtension
+	}
+	file, err := createFile(opts.output, opts.stdout, extension)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer file.Close()
+
+	t := transferer.NewRewriter(file, opts.workersCount)
+	t.SetIdentities(identities)
+	t.SetCompression(opts.compression, opts.compressionLevel)
+	t.SetEncryption(opts.recipients, false)
+	if opts.format != "" {
+		t.SetNativeRevision(opts.revision)
+	}
+	err = t.Merge(ctx, dumps, meta, dumpLog, opts.format)
+	if errors.Is(err, transferer.ErrMixedVMDataFormat) {
+		return mixedFormatError(err)
+	}
+	return err
+}
+
+func mixedFormatError(err error) error {
+	return errors.Errorf("%v. Use `--to json` or `--to native` to convert VictoriaMetrics data to the same format", err)
+}
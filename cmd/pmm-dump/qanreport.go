@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"pmm-dump/pkg/qan"
+)
+
+// maxFingerprintLen limits the query shown in the table, the full query is available in json format
+const maxFingerprintLen = 80
+
+func printQANReport(w io.Writer, report *qan.Report, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	if report.Start != nil && report.End != nil {
+		fmt.Fprintf(w, "Window: %s - %s\n", formatTime(*report.Start), formatTime(*report.End))
+	}
+	fmt.Fprintf(w, "Unique queries: %d\n", report.UniqueQueries)
+	fmt.Fprintf(w, "Calls: %s\n", formatNumber(report.Count))
+	fmt.Fprintf(w, "Total time: %s\n\n", formatSeconds(report.TotalTime))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tQUERY ID\tSERVICE\tTIME\tTIME %\tCALLS\tR/CALL\tMAX\tROWS EXAMINED\tLOCK TIME\tQUERY")
+	for i, q := range report.Queries {
+		var percent float64
+		if report.TotalTime > 0 {
+			percent = q.TotalTime / report.TotalTime * 100
+		}
+		// Multiline queries would break the table
+		fingerprint := strings.Join(strings.Fields(q.Fingerprint), " ")
+		if len(fingerprint) > maxFingerprintLen {
+			fingerprint = fingerprint[:maxFingerprintLen-3] + "..."
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%.1f%%\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, q.QueryID, q.ServiceName,
+			formatSeconds(q.TotalTime), percent, formatNumber(q.Count), formatSeconds(q.AvgTime()), formatSeconds(q.MaxTime),
+			formatNumber(q.RowsExamined), formatSeconds(q.LockTime), fingerprint)
+	}
+	return tw.Flush()
+}
+
+func formatSeconds(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64) + "s"
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"pmm-dump/pkg/promql"
+)
+
+func printQueryResult(w io.Writer, result *promql.Result, instant bool, format string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(promql.ResultData(result, instant), "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "csv":
+		return printQueryCSV(w, result)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tSERIES\tVALUE")
+	for _, s := range result.Series {
+		series := promql.FormatLabels(s.Labels)
+		if result.Scalar {
+			series = "scalar"
+		}
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", formatTime(time.UnixMilli(result.Timestamps[i])), series, promql.FormatValue(v))
+		}
+	}
+	return tw.Flush()
+}
+
+// printQueryCSV prints a row per sample with a column for every label found in the result
+func printQueryCSV(w io.Writer, result *promql.Result) error {
+	names := make(map[string]struct{})
+	for _, s := range result.Series {
+		for name := range s.Labels {
+			names[name] = struct{}{}
+		}
+	}
+	columns := make([]string, 0, len(names))
+	for name := range names {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append(append([]string{"timestamp"}, columns...), "value")); err != nil {
+		return err
+	}
+	for _, s := range result.Series {
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			record := []string{formatTime(time.UnixMilli(result.Timestamps[i]))}
+			for _, name := range columns {
+				record = append(record, s.Labels[name])
+			}
+			if err := cw.Write(append(record, promql.FormatValue(v))); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
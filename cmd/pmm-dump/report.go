@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/promql"
+	"pmm-dump/pkg/report"
+	"pmm-dump/pkg/transferer"
+)
+
+// generateReport reads the dump several times: for the coverage, the graphs and the QAN queries, so piped dumps are not supported
+func generateReport(dumpPath, identityPath, passphrase, outputPath string, qanLimit int) error {
+	piped, err := checkPiped()
+	if err != nil {
+		return errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if piped {
+		return errors.New("piped dump is not supported, please, specify path to dump file")
+	}
+	if dumpPath == "" {
+		return errors.New("please, specify path to dump file")
+	}
+
+	identities, err := dump.ParseIdentities(identityPath, passphrase)
+	if err != nil {
+		return errors.Wrap(err, "invalid decryption options")
+	}
+	dumpParts, err := dump.ListParts(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to find dump parts")
+	}
+
+	inspector := transferer.NewInspector(identities...)
+	for _, dumpPart := range dumpParts {
+		file, err := getFile(dumpPart, false)
+		if err != nil {
+			return errors.Wrap(err, "failed to get file")
+		}
+		err = inspector.Add(file)
+		file.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to inspect %s", dumpPart)
+		}
+	}
+
+	data := &report.Data{
+		DumpPath:  dumpPath,
+		Generated: time.Now(),
+		Inspect:   inspector.Report(),
+	}
+
+	storage, err := loadDumpMetrics(dumpPath, identityPath, passphrase)
+	switch {
+	case errors.Is(err, transferer.ErrNativeFormat):
+		log.Warn().Msgf("Skipping graphs: %v", err)
+		data.Notes = append(data.Notes, "Graphs are not available: "+err.Error())
+	case err != nil:
+		return errors.Wrap(err, "failed to load metrics")
+	default:
+		if data.Graphs, err = report.EvalGraphs(promql.NewEngine(storage), report.DefaultGraphs); err != nil {
+			return err
+		}
+	}
+
+	aggregator, err := loadDumpQAN(dumpPath, identityPath, passphrase, nil, nil)
+	switch {
+	case errors.Is(err, transferer.ErrNoClickHouseColumns):
+		log.Warn().Msgf("Skipping QAN: %v", err)
+		data.Notes = append(data.Notes, "QAN queries are not available: "+err.Error())
+	case err != nil:
+		return errors.Wrap(err, "failed to load QAN")
+	case aggregator != nil:
+		if data.QAN, err = aggregator.Report("time", qanLimit); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create report file")
+	}
+	if err = report.Render(file, data); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to render report")
+	}
+	return file.Close()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -15,6 +16,7 @@ import (
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/alecthomas/kingpin"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -24,7 +26,12 @@ import (
 	"pmm-dump/pkg/clickhouse"
 	"pmm-dump/pkg/dump"
 	"pmm-dump/pkg/grafana"
+	"pmm-dump/pkg/promql"
+	"pmm-dump/pkg/qan"
+	"pmm-dump/pkg/retry"
+	"pmm-dump/pkg/transferer"
 	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
 )
 
 const minPMMServerVersion = "2.12.0"
@@ -228,25 +235,10 @@ func composeMeta(pmmURL string, c grafana.Client, exportServices bool, cli *king
 		pmmTz = &pmmTzRaw
 	}
 
-	context, err := cli.DefaultEnvars().ParseContext(os.Args[1:])
+	args, err := commandArguments(cli)
 	if err != nil {
 		return nil, err
 	}
-	var args []string
-	for _, element := range context.Elements {
-		switch element.Clause.(type) {
-		case *kingpin.CmdClause:
-			args = append(args, element.Clause.(*kingpin.CmdClause).FullCommand())
-		case *kingpin.FlagClause:
-			model := element.Clause.(*kingpin.FlagClause).Model()
-			value := model.Value.String()
-			switch model.Name {
-			case "pmm-user", "pmm-pass":
-				value = "***"
-			}
-			args = append(args, fmt.Sprintf("--%s=%s", model.Name, value))
-		}
-	}
 
 	pmmServices := []dump.PMMServerService(nil)
 	if exportServices {
@@ -263,7 +255,7 @@ func composeMeta(pmmURL string, c grafana.Client, exportServices bool, cli *king
 		},
 		PMMServerVersion:  pmmVer,
 		PMMTimezone:       pmmTz,
-		Arguments:         strings.Join(args, " "),
+		Arguments:         args,
 		PMMServerServices: pmmServices,
 		VMDataFormat:      "json",
 	}
@@ -275,6 +267,32 @@ func composeMeta(pmmURL string, c grafana.Client, exportServices bool, cli *king
 	return meta, nil
 }
 
+// commandArguments returns the command line with the values of flags and arguments. Credentials are masked
+func commandArguments(cli *kingpin.Application) (string, error) {
+	context, err := cli.DefaultEnvars().ParseContext(os.Args[1:])
+	if err != nil {
+		return "", err
+	}
+	var args []string
+	for _, element := range context.Elements {
+		switch clause := element.Clause.(type) {
+		case *kingpin.CmdClause:
+			args = append(args, clause.FullCommand())
+		case *kingpin.ArgClause:
+			args = append(args, *element.Value)
+		case *kingpin.FlagClause:
+			model := clause.Model()
+			value := model.Value.String()
+			switch model.Name {
+			case "pmm-user", "pmm-pass", "encrypt-passphrase", "decrypt-passphrase":
+				value = "***"
+			}
+			args = append(args, fmt.Sprintf("--%s=%s", model.Name, value))
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
 func ByteCountDecimal(b int64) string {
 	const unit = 1000
 	if b < unit {
@@ -358,6 +376,50 @@ func checkVersionSupport(c grafana.Client, pmmURL, victoriaMetricsURL string) {
 	}
 }
 
+// minPMMVersionNativeV2 is the first PMM version shipped with VictoriaMetrics 1.82, which uses v2 native format revision
+const minPMMVersionNativeV2 = "2.33.0"
+
+// targetNativeRevision returns revision of the native format accepted by VictoriaMetrics of PMM. It's taken from VictoriaMetrics
+// version if it's available, otherwise it's guessed by PMM version. Unknown revision is returned if both versions are unavailable
+func targetNativeRevision(c grafana.Client, pmmURL string, vmSource *victoriametrics.Source) native.Revision {
+	vmVersion, err := vmSource.Version()
+	if err == nil {
+		rev, err := native.RevisionForVersion(vmVersion)
+		if err == nil {
+			log.Info().Msgf("VictoriaMetrics %s accepts native format revision %s", vmVersion, rev)
+			return rev
+		}
+		log.Debug().Msgf("Failed to parse VictoriaMetrics version: %v", err)
+	} else {
+		log.Debug().Msgf("Failed to get VictoriaMetrics version: %v", err)
+	}
+
+	pmmVer, _, err := getPMMVersion(pmmURL, c)
+	if err != nil {
+		log.Warn().Msgf("Failed to get PMM version, native format revision of the dump can't be checked: %v", err)
+		return native.RevisionUnknown
+	}
+	v, err := native.CompareVersions(pmmVer, minPMMVersionNativeV2)
+	if err != nil {
+		log.Warn().Msgf("Failed to parse PMM version, native format revision of the dump can't be checked: %v", err)
+		return native.RevisionUnknown
+	}
+	rev := native.RevisionV2
+	if v < 0 {
+		rev = native.RevisionV1
+	}
+	log.Info().Msgf("PMM %s accepts native format revision %s", pmmVer, rev)
+	return rev
+}
+
+// nativeRevisionFlag returns value of `--vm-native-revision` flag for the revision
+func nativeRevisionFlag(rev native.Revision) string {
+	if rev == native.RevisionV1 {
+		return "v1"
+	}
+	return "v2"
+}
+
 func prepareVictoriaMetricsSource(grafanaC grafana.Client, dumpCore bool, url string, selectors []string, nativeData bool, contentLimit uint64) (*victoriametrics.Source, bool) {
 	if !dumpCore {
 		return nil, false
@@ -375,14 +437,15 @@ func prepareVictoriaMetricsSource(grafanaC grafana.Client, dumpCore bool, url st
 	return victoriametrics.NewSource(grafanaC, *c), true
 }
 
-func prepareClickHouseSource(ctx context.Context, dumpQAN bool, url, where string) (*clickhouse.Source, bool) {
+func prepareClickHouseSource(ctx context.Context, dumpQAN bool, url, where string, commitEveryChunk bool) (*clickhouse.Source, bool) {
 	if !dumpQAN {
 		return nil, false
 	}
 
 	c := &clickhouse.Config{
-		ConnectionURL: url,
-		Where:         where,
+		ConnectionURL:    url,
+		Where:            where,
+		CommitEveryChunk: commitEveryChunk,
 	}
 
 	clickhouseSource, err := clickhouse.NewSource(ctx, *c)
@@ -472,14 +535,61 @@ func getFile(dumpPath string, piped bool) (io.ReadWriteCloser, error) {
 	return file, nil
 }
 
-func createFile(dumpPath string, piped bool) (io.ReadWriteCloser, error) {
+// readDumpPartMeta reads meta of the dump and checks that its chunks listed in the manifest are in place.
+// Chunk contents are skipped, so checksums are checked by `verify` only.
+// Meta kept in clear is returned for encrypted dump, if no identities are provided
+func readDumpPartMeta(dumpPath string, piped bool, identities []age.Identity) (*dump.Meta, error) {
+	file, err := getFile(dumpPath, piped)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file")
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	if dump.IsEncrypted(br) && len(identities) == 0 {
+		meta, err := dump.ReadClearMeta(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "provide `--decrypt-identity` or `--decrypt-passphrase` to decrypt the dump")
+		}
+		log.Warn().Msg("Dump is encrypted: showing meta kept in clear, chunks weren't verified")
+		return meta, nil
+	}
+
+	meta, manifest, err := transferer.ReadMetaAndManifest(br, identities...)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, errors.New("no meta file found in dump")
+	}
+	if manifest != nil {
+		log.Info().Msgf("All %d chunks of the manifest are in place. Use `verify` to check their checksums", len(manifest.Chunks))
+	} else {
+		log.Warn().Msg("No manifest found in dump. Chunks weren't verified")
+	}
+	return meta, nil
+}
+
+// readDumpInfo reads meta, manifest and native format revision of the dump file before import, so missing or truncated chunks
+// and incompatible native data are found before anything is imported, and checksum of every chunk is checked before it's written
+func readDumpInfo(dumpPath string, identities []age.Identity) (*transferer.DumpInfo, error) {
+	file, err := getFile(dumpPath, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get file")
+	}
+	defer file.Close()
+
+	return transferer.ReadDumpInfo(file, identities...)
+}
+
+func createFile(dumpPath string, piped bool, extension string) (io.ReadWriteCloser, error) {
 	var file *os.File
 	if piped {
 		file = os.Stdout
 	} else {
 		exportTS := time.Now().UTC()
 		log.Debug().Msgf("Trying to determine filepath")
-		filepath, err := getDumpFilepath(dumpPath, exportTS)
+		filepath, err := getDumpFilepath(dumpPath, exportTS, extension)
 		if err != nil {
 			return nil, err
 		}
@@ -496,8 +606,77 @@ func createFile(dumpPath string, piped bool) (io.ReadWriteCloser, error) {
 	return file, nil
 }
 
-func getDumpFilepath(customPath string, ts time.Time) (string, error) {
-	autoFilename := fmt.Sprintf("pmm-dump-%v.tar.gz", ts.Unix())
+// loadDumpMetrics reads VictoriaMetrics data of all the dump parts into the in-memory storage
+func loadDumpMetrics(dumpPath, identityPath, passphrase string) (*promql.Storage, error) {
+	piped, err := checkPiped()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if dumpPath == "" && !piped {
+		return nil, errors.New("please, specify path to dump file")
+	}
+
+	identities, err := dump.ParseIdentities(identityPath, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid decryption options")
+	}
+
+	dumpParts := []string{dumpPath}
+	if !piped {
+		if dumpParts, err = dump.ListParts(dumpPath); err != nil {
+			return nil, errors.Wrap(err, "failed to find dump parts")
+		}
+	}
+
+	storage := promql.NewStorage()
+	for _, dumpPart := range dumpParts {
+		file, err := getFile(dumpPart, piped)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get file")
+		}
+		err = transferer.ReadVMMetrics(file, func(m victoriametrics.Metric) {
+			storage.Add(m.Metric, m.Timestamps, m.Values)
+		}, identities...)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	storage.Sort()
+
+	start, end := storage.TimeRange()
+	log.Info().Msgf("Loaded %d series from %s to %s", storage.SeriesCount(),
+		time.UnixMilli(start).UTC().Format(time.RFC3339), time.UnixMilli(end).UTC().Format(time.RFC3339))
+	return storage, nil
+}
+
+// minSplitSize is the minimal size of the dump part
+const minSplitSize = 1 << 20 // 1MiB
+
+// partCreator returns function, which creates dump parts next to the dump path
+func partCreator(dumpPath, extension string) (transferer.PartCreator, error) {
+	log.Debug().Msgf("Trying to determine filepath")
+	filepath, err := getDumpFilepath(dumpPath, time.Now().UTC(), extension)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(filepath), 0777); err != nil {
+		return nil, errors.Wrap(err, "failed to create folders for the dump file")
+	}
+
+	return func(number int) (io.WriteCloser, error) {
+		partPath := dump.PartPath(filepath, number)
+		log.Debug().Msgf("Preparing dump part: %s", partPath)
+		file, err := os.Create(partPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create %s", partPath)
+		}
+		return file, nil
+	}, nil
+}
+
+func getDumpFilepath(customPath string, ts time.Time, extension string) (string, error) {
+	autoFilename := fmt.Sprintf("pmm-dump-%v%s", ts.Unix(), extension)
 	if customPath == "" {
 		return autoFilename, nil
 	}
@@ -514,3 +693,133 @@ func getDumpFilepath(customPath string, ts time.Time) (string, error) {
 
 	return customPath, nil
 }
+
+// isFilePath reports whether the dump path points to a file and not to a directory
+func isFilePath(dumpPath string) bool {
+	if dumpPath == "" || os.IsPathSeparator(dumpPath[len(dumpPath)-1]) {
+		return false
+	}
+	info, err := os.Stat(dumpPath)
+	return err != nil || !info.IsDir()
+}
+
+// openFileForResume opens existing dump file and truncates it to the offset of the last journaled chunk
+func openFileForResume(dumpPath string, offset int64) (io.ReadWriteCloser, error) {
+	log.Debug().Msgf("Opening dump file %s to resume from offset %d", dumpPath, offset)
+	if err := os.MkdirAll(path.Dir(dumpPath), 0777); err != nil {
+		return nil, errors.Wrap(err, "failed to create folders for the dump file")
+	}
+
+	file, err := os.OpenFile(dumpPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", dumpPath)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to stat %s", dumpPath)
+	}
+	if info.Size() < offset {
+		file.Close()
+		return nil, errors.Errorf("dump file %s is smaller than recorded in the journal: %d < %d", dumpPath, info.Size(), offset)
+	}
+
+	if err = file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to truncate %s", dumpPath)
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to seek %s", dumpPath)
+	}
+	return file, nil
+}
+
+// loadDumpQAN aggregates QAN rows of the dump with period_start within [start, end). Nil is returned if there are no QAN rows
+func loadDumpQAN(dumpPath, identityPath, passphrase string, start, end *time.Time) (*qan.Aggregator, error) {
+	piped, err := checkPiped()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check if a program is piped")
+	}
+	if dumpPath == "" && !piped {
+		return nil, errors.New("please, specify path to dump file")
+	}
+
+	identities, err := dump.ParseIdentities(identityPath, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid decryption options")
+	}
+
+	dumpParts := []string{dumpPath}
+	if !piped {
+		if dumpParts, err = dump.ListParts(dumpPath); err != nil {
+			return nil, errors.Wrap(err, "failed to find dump parts")
+		}
+	}
+
+	var aggregator *qan.Aggregator
+	rows := 0
+	for _, dumpPart := range dumpParts {
+		file, err := getFile(dumpPart, piped)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get file")
+		}
+		err = transferer.ReadClickHouseRecords(file, func(columns []dump.ClickHouseColumn, record []string) error {
+			if aggregator == nil {
+				var err error
+				if aggregator, err = qan.NewAggregator(columns, start, end); err != nil {
+					return err
+				}
+			}
+			rows++
+			return aggregator.Add(record)
+		}, identities...)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if aggregator == nil {
+		return nil, nil
+	}
+
+	log.Info().Msgf("Loaded %d QAN rows", rows)
+	return aggregator, nil
+}
+
+// readParentDump returns the previous dump of the incremental export with the end of its data for every source
+func readParentDump(dumpPath, identityPath, passphrase string) (*dump.ParentDump, error) {
+	identities, err := dump.ParseIdentities(identityPath, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid decryption options")
+	}
+	dumpParts, err := dump.ListParts(dumpPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find dump parts")
+	}
+	parent, err := transferer.ReadParentDump(dumpParts, identities...)
+	if err != nil {
+		return nil, err
+	}
+	parent.Filename = path.Base(dumpPath)
+	return parent, nil
+}
+
+// incrementalStart returns start of the data, which isn't exported to the previous dump yet.
+// Start set by the user is kept if it's later than the end of the previous dump
+func incrementalStart(start time.Time, userStart bool, previousEnd *time.Time) time.Time {
+	if previousEnd == nil || (userStart && start.After(*previousEnd)) {
+		return start
+	}
+	return *previousEnd
+}
+
+// retryPolicy returns policy of chunk retries with the default jitter and retryable statuses
+func retryPolicy(attempts int, backoff, maxBackoff time.Duration) retry.Policy {
+	p := retry.DefaultPolicy()
+	p.MaxAttempts = attempts
+	p.Backoff = backoff
+	p.MaxBackoff = maxBackoff
+	return p
+}
@@ -1,18 +1,10 @@
 package e2e
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
-	"crypto/sha256"
 	"encoding/json"
-	"fmt"
-	"io"
 	"math"
-	"os"
-	"path"
 	"path/filepath"
-	"reflect"
 	"testing"
 	"time"
 
@@ -20,6 +12,7 @@ import (
 
 	"pmm-dump/internal/test/util"
 	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/transferer"
 	"pmm-dump/pkg/victoriametrics"
 )
 
@@ -106,250 +99,132 @@ func TestValidate(t *testing.T) {
 	newPMM.Stop()
 }
 
+// validateChunks compares the dumps with diff and returns share of the missing or different samples.
+// Series, time coverage and QAN chunks should be the same. Diff compares only samples count,
+// so values of the samples are compared by their timestamps as well
 func validateChunks(t *testing.T, xDump, yDump string) (float64, error) {
-	xChunkMap, err := readChunks(xDump)
+	report, err := transferer.Diff([]string{xDump}, []string{yDump})
 	if err != nil {
-		return 0, errors.Wrapf(err, "failed to read dump %s", xDump)
+		return 0, errors.Wrap(err, "failed to compare dumps")
 	}
-	yChunkMap, err := readChunks(yDump)
-	if err != nil {
-		return 0, errors.Wrapf(err, "failed to read dump %s", yDump)
+	for _, s := range report.SeriesOnlyInA {
+		t.Logf("Series %s not found in %s", s, yDump)
 	}
-
-	if len(xChunkMap) != len(yChunkMap) {
-		return 0, errors.Wrapf(err, "number of chunks is different in %s = %d and %s = %d", xDump, len(xChunkMap), yDump, len(yChunkMap))
+	for _, s := range report.SeriesOnlyInB {
+		t.Logf("Series %s not found in %s", s, xDump)
 	}
-	var totalValues, totalMissingValues int
-
-	for xFilename, xChunkData := range xChunkMap {
-		yChunkData, ok := yChunkMap[xFilename]
-		if !ok {
-			return 0, errors.Errorf("chunk %s is missing in %s", xFilename, yDump)
-		}
-		dir, _ := path.Split(xFilename)
-		st := dump.ParseSourceType(dir[:len(dir)-1])
-		switch st {
-		case dump.VictoriaMetrics:
-			xChunk, err := vmParseChunk(xChunkData)
-			if err != nil {
-				return 0, errors.Wrapf(err, "failed to parse chunk %s", xFilename)
-			}
-			yChunk, err := vmParseChunk(yChunkData)
-			if err != nil {
-				return 0, errors.Wrapf(err, "failed to parse chunk %s", xFilename)
-			}
-
-			xValues := vmValuesCount(xChunk)
-			yValues := vmValuesCount(yChunk)
-			if xValues > yValues {
-				totalValues += xValues
-			} else {
-				totalValues += yValues
-			}
-
-			missingValues, err := vmCompareChunkData(t, xChunk, yChunk)
-			if err != nil {
-				return 0, errors.Wrapf(err, "failed to compare chunk %s", xFilename)
-			}
-
-			totalMissingValues += missingValues
-		case dump.ClickHouse:
-			if !reflect.DeepEqual(xChunkData, yChunkData) {
-				return 0, errors.Errorf("chunk %s is different", xFilename)
-			}
-		default:
-			return 0, errors.Errorf("unknown source type %s", st)
-		}
+	for _, m := range report.Metrics {
+		t.Logf("Metric %s has %d samples in %s and %d samples in %s", m.Name, m.SamplesA, xDump, m.SamplesB, yDump)
 	}
-	return float64(totalMissingValues) / float64(totalValues), nil
-}
-
-func vmValuesCount(xChunk []vmMetric) int {
-	total := 0
-	for _, v := range xChunk {
-		total += len(v.Values)
+	if len(report.SeriesOnlyInA) != 0 || len(report.SeriesOnlyInB) != 0 {
+		return 0, errors.Errorf("series are different: %d only in %s, %d only in %s", len(report.SeriesOnlyInA), xDump, len(report.SeriesOnlyInB), yDump)
 	}
-	return total
-}
-
-func vmCompareChunkData(t *testing.T, xChunk, yChunk []vmMetric) (int, error) {
-	if len(xChunk) != len(yChunk) {
-		return 0, errors.Errorf("len(x)=%d, len(y)=%d", len(xChunk), len(yChunk))
+	if len(report.CoverageOnlyInA) != 0 || len(report.CoverageOnlyInB) != 0 {
+		return 0, errors.Errorf("time coverage is different: %v only in %s, %v only in %s", report.CoverageOnlyInA, xDump, report.CoverageOnlyInB, yDump)
 	}
 
-	xHashMap := map[string]vmMetric{}
-	for _, v := range xChunk {
-		if _, ok := xHashMap[v.MetricHash()]; ok && v.Hash() != xHashMap[v.MetricHash()].Hash() {
-			return 0, errors.New("duplicate metric but different values")
-		}
-		xHashMap[v.MetricHash()] = v
+	xChunks, err := readCHChunks(xDump)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read dump %s", xDump)
 	}
-
-	yHashMap := map[string]vmMetric{}
-	for _, v := range yChunk {
-		if _, ok := yHashMap[v.MetricHash()]; ok && v.Hash() != yHashMap[v.MetricHash()].Hash() {
-			return 0, errors.New("duplicate metric but different values")
-		}
-		yHashMap[v.MetricHash()] = v
+	yChunks, err := readCHChunks(yDump)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read dump %s", yDump)
 	}
-
-	loss := 0
-
-	for k, xMetric := range xHashMap {
-		yMetric, ok := yHashMap[k]
+	if len(xChunks) != len(yChunks) {
+		return 0, errors.Errorf("number of QAN chunks is different in %s = %d and %s = %d", xDump, len(xChunks), yDump, len(yChunks))
+	}
+	for filename, xContent := range xChunks {
+		yContent, ok := yChunks[filename]
 		if !ok {
-			continue
+			return 0, errors.Errorf("chunk %s is missing in %s", filename, yDump)
 		}
-
-		currentLoss := xMetric.CompareTimestampValues(t, yMetric)
-		if currentLoss > 0 {
-			loss += currentLoss
-			continue
+		if !bytes.Equal(xContent, yContent) {
+			return 0, errors.Errorf("chunk %s is different", filename)
 		}
-
-		delete(xHashMap, k)
-		delete(yHashMap, k)
 	}
 
-	return loss, nil
-}
-
-type chunkMap map[string][]byte
-
-func readChunks(filename string) (chunkMap, error) {
-	f, err := os.Open(filename)
+	xSamples, err := readVMSamples(xDump)
 	if err != nil {
-		return nil, err
+		return 0, errors.Wrapf(err, "failed to read dump %s", xDump)
 	}
-	defer f.Close()
-
-	gzr, err := gzip.NewReader(f)
+	ySamples, err := readVMSamples(yDump)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open as gzip")
+		return 0, errors.Wrapf(err, "failed to read dump %s", yDump)
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
-	chunkMap := make(chunkMap)
-
-	for {
-		header, err := tr.Next()
-
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			return nil, err
-		}
-
-		dir, filename := path.Split(header.Name)
-
-		switch filename {
-		case dump.MetaFilename, dump.LogFilename:
-			continue
+	var total, lost int
+	for series, xValues := range xSamples {
+		yValues := ySamples[series]
+		total += int(math.Max(float64(len(xValues)), float64(len(yValues))))
+		for timestamp, xValue := range xValues {
+			yValue, ok := yValues[timestamp]
+			switch {
+			case !ok:
+				t.Logf("Value not found for series %s in %s: wanted %v for %d", series, yDump, xValue, timestamp)
+				lost++
+			case !sameValue(xValue, yValue):
+				t.Logf("Values for timestamp %d of series %s are not the same: %v and %v", timestamp, series, xValue, yValue)
+				lost++
+			}
 		}
-
-		if len(dir) == 0 {
-			return nil, errors.Errorf("corrupted dump: found unknown file %s", filename)
+		for timestamp, yValue := range yValues {
+			if _, ok := xValues[timestamp]; !ok {
+				t.Logf("Value not found for series %s in %s: wanted %v for %d", series, xDump, yValue, timestamp)
+				lost++
+			}
 		}
+	}
+	if total == 0 {
+		return report.Loss, nil
+	}
+	return math.Max(report.Loss, float64(lost)/float64(total)), nil
+}
 
-		st := dump.ParseSourceType(dir[:len(dir)-1])
-		if st == dump.UndefinedSource {
-			return nil, errors.Errorf("corrupted dump: found undefined source: %s", dir)
+// readVMSamples returns values of the samples of the dump by their series and timestamps
+func readVMSamples(dumpPath string) (map[string]map[int64]float64, error) {
+	samples := make(map[string]map[int64]float64)
+	err := transferer.ReadDumpChunks(dumpPath, func(c *dump.Chunk) error {
+		if c.Source != dump.VictoriaMetrics {
+			return nil
 		}
-
-		content, err := io.ReadAll(tr)
+		metrics, _, err := victoriametrics.DecodeChunk(c.Content)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to read chunk content")
+			return errors.Wrapf(err, "failed to parse chunk %s", c.Filename)
 		}
-
-		if len(content) == 0 {
-			continue
+		for _, m := range metrics {
+			key, err := json.Marshal(m.Metric)
+			if err != nil {
+				return err
+			}
+			values, ok := samples[string(key)]
+			if !ok {
+				values = make(map[int64]float64)
+				samples[string(key)] = values
+			}
+			for i, timestamp := range m.Timestamps {
+				values[timestamp] = m.Values[i]
+			}
 		}
-
-		chunkMap[header.Name] = content
-	}
-	return chunkMap, nil
+		return nil
+	})
+	return samples, err
 }
 
-func vmParseChunk(data []byte) ([]vmMetric, error) {
-	r, err := gzip.NewReader(bytes.NewBuffer(data))
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create reader")
-	}
-	defer r.Close()
-	metrics, err := victoriametrics.ParseMetrics(r)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse metrics")
-	}
-	result := make([]vmMetric, len(metrics))
-	for i, v := range metrics {
-		result[i] = vmMetric(v)
-	}
-	return result, nil
+// sameValue compares the sample values treating NaN staleness markers as equal
+func sameValue(x, y float64) bool {
+	return x == y || (math.IsNaN(x) && math.IsNaN(y))
 }
 
-type vmMetric victoriametrics.Metric
-
-func (vm vmMetric) MetricString() string {
-	m := vm.Metric
-	return fmt.Sprintf(`{"__name__": "%s", "job": "%s", "instance": "%s", "agent_id": "%s", "agent_type": "%s"}`, m["__name__"], m["job"], m["instance"], m["agent_id"], m["agent_type"])
-}
-
-func (vm vmMetric) Hash() string {
-	data, err := json.Marshal(vm)
-	if err != nil {
-		panic(err)
-	}
-	return fmt.Sprintf("%x", sha256.Sum256(data))
-}
-
-func (vm vmMetric) MetricHash() string {
-	data, err := json.Marshal(vm.Metric)
-	if err != nil {
-		panic(err)
-	}
-	return fmt.Sprintf("%x", sha256.Sum256(data))
-}
-
-func (vm vmMetric) CompareTimestampValues(t *testing.T, with vmMetric) int {
-	xMap := map[int64]float64{}
-	for i, v := range vm.Timestamps {
-		xMap[v] = vm.Values[i]
-	}
-	yMap := map[int64]float64{}
-	for i, v := range with.Timestamps {
-		yMap[v] = with.Values[i]
-	}
-
-	for timestamp, xValue := range xMap {
-		yValue, ok := yMap[timestamp]
-		if !ok {
-			if t != nil {
-				t.Logf("Value and timestamp not found for metric %s in second dump: wanted %v for %d", vm.MetricString(), xValue, timestamp)
-			}
-			continue
-		}
-		if xValue != yValue {
-			if t != nil {
-				t.Logf("Values for timestamp %d in metric %s are not the same: %v and %v", timestamp, vm.MetricString(), xValue, yValue)
-			}
-			continue
-		}
-		delete(xMap, timestamp)
-		delete(yMap, timestamp)
-	}
+type chunkMap map[string][]byte
 
-	for timestamp, yValue := range yMap {
-		_, ok := xMap[timestamp]
-		if !ok {
-			if t != nil {
-				t.Logf("Value and timestamp not found for metric %s in first dump: wanted %v for %d", vm.MetricString(), yValue, timestamp)
-			}
-			continue
+// readCHChunks returns not empty ClickHouse chunks of the dump by their filenames
+func readCHChunks(dumpPath string) (chunkMap, error) {
+	chunks := make(chunkMap)
+	err := transferer.ReadDumpChunks(dumpPath, func(c *dump.Chunk) error {
+		if c.Source == dump.ClickHouse && len(c.Content) != 0 {
+			chunks[c.Filename] = c.Content
 		}
-	}
-
-	return int(math.Abs(float64(len(xMap) - len(yMap))))
+		return nil
+	})
+	return chunks, err
 }
@@ -3,4 +3,7 @@ package clickhouse
 type Config struct {
 	ConnectionURL string
 	Where         string
+	// CommitEveryChunk makes import insert every chunk in a separate batch, so interrupted import could be resumed.
+	// Otherwise all the chunks are inserted in a single batch committed by FinalizeWrites
+	CommitEveryChunk bool
 }
@@ -11,15 +11,23 @@ import (
 	"io"
 	"pmm-dump/pkg/clickhouse/tsv"
 	"pmm-dump/pkg/dump"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Source struct {
-	db   *sql.DB
-	cfg  Config
+	db    *sql.DB
+	cfg   Config
+	ct    []*sql.ColumnType
+	batch *insertBatch
+}
+
+// insertBatch is the single transaction of the import, which is started by the first written chunk
+type insertBatch struct {
+	mu   sync.Mutex
 	tx   *sql.Tx
-	ct   []*sql.ColumnType
 	stmt *sql.Stmt
 }
 
@@ -39,26 +47,16 @@ func NewSource(ctx context.Context, cfg Config) (*Source, error) {
 			return nil, err
 		}
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, err
-	}
-
 	ct, err := columnTypes(db)
 	if err != nil {
 		return nil, err
 	}
 
-	stmt, err := prepareInsertStatement(tx, len(ct))
-	if err != nil {
-		return nil, err
-	}
 	return &Source{
-		cfg:  cfg,
-		db:   db,
-		tx:   tx,
-		ct:   ct,
-		stmt: stmt,
+		cfg:   cfg,
+		db:    db,
+		ct:    ct,
+		batch: new(insertBatch),
 	}, nil
 }
 
@@ -74,29 +72,19 @@ func (s Source) Type() dump.SourceType {
 	return dump.ClickHouse
 }
 
+// ReadChunk reads rows of the chunk keyset range ordered by period_start and queryid
 func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
-	offset := m.Index * m.RowsLen
-	limit := m.RowsLen
-	query := "SELECT * FROM metrics"
-	where := make([]string, 0, 3)
+	conditions := make([]string, 0, 3)
 	if s.cfg.Where != "" {
-		where = append(where, fmt.Sprintf("(%s)", s.cfg.Where))
+		conditions = append(conditions, fmt.Sprintf("(%s)", s.cfg.Where))
 	}
 	if m.Start != nil {
-		where = append(where, fmt.Sprintf("period_start > %d", m.Start.Unix()))
+		conditions = append(conditions, keysetCondition(">", *m.Start, m.StartKey))
 	}
 	if m.End != nil {
-		where = append(where, fmt.Sprintf("period_start < %d", m.End.Unix()))
-	}
-	for i := range where {
-		if i == 0 {
-			query += " WHERE "
-		} else {
-			query += " AND "
-		}
-		query += where[i]
+		conditions = append(conditions, keysetCondition("<", *m.End, m.EndKey))
 	}
-	query += fmt.Sprintf(" ORDER BY period_start, queryid LIMIT %d OFFSET %d", limit, offset)
+	query := "SELECT * FROM metrics" + whereClause(conditions) + " ORDER BY period_start, queryid"
 	rows, err := s.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -152,8 +140,113 @@ func toStringSlice(iSlice []interface{}) []string {
 	return values
 }
 
+// WriteChunk adds rows of the chunk to the single batch of the import. With CommitEveryChunk set every chunk is inserted
+// in a separate batch instead, so the chunk is either written completely or not written at all.
+// It allows to resume interrupted import without inserting the same rows twice.
 func (s Source) WriteChunk(_ string, r io.Reader) error {
+	if !s.cfg.CommitEveryChunk {
+		stmt, err := s.batchStatement()
+		if err != nil {
+			return err
+		}
+		return insertRows(stmt, r, s.ColumnTypes())
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	stmt, err := prepareInsertStatement(tx, len(s.ct))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	if err = insertRows(stmt, r, s.ColumnTypes()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// batchStatement returns insert statement of the import batch starting the batch if it isn't started yet
+func (s Source) batchStatement() (*sql.Stmt, error) {
+	s.batch.mu.Lock()
+	defer s.batch.mu.Unlock()
+	if s.batch.stmt != nil {
+		return s.batch.stmt, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	stmt, err := prepareInsertStatement(tx, len(s.ct))
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	s.batch.tx, s.batch.stmt = tx, stmt
+	return stmt, nil
+}
+
+// reconcileColumns identify QAN rows: the agent reports one row per period, query and service
+var reconcileColumns = []string{"period_start", "queryid", "service_name"}
+
+// ChunkWritten reports whether rows of the chunk are already in the table. It's used on resume for the chunk,
+// which insert was interrupted: the chunk is inserted in a single batch, so either all its rows are there or none
+func (s Source) ChunkWritten(r io.Reader) (bool, error) {
+	indexes := make([]int, 0, len(reconcileColumns))
+	for _, name := range reconcileColumns {
+		idx := -1
+		for i, c := range s.ct {
+			if c.Name() == name {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return false, errors.Errorf("metrics table has no %s column", name)
+		}
+		indexes = append(indexes, idx)
+	}
+
+	keys := make(map[string]struct{})
 	reader := tsv.NewReader(r, s.ColumnTypes())
+	for {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "failed to read chunk")
+		}
+		periodStart, ok := values[indexes[0]].(time.Time)
+		if !ok {
+			return false, errors.Errorf("invalid period_start: %v", values[indexes[0]])
+		}
+		keys[fmt.Sprintf("(%d, %s, %s)", periodStart.Unix(), quote(fmt.Sprint(values[indexes[1]])), quote(fmt.Sprint(values[indexes[2]])))] = struct{}{}
+	}
+	if len(keys) == 0 {
+		return false, nil
+	}
+
+	tuples := make([]string, 0, len(keys))
+	for k := range keys {
+		tuples = append(tuples, k)
+	}
+	query := fmt.Sprintf("SELECT uniqExact(toUnixTimestamp(period_start), queryid, service_name) FROM metrics "+
+		"WHERE (toUnixTimestamp(period_start), queryid, service_name) IN (%s)", strings.Join(tuples, ", "))
+	var found int
+	if err := s.db.QueryRow(query).Scan(&found); err != nil {
+		return false, errors.Wrap(err, "failed to count rows of the chunk")
+	}
+	return found == len(keys), nil
+}
+
+func insertRows(stmt *sql.Stmt, r io.Reader, ct []*sql.ColumnType) error {
+	reader := tsv.NewReader(r, ct)
 
 	for {
 		records, err := reader.Read()
@@ -163,7 +256,7 @@ func (s Source) WriteChunk(_ string, r io.Reader) error {
 			}
 			return err
 		}
-		_, err = s.stmt.Exec(records...)
+		_, err = stmt.Exec(records...)
 		if err != nil {
 			return err
 		}
@@ -184,57 +277,65 @@ func prepareInsertStatement(tx *sql.Tx, columnsCount int) (*sql.Stmt, error) {
 	return tx.Prepare(query.String())
 }
 
+// FinalizeWrites commits the import batch. Chunks written with CommitEveryChunk are already committed
 func (s Source) FinalizeWrites() error {
-	if err := s.stmt.Close(); err != nil {
-		return err
+	s.batch.mu.Lock()
+	defer s.batch.mu.Unlock()
+	if s.batch.tx == nil {
+		return nil
 	}
-	return s.tx.Commit()
-}
-
-func (s Source) Count(where string) (int, error) {
-	var count int
-	query := "SELECT COUNT(*) FROM metrics"
-	if where != "" {
-		query += fmt.Sprintf(" WHERE %s", where)
-	}
-	row := s.db.QueryRow(query)
-	if err := row.Scan(&count); err != nil {
-		return 0, err
+	if err := s.batch.stmt.Close(); err != nil {
+		return err
 	}
-	return count, nil
+	err := s.batch.tx.Commit()
+	s.batch.tx, s.batch.stmt = nil, nil
+	return err
 }
 
 func (s Source) ColumnTypes() []*sql.ColumnType {
 	return s.ct
 }
 
+// Columns returns names and types of the metrics table columns in the order of values in the chunks
+func (s Source) Columns() []dump.ClickHouseColumn {
+	columns := make([]dump.ClickHouseColumn, 0, len(s.ct))
+	for _, c := range s.ct {
+		columns = append(columns, dump.ClickHouseColumn{Name: c.Name(), Type: c.DatabaseTypeName()})
+	}
+	return columns
+}
+
+// SplitIntoChunks splits rows with period_start in (startTime, endTime) into chunks of chunkRowsLen rows at most.
+// Chunks are ranges of the (period_start, queryid) keyset, so every chunk is read by the index and rows inserted
+// during the export don't shift rows between chunks. Rows of the same period_start and queryid are never split,
+// so the chunk exceeds chunkRowsLen if there are more of them
 func (s Source) SplitIntoChunks(startTime, endTime time.Time, chunkRowsLen int) ([]dump.ChunkMeta, error) {
 	if chunkRowsLen <= 0 {
 		return nil, errors.Errorf("invalid chunk rows len: %v", chunkRowsLen)
 	}
 
-	totalRows, err := s.Count(s.cfg.Where)
+	rangeConditions := make([]string, 0, 3)
+	if s.cfg.Where != "" {
+		rangeConditions = append(rangeConditions, fmt.Sprintf("(%s)", s.cfg.Where))
+	}
+	rangeConditions = append(rangeConditions,
+		fmt.Sprintf("period_start > %d", startTime.Unix()),
+		fmt.Sprintf("period_start < %d", endTime.Unix()))
+
+	periods, err := s.countRows("toUnixTimestamp(period_start)", rangeConditions)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get amount of ClickHouse records")
+		return nil, errors.Wrap(err, "failed to count ClickHouse records by period_start")
 	}
 
-	rowsCounter := totalRows
-	chunksLen := rowsCounter/chunkRowsLen + 1
-	chunks := make([]dump.ChunkMeta, 0, chunksLen)
-	i := 0
-	for rowsCounter > 0 {
-		newChunk := dump.ChunkMeta{
-			Source:  dump.ClickHouse,
-			RowsLen: chunkRowsLen,
-			Index:   i,
-			Start:   &startTime,
-			End:     &endTime,
-		}
-		chunks = append(chunks, newChunk)
-		rowsCounter -= chunkRowsLen
-		i++
+	bounds, totalRows, err := planBounds(periods, chunkRowsLen, func(period int64) ([]rowsCount, error) {
+		return s.countRows("queryid", append([]string{fmt.Sprintf("period_start = %d", period)}, rangeConditions...))
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	chunks := keysetChunks(startTime, endTime, bounds)
+
 	log.Debug().
 		Int("rows", totalRows).
 		Int("chunk_size", chunkRowsLen).
@@ -243,3 +344,137 @@ func (s Source) SplitIntoChunks(startTime, endTime time.Time, chunkRowsLen int)
 
 	return chunks, nil
 }
+
+// planBounds packs rows of period_start groups into chunks. Rows of the single period_start, which don't fit into the chunk,
+// are split by queryid counted by queryIDs. It returns lower bounds of the chunks and the total number of rows
+func planBounds(periods []rowsCount, chunkRowsLen int, queryIDs func(period int64) ([]rowsCount, error)) ([]keysetBound, int, error) {
+	var bounds []keysetBound
+	totalRows := 0
+	for _, g := range packRows(periods, chunkRowsLen) {
+		totalRows += g.rows
+		period, err := strconv.ParseInt(periods[g.first].key, 10, 64)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "invalid period_start %s", periods[g.first].key)
+		}
+		if g.count > 1 || g.rows <= chunkRowsLen {
+			bounds = append(bounds, keysetBound{period: time.Unix(period, 0).UTC(), rows: g.rows})
+			continue
+		}
+
+		counts, err := queryIDs(period)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to count ClickHouse records by queryid")
+		}
+		for _, qg := range packRows(counts, chunkRowsLen) {
+			bounds = append(bounds, keysetBound{period: time.Unix(period, 0).UTC(), key: counts[qg.first].key, rows: qg.rows})
+		}
+	}
+	return bounds, totalRows, nil
+}
+
+// rowsCount is the number of rows with the key
+type rowsCount struct {
+	key  string
+	rows int
+}
+
+// countRows returns numbers of rows matching the conditions grouped by the expression and ordered by it
+func (s Source) countRows(expr string, conditions []string) ([]rowsCount, error) {
+	query := fmt.Sprintf("SELECT toString(%[1]s), count() FROM metrics%[2]s GROUP BY %[1]s ORDER BY %[1]s", expr, whereClause(conditions))
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	var counts []rowsCount
+	for rows.Next() {
+		var c rowsCount
+		if err := rows.Scan(&c.key, &c.rows); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// rowsGroup is the group of count consecutive keys starting from the first one
+type rowsGroup struct {
+	first, count int
+	rows         int
+}
+
+// packRows groups consecutive keys, so every group has limit rows at most. Key with more rows is a group by itself
+func packRows(counts []rowsCount, limit int) []rowsGroup {
+	var groups []rowsGroup
+	for i, c := range counts {
+		if len(groups) == 0 || groups[len(groups)-1].rows+c.rows > limit {
+			groups = append(groups, rowsGroup{first: i})
+		}
+		g := &groups[len(groups)-1]
+		g.count++
+		g.rows += c.rows
+	}
+	return groups
+}
+
+// keysetBound is the lower keyset bound of the chunk with the number of rows in it at the moment of planning
+type keysetBound struct {
+	period time.Time
+	key    string
+	rows   int
+}
+
+// keysetChunks returns chunks between the consecutive bounds. The first chunk starts right after startTime
+// and the last one ends at endTime, so rows inserted out of the planned bounds during the export are still read
+func keysetChunks(startTime, endTime time.Time, bounds []keysetBound) []dump.ChunkMeta {
+	chunks := make([]dump.ChunkMeta, 0, len(bounds))
+	for i, b := range bounds {
+		start, startKey := b.period, b.key
+		if i == 0 {
+			start, startKey = time.Unix(startTime.Unix()+1, 0).UTC(), ""
+		}
+		end, endKey := time.Unix(endTime.Unix(), 0).UTC(), ""
+		if i+1 < len(bounds) {
+			end, endKey = bounds[i+1].period, bounds[i+1].key
+		}
+		chunks = append(chunks, dump.ChunkMeta{
+			Source:   dump.ClickHouse,
+			Start:    &start,
+			End:      &end,
+			StartKey: startKey,
+			EndKey:   endKey,
+			Index:    i,
+			RowsLen:  b.rows,
+		})
+	}
+	return chunks
+}
+
+// keysetCondition compares (period_start, queryid) with the bound: ">" includes the bound, "<" excludes it
+func keysetCondition(op string, period time.Time, key string) string {
+	if key == "" {
+		if op == ">" {
+			return fmt.Sprintf("period_start >= %d", period.Unix())
+		}
+		return fmt.Sprintf("period_start < %d", period.Unix())
+	}
+	keyOp := ">="
+	if op == "<" {
+		keyOp = "<"
+	}
+	return fmt.Sprintf("(period_start %s %d OR (period_start = %d AND queryid %s %s))", op, period.Unix(), period.Unix(), keyOp, quote(key))
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func quote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,124 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestPackRows(t *testing.T) {
+	counts := []rowsCount{{"a", 3}, {"b", 4}, {"c", 12}, {"d", 5}, {"e", 5}, {"f", 1}}
+	expected := []rowsGroup{{first: 0, count: 2, rows: 7}, {first: 2, count: 1, rows: 12}, {first: 3, count: 2, rows: 10}, {first: 5, count: 1, rows: 1}}
+	actual := packRows(counts, 10)
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	period := time.Unix(1714557600, 0)
+	tests := []struct {
+		op, key  string
+		expected string
+	}{
+		{">", "", "period_start >= 1714557600"},
+		{"<", "", "period_start < 1714557600"},
+		{">", "AB12", "(period_start > 1714557600 OR (period_start = 1714557600 AND queryid >= 'AB12'))"},
+		{"<", "it's", `(period_start < 1714557600 OR (period_start = 1714557600 AND queryid < 'it\'s'))`},
+	}
+	for _, tt := range tests {
+		if actual := keysetCondition(tt.op, period, tt.key); actual != tt.expected {
+			t.Fatalf("expected %s, got %s", tt.expected, actual)
+		}
+	}
+}
+
+func TestKeysetChunks(t *testing.T) {
+	type row struct {
+		period  int64
+		queryID string
+	}
+	start := time.Unix(1714557600, 0).UTC()
+	end := start.Add(10 * time.Minute)
+
+	// The third minute is busy and has to be split by queryid. Rows at the range bounds aren't exported
+	var rows []row
+	for m := int64(0); m <= 10; m++ {
+		n := 3
+		if m == 3 {
+			n = 25
+		}
+		for q := 0; q < n; q++ {
+			rows = append(rows, row{period: start.Unix() + m*60, queryID: fmt.Sprintf("Q%02d", q)}, row{period: start.Unix() + m*60, queryID: fmt.Sprintf("Q%02d", q)})
+		}
+	}
+
+	count := func(filter func(row) bool, key func(row) string) []rowsCount {
+		counts := make(map[string]int)
+		for _, r := range rows {
+			if r.period > start.Unix() && r.period < end.Unix() && filter(r) {
+				counts[key(r)]++
+			}
+		}
+		result := make([]rowsCount, 0, len(counts))
+		for k, c := range counts {
+			result = append(result, rowsCount{key: k, rows: c})
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+		return result
+	}
+	periods := count(func(row) bool { return true }, func(r row) string { return strconv.FormatInt(r.period, 10) })
+	bounds, total, err := planBounds(periods, 10, func(period int64) ([]rowsCount, error) {
+		return count(func(r row) bool { return r.period == period }, func(r row) string { return r.queryID }), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 9*6+44 {
+		t.Fatalf("expected %d rows, got %d", 9*6+44, total)
+	}
+	chunks := keysetChunks(start, end, bounds)
+
+	inChunk := func(c dump.ChunkMeta, r row) bool {
+		after := r.period > c.Start.Unix() || (r.period == c.Start.Unix() && r.queryID >= c.StartKey)
+		before := r.period < c.End.Unix() || (r.period == c.End.Unix() && c.EndKey != "" && r.queryID < c.EndKey)
+		return after && before
+	}
+	read := make([]int, len(chunks))
+	for _, r := range rows {
+		var matched []int
+		for i, c := range chunks {
+			if inChunk(c, r) {
+				matched = append(matched, i)
+			}
+		}
+		exported := r.period > start.Unix() && r.period < end.Unix()
+		switch {
+		case exported && len(matched) != 1:
+			t.Fatalf("row %+v matches chunks %v, expected exactly one", r, matched)
+		case !exported && len(matched) != 0:
+			t.Fatalf("row %+v out of range matches chunks %v", r, matched)
+		case exported:
+			read[matched[0]]++
+		}
+	}
+	for i, c := range chunks {
+		if c.Index != i || c.Source != dump.ClickHouse {
+			t.Fatalf("invalid chunk %d: %+v", i, c)
+		}
+		if read[i] > 10 || read[i] != c.RowsLen {
+			t.Fatalf("chunk %d has %d rows, planned %d", i, read[i], c.RowsLen)
+		}
+	}
+	if len(chunks) <= 9*6/10+44/10 {
+		t.Fatalf("expected the busy minute to be split, got %d chunks", len(chunks))
+	}
+
+	if chunks := keysetChunks(start, end, nil); len(chunks) != 0 {
+		t.Fatalf("expected no chunks without rows, got %d", len(chunks))
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"time"
 )
 
+// TimeLayout is the layout of DateTime values in the chunks
+const TimeLayout = "2006-01-02 15:04:05 -0700 UTC"
+
 type Reader struct {
 	*csv.Reader
 	columnTypes []*sql.ColumnType
@@ -142,7 +145,7 @@ func parseElement(record string, st reflect.Type) (value interface{}, err error)
 	default:
 		switch st.Name() {
 		case "Time":
-			value, err = time.Parse("2006-01-02 15:04:05 -0700 UTC", record)
+			value, err = time.Parse(TimeLayout, record)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,197 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/pgzip"
+)
+
+// Compression is a compression of the whole dump archive. Chunks content is compressed separately by the sources
+type Compression int
+
+const (
+	GzipCompression Compression = iota
+	ZstdCompression
+	NoCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case GzipCompression:
+		return "gzip"
+	case ZstdCompression:
+		return "zstd"
+	case NoCompression:
+		return "none"
+	default:
+		return "undefined"
+	}
+}
+
+// Extension returns dump file extension for the compression
+func (c Compression) Extension() string {
+	switch c {
+	case ZstdCompression:
+		return ".tar.zst"
+	case NoCompression:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+func ParseCompression(v string) (Compression, error) {
+	switch v {
+	case "gzip":
+		return GzipCompression, nil
+	case "zstd":
+		return ZstdCompression, nil
+	case "none":
+		return NoCompression, nil
+	default:
+		return 0, errors.Errorf("unknown compression %q", v)
+	}
+}
+
+// CompressWriter compresses the dump archive. The writer must be closed before Reset: data written after it
+// goes to a new gzip member or zstd frame, which is read as a continuation of the previous one.
+type CompressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+const maxZstdLevel = 22
+
+// ValidateLevel checks compression level. Zero level is always valid and means the default level of the compression
+func (c Compression) ValidateLevel(level int) error {
+	if level == 0 {
+		return nil
+	}
+	switch c {
+	case GzipCompression:
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return errors.Errorf("invalid gzip compression level %d: should be from %d to %d", level, gzip.BestSpeed, gzip.BestCompression)
+		}
+	case ZstdCompression:
+		if level < 1 || level > maxZstdLevel {
+			return errors.Errorf("invalid zstd compression level %d: should be from 1 to %d", level, maxZstdLevel)
+		}
+	default:
+		return errors.Errorf("compression level is not supported for %s compression", c)
+	}
+	return nil
+}
+
+// NewCompressWriter returns writer for the compression. Zero level means the default level of the compression:
+// best compression for gzip, as it was always used for the dumps, and default speed for zstd.
+// With more than one worker data is compressed concurrently: gzip stream is written as a sequence of members
+func NewCompressWriter(w io.Writer, c Compression, level, workers int) (CompressWriter, error) {
+	if err := c.ValidateLevel(level); err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case GzipCompression:
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		if workers > 1 {
+			return pgzip.NewWriterLevel(w, level, workers)
+		}
+		return gzip.NewWriterLevel(w, level)
+	case ZstdCompression:
+		if workers < 1 {
+			workers = 1
+		}
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(workers)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case NoCompression:
+		return &nopCompressWriter{w: w}, nil
+	default:
+		return nil, errors.Errorf("unsupported compression %s", c)
+	}
+}
+
+type nopCompressWriter struct {
+	w io.Writer
+}
+
+func (n *nopCompressWriter) Write(p []byte) (int, error) { return n.w.Write(p) }
+
+func (n *nopCompressWriter) Close() error { return nil }
+
+func (n *nopCompressWriter) Reset(w io.Writer) { n.w = w }
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	tarMagic  = []byte("ustar")
+)
+
+// tarMagicOffset is an offset of the magic field in the tar header
+const tarMagicOffset = 257
+
+// DetectCompression detects compression of the dump by the magic bytes without consuming them
+func DetectCompression(r *bufio.Reader) (Compression, error) {
+	header, err := r.Peek(tarMagicOffset + len(tarMagic))
+	if err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "failed to read dump header")
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return GzipCompression, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return ZstdCompression, nil
+	case len(header) > tarMagicOffset && bytes.HasPrefix(header[tarMagicOffset:], tarMagic):
+		return NoCompression, nil
+	default:
+		return 0, errors.New("unknown dump format: expected tar archive compressed with gzip, zstd or uncompressed")
+	}
+}
+
+// NewDecompressReader detects compression of the dump and returns reader of the tar archive.
+// Encrypted dump is decrypted with the identities
+func NewDecompressReader(r io.Reader, identities ...age.Identity) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	if IsEncrypted(br) {
+		dr, err := newDecryptReader(br, identities)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(dr)
+	}
+
+	c, err := DetectCompression(br)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case GzipCompression:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open as gzip")
+		}
+		return gzr, nil
+	case ZstdCompression:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open as zstd")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
@@ -3,6 +3,9 @@ package dump
 import (
 	"errors"
 	"fmt"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,8 +13,9 @@ import (
 )
 
 const (
-	MetaFilename = "meta.json"
-	LogFilename  = "log.json"
+	MetaFilename     = "meta.json"
+	LogFilename      = "log.json"
+	ManifestFilename = "manifest.json"
 )
 
 type Meta struct {
@@ -22,6 +26,49 @@ type Meta struct {
 	Arguments         string             `json:"arguments"`
 	VMDataFormat      string             `json:"vm-data-format"`
 	PMMServerServices []PMMServerService `json:"pmm-server-services,omitempty"`
+	// Part is the number of the dump part starting from 1. It's zero for the dump, which is not split
+	Part int `json:"part,omitempty"`
+	// ClickHouseColumns lists columns of QAN metrics table in the order of values in ClickHouse chunks
+	ClickHouseColumns []ClickHouseColumn `json:"clickhouse-columns,omitempty"`
+	// MergedDumps lists the dumps, which were merged into this one
+	MergedDumps []MergedDump `json:"merged-dumps,omitempty"`
+	// Start and End is the time range requested by export
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+	// Parent is the previous dump, which data was skipped by export with --since-dump
+	Parent *ParentDump `json:"parent,omitempty"`
+	// Retries are counters of the chunks retried by export
+	Retries *RetryStats `json:"retries,omitempty"`
+}
+
+// RetryStats contains counters of the chunks retried by export. Retries is the number of repeated attempts,
+// Recovered and Failed are the numbers of retried chunks, which were eventually read or failed
+type RetryStats struct {
+	Retries   int64 `json:"retries"`
+	Recovered int64 `json:"recovered"`
+	Failed    int64 `json:"failed"`
+}
+
+// ParentDump describes the previous dump of the incremental export. VMEnd is the end of its VictoriaMetrics data
+// and QANEnd is the latest period_start of its QAN rows, the incremental dump contains only the data after them
+type ParentDump struct {
+	Filename string     `json:"filename"`
+	VMEnd    *time.Time `json:"vm-end,omitempty"`
+	QANEnd   *time.Time `json:"qan-end,omitempty"`
+}
+
+// MergedDump keeps provenance of the dump merged by merge command
+type MergedDump struct {
+	Filename         string `json:"filename"`
+	PMMServerVersion string `json:"pmm-server-version"`
+	Arguments        string `json:"arguments"`
+	VMDataFormat     string `json:"vm-data-format"`
+	Parent           string `json:"parent,omitempty"`
+}
+
+type ClickHouseColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
 }
 
 type PMMServerService struct {
@@ -36,6 +83,22 @@ type PMMDumpVersion struct {
 	GitCommit string `json:"git-commit"`
 }
 
+// Manifest lists all the chunks of the dump with their checksums
+type Manifest struct {
+	Chunks []ManifestChunk `json:"chunks"`
+}
+
+type ManifestChunk struct {
+	Filename string     `json:"filename"`
+	Source   string     `json:"source"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Series   int        `json:"series,omitempty"`
+	Rows     int        `json:"rows,omitempty"`
+	Size     int64      `json:"size"`
+	SHA256   string     `json:"sha256"`
+}
+
 type ChunkMeta struct {
 	Source SourceType
 	Start  *time.Time
@@ -43,6 +106,10 @@ type ChunkMeta struct {
 
 	Index   int
 	RowsLen int
+	// StartKey and EndKey are queryid parts of the ClickHouse chunk keyset bounds (Start, StartKey) and (End, EndKey).
+	// Empty key is less than any queryid, so the bound includes the whole second
+	StartKey string
+	EndKey   string
 }
 
 func (c ChunkMeta) String() string {
@@ -56,6 +123,38 @@ func (c ChunkMeta) String() string {
 	return fmt.Sprintf("%d-%d", s, e)
 }
 
+// ParseChunkMeta decodes chunk filename: <start>-<end>.bin for VictoriaMetrics and <index>.tsv for ClickHouse
+func ParseChunkMeta(source SourceType, filename string) (ChunkMeta, error) {
+	m := ChunkMeta{Source: source}
+	name := strings.TrimSuffix(filename, path.Ext(filename))
+	switch source {
+	case VictoriaMetrics:
+		s, e, ok := strings.Cut(name, "-")
+		if !ok {
+			return m, fmt.Errorf("invalid chunk filename %s: expected <start>-<end>", filename)
+		}
+		start, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid chunk filename %s: %w", filename, err)
+		}
+		end, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid chunk filename %s: %w", filename, err)
+		}
+		startTime, endTime := time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC()
+		m.Start, m.End = &startTime, &endTime
+	case ClickHouse:
+		index, err := strconv.Atoi(name)
+		if err != nil {
+			return m, fmt.Errorf("invalid chunk filename %s: %w", filename, err)
+		}
+		m.Index = index
+	default:
+		return m, fmt.Errorf("undefined source of chunk %s", filename)
+	}
+	return m, nil
+}
+
 type Chunk struct {
 	ChunkMeta
 	Content  []byte
@@ -95,3 +194,12 @@ func (p *ChunkPool) Next() (ChunkMeta, bool) {
 
 	return m, true
 }
+
+// Insert adds chunks to the pool right after the ones already returned by Next, so they are returned first
+func (p *ChunkPool) Insert(chunks ...ChunkMeta) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rest := append([]ChunkMeta(nil), p.chunks[p.currentIdx:]...)
+	p.chunks = append(append(p.chunks[:p.currentIdx], chunks...), rest...)
+}
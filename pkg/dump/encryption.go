@@ -0,0 +1,154 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+)
+
+// EncryptedExtension is appended to the extension of the encrypted dump file
+const EncryptedExtension = ".age"
+
+// encryptedHeader starts the encrypted dump. It's followed by the line with meta in clear (empty line if meta
+// is not kept in clear) and the age encrypted stream of the compressed tar archive
+const encryptedHeader = "pmm-dump-encrypted/v1\n"
+
+// ErrEncrypted is returned when the dump is encrypted, but no identities are provided to decrypt it
+var ErrEncrypted = errors.New("dump is encrypted: provide identity or passphrase to decrypt it")
+
+// ErrNoClearMeta is returned when the encrypted dump doesn't keep meta in clear
+var ErrNoClearMeta = errors.New("encrypted dump doesn't keep meta in clear")
+
+// ParseRecipients parses age X25519 public keys (age1...). Passphrase is used instead of the keys if it's not empty
+func ParseRecipients(keys []string, passphrase string) ([]age.Recipient, error) {
+	if passphrase != "" {
+		if len(keys) > 0 {
+			return nil, errors.New("passphrase can't be used together with recipients")
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create passphrase recipient")
+		}
+		return []age.Recipient{r}, nil
+	}
+
+	recipients := make([]age.Recipient, 0, len(keys))
+	for _, key := range keys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse recipient %q", key)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// ParseIdentities reads age X25519 secret keys from the identity file. Passphrase is added as an identity if it's not empty
+func ParseIdentities(identityPath, passphrase string) ([]age.Identity, error) {
+	var identities []age.Identity
+	if identityPath != "" {
+		f, err := os.Open(identityPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open identity file")
+		}
+		defer f.Close()
+
+		if identities, err = age.ParseIdentities(f); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse identity file %s", identityPath)
+		}
+	}
+	if passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create passphrase identity")
+		}
+		identities = append(identities, identity)
+	}
+	return identities, nil
+}
+
+// NewEncryptWriter writes header of the encrypted dump and returns writer, which encrypts data for the recipients.
+// If clearMeta is not nil, it's written in clear to the header. Close must be called to finish the encryption
+func NewEncryptWriter(w io.Writer, recipients []age.Recipient, clearMeta *Meta) (io.WriteCloser, error) {
+	var metaLine []byte
+	if clearMeta != nil {
+		var err error
+		if metaLine, err = json.Marshal(clearMeta); err != nil {
+			return nil, errors.Wrap(err, "failed to marshal meta")
+		}
+	}
+
+	header := make([]byte, 0, len(encryptedHeader)+len(metaLine)+1)
+	header = append(header, encryptedHeader...)
+	header = append(header, metaLine...)
+	header = append(header, '\n')
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "failed to write encryption header")
+	}
+
+	ew, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start encryption")
+	}
+	return ew, nil
+}
+
+// IsEncrypted reports whether the dump is encrypted without consuming any data
+func IsEncrypted(r *bufio.Reader) bool {
+	header, _ := r.Peek(len(encryptedHeader))
+	return string(header) == encryptedHeader
+}
+
+// ReadClearMeta reads meta kept in clear in the header of the encrypted dump.
+// Meta is written in clear at the start of export, so it doesn't contain max chunk size
+func ReadClearMeta(r io.Reader) (*Meta, error) {
+	br := bufio.NewReader(r)
+	if !IsEncrypted(br) {
+		return nil, errors.New("dump is not encrypted")
+	}
+	metaLine, err := readEncryptedHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(metaLine) == 0 {
+		return nil, ErrNoClearMeta
+	}
+
+	meta := new(Meta)
+	if err = json.Unmarshal(metaLine, meta); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal meta")
+	}
+	return meta, nil
+}
+
+func readEncryptedHeader(br *bufio.Reader) ([]byte, error) {
+	if _, err := br.Discard(len(encryptedHeader)); err != nil {
+		return nil, errors.Wrap(err, "failed to read encryption header")
+	}
+	metaLine, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read encryption header")
+	}
+	return bytes.TrimSuffix(metaLine, []byte{'\n'}), nil
+}
+
+// newDecryptReader skips the header of the encrypted dump and returns reader of the decrypted stream
+func newDecryptReader(br *bufio.Reader, identities []age.Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, ErrEncrypted
+	}
+	if _, err := readEncryptedHeader(br); err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(br, identities...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt dump")
+	}
+	return r, nil
+}
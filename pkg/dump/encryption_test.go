@@ -0,0 +1,134 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	another, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase, err := age.NewScryptIdentity("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		keys       []string
+		passphrase string
+		clearMeta  *Meta
+		identities []age.Identity
+		shouldErr  bool
+	}{
+		{
+			name:       "recipient",
+			keys:       []string{identity.Recipient().String()},
+			identities: []age.Identity{identity},
+		},
+		{
+			name:       "several recipients",
+			keys:       []string{another.Recipient().String(), identity.Recipient().String()},
+			identities: []age.Identity{identity},
+		},
+		{
+			name:       "passphrase with clear meta",
+			passphrase: "secret",
+			clearMeta:  &Meta{PMMServerVersion: "2.38.0"},
+			identities: []age.Identity{passphrase},
+		},
+		{
+			name:       "wrong identity",
+			keys:       []string{identity.Recipient().String()},
+			identities: []age.Identity{another},
+			shouldErr:  true,
+		},
+		{
+			name:      "no identity",
+			keys:      []string{identity.Recipient().String()},
+			shouldErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recipients, err := ParseRecipients(tt.keys, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := new(bytes.Buffer)
+			ew, err := NewEncryptWriter(buf, recipients, tt.clearMeta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cw, err := NewCompressWriter(ew, GzipCompression, 0, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := bytes.Repeat([]byte("0123456789"), 1000)
+			if _, err = cw.Write(content); err != nil {
+				t.Fatal(err)
+			}
+			if err = cw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err = ew.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !IsEncrypted(bufio.NewReader(bytes.NewReader(buf.Bytes()))) {
+				t.Fatal("dump should be detected as encrypted")
+			}
+			if bytes.Contains(buf.Bytes(), []byte("0123456789")) {
+				t.Fatal("content is written in clear")
+			}
+
+			meta, err := ReadClearMeta(bytes.NewReader(buf.Bytes()))
+			switch {
+			case tt.clearMeta == nil && !errors.Is(err, ErrNoClearMeta):
+				t.Fatalf("expected no clear meta, got %v, %v", meta, err)
+			case tt.clearMeta != nil && (err != nil || meta.PMMServerVersion != tt.clearMeta.PMMServerVersion):
+				t.Fatalf("failed to read clear meta: %v, %v", meta, err)
+			}
+
+			r, err := NewDecompressReader(bytes.NewReader(buf.Bytes()), tt.identities...)
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatal("there was no err")
+				}
+				if len(tt.identities) == 0 && !errors.Is(err, ErrEncrypted) {
+					t.Fatalf("expected ErrEncrypted, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, content) {
+				t.Fatal("decrypted content doesn't match")
+			}
+		})
+	}
+
+	if _, err := ParseRecipients([]string{identity.Recipient().String()}, "secret"); err == nil {
+		t.Fatal("passphrase together with recipients should be rejected")
+	}
+	if _, err := ParseRecipients([]string{"invalid"}, ""); err == nil {
+		t.Fatal("invalid recipient should be rejected")
+	}
+}
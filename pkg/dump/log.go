@@ -0,0 +1,33 @@
+package dump
+
+import (
+	"bytes"
+	"sync"
+)
+
+// LogBuffer collects the log written to the dump. It's written by the logger, while the dump writer reads it,
+// so all the access is guarded by the mutex
+type LogBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Len returns the current size of the log
+func (b *LogBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// Snapshot returns copy of the log written so far
+func (b *LogBuffer) Snapshot() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
@@ -0,0 +1,110 @@
+package dump
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dumpExtensions are known extensions of the dump file. Longer extensions go first
+var dumpExtensions = []string{
+	".tar.gz" + EncryptedExtension,
+	".tar.zst" + EncryptedExtension,
+	".tar" + EncryptedExtension,
+	".tar.gz",
+	".tar.zst",
+	".tar",
+}
+
+var partRegexp = regexp.MustCompile(`^(.*)\.part(\d{3,})(\.[^/]*)?$`)
+
+// PartPath returns path of the dump part with the given number: dump.tar.gz -> dump.part001.tar.gz
+func PartPath(dumpPath string, number int) string {
+	base, ext := dumpPath, ""
+	for _, e := range dumpExtensions {
+		if strings.HasSuffix(dumpPath, e) {
+			base, ext = strings.TrimSuffix(dumpPath, e), e
+			break
+		}
+	}
+	return fmt.Sprintf("%s.part%03d%s", base, number, ext)
+}
+
+// ListParts returns paths of all the dump parts in order. The dump path could be a path to any part,
+// a glob pattern or a path to the dump, which is not split
+func ListParts(dumpPath string) ([]string, error) {
+	if strings.ContainsAny(dumpPath, "*?[") {
+		paths, err := filepath.Glob(dumpPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid dump path pattern")
+		}
+		if len(paths) == 0 {
+			return nil, errors.Errorf("no dump files match %s", dumpPath)
+		}
+		sortParts(paths)
+		return paths, nil
+	}
+
+	m := partRegexp.FindStringSubmatch(dumpPath)
+	if m == nil {
+		return []string{dumpPath}, nil
+	}
+
+	paths, err := filepath.Glob(escapeGlob(m[1]) + ".part*" + escapeGlob(m[3]))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list dump parts")
+	}
+	var parts []string
+	for _, p := range paths {
+		if pm := partRegexp.FindStringSubmatch(p); pm != nil && pm[1] == m[1] && pm[3] == m[3] {
+			parts = append(parts, p)
+		}
+	}
+	sortParts(parts)
+
+	for i, p := range parts {
+		if number := partNumber(p); number != i+1 {
+			return nil, errors.Errorf("dump part %d is missing: found %s instead", i+1, p)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, errors.Errorf("no dump parts found for %s", dumpPath)
+	}
+	return parts, nil
+}
+
+func sortParts(paths []string) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		ni, nj := partNumber(paths[i]), partNumber(paths[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return paths[i] < paths[j]
+	})
+}
+
+// partNumber returns number of the dump part or zero if the path is not a part
+func partNumber(path string) int {
+	m := partRegexp.FindStringSubmatch(path)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[2])
+	return n
+}
+
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
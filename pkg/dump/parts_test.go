@@ -0,0 +1,77 @@
+package dump
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPartPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		number   int
+		expected string
+	}{
+		{path: "dump.tar.gz", number: 1, expected: "dump.part001.tar.gz"},
+		{path: "dir/dump.tar.zst.age", number: 12, expected: "dir/dump.part012.tar.zst.age"},
+		{path: "dump.tar", number: 1000, expected: "dump.part1000.tar"},
+		{path: "dump", number: 2, expected: "dump.part002"},
+	}
+	for _, tt := range tests {
+		if got := PartPath(tt.path, tt.number); got != tt.expected {
+			t.Errorf("PartPath(%q, %d) = %q, expected %q", tt.path, tt.number, got, tt.expected)
+		}
+	}
+}
+
+func TestListParts(t *testing.T) {
+	dir := t.TempDir()
+	create := func(names ...string) {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	create("dump.part001.tar.gz", "dump.part002.tar.gz", "dump.part010.tar.gz", "other.part001.tar.gz", "dump.part001.tar.zst")
+	for i := 3; i < 10; i++ {
+		create(filepath.Base(PartPath("dump.tar.gz", i)))
+	}
+
+	parts, err := ListParts(filepath.Join(dir, "dump.part002.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 10 {
+		t.Fatalf("expected 10 parts, got %v", parts)
+	}
+	for i, p := range parts {
+		if expected := PartPath(filepath.Join(dir, "dump.tar.gz"), i+1); p != expected {
+			t.Fatalf("expected part %s, got %s", expected, p)
+		}
+	}
+
+	globbed, err := ListParts(filepath.Join(dir, "dump.part*.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(globbed, parts) {
+		t.Fatalf("glob returned different parts: %v", globbed)
+	}
+
+	single, err := ListParts(filepath.Join(dir, "dump.tar.gz"))
+	if err != nil || len(single) != 1 {
+		t.Fatalf("dump, which is not split, should be returned as is: %v, %v", single, err)
+	}
+
+	if err = os.Remove(filepath.Join(dir, "dump.part005.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ListParts(filepath.Join(dir, "dump.part001.tar.gz")); err == nil {
+		t.Fatal("missing part should be reported")
+	}
+	if _, err = ListParts(filepath.Join(dir, "missing*.tar.gz")); err == nil {
+		t.Fatal("pattern without matches should be reported")
+	}
+}
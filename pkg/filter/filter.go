@@ -0,0 +1,66 @@
+// Package filter selects series and QAN rows of the dump offline, like export does with PMM
+package filter
+
+import (
+	"time"
+
+	"pmm-dump/pkg/promql"
+	"pmm-dump/pkg/victoriametrics"
+)
+
+// SeriesFilter selects VictoriaMetrics series by series selectors and trims their samples to the time window
+type SeriesFilter struct {
+	selector   *promql.Selector
+	start, end *time.Time
+}
+
+// NewSeriesFilter returns filter of the series matching any of the selectors. Samples are kept from start up to end, excluding it.
+// Nil start or end isn't limited
+func NewSeriesFilter(selectors []string, start, end *time.Time) (*SeriesFilter, error) {
+	selector, err := promql.ParseSelector(selectors...)
+	if err != nil {
+		return nil, err
+	}
+	return &SeriesFilter{
+		selector: selector,
+		start:    start,
+		end:      end,
+	}, nil
+}
+
+// Overlaps returns true if the time range of the chunk overlaps the time window of the filter. Unknown time range overlaps any window
+func (f *SeriesFilter) Overlaps(start, end *time.Time) bool {
+	if start == nil || end == nil {
+		return true
+	}
+	return (f.end == nil || start.Before(*f.end)) && (f.start == nil || !end.Before(*f.start))
+}
+
+// Filter returns the matched metrics with samples of the time window. Metrics without samples are dropped
+func (f *SeriesFilter) Filter(metrics []victoriametrics.Metric) []victoriametrics.Metric {
+	var result []victoriametrics.Metric
+	for _, m := range metrics {
+		if !f.selector.Match(m.Metric) {
+			continue
+		}
+		if f.start != nil || f.end != nil {
+			m = f.trim(m)
+		}
+		if len(m.Values) != 0 {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (f *SeriesFilter) trim(m victoriametrics.Metric) victoriametrics.Metric {
+	result := victoriametrics.Metric{Metric: m.Metric}
+	for i, ts := range m.Timestamps {
+		if f.start != nil && ts < f.start.UnixMilli() || f.end != nil && ts >= f.end.UnixMilli() {
+			continue
+		}
+		result.Timestamps = append(result.Timestamps, ts)
+		result.Values = append(result.Values, m.Values[i])
+	}
+	return result
+}
@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/victoriametrics"
+)
+
+func TestSeriesFilter(t *testing.T) {
+	metrics := []victoriametrics.Metric{
+		{Metric: map[string]string{"__name__": "up", "service_name": "mysql-1"}, Timestamps: []int64{1000, 2000, 3000}, Values: []float64{1, 1, 0}},
+		{Metric: map[string]string{"__name__": "up", "service_name": "pg-1"}, Timestamps: []int64{1000, 2000, 3000}, Values: []float64{1, 1, 1}},
+		{Metric: map[string]string{"__name__": "node_load1", "service_name": "mysql-1"}, Timestamps: []int64{3000}, Values: []float64{0.5}},
+	}
+	start, end := time.UnixMilli(2000), time.UnixMilli(3000)
+
+	tests := []struct {
+		name       string
+		selectors  []string
+		start, end *time.Time
+		expected   []victoriametrics.Metric
+	}{
+		{
+			name:     "no filter",
+			expected: metrics,
+		},
+		{
+			name:      "selector",
+			selectors: []string{`{service_name="mysql-1"}`},
+			expected:  []victoriametrics.Metric{metrics[0], metrics[2]},
+		},
+		{
+			name:      "any of selectors",
+			selectors: []string{`up{service_name=~"pg.*"}`, `node_load1`},
+			expected:  []victoriametrics.Metric{metrics[1], metrics[2]},
+		},
+		{
+			name:      "time window",
+			selectors: []string{`up`},
+			start:     &start,
+			end:       &end,
+			expected: []victoriametrics.Metric{
+				{Metric: metrics[0].Metric, Timestamps: []int64{2000}, Values: []float64{1}},
+				{Metric: metrics[1].Metric, Timestamps: []int64{2000}, Values: []float64{1}},
+			},
+		},
+		{
+			name:     "series without samples in window",
+			end:      &start,
+			expected: []victoriametrics.Metric{{Metric: metrics[0].Metric, Timestamps: []int64{1000}, Values: []float64{1}}, {Metric: metrics[1].Metric, Timestamps: []int64{1000}, Values: []float64{1}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewSeriesFilter(tt.selectors, tt.start, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Filter(metrics); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	f, err := NewSeriesFilter(nil, &start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := time.UnixMilli(0), time.UnixMilli(1000)
+	if f.Overlaps(&before, &after) || !f.Overlaps(&after, &start) || f.Overlaps(&end, &end) || !f.Overlaps(nil, nil) {
+		t.Fatal("unexpected overlapping of chunks")
+	}
+
+	if _, err = NewSeriesFilter([]string{`rate(up[5m])`}, nil, nil); err == nil {
+		t.Fatal("expression should be rejected")
+	}
+}
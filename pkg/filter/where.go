@@ -0,0 +1,556 @@
+package filter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/clickhouse/tsv"
+	"pmm-dump/pkg/dump"
+)
+
+const (
+	columnPeriodStart = "period_start"
+	nullValue         = "<nil>"
+)
+
+// literalTimeLayouts are accepted for the DateTime values in the WHERE statement
+var literalTimeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02", time.RFC3339}
+
+// RowFilter selects rows of QAN chunks by the WHERE statement and period_start in the time window
+type RowFilter struct {
+	expr       predicate
+	start, end *time.Time
+	periodIdx  int
+}
+
+// NewRowFilter returns filter of the rows with the columns. It supports subset of ClickHouse WHERE statement:
+// comparisons of the columns with literals, IN, LIKE and IS NULL combined with AND, OR, NOT and parentheses.
+// Rows are kept if their period_start is from start up to end, excluding it. Nil start or end isn't limited
+func NewRowFilter(columns []dump.ClickHouseColumn, where string, start, end *time.Time) (*RowFilter, error) {
+	f := &RowFilter{start: start, end: end, periodIdx: -1}
+	for i, c := range columns {
+		if c.Name == columnPeriodStart {
+			f.periodIdx = i
+		}
+	}
+	if f.periodIdx < 0 && (start != nil || end != nil) {
+		return nil, errors.Errorf("column %s is not found", columnPeriodStart)
+	}
+
+	if strings.TrimSpace(where) != "" {
+		tokens, err := tokenize(where)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid WHERE statement")
+		}
+		p := &parser{tokens: tokens, columns: columns}
+		if f.expr, err = p.parse(); err != nil {
+			return nil, errors.Wrap(err, "invalid WHERE statement")
+		}
+	}
+	return f, nil
+}
+
+// Match returns true if the row of the chunk matches the filter
+func (f *RowFilter) Match(record []string) (bool, error) {
+	if f.periodIdx >= 0 && (f.start != nil || f.end != nil) {
+		if f.periodIdx >= len(record) {
+			return false, errors.Errorf("row has %d columns", len(record))
+		}
+		periodStart, err := time.Parse(tsv.TimeLayout, record[f.periodIdx])
+		if err != nil {
+			return false, errors.Wrap(err, "invalid period_start")
+		}
+		if f.start != nil && periodStart.Before(*f.start) || f.end != nil && !periodStart.Before(*f.end) {
+			return false, nil
+		}
+	}
+	if f.expr == nil {
+		return true, nil
+	}
+	return f.expr.eval(record)
+}
+
+type predicate interface {
+	eval(record []string) (bool, error)
+}
+
+type andPredicate struct{ left, right predicate }
+
+func (p andPredicate) eval(record []string) (bool, error) {
+	ok, err := p.left.eval(record)
+	if err != nil || !ok {
+		return false, err
+	}
+	return p.right.eval(record)
+}
+
+type orPredicate struct{ left, right predicate }
+
+func (p orPredicate) eval(record []string) (bool, error) {
+	ok, err := p.left.eval(record)
+	if err != nil || ok {
+		return ok, err
+	}
+	return p.right.eval(record)
+}
+
+type notPredicate struct{ p predicate }
+
+func (p notPredicate) eval(record []string) (bool, error) {
+	ok, err := p.p.eval(record)
+	return !ok, err
+}
+
+// valueKind defines how the values of the column are compared
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindNumber
+	kindTime
+)
+
+// comparison compares value of the column with the literals. NULL values don't match any comparison except IS NULL
+type comparison struct {
+	column int
+	kind   valueKind
+	op     string
+	values []string
+	like   *regexp.Regexp
+}
+
+func (c comparison) eval(record []string) (bool, error) {
+	if c.column >= len(record) {
+		return false, errors.Errorf("row has %d columns", len(record))
+	}
+	v := record[c.column]
+	switch c.op {
+	case "IS NULL":
+		return v == nullValue, nil
+	case "IS NOT NULL":
+		return v != nullValue, nil
+	}
+	if v == nullValue {
+		return false, nil
+	}
+	switch c.op {
+	case "LIKE":
+		return c.like.MatchString(v), nil
+	case "NOT LIKE":
+		return !c.like.MatchString(v), nil
+	case "IN", "NOT IN":
+		for _, literal := range c.values {
+			cmp, err := compareValues(c.kind, v, literal)
+			if err != nil {
+				return false, err
+			}
+			if cmp == 0 {
+				return c.op == "IN", nil
+			}
+		}
+		return c.op == "NOT IN", nil
+	}
+
+	cmp, err := compareValues(c.kind, v, c.values[0])
+	if err != nil {
+		return false, err
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// compareValues compares the value of the row with the literal of the statement
+func compareValues(kind valueKind, value, literal string) (int, error) {
+	switch kind {
+	case kindNumber:
+		a, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid number %q", value)
+		}
+		b, _ := strconv.ParseFloat(literal, 64)
+		switch {
+		case a < b:
+			return -1, nil
+		case a > b:
+			return 1, nil
+		}
+		return 0, nil
+	case kindTime:
+		a, err := time.Parse(tsv.TimeLayout, value)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid time %q", value)
+		}
+		b, _ := parseLiteralTime(literal)
+		return a.Compare(b), nil
+	}
+	return strings.Compare(value, literal), nil
+}
+
+func parseLiteralTime(s string) (time.Time, error) {
+	for _, layout := range literalTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	return time.Time{}, errors.Errorf("invalid time %q", s)
+}
+
+// columnKind returns the kind of values of ClickHouse type
+func columnKind(chType string) valueKind {
+	for _, modifier := range []string{"LowCardinality", "Nullable", "LowCardinality"} {
+		if strings.HasPrefix(chType, modifier+"(") && strings.HasSuffix(chType, ")") {
+			chType = chType[len(modifier)+1 : len(chType)-1]
+		}
+	}
+	switch {
+	case strings.HasPrefix(chType, "Int"), strings.HasPrefix(chType, "UInt"),
+		strings.HasPrefix(chType, "Float"), strings.HasPrefix(chType, "Decimal"):
+		return kindNumber
+	case strings.HasPrefix(chType, "DateTime"), strings.HasPrefix(chType, "Date"):
+		return kindTime
+	}
+	return kindString
+}
+
+type tokenType int
+
+const (
+	tokenIdent tokenType = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+)
+
+type token struct {
+	typ   tokenType
+	value string
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLeftParen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRightParen, ")"})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokenComma, ","})
+			i++
+		case r == '\'' || r == '`' || r == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes); j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				} else if runes[j] == r {
+					if j+1 < len(runes) && runes[j+1] == r {
+						j++
+					} else {
+						break
+					}
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, errors.Errorf("unterminated quote at %d", i)
+			}
+			typ := tokenString
+			if r != '\'' {
+				typ = tokenIdent
+			}
+			tokens = append(tokens, token{typ, sb.String()})
+			i = j + 1
+		case strings.ContainsRune("=!<>", r):
+			j := i + 1
+			if j < len(runes) && strings.ContainsRune("=>", runes[j]) {
+				j++
+			}
+			op := string(runes[i:j])
+			switch op {
+			case "==":
+				op = "="
+			case "<>":
+				op = "!="
+			case "=", "!=", "<", "<=", ">", ">=":
+			default:
+				return nil, errors.Errorf("unknown operator %s", op)
+			}
+			tokens = append(tokens, token{tokenOperator, op})
+			i = j
+		case unicode.IsDigit(r) || r == '-' || r == '.':
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || strings.ContainsRune(".eE+-", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[i:j])})
+			i = j
+		default:
+			return nil, errors.Errorf("unexpected character %q at %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+// parser builds predicate from the tokens of the statement:
+//
+//	expr    = and {OR and}
+//	and     = not {AND not}
+//	not     = NOT not | primary
+//	primary = "(" expr ")" | column operator literal | column [NOT] IN "(" literal {"," literal} ")" |
+//	          column [NOT] LIKE string | column IS [NOT] NULL
+type parser struct {
+	tokens  []token
+	pos     int
+	columns []dump.ClickHouseColumn
+}
+
+func (p *parser) parse() (predicate, error) {
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.Errorf("unexpected %q", p.tokens[p.pos].value)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+// keyword consumes the keyword if it's the next token
+func (p *parser) keyword(kw string) bool {
+	t := p.peek()
+	if t != nil && t.typ == tokenIdent && strings.EqualFold(t.value, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orPredicate{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (predicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andPredicate{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (predicate, error) {
+	if p.keyword("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notPredicate{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (predicate, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, errors.New("unexpected end of statement")
+	}
+	if t.typ == tokenLeftParen {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.typ != tokenRightParen {
+			return nil, errors.New("expected )")
+		}
+		p.pos++
+		return expr, nil
+	}
+	if t.typ != tokenIdent {
+		return nil, errors.Errorf("expected column, got %q", t.value)
+	}
+	p.pos++
+
+	c := comparison{column: -1}
+	for i, column := range p.columns {
+		if column.Name == t.value {
+			c.column = i
+			c.kind = columnKind(column.Type)
+		}
+	}
+	if c.column < 0 {
+		return nil, errors.Errorf("unknown column %s", t.value)
+	}
+
+	switch {
+	case p.keyword("IS"):
+		c.op = "IS NULL"
+		if p.keyword("NOT") {
+			c.op = "IS NOT NULL"
+		}
+		if !p.keyword("NULL") {
+			return nil, errors.New("expected NULL")
+		}
+		return c, nil
+	case p.keyword("NOT"):
+		if p.keyword("IN") {
+			c.op = "NOT IN"
+		} else if p.keyword("LIKE") {
+			c.op = "NOT LIKE"
+		} else {
+			return nil, errors.New("expected IN or LIKE after NOT")
+		}
+	case p.keyword("IN"):
+		c.op = "IN"
+	case p.keyword("LIKE"):
+		c.op = "LIKE"
+	default:
+		op := p.peek()
+		if op == nil || op.typ != tokenOperator {
+			return nil, errors.Errorf("expected operator after %s", t.value)
+		}
+		p.pos++
+		c.op = op.value
+	}
+
+	switch c.op {
+	case "LIKE", "NOT LIKE":
+		pattern := p.peek()
+		if pattern == nil || pattern.typ != tokenString {
+			return nil, errors.New("expected string pattern")
+		}
+		p.pos++
+		c.like = likeRegexp(pattern.value)
+		return c, nil
+	case "IN", "NOT IN":
+		if t := p.peek(); t == nil || t.typ != tokenLeftParen {
+			return nil, errors.New("expected ( after IN")
+		}
+		p.pos++
+		for {
+			v, err := p.parseLiteral(c.kind)
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, v)
+			t := p.peek()
+			if t == nil {
+				return nil, errors.New("expected )")
+			}
+			p.pos++
+			if t.typ == tokenRightParen {
+				break
+			}
+			if t.typ != tokenComma {
+				return nil, errors.Errorf("unexpected %q in IN list", t.value)
+			}
+		}
+		return c, nil
+	}
+
+	v, err := p.parseLiteral(c.kind)
+	if err != nil {
+		return nil, err
+	}
+	c.values = []string{v}
+	return c, nil
+}
+
+// parseLiteral returns the next literal validated for the kind of the column
+func (p *parser) parseLiteral(kind valueKind) (string, error) {
+	t := p.peek()
+	if t == nil || t.typ != tokenString && t.typ != tokenNumber {
+		return "", errors.New("expected literal")
+	}
+	p.pos++
+	switch kind {
+	case kindNumber:
+		if _, err := strconv.ParseFloat(t.value, 64); err != nil {
+			return "", errors.Errorf("invalid number %q", t.value)
+		}
+	case kindTime:
+		if _, err := parseLiteralTime(t.value); err != nil {
+			return "", err
+		}
+	}
+	return t.value, nil
+}
+
+// likeRegexp converts LIKE pattern to the regexp: % matches any sequence of characters and _ matches any single character
+func likeRegexp(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
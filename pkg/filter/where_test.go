@@ -0,0 +1,86 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestRowFilter(t *testing.T) {
+	columns := []dump.ClickHouseColumn{
+		{Name: "service_name", Type: "LowCardinality(String)"},
+		{Name: "period_start", Type: "DateTime"},
+		{Name: "num_queries", Type: "Float32"},
+		{Name: "m_query_time_sum", Type: "Nullable(Float32)"},
+		{Name: "fingerprint", Type: "String"},
+	}
+	rows := [][]string{
+		{"mysql-1", "2023-04-20 10:00:00 +0000 UTC", "5", "0.5", "SELECT * FROM t"},
+		{"mysql-2", "2023-04-20 10:01:00 +0000 UTC", "1", "<nil>", "INSERT INTO t VALUES (?)"},
+		{"pg-1", "2023-04-20 10:02:00 +0000 UTC", "10", "2", "select \"it's\""},
+	}
+
+	tests := []struct {
+		where     string
+		expected  []bool
+		shouldErr bool
+	}{
+		{where: "", expected: []bool{true, true, true}},
+		{where: "service_name='mysql-1'", expected: []bool{true, false, false}},
+		{where: "service_name = 'mysql-1' OR service_name == 'pg-1'", expected: []bool{true, false, true}},
+		{where: "service_name IN ('mysql-1', 'mysql-2') AND num_queries > 2", expected: []bool{true, false, false}},
+		{where: "service_name NOT IN ('mysql-1')", expected: []bool{false, true, true}},
+		{where: "NOT (service_name LIKE 'mysql%')", expected: []bool{false, false, true}},
+		{where: "fingerprint LIKE '%it''s%'", expected: []bool{false, false, true}},
+		{where: "num_queries >= 5 and num_queries <> 10", expected: []bool{true, false, false}},
+		{where: "num_queries < 9.5", expected: []bool{true, true, false}},
+		{where: "m_query_time_sum IS NULL", expected: []bool{false, true, false}},
+		{where: "m_query_time_sum IS NOT NULL AND m_query_time_sum < 1", expected: []bool{true, false, false}},
+		{where: "period_start >= '2023-04-20 10:01:00'", expected: []bool{false, true, true}},
+		{where: "`service_name` != 'pg-1' AND (num_queries = 1 OR num_queries = 5)", expected: []bool{true, true, false}},
+		{where: "unknown = 1", shouldErr: true},
+		{where: "num_queries = 'many'", shouldErr: true},
+		{where: "service_name = 'a' AND", shouldErr: true},
+		{where: "service_name = 'a", shouldErr: true},
+		{where: "(service_name = 'a'", shouldErr: true},
+		{where: "service_name LIKE 5", shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			f, err := NewRowFilter(columns, tt.where, nil, nil)
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatal("there was no err")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, row := range rows {
+				ok, err := f.Match(row)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != tt.expected[i] {
+					t.Fatalf("row %d: expected %v, got %v", i, tt.expected[i], ok)
+				}
+			}
+		})
+	}
+
+	start, end := time.Date(2023, 4, 20, 10, 1, 0, 0, time.UTC), time.Date(2023, 4, 20, 10, 2, 0, 0, time.UTC)
+	f, err := NewRowFilter(columns, "", &start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []bool{false, true, false} {
+		if ok, err := f.Match(rows[i]); err != nil || ok != expected {
+			t.Fatalf("row %d: expected %v, got %v: %v", i, expected, ok, err)
+		}
+	}
+	if _, err = NewRowFilter(columns[:1], "", &start, nil); err == nil {
+		t.Fatal("time window without period_start column should be rejected")
+	}
+}
@@ -0,0 +1,75 @@
+package parquet
+
+import (
+	"io"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/victoriametrics"
+)
+
+const metricNameLabel = "__name__"
+
+// metricsSchema is the long format of the series: a row per sample
+const metricsSchema = `message metrics {
+	required binary metric_name (STRING);
+	optional group labels (MAP) {
+		repeated group key_value {
+			required binary key (STRING);
+			required binary value (STRING);
+		}
+	}
+	required int64 ts (TIMESTAMP(MILLIS, true));
+	required double value;
+}`
+
+// MetricsWriter writes VictoriaMetrics series to the Parquet file in the long format.
+// Every written chunk is flushed as a separate row group, so only a single chunk is kept in memory
+type MetricsWriter struct {
+	w *goparquet.FileWriter
+}
+
+func NewMetricsWriter(w io.Writer) (*MetricsWriter, error) {
+	fw, err := newFileWriter(w, metricsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsWriter{w: fw}, nil
+}
+
+// WriteChunk writes samples of the chunk metrics as a row group
+func (w *MetricsWriter) WriteChunk(metrics []victoriametrics.Metric) error {
+	for _, m := range metrics {
+		if len(m.Values) != len(m.Timestamps) {
+			return errors.Errorf("metric %v has %d values, but %d timestamps", m.Metric, len(m.Values), len(m.Timestamps))
+		}
+		labels := make([]map[string]interface{}, 0, len(m.Metric))
+		for k, v := range m.Metric {
+			if k != metricNameLabel {
+				labels = append(labels, map[string]interface{}{"key": []byte(k), "value": []byte(v)})
+			}
+		}
+		name := []byte(m.Metric[metricNameLabel])
+		for i, v := range m.Values {
+			row := map[string]interface{}{
+				"metric_name": name,
+				"ts":          m.Timestamps[i],
+				"value":       v,
+			}
+			// Empty repeated group can't be written by the library, so series without labels have null map
+			if len(labels) != 0 {
+				row["labels"] = map[string]interface{}{"key_value": labels}
+			}
+			if err := w.w.AddData(row); err != nil {
+				return errors.Wrap(err, "failed to add row")
+			}
+		}
+	}
+	return errors.Wrap(w.w.FlushRowGroup(), "failed to flush row group")
+}
+
+// Close writes the footer of the Parquet file. The underlying writer isn't closed
+func (w *MetricsWriter) Close() error {
+	return errors.Wrap(w.w.Close(), "failed to close parquet writer")
+}
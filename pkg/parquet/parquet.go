@@ -0,0 +1,48 @@
+// Package parquet converts chunks of the dump to Parquet files for analytics tools like DuckDB or Spark
+package parquet
+
+import (
+	"io"
+
+	goparquet "github.com/fraugster/parquet-go"
+	pq "github.com/fraugster/parquet-go/parquet"
+	"github.com/fraugster/parquet-go/parquetschema"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Format is the name of the format for convert command
+const Format = "parquet"
+
+func init() {
+	goparquet.RegisterBlockCompressor(pq.CompressionCodec_ZSTD, zstdCompressor{})
+}
+
+// zstdCompressor compresses pages of Parquet files with zstd, which isn't supported by the library out of the box
+type zstdCompressor struct{}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (zstdCompressor) CompressBlock(block []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(block, nil), nil
+}
+
+func (zstdCompressor) DecompressBlock(block []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(block, nil)
+}
+
+// newFileWriter returns zstd compressed Parquet writer with the schema in the textual definition
+func newFileWriter(w io.Writer, schema string) (*goparquet.FileWriter, error) {
+	schemaDef, err := parquetschema.ParseSchemaDefinition(schema)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse schema")
+	}
+	return goparquet.NewFileWriter(w,
+		goparquet.WithSchemaDefinition(schemaDef),
+		goparquet.WithCompressionCodec(pq.CompressionCodec_ZSTD),
+		goparquet.WithCreator("pmm-dump"),
+	), nil
+}
@@ -0,0 +1,131 @@
+package parquet
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	goparquet "github.com/fraugster/parquet-go"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics"
+)
+
+func readRows(t *testing.T, data []byte) ([]map[string]interface{}, int) {
+	t.Helper()
+	r, err := goparquet.NewFileReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []map[string]interface{}
+	for {
+		row, err := r.NextRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, r.RowGroupCount()
+}
+
+func TestMetricsWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewMetricsWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][]victoriametrics.Metric{
+		{
+			{Metric: map[string]string{metricNameLabel: "up", "job": "node"}, Timestamps: []int64{1000, 2000}, Values: []float64{1, 0}},
+		},
+		{},
+		{
+			{Metric: map[string]string{metricNameLabel: "node_load1"}, Timestamps: []int64{3000}, Values: []float64{0.5}},
+		},
+	}
+	for _, c := range chunks {
+		if err = w.WriteChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, rowGroups := readRows(t, buf.Bytes())
+	if rowGroups != 2 {
+		t.Fatalf("expected a row group per non-empty chunk, got %d", rowGroups)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if string(rows[1]["metric_name"].([]byte)) != "up" || rows[1]["ts"] != int64(2000) || rows[1]["value"] != float64(0) {
+		t.Fatalf("unexpected row: %v", rows[1])
+	}
+	labels := rows[0]["labels"].(map[string]interface{})["key_value"].([]map[string]interface{})
+	if len(labels) != 1 || string(labels[0]["key"].([]byte)) != "job" || string(labels[0]["value"].([]byte)) != "node" {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+
+	if err = w.WriteChunk([]victoriametrics.Metric{{Timestamps: []int64{1}}}); err == nil {
+		t.Fatal("metric with mismatched samples should be rejected")
+	}
+}
+
+func TestWriteQAN(t *testing.T) {
+	columns := []dump.ClickHouseColumn{
+		{Name: "queryid", Type: "LowCardinality(String)"},
+		{Name: "period_start", Type: "DateTime"},
+		{Name: "num_queries", Type: "Float32"},
+		{Name: "rows_sent", Type: "UInt64"},
+		{Name: "m_query_time_sum", Type: "Nullable(Float64)"},
+		{Name: "labels.key", Type: "Array(LowCardinality(String))"},
+		{Name: "is_truncated", Type: "UInt8"},
+	}
+	content := "q1\t2023-04-20 10:00:00 +0000 UTC\t5\t18446744073709551615\t0.25\t[env az]\t1\n" +
+		"q2\t2023-04-20 10:01:00 +0000 UTC\t1\t0\t<nil>\t[]\t0\n"
+
+	buf := new(bytes.Buffer)
+	n, err := WriteQAN(buf, columns, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 rows, got %d", n)
+	}
+
+	rows, _ := readRows(t, buf.Bytes())
+	expected := []map[string]interface{}{
+		{
+			"queryid":          []byte("q1"),
+			"period_start":     int64(1681984800000),
+			"num_queries":      float32(5),
+			"rows_sent":        int64(-1),
+			"m_query_time_sum": 0.25,
+			"labels_key":       []byte("[env az]"),
+			"is_truncated":     int32(1),
+		},
+		{
+			"queryid":      []byte("q2"),
+			"period_start": int64(1681984860000),
+			"num_queries":  float32(1),
+			"rows_sent":    int64(0),
+			"labels_key":   []byte("[]"),
+			"is_truncated": int32(0),
+		},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected %v, got %v", expected, rows)
+	}
+
+	if _, err = WriteQAN(new(bytes.Buffer), columns, []byte("q1\tnot a time\t5\t0\t0\t[]\t0\n")); err == nil {
+		t.Fatal("invalid DateTime value should be rejected")
+	}
+	if _, err = WriteQAN(new(bytes.Buffer), nil, []byte(content)); err == nil {
+		t.Fatal("chunk without columns should be rejected")
+	}
+}
@@ -0,0 +1,189 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+)
+
+// timeLayout parses DateTime and Date values of the chunks, which are written by ClickHouse source as Go time
+const timeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// nullValue is written by ClickHouse source for NULL values of Nullable columns
+const nullValue = "<nil>"
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// column converts values of the ClickHouse column to the values of Parquet column
+type column struct {
+	name     string
+	field    string
+	optional bool
+	parse    func(s string) (interface{}, error)
+}
+
+// newColumn returns Parquet column for the ClickHouse type. Composite types like Array, Map or Tuple are written as text.
+// Nested columns like labels.key are named with underscore
+func newColumn(name, chType string) *column {
+	c := &column{name: invalidNameChars.ReplaceAllString(name, "_")}
+	chType = unwrapType(chType, "LowCardinality")
+	if t := unwrapType(chType, "Nullable"); t != chType {
+		c.optional = true
+		chType = unwrapType(t, "LowCardinality")
+	}
+
+	baseType := chType
+	if i := strings.IndexByte(baseType, '('); i >= 0 {
+		baseType = baseType[:i]
+	}
+	switch baseType {
+	case "Int8", "Int16", "Int32", "Int64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(baseType, "Int"))
+		c.field = fmt.Sprintf("int%d %s (INT(%d, true))", physicalBits(bits), c.name, bits)
+		c.parse = func(s string) (interface{}, error) {
+			v, err := strconv.ParseInt(s, 10, bits)
+			if bits == 64 {
+				return v, err
+			}
+			return int32(v), err
+		}
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(baseType, "UInt"))
+		c.field = fmt.Sprintf("int%d %s (INT(%d, false))", physicalBits(bits), c.name, bits)
+		c.parse = func(s string) (interface{}, error) {
+			v, err := strconv.ParseUint(s, 10, bits)
+			if bits == 64 {
+				return int64(v), err
+			}
+			return int32(v), err
+		}
+	case "Float32":
+		c.field = "float " + c.name
+		c.parse = func(s string) (interface{}, error) {
+			v, err := strconv.ParseFloat(s, 32)
+			return float32(v), err
+		}
+	case "Float64":
+		c.field = "double " + c.name
+		c.parse = func(s string) (interface{}, error) {
+			return strconv.ParseFloat(s, 64)
+		}
+	case "Bool":
+		c.field = "boolean " + c.name
+		c.parse = func(s string) (interface{}, error) {
+			return strconv.ParseBool(s)
+		}
+	case "DateTime", "DateTime64":
+		c.field = fmt.Sprintf("int64 %s (TIMESTAMP(MILLIS, true))", c.name)
+		c.parse = func(s string) (interface{}, error) {
+			t, err := time.Parse(timeLayout, s)
+			return t.UnixMilli(), err
+		}
+	case "Date", "Date32":
+		c.field = fmt.Sprintf("int32 %s (DATE)", c.name)
+		c.parse = func(s string) (interface{}, error) {
+			t, err := time.Parse(timeLayout, s)
+			return int32(t.Unix() / (24 * 60 * 60)), err
+		}
+	default:
+		c.field = fmt.Sprintf("binary %s (STRING)", c.name)
+		c.parse = func(s string) (interface{}, error) {
+			return []byte(s), nil
+		}
+	}
+	if c.optional {
+		c.field = "optional " + c.field
+	} else {
+		c.field = "required " + c.field
+	}
+	return c
+}
+
+// unwrapType returns type wrapped into the modifier, ex. String for LowCardinality(String)
+func unwrapType(chType, modifier string) string {
+	if strings.HasPrefix(chType, modifier+"(") && strings.HasSuffix(chType, ")") {
+		return chType[len(modifier)+1 : len(chType)-1]
+	}
+	return chType
+}
+
+// physicalBits returns size of the Parquet physical type for the integer, which is int32 or int64
+func physicalBits(bits int) int {
+	if bits < 32 {
+		return 32
+	}
+	return bits
+}
+
+// WriteQAN writes rows of the QAN chunk in TSV format to the Parquet file. Columns are typed by the ClickHouse types recorded at export.
+// It returns the number of written rows
+func WriteQAN(w io.Writer, columns []dump.ClickHouseColumn, content []byte) (int, error) {
+	if len(columns) == 0 {
+		return 0, errors.New("no ClickHouse columns provided")
+	}
+
+	schema := new(strings.Builder)
+	schema.WriteString("message qan {\n")
+	parquetColumns := make([]*column, 0, len(columns))
+	names := make(map[string]struct{}, len(columns))
+	for _, c := range columns {
+		pc := newColumn(c.Name, c.Type)
+		if _, ok := names[pc.name]; ok {
+			return 0, errors.Errorf("duplicate column %s", pc.name)
+		}
+		names[pc.name] = struct{}{}
+		parquetColumns = append(parquetColumns, pc)
+		schema.WriteString("\t" + pc.field + ";\n")
+	}
+	schema.WriteString("}")
+
+	fw, err := newFileWriter(w, schema.String())
+	if err != nil {
+		return 0, err
+	}
+
+	r := csv.NewReader(bytes.NewReader(content))
+	r.Comma = '\t'
+	r.FieldsPerRecord = len(columns)
+	r.ReuseRecord = true
+
+	rows := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to read TSV")
+		}
+		row := make(map[string]interface{}, len(parquetColumns))
+		for i, pc := range parquetColumns {
+			if pc.optional && (record[i] == nullValue || record[i] == "" && !strings.HasSuffix(pc.field, "(STRING)")) {
+				continue
+			}
+			v, err := pc.parse(record[i])
+			if err != nil {
+				return 0, errors.Wrapf(err, "invalid value %q of column %s", record[i], columns[i].Name)
+			}
+			row[pc.name] = v
+		}
+		if err = fw.AddData(row); err != nil {
+			return 0, errors.Wrap(err, "failed to add row")
+		}
+		rows++
+	}
+
+	if err = fw.Close(); err != nil {
+		return 0, errors.Wrap(err, "failed to close parquet writer")
+	}
+	return rows, nil
+}
@@ -0,0 +1,191 @@
+// Package pgzip implements gzip writer, which compresses blocks of the stream concurrently.
+// Every block is written as a separate gzip member, so the result is a standard multi-member gzip stream
+// readable by any gzip reader.
+package pgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBlockSize is a size of uncompressed data in a single gzip member
+const DefaultBlockSize = 1024 * 1024
+
+// Writer is an io.WriteCloser, which compresses data in parallel. Writes to the underlying writer are done
+// in order by a single goroutine. Close must be called to flush the last block and wait for all the writes.
+type Writer struct {
+	w         io.Writer
+	workers   int
+	blockSize int
+
+	buf     []byte
+	written bool
+	closed  bool
+
+	// blocks is an ordered queue of compression results. Its capacity limits the amount of blocks in memory
+	blocks chan chan *block
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	bufPool  sync.Pool
+	gzipPool sync.Pool
+}
+
+type block struct {
+	data *bytes.Buffer
+	err  error
+}
+
+// NewWriterLevel returns writer that compresses data with the given level using the given number of goroutines
+func NewWriterLevel(w io.Writer, level, workers int) (*Writer, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, errors.Errorf("invalid gzip compression level %d", level)
+	}
+	if workers <= 0 {
+		return nil, errors.Errorf("invalid workers count %d", workers)
+	}
+
+	z := &Writer{
+		workers:   workers,
+		blockSize: DefaultBlockSize,
+	}
+	z.bufPool.New = func() interface{} {
+		return new(bytes.Buffer)
+	}
+	z.gzipPool.New = func() interface{} {
+		gzw, _ := gzip.NewWriterLevel(nil, level) // level is validated above
+		return gzw
+	}
+	z.Reset(w)
+
+	return z, nil
+}
+
+// Reset discards the writer state and makes it write to w. Writer must be closed before reset,
+// otherwise the data that was not flushed yet is lost
+func (z *Writer) Reset(w io.Writer) {
+	z.w = w
+	z.buf = make([]byte, 0, z.blockSize)
+	z.written = false
+	z.closed = false
+	z.blocks = nil
+	z.done = nil
+	z.err = nil
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errors.New("write to closed writer")
+	}
+	if err := z.getErr(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		l := z.blockSize - len(z.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		z.buf = append(z.buf, p[:l]...)
+		p = p[l:]
+		n += l
+
+		if len(z.buf) == z.blockSize {
+			z.compressBlock()
+		}
+	}
+	return n, z.getErr()
+}
+
+// Close compresses the buffered data and waits for all the blocks to be written. It doesn't close the underlying writer
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.getErr()
+	}
+	z.closed = true
+
+	if len(z.buf) > 0 || !z.written {
+		// Empty member is written for the empty stream to keep it a valid gzip
+		z.compressBlock()
+	}
+	close(z.blocks)
+	<-z.done
+	z.blocks, z.done = nil, nil
+	return z.getErr()
+}
+
+// compressBlock sends the buffered data to compression. It blocks if there are too many blocks in memory
+func (z *Writer) compressBlock() {
+	if z.blocks == nil {
+		z.blocks = make(chan chan *block, z.workers)
+		z.done = make(chan struct{})
+		go z.writeBlocks(z.w, z.blocks, z.done)
+	}
+
+	data := z.buf
+	z.buf = make([]byte, 0, z.blockSize)
+	z.written = true
+
+	result := make(chan *block, 1)
+	z.blocks <- result
+	go func() {
+		result <- z.compress(data)
+	}()
+}
+
+func (z *Writer) compress(data []byte) *block {
+	buf := z.bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	gzw := z.gzipPool.Get().(*gzip.Writer)
+	defer z.gzipPool.Put(gzw)
+	gzw.Reset(buf)
+
+	if _, err := gzw.Write(data); err != nil {
+		return &block{err: errors.Wrap(err, "failed to compress block")}
+	}
+	if err := gzw.Close(); err != nil {
+		return &block{err: errors.Wrap(err, "failed to compress block")}
+	}
+	return &block{data: buf}
+}
+
+func (z *Writer) writeBlocks(w io.Writer, blocks <-chan chan *block, done chan<- struct{}) {
+	defer close(done)
+	for result := range blocks {
+		b := <-result
+		if b.err != nil {
+			z.setErr(b.err)
+		}
+		if b.data == nil {
+			continue
+		}
+		if z.getErr() == nil {
+			if _, err := w.Write(b.data.Bytes()); err != nil {
+				z.setErr(err)
+			}
+		}
+		z.bufPool.Put(b.data)
+	}
+}
+
+func (z *Writer) getErr() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+func (z *Writer) setErr(err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.err == nil {
+		z.err = err
+	}
+}
@@ -0,0 +1,126 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	random := make([]byte, 10*1024+100)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("pmm-dump "), 5000)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty"},
+		{name: "smaller than block", data: []byte("content")},
+		{name: "exact block", data: random[:1024]},
+		{name: "several blocks", data: random},
+		{name: "compressible", data: text},
+	}
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s with %d workers", tt.name, workers), func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				w, err := NewWriterLevel(buf, gzip.BestCompression, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.blockSize = 1024
+
+				// Write in uneven parts to cross blocks boundaries
+				for data := tt.data; len(data) > 0; {
+					n := 700
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err = w.Write(data[:n]); err != nil {
+						t.Fatal(err)
+					}
+					data = data[n:]
+				}
+				if err = w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if got := gunzip(t, buf.Bytes()); !bytes.Equal(got, tt.data) {
+					t.Fatalf("decompressed data doesn't match: got %d bytes, expected %d bytes", len(got), len(tt.data))
+				}
+			})
+		}
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriterLevel(buf, gzip.DefaultCompression, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = w.Write([]byte("first ")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("closed")); err == nil {
+		t.Fatal("write to closed writer should fail")
+	}
+
+	w.Reset(buf)
+	if _, err = w.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(gunzip(t, buf.Bytes())); got != "first second" {
+		t.Fatalf("unexpected decompressed data: %q", got)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk is full")
+}
+
+func TestWriterError(t *testing.T) {
+	w, err := NewWriterLevel(failingWriter{}, gzip.BestSpeed, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err == nil {
+		t.Fatal("error of the underlying writer should be returned")
+	}
+
+	if _, err = NewWriterLevel(io.Discard, 10, 2); err == nil {
+		t.Fatal("invalid level should be rejected")
+	}
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
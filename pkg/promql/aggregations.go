@@ -0,0 +1,210 @@
+package promql
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+)
+
+// aggrFunc aggregates values of the group at a single step. Values don't contain NaN and aren't empty
+type aggrFunc func(values []float64) float64
+
+var aggrFuncs = map[string]aggrFunc{
+	"sum": func(values []float64) float64 {
+		return rollupSum(nil, values, 0, 0)
+	},
+	"avg": func(values []float64) float64 {
+		return rollupAvg(nil, values, 0, 0)
+	},
+	"min": func(values []float64) float64 {
+		return rollupMin(nil, values, 0, 0)
+	},
+	"max": func(values []float64) float64 {
+		return rollupMax(nil, values, 0, 0)
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+	"group": func([]float64) float64 {
+		return 1
+	},
+	"stddev": func(values []float64) float64 {
+		return math.Sqrt(variance(values))
+	},
+	"stdvar": variance,
+}
+
+type seriesGroup struct {
+	labels map[string]string
+	series []*Timeseries
+}
+
+// aggrWithParam lists aggregations, which take a scalar parameter as the first argument
+var aggrWithParam = map[string]bool{
+	"topk":     true,
+	"bottomk":  true,
+	"quantile": true,
+}
+
+func (e *Engine) evalAggr(ec *evalConfig, ae *metricsql.AggrFuncExpr) (value, error) {
+	name := strings.ToLower(ae.Name)
+	args := ae.Args
+	var param []float64
+	if aggrWithParam[name] {
+		if len(args) != 2 {
+			return value{}, errors.Errorf("%s: expected 2 arguments, got %d", name, len(args))
+		}
+		var err error
+		if param, err = e.evalScalarArg(ec, args[0]); err != nil {
+			return value{}, err
+		}
+		args = args[1:]
+	} else if len(args) != 1 {
+		return value{}, errors.Errorf("%s: expected 1 argument, got %d", name, len(args))
+	}
+
+	var aggregate func(step int, values []float64) float64
+	switch name {
+	case "topk", "bottomk":
+		series, err := e.evalVectorArg(ec, args[0])
+		if err != nil {
+			return value{}, err
+		}
+		return value{series: topK(series, ae.Modifier, param, name == "bottomk")}, nil
+	case "quantile":
+		aggregate = func(step int, values []float64) float64 {
+			return quantile(param[step], values)
+		}
+	default:
+		f, ok := aggrFuncs[name]
+		if !ok {
+			return value{}, errors.Errorf("aggregation %s is not supported", ae.Name)
+		}
+		aggregate = func(_ int, values []float64) float64 {
+			return f(values)
+		}
+	}
+
+	series, err := e.evalVectorArg(ec, args[0])
+	if err != nil {
+		return value{}, err
+	}
+
+	result := value{}
+	values := make([]float64, 0, len(series))
+	for _, g := range groupSeries(series, ae.Modifier) {
+		ts := &Timeseries{Labels: g.labels, Values: make([]float64, len(ec.timestamps))}
+		for i := range ec.timestamps {
+			values = values[:0]
+			for _, s := range g.series {
+				if !math.IsNaN(s.Values[i]) {
+					values = append(values, s.Values[i])
+				}
+			}
+			if len(values) == 0 {
+				ts.Values[i] = nan
+				continue
+			}
+			ts.Values[i] = aggregate(i, values)
+		}
+		result.series = append(result.series, ts)
+	}
+	return result, nil
+}
+
+// topK keeps k series with the largest (smallest for bottomk) values in every group at every step.
+// Series keep their labels and are sorted by the value at the last step
+func topK(series []*Timeseries, modifier metricsql.ModifierExpr, k []float64, bottom bool) []*Timeseries {
+	less := func(a, b float64) bool {
+		if bottom {
+			return a < b
+		}
+		return a > b
+	}
+
+	result := make([]*Timeseries, 0, len(series))
+	for _, g := range groupSeries(series, modifier) {
+		top := make([]*Timeseries, len(g.series))
+		for i, s := range g.series {
+			top[i] = &Timeseries{Labels: s.Labels, Values: nanValues(len(s.Values))}
+		}
+		indexes := make([]int, 0, len(g.series))
+		for step := range k {
+			indexes = indexes[:0]
+			for i, s := range g.series {
+				if !math.IsNaN(s.Values[step]) {
+					indexes = append(indexes, i)
+				}
+			}
+			sort.SliceStable(indexes, func(a, b int) bool {
+				return less(g.series[indexes[a]].Values[step], g.series[indexes[b]].Values[step])
+			})
+			for n, i := range indexes {
+				if float64(n) >= k[step] {
+					break
+				}
+				top[i].Values[step] = g.series[i].Values[step]
+			}
+		}
+		result = append(result, top...)
+	}
+
+	last := len(k) - 1
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].Values[last], result[j].Values[last]
+		return less(a, b) || math.IsNaN(b) && !math.IsNaN(a)
+	})
+	return result
+}
+
+// quantile calculates φ-quantile of the values the same way as Prometheus does
+func quantile(q float64, values []float64) float64 {
+	switch {
+	case math.IsNaN(q) || len(values) == 0:
+		return nan
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := q * float64(len(sorted)-1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(float64(len(sorted)-1), lower+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+// groupSeries groups series by the labels of `by (...)` or `without (...)` modifier keeping order of the groups
+func groupSeries(series []*Timeseries, modifier metricsql.ModifierExpr) []*seriesGroup {
+	var groups []*seriesGroup
+	byKey := make(map[string]*seriesGroup)
+	for _, s := range series {
+		labels := groupLabels(s.Labels, modifier)
+		key := labelsKey(labels)
+		g, ok := byKey[key]
+		if !ok {
+			g = &seriesGroup{labels: labels}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.series = append(g.series, s)
+	}
+	return groups
+}
+
+func groupLabels(labels map[string]string, modifier metricsql.ModifierExpr) map[string]string {
+	switch strings.ToLower(modifier.Op) {
+	case "by":
+		return onlyLabels(labels, modifier.Args)
+	case "without":
+		return withoutName(withoutLabels(labels, modifier.Args...))
+	default:
+		return map[string]string{}
+	}
+}
@@ -0,0 +1,301 @@
+package promql
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultInstantStep is the step used for subqueries of the instant query
+const defaultInstantStep = 60 * 1000
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  samplePair        `json:"value"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []samplePair      `json:"values"`
+}
+
+// samplePair is marshalled as [<unix seconds>, "<value>"]
+type samplePair struct {
+	Timestamp int64
+	Value     float64
+}
+
+func (p samplePair) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{float64(p.Timestamp) / 1000, FormatValue(p.Value)})
+}
+
+// FormatValue formats sample value the same way as Prometheus does
+func FormatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
+
+// ResultData returns the query result in the format of Prometheus API: vector or scalar for the instant query and matrix otherwise
+func ResultData(result *Result, instant bool) interface{} {
+	if instant {
+		ts := result.Timestamps[len(result.Timestamps)-1]
+		if result.Scalar {
+			return queryData{
+				ResultType: "scalar",
+				Result:     samplePair{Timestamp: ts, Value: result.Series[0].Values[len(result.Timestamps)-1]},
+			}
+		}
+		vector := make([]vectorSample, 0, len(result.Series))
+		for _, s := range result.Series {
+			vector = append(vector, vectorSample{
+				Metric: s.Labels,
+				Value:  samplePair{Timestamp: ts, Value: s.Values[len(result.Timestamps)-1]},
+			})
+		}
+		return queryData{ResultType: "vector", Result: vector}
+	}
+
+	matrix := make([]matrixSeries, 0, len(result.Series))
+	for _, s := range result.Series {
+		ms := matrixSeries{Metric: s.Labels}
+		for i, v := range s.Values {
+			if !math.IsNaN(v) {
+				ms.Values = append(ms.Values, samplePair{Timestamp: result.Timestamps[i], Value: v})
+			}
+		}
+		matrix = append(matrix, ms)
+	}
+	return queryData{ResultType: "matrix", Result: matrix}
+}
+
+type apiHandler struct {
+	engine *Engine
+}
+
+// NewHandler returns handler of the read only Prometheus-compatible query API
+func NewHandler(engine *Engine) http.Handler {
+	h := &apiHandler{engine: engine}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", h.query)
+	mux.HandleFunc("/api/v1/query_range", h.queryRange)
+	mux.HandleFunc("/api/v1/series", h.series)
+	mux.HandleFunc("/api/v1/labels", h.labels)
+	mux.HandleFunc("/api/v1/label/", h.labelValues)
+	mux.HandleFunc("/api/v1/status/buildinfo", h.buildInfo)
+	return mux
+}
+
+func (h *apiHandler) query(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	_, maxTime := h.engine.storage.TimeRange()
+	ts, err := parseTime(r.Form.Get("time"), maxTime)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", errors.Wrap(err, "invalid time"))
+		return
+	}
+
+	result, err := h.engine.Query(r.Form.Get("query"), ts, ts, defaultInstantStep)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	writeData(w, ResultData(result, true))
+}
+
+func (h *apiHandler) queryRange(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	start, err := parseTime(r.Form.Get("start"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", errors.Wrap(err, "invalid start"))
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", errors.Wrap(err, "invalid end"))
+		return
+	}
+	step, err := parseDuration(r.Form.Get("step"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", errors.Wrap(err, "invalid step"))
+		return
+	}
+
+	result, err := h.engine.Query(r.Form.Get("query"), start, end, step)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	writeData(w, ResultData(result, false))
+}
+
+func (h *apiHandler) series(w http.ResponseWriter, r *http.Request) {
+	filterss, start, end, err := parseSeriesParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if len(filterss) == 0 {
+		writeError(w, http.StatusBadRequest, "bad_data", errors.New("no match[] parameter provided"))
+		return
+	}
+
+	series, err := h.engine.storage.Select(filterss, start, end)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	result := make([]map[string]string, 0, len(series))
+	for _, s := range series {
+		result = append(result, s.Labels)
+	}
+	writeData(w, result)
+}
+
+func (h *apiHandler) labels(w http.ResponseWriter, r *http.Request) {
+	filterss, start, end, err := parseSeriesParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	names, err := h.engine.storage.LabelNames(filterss, start, end)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	writeData(w, names)
+}
+
+func (h *apiHandler) labelValues(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+
+	filterss, start, end, err := parseSeriesParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	values, err := h.engine.storage.LabelValues(name, filterss, start, end)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	writeData(w, values)
+}
+
+func (h *apiHandler) buildInfo(w http.ResponseWriter, _ *http.Request) {
+	writeData(w, map[string]string{"version": "2.40.0"})
+}
+
+// parseSeriesParams parses match[], start and end parameters. The whole time range is used by default
+func parseSeriesParams(r *http.Request) ([][]metricsql.LabelFilter, int64, int64, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, 0, 0, err
+	}
+	start, err := parseTime(r.Form.Get("start"), math.MinInt64)
+	if err != nil {
+		return nil, 0, 0, errors.Wrap(err, "invalid start")
+	}
+	end, err := parseTime(r.Form.Get("end"), math.MaxInt64)
+	if err != nil {
+		return nil, 0, 0, errors.Wrap(err, "invalid end")
+	}
+
+	var filterss [][]metricsql.LabelFilter
+	for _, match := range r.Form["match[]"] {
+		expr, err := metricsql.Parse(match)
+		if err != nil {
+			return nil, 0, 0, errors.Wrapf(err, "invalid match[] %q", match)
+		}
+		me, ok := expr.(*metricsql.MetricExpr)
+		if !ok {
+			return nil, 0, 0, errors.Errorf("match[] %q should be a series selector", match)
+		}
+		filterss = append(filterss, me.LabelFilterss...)
+	}
+	return filterss, start, end, nil
+}
+
+// parseTime parses unix timestamp in seconds or RFC3339 time and returns it in milliseconds
+func parseTime(s string, defaultValue int64) (int64, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(f * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, errors.Errorf("cannot parse %q as unix timestamp or RFC3339 time", s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// parseDuration parses duration in seconds or in Prometheus format (ex. 5m) and returns it in milliseconds
+func parseDuration(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("duration is empty")
+	}
+	d, err := metricsql.PositiveDurationValue(s, 0)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("duration %q should be positive", s)
+	}
+	return d, nil
+}
+
+func writeData(w http.ResponseWriter, data interface{}) {
+	writeResponse(w, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+func writeError(w http.ResponseWriter, code int, errorType string, err error) {
+	writeResponse(w, code, apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+func writeResponse(w http.ResponseWriter, code int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Debug().Msgf("Failed to write response: %v", err)
+	}
+}
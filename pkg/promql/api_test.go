@@ -0,0 +1,109 @@
+package promql
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	server := httptest.NewServer(NewHandler(NewEngine(testStorage())))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		params   url.Values
+		code     int
+		expected string
+	}{
+		{
+			name:     "instant query",
+			path:     "/api/v1/query",
+			params:   url.Values{"query": {`sum(up)`}, "time": {"600"}},
+			code:     http.StatusOK,
+			expected: `{"resultType":"vector","result":[{"metric":{},"value":[600,"2"]}]}`,
+		},
+		{
+			name:     "instant query at the end of data by default",
+			path:     "/api/v1/query",
+			params:   url.Values{"query": {`scalar(sum(up))`}},
+			code:     http.StatusOK,
+			expected: `{"resultType":"scalar","result":[1200,"2"]}`,
+		},
+		{
+			name:     "range query",
+			path:     "/api/v1/query_range",
+			params:   url.Values{"query": {`up{instance="a"}`}, "start": {"1970-01-01T00:19:00Z"}, "end": {"1200"}, "step": {"30s"}},
+			code:     http.StatusOK,
+			expected: `{"resultType":"matrix","result":[{"metric":{"__name__":"up","instance":"a","job":"node"},"values":[[1140,"1"],[1170,"1"],[1200,"1"]]}]}`,
+		},
+		{
+			name:     "series",
+			path:     "/api/v1/series",
+			params:   url.Values{"match[]": {`{__name__="up",instance="b"}`}},
+			code:     http.StatusOK,
+			expected: `[{"__name__":"up","instance":"b","job":"node"}]`,
+		},
+		{
+			name:     "labels",
+			path:     "/api/v1/labels",
+			code:     http.StatusOK,
+			expected: `["__name__","instance","job"]`,
+		},
+		{
+			name:     "label values",
+			path:     "/api/v1/label/__name__/values",
+			code:     http.StatusOK,
+			expected: `["requests_total","up"]`,
+		},
+		{
+			name:   "invalid query",
+			path:   "/api/v1/query",
+			params: url.Values{"query": {`sum(`}},
+			code:   http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "invalid step",
+			path:   "/api/v1/query_range",
+			params: url.Values{"query": {`up`}, "start": {"0"}, "end": {"60"}, "step": {"-1"}},
+			code:   http.StatusBadRequest,
+		},
+		{
+			name: "series without match",
+			path: "/api/v1/series",
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.PostForm(server.URL+tt.path, tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.code {
+				t.Fatalf("expected status %d, got %d", tt.code, resp.StatusCode)
+			}
+			var body struct {
+				Status string          `json:"status"`
+				Data   json.RawMessage `json:"data"`
+			}
+			if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code != http.StatusOK {
+				if body.Status != "error" {
+					t.Fatalf("expected error status, got %s", body.Status)
+				}
+				return
+			}
+			if string(body.Data) != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, body.Data)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package promql
+
+import (
+	"math"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/VictoriaMetrics/metricsql/binaryop"
+	"github.com/pkg/errors"
+)
+
+var arithmeticOps = map[string]func(left, right float64) float64{
+	"+":     binaryop.Plus,
+	"-":     binaryop.Minus,
+	"*":     binaryop.Mul,
+	"/":     binaryop.Div,
+	"%":     binaryop.Mod,
+	"^":     binaryop.Pow,
+	"atan2": binaryop.Atan2,
+}
+
+var comparisonOps = map[string]func(left, right float64) bool{
+	"==": binaryop.Eq,
+	"!=": binaryop.Neq,
+	">":  binaryop.Gt,
+	"<":  binaryop.Lt,
+	">=": binaryop.Gte,
+	"<=": binaryop.Lte,
+}
+
+// binaryOp calculates result of the operation for a pair of values. The second result is false if the value is filtered out
+type binaryOp struct {
+	arithmetic func(left, right float64) float64
+	comparison func(left, right float64) bool
+	isBool     bool
+}
+
+func (op binaryOp) eval(left, right float64) (float64, bool) {
+	if math.IsNaN(left) || math.IsNaN(right) {
+		return nan, false
+	}
+	if op.arithmetic != nil {
+		return op.arithmetic(left, right), true
+	}
+	ok := op.comparison(left, right)
+	if op.isBool {
+		if ok {
+			return 1, true
+		}
+		return 0, true
+	}
+	return left, ok
+}
+
+// dropsName reports whether the operation drops metric name: all of them except filtering comparisons do
+func (op binaryOp) dropsName() bool {
+	return op.arithmetic != nil || op.isBool
+}
+
+func (e *Engine) evalBinaryOp(ec *evalConfig, be *metricsql.BinaryOpExpr) (value, error) {
+	opName := strings.ToLower(be.Op)
+	left, err := e.eval(ec, be.Left)
+	if err != nil {
+		return value{}, err
+	}
+	right, err := e.eval(ec, be.Right)
+	if err != nil {
+		return value{}, err
+	}
+
+	switch opName {
+	case "and", "or", "unless":
+		if left.scalar || right.scalar {
+			return value{}, errors.Errorf("%s: set operations are not allowed for scalars", be.AppendString(nil))
+		}
+		return value{series: evalSetOp(opName, be, left.series, right.series, len(ec.timestamps))}, nil
+	}
+
+	op := binaryOp{arithmetic: arithmeticOps[opName], comparison: comparisonOps[opName], isBool: be.Bool}
+	if op.arithmetic == nil && op.comparison == nil {
+		return value{}, errors.Errorf("binary operation %s is not supported", be.Op)
+	}
+
+	switch {
+	case left.scalar && right.scalar:
+		if op.comparison != nil && !op.isBool {
+			return value{}, errors.Errorf("%s: comparisons between scalars must use bool modifier", be.AppendString(nil))
+		}
+		values := make([]float64, len(ec.timestamps))
+		for i := range values {
+			values[i], _ = op.eval(left.series[0].Values[i], right.series[0].Values[i])
+		}
+		return value{series: []*Timeseries{{Labels: map[string]string{}, Values: values}}, scalar: true}, nil
+	case left.scalar || right.scalar:
+		return value{series: evalVectorScalar(op, left, right)}, nil
+	default:
+		series, err := evalVectorVector(op, be, left.series, right.series, len(ec.timestamps))
+		return value{series: series}, err
+	}
+}
+
+func evalVectorScalar(op binaryOp, left, right value) []*Timeseries {
+	vector, scalar := left.series, right.series
+	if left.scalar {
+		vector, scalar = right.series, left.series
+	}
+
+	result := make([]*Timeseries, 0, len(vector))
+	for _, s := range vector {
+		values := make([]float64, len(s.Values))
+		for i, v := range s.Values {
+			l, r := v, scalar[0].Values[i]
+			if left.scalar {
+				l, r = r, l
+			}
+			res, ok := op.eval(l, r)
+			switch {
+			case !ok:
+				values[i] = nan
+			case op.comparison != nil && !op.isBool:
+				// Filtering keeps value of the vector
+				values[i] = v
+			default:
+				values[i] = res
+			}
+		}
+		labels := s.Labels
+		if op.dropsName() {
+			labels = withoutName(labels)
+		}
+		result = append(result, &Timeseries{Labels: labels, Values: values})
+	}
+	return result
+}
+
+// signatureFunc returns function, which calculates key of the series for vector matching
+func signatureFunc(modifier metricsql.ModifierExpr) func(labels map[string]string) string {
+	switch strings.ToLower(modifier.Op) {
+	case "on":
+		return func(labels map[string]string) string {
+			return labelsKey(onlyLabels(labels, modifier.Args))
+		}
+	default:
+		return func(labels map[string]string) string {
+			return labelsKey(withoutName(withoutLabels(labels, modifier.Args...)))
+		}
+	}
+}
+
+func evalVectorVector(op binaryOp, be *metricsql.BinaryOpExpr, left, right []*Timeseries, points int) ([]*Timeseries, error) {
+	signature := signatureFunc(be.GroupModifier)
+	join := strings.ToLower(be.JoinModifier.Op)
+	many, one := left, right
+	swapped := join == "group_right"
+	if swapped {
+		many, one = right, left
+	}
+
+	// Series of the "one" side with the same signature are merged, but they must not have values at the same steps
+	oneBySig := make(map[string]*Timeseries)
+	for _, s := range one {
+		sig := signature(s.Labels)
+		merged, ok := oneBySig[sig]
+		if !ok {
+			oneBySig[sig] = &Timeseries{Labels: s.Labels, Values: append([]float64(nil), s.Values...)}
+			continue
+		}
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			if !math.IsNaN(merged.Values[i]) {
+				return nil, errors.Errorf("%s: found duplicate series for the match group %s on the %s side of the operation",
+					be.AppendString(nil), sig, side(swapped))
+			}
+			merged.Values[i] = v
+		}
+	}
+
+	// matched tracks steps, which already have a match on the "many" side for one-to-one matching
+	matched := make(map[string][]bool)
+	var result []*Timeseries
+	for _, s := range many {
+		sig := signature(s.Labels)
+		o, ok := oneBySig[sig]
+		if !ok {
+			continue
+		}
+		values := nanValues(points)
+		found := false
+		for i := range values {
+			l, r := s.Values[i], o.Values[i]
+			if swapped {
+				l, r = r, l
+			}
+			v, ok := op.eval(l, r)
+			if !ok {
+				continue
+			}
+			if join == "" {
+				if matched[sig] == nil {
+					matched[sig] = make([]bool, points)
+				}
+				if matched[sig][i] {
+					return nil, errors.Errorf("%s: multiple matches for labels %s: many-to-one matching must be explicit (group_left/group_right)",
+						be.AppendString(nil), sig)
+				}
+				matched[sig][i] = true
+			}
+			values[i] = v
+			found = true
+		}
+		if found {
+			result = append(result, &Timeseries{Labels: resultLabels(op, be, s.Labels, o.Labels), Values: values})
+		}
+	}
+	return result, nil
+}
+
+func side(left bool) string {
+	if left {
+		return "left"
+	}
+	return "right"
+}
+
+// resultLabels returns labels of the vector matching result: labels of the "many" side adjusted by the modifiers
+func resultLabels(op binaryOp, be *metricsql.BinaryOpExpr, many, one map[string]string) map[string]string {
+	labels := many
+	if op.dropsName() {
+		labels = withoutName(labels)
+	}
+
+	if be.JoinModifier.Op == "" {
+		switch strings.ToLower(be.GroupModifier.Op) {
+		case "on":
+			labels = onlyLabels(labels, be.GroupModifier.Args)
+		case "ignoring":
+			labels = withoutLabels(labels, be.GroupModifier.Args...)
+		}
+		return labels
+	}
+
+	if len(be.JoinModifier.Args) > 0 {
+		labels = withoutLabels(labels)
+		for _, name := range be.JoinModifier.Args {
+			if v, ok := one[name]; ok {
+				labels[name] = v
+			} else {
+				delete(labels, name)
+			}
+		}
+	}
+	return labels
+}
+
+func evalSetOp(op string, be *metricsql.BinaryOpExpr, left, right []*Timeseries, points int) []*Timeseries {
+	signature := signatureFunc(be.GroupModifier)
+	present := func(series []*Timeseries) map[string][]bool {
+		result := make(map[string][]bool)
+		for _, s := range series {
+			sig := signature(s.Labels)
+			if result[sig] == nil {
+				result[sig] = make([]bool, points)
+			}
+			for i, v := range s.Values {
+				if !math.IsNaN(v) {
+					result[sig][i] = true
+				}
+			}
+		}
+		return result
+	}
+	filter := func(series []*Timeseries, other map[string][]bool, keep bool) []*Timeseries {
+		result := make([]*Timeseries, 0, len(series))
+		for _, s := range series {
+			has := other[signature(s.Labels)]
+			values := make([]float64, len(s.Values))
+			for i, v := range s.Values {
+				if has != nil && has[i] == keep || has == nil && !keep {
+					values[i] = v
+				} else {
+					values[i] = nan
+				}
+			}
+			result = append(result, &Timeseries{Labels: s.Labels, Values: values})
+		}
+		return result
+	}
+
+	switch op {
+	case "and":
+		return filter(left, present(right), true)
+	case "unless":
+		return filter(left, present(right), false)
+	default:
+		return append(left, filter(right, present(left), false)...)
+	}
+}
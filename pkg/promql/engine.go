@@ -0,0 +1,254 @@
+package promql
+
+import (
+	"math"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultLookbackDelta is the max time to look back for the last sample of the series
+	defaultLookbackDelta = 5 * 60 * 1000
+	// maxPoints limits the number of steps in the query
+	maxPoints = 11000
+)
+
+var nan = math.NaN()
+
+// Timeseries is a series of the query result. It has a value for every timestamp of the result, missing values are NaN
+type Timeseries struct {
+	Labels map[string]string
+	Values []float64
+}
+
+// Result is a result of the query evaluation
+type Result struct {
+	Timestamps []int64
+	Series     []*Timeseries
+
+	// Scalar is set if the query returns a scalar. Series contains a single series without labels then
+	Scalar bool
+}
+
+// Engine evaluates PromQL (MetricsQL subset) queries against the storage
+type Engine struct {
+	storage       *Storage
+	lookbackDelta int64
+}
+
+func NewEngine(storage *Storage) *Engine {
+	return &Engine{
+		storage:       storage,
+		lookbackDelta: defaultLookbackDelta,
+	}
+}
+
+// Storage returns the storage of the engine
+func (e *Engine) Storage() *Storage {
+	return e.storage
+}
+
+type evalConfig struct {
+	start, end, step int64
+	timestamps       []int64
+}
+
+func newEvalConfig(start, end, step int64) (*evalConfig, error) {
+	if step <= 0 {
+		return nil, errors.New("step should be positive")
+	}
+	if end < start {
+		return nil, errors.New("end should not be before start")
+	}
+	if (end-start)/step+1 > maxPoints {
+		return nil, errors.Errorf("too many points: %d, reduce the time range or increase the step", (end-start)/step+1)
+	}
+	ec := &evalConfig{start: start, end: end, step: step}
+	for t := start; t <= end; t += step {
+		ec.timestamps = append(ec.timestamps, t)
+	}
+	return ec, nil
+}
+
+// value is a result of the expression evaluation
+type value struct {
+	series []*Timeseries
+	scalar bool
+}
+
+// Query evaluates the query at every step from start to end. Timestamps are in milliseconds
+func (e *Engine) Query(query string, start, end, step int64) (*Result, error) {
+	expr, err := metricsql.Parse(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse query")
+	}
+	ec, err := newEvalConfig(start, end, step)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := e.eval(ec, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Timestamps: ec.timestamps,
+		Scalar:     v.scalar,
+	}
+	for _, s := range v.series {
+		if v.scalar || !isEmpty(s.Values) {
+			result.Series = append(result.Series, s)
+		}
+	}
+	return result, nil
+}
+
+func (e *Engine) eval(ec *evalConfig, expr metricsql.Expr) (value, error) {
+	switch expr := expr.(type) {
+	case *metricsql.NumberExpr:
+		return scalarValue(ec, expr.N), nil
+	case *metricsql.StringExpr:
+		return value{}, errors.Errorf("unexpected string %q", expr.S)
+	case *metricsql.MetricExpr:
+		series, err := e.selectSeries(ec, expr, 0)
+		return value{series: series}, err
+	case *metricsql.RollupExpr:
+		if expr.At != nil {
+			return value{}, errors.Errorf("%s: @ modifier is not supported", expr.AppendString(nil))
+		}
+		if expr.Window != nil || expr.ForSubquery() {
+			return value{}, errors.Errorf("%s: range vector could be used only as an argument of the rollup function", expr.AppendString(nil))
+		}
+		offset := expr.Offset.Duration(ec.step)
+		if me, ok := expr.Expr.(*metricsql.MetricExpr); ok {
+			series, err := e.selectSeries(ec, me, offset)
+			return value{series: series}, err
+		}
+		shifted := *ec
+		shifted.timestamps = make([]int64, len(ec.timestamps))
+		for i, t := range ec.timestamps {
+			shifted.timestamps[i] = t - offset
+		}
+		shifted.start, shifted.end = ec.start-offset, ec.end-offset
+		return e.eval(&shifted, expr.Expr)
+	case *metricsql.FuncExpr:
+		return e.evalFunc(ec, expr)
+	case *metricsql.AggrFuncExpr:
+		return e.evalAggr(ec, expr)
+	case *metricsql.BinaryOpExpr:
+		return e.evalBinaryOp(ec, expr)
+	default:
+		return value{}, errors.Errorf("unsupported expression %s", expr.AppendString(nil))
+	}
+}
+
+// selectSeries returns the last sample of every matching series at every step within the lookback delta
+func (e *Engine) selectSeries(ec *evalConfig, me *metricsql.MetricExpr, offset int64) ([]*Timeseries, error) {
+	series, err := e.storage.Select(me.LabelFilterss, ec.start-offset-e.lookbackDelta, ec.end-offset)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Timeseries, 0, len(series))
+	for _, s := range series {
+		values := make([]float64, len(ec.timestamps))
+		found := false
+		j := 0
+		for i, t := range ec.timestamps {
+			t -= offset
+			for j < len(s.Timestamps) && s.Timestamps[j] <= t {
+				j++
+			}
+			if j > 0 && s.Timestamps[j-1] > t-e.lookbackDelta {
+				values[i] = s.Values[j-1]
+				found = true
+			} else {
+				values[i] = nan
+			}
+		}
+		if found {
+			result = append(result, &Timeseries{Labels: s.Labels, Values: values})
+		}
+	}
+	return result, nil
+}
+
+// evalScalarArg evaluates the argument, which should be a scalar, and returns its values
+func (e *Engine) evalScalarArg(ec *evalConfig, expr metricsql.Expr) ([]float64, error) {
+	v, err := e.eval(ec, expr)
+	if err != nil {
+		return nil, err
+	}
+	if !v.scalar {
+		return nil, errors.Errorf("%s: expected scalar", expr.AppendString(nil))
+	}
+	return v.series[0].Values, nil
+}
+
+// evalVectorArg evaluates the argument, which should be an instant vector
+func (e *Engine) evalVectorArg(ec *evalConfig, expr metricsql.Expr) ([]*Timeseries, error) {
+	v, err := e.eval(ec, expr)
+	if err != nil {
+		return nil, err
+	}
+	if v.scalar {
+		return nil, errors.Errorf("%s: expected instant vector, got scalar", expr.AppendString(nil))
+	}
+	return v.series, nil
+}
+
+func scalarValue(ec *evalConfig, n float64) value {
+	values := make([]float64, len(ec.timestamps))
+	for i := range values {
+		values[i] = n
+	}
+	return value{
+		series: []*Timeseries{{Labels: map[string]string{}, Values: values}},
+		scalar: true,
+	}
+}
+
+func isEmpty(values []float64) bool {
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func nanValues(n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = nan
+	}
+	return values
+}
+
+// withoutName returns copy of the labels without metric name
+func withoutName(labels map[string]string) map[string]string {
+	return withoutLabels(labels, MetricNameLabel)
+}
+
+func withoutLabels(labels map[string]string, names ...string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	for _, name := range names {
+		delete(result, name)
+	}
+	return result
+}
+
+func onlyLabels(labels map[string]string, names []string) map[string]string {
+	result := make(map[string]string, len(names))
+	for _, name := range names {
+		if v, ok := labels[name]; ok {
+			result[name] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,232 @@
+package promql
+
+import (
+	"math"
+	"testing"
+)
+
+// testStorage returns storage with samples every 15 seconds from 0 to 20 minutes
+func testStorage() *Storage {
+	s := NewStorage()
+	for _, instance := range []struct {
+		name string
+		rate float64
+	}{{"a", 1}, {"b", 2}} {
+		var timestamps []int64
+		var requests, up []float64
+		for i := 0; i <= 80; i++ {
+			timestamps = append(timestamps, int64(i)*15000)
+			requests = append(requests, float64(i)*15*instance.rate)
+			up = append(up, 1)
+		}
+		s.Add(map[string]string{MetricNameLabel: "requests_total", "instance": instance.name, "job": "node"}, timestamps, requests)
+		s.Add(map[string]string{MetricNameLabel: "up", "instance": instance.name, "job": "node"}, timestamps, up)
+	}
+	s.Sort()
+	return s
+}
+
+// addHistogram adds histogram buckets with 10 observations of each 1, 2 and 3 seconds
+func addHistogram(s *Storage) {
+	for le, count := range map[string]float64{"1": 10, "2": 20, "4": 30, "+Inf": 30} {
+		var timestamps []int64
+		var values []float64
+		for i := 0; i <= 80; i++ {
+			timestamps = append(timestamps, int64(i)*15000)
+			values = append(values, count)
+		}
+		s.Add(map[string]string{MetricNameLabel: "duration_seconds_bucket", "job": "node", "le": le}, timestamps, values)
+	}
+	s.Sort()
+}
+
+func TestQuery(t *testing.T) {
+	s := testStorage()
+	addHistogram(s)
+	e := NewEngine(s)
+	const ts = 10 * 60 * 1000
+
+	tests := []struct {
+		query     string
+		expected  map[string]float64
+		scalar    bool
+		shouldErr bool
+	}{
+		{
+			query: `up{instance="a"}`,
+			expected: map[string]float64{
+				`{__name__="up",instance="a",job="node"}`: 1,
+			},
+		},
+		{
+			query: `rate(requests_total[5m])`,
+			expected: map[string]float64{
+				`{instance="a",job="node"}`: 1,
+				`{instance="b",job="node"}`: 2,
+			},
+		},
+		{
+			query: `sum(increase(requests_total[5m])) by (job)`,
+			expected: map[string]float64{
+				`{job="node"}`: 900,
+			},
+		},
+		{
+			query: `avg without (instance) (requests_total)`,
+			expected: map[string]float64{
+				`{job="node"}`: 900,
+			},
+		},
+		{
+			query: `requests_total / on(instance) up`,
+			expected: map[string]float64{
+				`{instance="a"}`: 600,
+				`{instance="b"}`: 1200,
+			},
+		},
+		{
+			query: `requests_total > 1000`,
+			expected: map[string]float64{
+				`{__name__="requests_total",instance="b",job="node"}`: 1200,
+			},
+		},
+		{
+			query: `requests_total > bool 1000`,
+			expected: map[string]float64{
+				`{instance="a",job="node"}`: 0,
+				`{instance="b",job="node"}`: 1,
+			},
+		},
+		{
+			query: `requests_total offset 5m`,
+			expected: map[string]float64{
+				`{__name__="requests_total",instance="a",job="node"}`: 300,
+				`{__name__="requests_total",instance="b",job="node"}`: 600,
+			},
+		},
+		{
+			query: `max_over_time(rate(requests_total{instance="b"}[1m])[5m:1m])`,
+			expected: map[string]float64{
+				`{instance="b",job="node"}`: 2,
+			},
+		},
+		{
+			query: `up and on(instance) requests_total{instance="a"}`,
+			expected: map[string]float64{
+				`{__name__="up",instance="a",job="node"}`: 1,
+			},
+		},
+		{
+			query: `label_replace(up{instance="a"}, "host", "host-$1", "instance", "(.*)")`,
+			expected: map[string]float64{
+				`{__name__="up",host="host-a",instance="a",job="node"}`: 1,
+			},
+		},
+		{
+			query:    `time() + 1`,
+			expected: map[string]float64{`{}`: 601},
+			scalar:   true,
+		},
+		{
+			query:    `absent(missing{job="node"})`,
+			expected: map[string]float64{`{job="node"}`: 1},
+		},
+		{
+			query: `topk(1, requests_total)`,
+			expected: map[string]float64{
+				`{__name__="requests_total",instance="b",job="node"}`: 1200,
+			},
+		},
+		{
+			query: `bottomk(1, rate(requests_total[5m])) by (job)`,
+			expected: map[string]float64{
+				`{instance="a",job="node"}`: 1,
+			},
+		},
+		{
+			query: `quantile(0.5, requests_total)`,
+			expected: map[string]float64{
+				`{}`: 900,
+			},
+		},
+		{
+			query: `quantile_over_time(0.5, requests_total{instance="a"}[1m])`,
+			expected: map[string]float64{
+				`{instance="a",job="node"}`: 577.5,
+			},
+		},
+		{
+			query: `histogram_quantile(0.5, duration_seconds_bucket)`,
+			expected: map[string]float64{
+				`{job="node"}`: 1.5,
+			},
+		},
+		{
+			query: `histogram_quantile(0.9, sum(duration_seconds_bucket) by (le))`,
+			expected: map[string]float64{
+				`{}`: 3.4,
+			},
+		},
+		{
+			query:    `100 * missing`,
+			expected: map[string]float64{},
+		},
+		{query: `topk(up)`, shouldErr: true},
+		{query: `rate(requests_total)`, shouldErr: true},
+		{query: `requests_total + ignoring(instance) up`, shouldErr: true},
+		{query: `unknown_function(up)`, shouldErr: true},
+		{query: `sum(`, shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := e.Query(tt.query, ts, ts, 60000)
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatal("there was no err")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Scalar != tt.scalar {
+				t.Fatalf("expected scalar=%v, got %v", tt.scalar, result.Scalar)
+			}
+			got := make(map[string]float64)
+			for _, s := range result.Series {
+				got[labelsKey(s.Labels)] = s.Values[0]
+			}
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			for key, v := range tt.expected {
+				if g, ok := got[key]; !ok || math.Abs(g-v) > 1e-9 {
+					t.Fatalf("expected %s=%v, got %v", key, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	e := NewEngine(testStorage())
+
+	result, err := e.Query(`up{instance="a"}`, 10*60*1000, 30*60*1000, 5*60*1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Timestamps) != 5 || len(result.Series) != 1 {
+		t.Fatalf("unexpected result: %d timestamps, %d series", len(result.Timestamps), len(result.Series))
+	}
+	// The last sample is at 20m, so it's found within 5m lookback delta only till 25m
+	expected := []float64{1, 1, 1, nan, nan}
+	for i, v := range result.Series[0].Values {
+		if v != expected[i] && !(math.IsNaN(v) && math.IsNaN(expected[i])) {
+			t.Fatalf("expected %v, got %v", expected, result.Series[0].Values)
+		}
+	}
+
+	if _, err = e.Query(`up`, 0, maxPoints*1000, 1); err == nil {
+		t.Fatal("too many points should be rejected")
+	}
+}
@@ -0,0 +1,708 @@
+package promql
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+)
+
+// rollupFunc calculates value over the samples in the (start, end] window. NaN is returned if there is no value
+type rollupFunc func(timestamps []int64, values []float64, start, end int64) float64
+
+var rollupFuncs = map[string]rollupFunc{
+	"rate":              extrapolatedRate(true, true),
+	"increase":          extrapolatedRate(true, false),
+	"delta":             extrapolatedRate(false, false),
+	"irate":             instantRate(true),
+	"idelta":            instantRate(false),
+	"changes":           rollupChanges,
+	"resets":            rollupResets,
+	"avg_over_time":     rollupAvg,
+	"min_over_time":     rollupMin,
+	"max_over_time":     rollupMax,
+	"sum_over_time":     rollupSum,
+	"count_over_time":   rollupCount,
+	"last_over_time":    rollupLast,
+	"present_over_time": rollupPresent,
+	"stddev_over_time":  rollupStddev,
+	"stdvar_over_time":  rollupStdvar,
+	"deriv":             rollupDeriv,
+}
+
+// rollupKeepsName lists the rollup functions, which keep metric name
+var rollupKeepsName = map[string]bool{
+	"last_over_time": true,
+}
+
+// mathFuncs are applied to every value of the series
+var mathFuncs = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"exp":   math.Exp,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"sqrt":  math.Sqrt,
+}
+
+func (e *Engine) evalFunc(ec *evalConfig, fe *metricsql.FuncExpr) (value, error) {
+	name := strings.ToLower(fe.Name)
+	if f, ok := rollupFuncs[name]; ok {
+		if len(fe.Args) != 1 {
+			return value{}, errors.Errorf("%s: expected 1 argument, got %d", name, len(fe.Args))
+		}
+		return e.evalRollup(ec, name, f, fe.Args[0])
+	}
+	if f, ok := mathFuncs[name]; ok {
+		if len(fe.Args) != 1 {
+			return value{}, errors.Errorf("%s: expected 1 argument, got %d", name, len(fe.Args))
+		}
+		return e.transformValues(ec, fe.Args[0], func(_ int, v float64) float64 { return f(v) })
+	}
+
+	switch name {
+	case "time":
+		v := scalarValue(ec, 0)
+		for i, t := range ec.timestamps {
+			v.series[0].Values[i] = float64(t) / 1000
+		}
+		return v, nil
+	case "vector":
+		if len(fe.Args) != 1 {
+			return value{}, errors.Errorf("vector: expected 1 argument, got %d", len(fe.Args))
+		}
+		values, err := e.evalScalarArg(ec, fe.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		return value{series: []*Timeseries{{Labels: map[string]string{}, Values: values}}}, nil
+	case "scalar":
+		if len(fe.Args) != 1 {
+			return value{}, errors.Errorf("scalar: expected 1 argument, got %d", len(fe.Args))
+		}
+		series, err := e.evalVectorArg(ec, fe.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		v := scalarValue(ec, nan)
+		for i := range ec.timestamps {
+			found := 0
+			for _, s := range series {
+				if !math.IsNaN(s.Values[i]) {
+					v.series[0].Values[i] = s.Values[i]
+					found++
+				}
+			}
+			if found != 1 {
+				v.series[0].Values[i] = nan
+			}
+		}
+		return v, nil
+	case "round":
+		if len(fe.Args) < 1 || len(fe.Args) > 2 {
+			return value{}, errors.Errorf("round: expected 1 or 2 arguments, got %d", len(fe.Args))
+		}
+		nearest := scalarValue(ec, 1).series[0].Values
+		if len(fe.Args) == 2 {
+			var err error
+			if nearest, err = e.evalScalarArg(ec, fe.Args[1]); err != nil {
+				return value{}, err
+			}
+		}
+		return e.transformValues(ec, fe.Args[0], func(i int, v float64) float64 {
+			return math.Floor(v/nearest[i]+0.5) * nearest[i]
+		})
+	case "clamp", "clamp_min", "clamp_max":
+		expected := 2
+		if name == "clamp" {
+			expected = 3
+		}
+		if len(fe.Args) != expected {
+			return value{}, errors.Errorf("%s: expected %d arguments, got %d", name, expected, len(fe.Args))
+		}
+		var limits [][]float64
+		for _, arg := range fe.Args[1:] {
+			values, err := e.evalScalarArg(ec, arg)
+			if err != nil {
+				return value{}, err
+			}
+			limits = append(limits, values)
+		}
+		return e.transformValues(ec, fe.Args[0], func(i int, v float64) float64 {
+			switch name {
+			case "clamp_min":
+				return math.Max(v, limits[0][i])
+			case "clamp_max":
+				return math.Min(v, limits[0][i])
+			default:
+				return math.Max(math.Min(v, limits[1][i]), limits[0][i])
+			}
+		})
+	case "sort", "sort_desc":
+		if len(fe.Args) != 1 {
+			return value{}, errors.Errorf("%s: expected 1 argument, got %d", name, len(fe.Args))
+		}
+		series, err := e.evalVectorArg(ec, fe.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		last := len(ec.timestamps) - 1
+		sort.SliceStable(series, func(i, j int) bool {
+			a, b := series[i].Values[last], series[j].Values[last]
+			if name == "sort_desc" {
+				a, b = b, a
+			}
+			return a < b || math.IsNaN(b) && !math.IsNaN(a)
+		})
+		return value{series: series}, nil
+	case "absent":
+		if len(fe.Args) != 1 {
+			return value{}, errors.Errorf("absent: expected 1 argument, got %d", len(fe.Args))
+		}
+		series, err := e.evalVectorArg(ec, fe.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		labels := make(map[string]string)
+		if me, ok := fe.Args[0].(*metricsql.MetricExpr); ok && len(me.LabelFilterss) == 1 {
+			for _, f := range me.LabelFilterss[0] {
+				if !f.IsNegative && !f.IsRegexp && f.Label != MetricNameLabel {
+					labels[f.Label] = f.Value
+				}
+			}
+		}
+		values := make([]float64, len(ec.timestamps))
+		for i := range values {
+			values[i] = 1
+			for _, s := range series {
+				if !math.IsNaN(s.Values[i]) {
+					values[i] = nan
+					break
+				}
+			}
+		}
+		return value{series: []*Timeseries{{Labels: labels, Values: values}}}, nil
+	case "quantile_over_time":
+		if len(fe.Args) != 2 {
+			return value{}, errors.Errorf("quantile_over_time: expected 2 arguments, got %d", len(fe.Args))
+		}
+		phi, err := e.evalScalarArg(ec, fe.Args[0])
+		if err != nil {
+			return value{}, err
+		}
+		return e.evalRollup(ec, name, func(_ []int64, values []float64, _, _ int64) float64 {
+			return quantile(phi[0], values)
+		}, fe.Args[1])
+	case "histogram_quantile":
+		return e.histogramQuantile(ec, fe)
+	case "label_replace":
+		return e.labelReplace(ec, fe)
+	case "label_join":
+		return e.labelJoin(ec, fe)
+	default:
+		return value{}, errors.Errorf("function %s is not supported", fe.Name)
+	}
+}
+
+// transformValues applies f to every value of the vector argument and drops metric name
+func (e *Engine) transformValues(ec *evalConfig, arg metricsql.Expr, f func(i int, v float64) float64) (value, error) {
+	v, err := e.eval(ec, arg)
+	if err != nil {
+		return value{}, err
+	}
+	result := value{scalar: v.scalar}
+	for _, s := range v.series {
+		values := make([]float64, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = f(i, v)
+		}
+		result.series = append(result.series, &Timeseries{Labels: withoutName(s.Labels), Values: values})
+	}
+	return result, nil
+}
+
+// rangeSamples are samples of a single series used by the rollup function
+type rangeSamples struct {
+	labels     map[string]string
+	timestamps []int64
+	values     []float64
+}
+
+func (e *Engine) evalRollup(ec *evalConfig, name string, f rollupFunc, arg metricsql.Expr) (value, error) {
+	re, ok := arg.(*metricsql.RollupExpr)
+	if !ok || (re.Window == nil && !re.ForSubquery()) {
+		return value{}, errors.Errorf("%s: expected range vector argument, ex. metric[5m]", name)
+	}
+	if re.At != nil {
+		return value{}, errors.Errorf("%s: @ modifier is not supported", re.AppendString(nil))
+	}
+	window := re.Window.Duration(ec.step)
+	offset := re.Offset.Duration(ec.step)
+	if window <= 0 {
+		return value{}, errors.Errorf("%s: window should be positive", re.AppendString(nil))
+	}
+
+	var samples []rangeSamples
+	if re.ForSubquery() {
+		var err error
+		if samples, err = e.evalSubquery(ec, re, window, offset); err != nil {
+			return value{}, err
+		}
+	} else {
+		me, ok := re.Expr.(*metricsql.MetricExpr)
+		if !ok {
+			return value{}, errors.Errorf("%s: expected series selector", re.AppendString(nil))
+		}
+		series, err := e.storage.Select(me.LabelFilterss, ec.start-offset-window, ec.end-offset)
+		if err != nil {
+			return value{}, err
+		}
+		for _, s := range series {
+			samples = append(samples, rangeSamples{labels: s.Labels, timestamps: s.Timestamps, values: s.Values})
+		}
+	}
+
+	result := value{}
+	for _, s := range samples {
+		values := make([]float64, len(ec.timestamps))
+		lo, hi := 0, 0
+		for i, t := range ec.timestamps {
+			end := t - offset
+			start := end - window
+			for lo < len(s.timestamps) && s.timestamps[lo] <= start {
+				lo++
+			}
+			if hi < lo {
+				hi = lo
+			}
+			for hi < len(s.timestamps) && s.timestamps[hi] <= end {
+				hi++
+			}
+			if lo == hi {
+				values[i] = nan
+				continue
+			}
+			values[i] = f(s.timestamps[lo:hi], s.values[lo:hi], start, end)
+		}
+		if isEmpty(values) {
+			continue
+		}
+		labels := s.labels
+		if !rollupKeepsName[name] {
+			labels = withoutName(labels)
+		}
+		result.series = append(result.series, &Timeseries{Labels: labels, Values: values})
+	}
+	return result, nil
+}
+
+// evalSubquery evaluates the inner expression of the subquery at its own steps aligned to the step
+func (e *Engine) evalSubquery(ec *evalConfig, re *metricsql.RollupExpr, window, offset int64) ([]rangeSamples, error) {
+	step := ec.step
+	if re.Step != nil {
+		step = re.Step.Duration(ec.step)
+	}
+	if step <= 0 {
+		return nil, errors.Errorf("%s: step should be positive", re.AppendString(nil))
+	}
+
+	start := ec.start - offset - window
+	start += (step - start%step) % step
+	sub, err := newEvalConfig(start, ec.end-offset, step)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", re.AppendString(nil))
+	}
+	series, err := e.evalVectorArg(sub, re.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]rangeSamples, 0, len(series))
+	for _, s := range series {
+		rs := rangeSamples{labels: s.Labels}
+		for i, v := range s.Values {
+			if !math.IsNaN(v) {
+				rs.timestamps = append(rs.timestamps, sub.timestamps[i])
+				rs.values = append(rs.values, v)
+			}
+		}
+		samples = append(samples, rs)
+	}
+	return samples, nil
+}
+
+// extrapolatedRate calculates rate, increase and delta the same way as Prometheus does
+func extrapolatedRate(isCounter, isRate bool) rollupFunc {
+	return func(timestamps []int64, values []float64, start, end int64) float64 {
+		if len(values) < 2 {
+			return nan
+		}
+		first, last := values[0], values[len(values)-1]
+		result := last - first
+		if isCounter {
+			prev := first
+			for _, v := range values[1:] {
+				if v < prev {
+					result += prev
+				}
+				prev = v
+			}
+		}
+
+		durationToStart := float64(timestamps[0]-start) / 1000
+		durationToEnd := float64(end-timestamps[len(timestamps)-1]) / 1000
+		sampledInterval := float64(timestamps[len(timestamps)-1]-timestamps[0]) / 1000
+		averageDurationBetweenSamples := sampledInterval / float64(len(timestamps)-1)
+
+		if isCounter && result > 0 && first >= 0 {
+			if durationToZero := sampledInterval * (first / result); durationToZero < durationToStart {
+				durationToStart = durationToZero
+			}
+		}
+
+		extrapolationThreshold := averageDurationBetweenSamples * 1.1
+		extrapolateToInterval := sampledInterval
+		if durationToStart < extrapolationThreshold {
+			extrapolateToInterval += durationToStart
+		} else {
+			extrapolateToInterval += averageDurationBetweenSamples / 2
+		}
+		if durationToEnd < extrapolationThreshold {
+			extrapolateToInterval += durationToEnd
+		} else {
+			extrapolateToInterval += averageDurationBetweenSamples / 2
+		}
+		result *= extrapolateToInterval / sampledInterval
+		if isRate {
+			result /= float64(end-start) / 1000
+		}
+		return result
+	}
+}
+
+// instantRate calculates irate and idelta by the last two samples
+func instantRate(isRate bool) rollupFunc {
+	return func(timestamps []int64, values []float64, _, _ int64) float64 {
+		if len(values) < 2 {
+			return nan
+		}
+		n := len(values)
+		last, prev := values[n-1], values[n-2]
+		result := last - prev
+		if !isRate {
+			return result
+		}
+		if last < prev {
+			// Counter reset
+			result = last
+		}
+		interval := float64(timestamps[n-1]-timestamps[n-2]) / 1000
+		if interval == 0 {
+			return nan
+		}
+		return result / interval
+	}
+}
+
+func rollupChanges(_ []int64, values []float64, _, _ int64) float64 {
+	changes := 0
+	for i := 1; i < len(values); i++ {
+		if values[i] != values[i-1] && !(math.IsNaN(values[i]) && math.IsNaN(values[i-1])) {
+			changes++
+		}
+	}
+	return float64(changes)
+}
+
+func rollupResets(_ []int64, values []float64, _, _ int64) float64 {
+	resets := 0
+	for i := 1; i < len(values); i++ {
+		if values[i] < values[i-1] {
+			resets++
+		}
+	}
+	return float64(resets)
+}
+
+func rollupAvg(_ []int64, values []float64, _, _ int64) float64 {
+	return rollupSum(nil, values, 0, 0) / float64(len(values))
+}
+
+func rollupMin(_ []int64, values []float64, _, _ int64) float64 {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min || math.IsNaN(min) {
+			min = v
+		}
+	}
+	return min
+}
+
+func rollupMax(_ []int64, values []float64, _, _ int64) float64 {
+	max := values[0]
+	for _, v := range values[1:] {
+		if v > max || math.IsNaN(max) {
+			max = v
+		}
+	}
+	return max
+}
+
+func rollupSum(_ []int64, values []float64, _, _ int64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func rollupCount(_ []int64, values []float64, _, _ int64) float64 {
+	return float64(len(values))
+}
+
+func rollupLast(_ []int64, values []float64, _, _ int64) float64 {
+	return values[len(values)-1]
+}
+
+func rollupPresent(_ []int64, _ []float64, _, _ int64) float64 {
+	return 1
+}
+
+func rollupStdvar(_ []int64, values []float64, _, _ int64) float64 {
+	return variance(values)
+}
+
+func rollupStddev(_ []int64, values []float64, _, _ int64) float64 {
+	return math.Sqrt(variance(values))
+}
+
+// rollupDeriv calculates per-second derivative using simple linear regression
+func rollupDeriv(timestamps []int64, values []float64, _, _ int64) float64 {
+	if len(values) < 2 {
+		return nan
+	}
+	var sumX, sumY, sumXY, sumX2 float64
+	for i, v := range values {
+		x := float64(timestamps[i]-timestamps[0]) / 1000
+		sumX += x
+		sumY += v
+		sumXY += x * v
+		sumX2 += x * x
+	}
+	n := float64(len(values))
+	return (n*sumXY - sumX*sumY) / (n*sumX2 - sumX*sumX)
+}
+
+func variance(values []float64) float64 {
+	if len(values) == 0 {
+		return nan
+	}
+	mean := rollupSum(nil, values, 0, 0) / float64(len(values))
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return sum / float64(len(values))
+}
+
+// bucket is a single bucket of the classic histogram
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+func (e *Engine) histogramQuantile(ec *evalConfig, fe *metricsql.FuncExpr) (value, error) {
+	if len(fe.Args) != 2 {
+		return value{}, errors.Errorf("histogram_quantile: expected 2 arguments, got %d", len(fe.Args))
+	}
+	phi, err := e.evalScalarArg(ec, fe.Args[0])
+	if err != nil {
+		return value{}, err
+	}
+	series, err := e.evalVectorArg(ec, fe.Args[1])
+	if err != nil {
+		return value{}, err
+	}
+
+	type histogram struct {
+		labels      map[string]string
+		series      []*Timeseries
+		upperBounds []float64
+	}
+	var histograms []*histogram
+	byKey := make(map[string]*histogram)
+	for _, s := range series {
+		upperBound, err := strconv.ParseFloat(s.Labels["le"], 64)
+		if err != nil {
+			// Series without valid le label are not buckets
+			continue
+		}
+		labels := withoutName(withoutLabels(s.Labels, "le"))
+		key := labelsKey(labels)
+		h, ok := byKey[key]
+		if !ok {
+			h = &histogram{labels: labels}
+			byKey[key] = h
+			histograms = append(histograms, h)
+		}
+		h.series = append(h.series, s)
+		h.upperBounds = append(h.upperBounds, upperBound)
+	}
+
+	result := value{}
+	for _, h := range histograms {
+		values := make([]float64, len(ec.timestamps))
+		buckets := make([]bucket, 0, len(h.series))
+		for i := range values {
+			buckets = buckets[:0]
+			for n, s := range h.series {
+				if !math.IsNaN(s.Values[i]) {
+					buckets = append(buckets, bucket{upperBound: h.upperBounds[n], count: s.Values[i]})
+				}
+			}
+			values[i] = bucketQuantile(phi[i], buckets)
+		}
+		result.series = append(result.series, &Timeseries{Labels: h.labels, Values: values})
+	}
+	return result, nil
+}
+
+// bucketQuantile calculates φ-quantile of the classic histogram the same way as Prometheus does
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	switch {
+	case math.IsNaN(q):
+		return nan
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return nan
+	}
+
+	// Buckets with the same upper bound are merged, counts are made monotonic
+	merged := buckets[:1]
+	for _, b := range buckets[1:] {
+		last := &merged[len(merged)-1]
+		if b.upperBound == last.upperBound {
+			last.count += b.count
+			continue
+		}
+		merged = append(merged, b)
+	}
+	buckets = merged
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+	if len(buckets) < 2 {
+		return nan
+	}
+
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return nan
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	switch {
+	case b == len(buckets)-1:
+		return buckets[len(buckets)-2].upperBound
+	case b == 0 && buckets[0].upperBound <= 0:
+		return buckets[0].upperBound
+	}
+
+	bucketStart, bucketEnd, count := 0.0, buckets[b].upperBound, buckets[b].count
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+func (e *Engine) labelReplace(ec *evalConfig, fe *metricsql.FuncExpr) (value, error) {
+	if len(fe.Args) != 5 {
+		return value{}, errors.Errorf("label_replace: expected 5 arguments, got %d", len(fe.Args))
+	}
+	args, err := stringArgs("label_replace", fe.Args[1:])
+	if err != nil {
+		return value{}, err
+	}
+	dst, replacement, src, regex := args[0], args[1], args[2], args[3]
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return value{}, errors.Wrapf(err, "label_replace: invalid regexp %q", regex)
+	}
+
+	series, err := e.evalVectorArg(ec, fe.Args[0])
+	if err != nil {
+		return value{}, err
+	}
+	result := value{}
+	for _, s := range series {
+		labels := s.Labels
+		if m := re.FindStringSubmatchIndex(s.Labels[src]); m != nil {
+			labels = withoutLabels(s.Labels)
+			if v := string(re.ExpandString(nil, replacement, s.Labels[src], m)); v != "" {
+				labels[dst] = v
+			} else {
+				delete(labels, dst)
+			}
+		}
+		result.series = append(result.series, &Timeseries{Labels: labels, Values: s.Values})
+	}
+	return result, nil
+}
+
+func (e *Engine) labelJoin(ec *evalConfig, fe *metricsql.FuncExpr) (value, error) {
+	if len(fe.Args) < 3 {
+		return value{}, errors.Errorf("label_join: expected at least 3 arguments, got %d", len(fe.Args))
+	}
+	args, err := stringArgs("label_join", fe.Args[1:])
+	if err != nil {
+		return value{}, err
+	}
+	dst, separator, src := args[0], args[1], args[2:]
+
+	series, err := e.evalVectorArg(ec, fe.Args[0])
+	if err != nil {
+		return value{}, err
+	}
+	result := value{}
+	for _, s := range series {
+		values := make([]string, 0, len(src))
+		for _, name := range src {
+			values = append(values, s.Labels[name])
+		}
+		labels := withoutLabels(s.Labels)
+		if v := strings.Join(values, separator); v != "" {
+			labels[dst] = v
+		} else {
+			delete(labels, dst)
+		}
+		result.series = append(result.series, &Timeseries{Labels: labels, Values: s.Values})
+	}
+	return result, nil
+}
+
+func stringArgs(name string, args []metricsql.Expr) ([]string, error) {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		se, ok := arg.(*metricsql.StringExpr)
+		if !ok {
+			return nil, errors.Errorf("%s: expected string argument, got %s", name, arg.AppendString(nil))
+		}
+		result = append(result, se.S)
+	}
+	return result, nil
+}
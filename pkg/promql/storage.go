@@ -0,0 +1,296 @@
+package promql
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+)
+
+// MetricNameLabel is the label, which contains metric name
+const MetricNameLabel = "__name__"
+
+// Series is a single time series. Timestamps are in milliseconds
+type Series struct {
+	Labels     map[string]string
+	Timestamps []int64
+	Values     []float64
+}
+
+// Storage keeps time series in memory. It's filled once and must be sorted with Sort before querying
+type Storage struct {
+	series []*Series
+	byKey  map[string]*Series
+
+	minTime int64
+	maxTime int64
+}
+
+func NewStorage() *Storage {
+	return &Storage{
+		byKey:   make(map[string]*Series),
+		minTime: math.MaxInt64,
+		maxTime: math.MinInt64,
+	}
+}
+
+// Add appends samples to the series with the given labels
+func (s *Storage) Add(labels map[string]string, timestamps []int64, values []float64) {
+	if len(timestamps) != len(values) {
+		return
+	}
+	key := labelsKey(labels)
+	series, ok := s.byKey[key]
+	if !ok {
+		series = &Series{Labels: labels}
+		s.byKey[key] = series
+		s.series = append(s.series, series)
+	}
+	series.Timestamps = append(series.Timestamps, timestamps...)
+	series.Values = append(series.Values, values...)
+
+	for _, ts := range timestamps {
+		if ts < s.minTime {
+			s.minTime = ts
+		}
+		if ts > s.maxTime {
+			s.maxTime = ts
+		}
+	}
+}
+
+// Sort sorts samples of every series by timestamp and removes samples with duplicated timestamps
+func (s *Storage) Sort() {
+	for _, series := range s.series {
+		sort.Stable(samplesByTime{series})
+
+		n := 0
+		for i := range series.Timestamps {
+			if n > 0 && series.Timestamps[i] == series.Timestamps[n-1] {
+				series.Values[n-1] = series.Values[i]
+				continue
+			}
+			series.Timestamps[n], series.Values[n] = series.Timestamps[i], series.Values[i]
+			n++
+		}
+		series.Timestamps, series.Values = series.Timestamps[:n], series.Values[:n]
+	}
+
+	keys := make([]string, 0, len(s.byKey))
+	for key := range s.byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		s.series[i] = s.byKey[key]
+	}
+}
+
+type samplesByTime struct {
+	*Series
+}
+
+func (s samplesByTime) Len() int           { return len(s.Timestamps) }
+func (s samplesByTime) Less(i, j int) bool { return s.Timestamps[i] < s.Timestamps[j] }
+func (s samplesByTime) Swap(i, j int) {
+	s.Timestamps[i], s.Timestamps[j] = s.Timestamps[j], s.Timestamps[i]
+	s.Values[i], s.Values[j] = s.Values[j], s.Values[i]
+}
+
+// SeriesCount returns number of series in the storage
+func (s *Storage) SeriesCount() int {
+	return len(s.series)
+}
+
+// TimeRange returns timestamps of the first and the last samples in the storage. Both are zero for empty storage
+func (s *Storage) TimeRange() (int64, int64) {
+	if s.minTime > s.maxTime {
+		return 0, 0
+	}
+	return s.minTime, s.maxTime
+}
+
+// Select returns series matching any group of the label filters and having samples in [start, end].
+// All the series are returned for empty filters
+func (s *Storage) Select(filterss [][]metricsql.LabelFilter, start, end int64) ([]*Series, error) {
+	matchers, err := compileFilters(filterss)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Series
+	for _, series := range s.series {
+		if !matchers.match(series.Labels) || !series.hasSamples(start, end) {
+			continue
+		}
+		result = append(result, series)
+	}
+	return result, nil
+}
+
+// LabelNames returns sorted names of the labels of the series matching the filters
+func (s *Storage) LabelNames(filterss [][]metricsql.LabelFilter, start, end int64) ([]string, error) {
+	series, err := s.Select(filterss, start, end)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	for _, s := range series {
+		for name := range s.Labels {
+			names[name] = struct{}{}
+		}
+	}
+	return sortedKeys(names), nil
+}
+
+// LabelValues returns sorted values of the label of the series matching the filters
+func (s *Storage) LabelValues(name string, filterss [][]metricsql.LabelFilter, start, end int64) ([]string, error) {
+	series, err := s.Select(filterss, start, end)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]struct{})
+	for _, s := range series {
+		if v, ok := s.Labels[name]; ok {
+			values[v] = struct{}{}
+		}
+	}
+	return sortedKeys(values), nil
+}
+
+func (s *Series) hasSamples(start, end int64) bool {
+	i := sort.Search(len(s.Timestamps), func(i int) bool { return s.Timestamps[i] >= start })
+	return i < len(s.Timestamps) && s.Timestamps[i] <= end
+}
+
+type labelMatcher struct {
+	filter metricsql.LabelFilter
+	re     *regexp.Regexp
+}
+
+func (m labelMatcher) match(labels map[string]string) bool {
+	v := labels[m.filter.Label]
+	var ok bool
+	if m.re != nil {
+		ok = m.re.MatchString(v)
+	} else {
+		ok = v == m.filter.Value
+	}
+	return ok != m.filter.IsNegative
+}
+
+// matcherGroups are or-delimited groups of label matchers
+type matcherGroups [][]labelMatcher
+
+func compileFilters(filterss [][]metricsql.LabelFilter) (matcherGroups, error) {
+	groups := make(matcherGroups, 0, len(filterss))
+	for _, filters := range filterss {
+		group := make([]labelMatcher, 0, len(filters))
+		for _, f := range filters {
+			m := labelMatcher{filter: f}
+			if f.IsRegexp {
+				re, err := metricsql.CompileRegexpAnchored(f.Value)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid regexp %q", f.Value)
+				}
+				m.re = re
+			}
+			group = append(group, m)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (g matcherGroups) match(labels map[string]string) bool {
+	if len(g) == 0 {
+		return true
+	}
+	for _, group := range g {
+		matched := true
+		for _, m := range group {
+			if !m.match(labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Selector matches labels of the series by series selectors, ex. {job="node"} or up{instance=~"a|b"}
+type Selector struct {
+	groups matcherGroups
+}
+
+// ParseSelector returns selector matching the series by any of the series selectors. Selector without any series selectors matches all the series
+func ParseSelector(selectors ...string) (*Selector, error) {
+	var filterss [][]metricsql.LabelFilter
+	for _, selector := range selectors {
+		expr, err := metricsql.Parse(selector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid selector %q", selector)
+		}
+		me, ok := expr.(*metricsql.MetricExpr)
+		if !ok {
+			return nil, errors.Errorf("%q should be a series selector", selector)
+		}
+		filterss = append(filterss, me.LabelFilterss...)
+	}
+	groups, err := compileFilters(filterss)
+	if err != nil {
+		return nil, err
+	}
+	return &Selector{groups: groups}, nil
+}
+
+// Match returns true if labels match the selector
+func (s *Selector) Match(labels map[string]string) bool {
+	return s.groups.match(labels)
+}
+
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// FormatLabels formats labels as a series selector: name{label="value",...}
+func FormatLabels(labels map[string]string) string {
+	name := labels[MetricNameLabel]
+	if len(labels) == 1 && name != "" {
+		return name
+	}
+	return name + labelsKey(withoutName(labels))
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
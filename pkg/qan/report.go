@@ -0,0 +1,215 @@
+package qan
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/clickhouse/tsv"
+	"pmm-dump/pkg/dump"
+)
+
+// Columns of QAN metrics table used by the report
+const (
+	columnQueryID      = "queryid"
+	columnServiceName  = "service_name"
+	columnFingerprint  = "fingerprint"
+	columnPeriodStart  = "period_start"
+	columnNumQueries   = "num_queries"
+	columnQueryTime    = "m_query_time_sum"
+	columnQueryTimeMax = "m_query_time_max"
+	columnLockTime     = "m_lock_time_sum"
+	columnRowsExamined = "m_rows_examined_sum"
+	columnRowsSent     = "m_rows_sent_sum"
+)
+
+// requiredColumns must be present in the dump, the rest of the metrics are zero if they're missing
+var requiredColumns = []string{columnQueryID, columnServiceName, columnFingerprint, columnPeriodStart, columnNumQueries, columnQueryTime}
+
+// SortKeys lists metrics the queries could be ranked by
+var SortKeys = []string{"time", "count", "rows-examined", "lock-time"}
+
+// QueryStats contains metrics of the query summed over the report window
+type QueryStats struct {
+	QueryID      string  `json:"queryid"`
+	ServiceName  string  `json:"service_name"`
+	Fingerprint  string  `json:"fingerprint"`
+	Count        float64 `json:"count"`
+	TotalTime    float64 `json:"total_time"`
+	MaxTime      float64 `json:"max_time"`
+	LockTime     float64 `json:"lock_time"`
+	RowsExamined float64 `json:"rows_examined"`
+	RowsSent     float64 `json:"rows_sent"`
+}
+
+// AvgTime returns the average response time of the query
+func (q *QueryStats) AvgTime() float64 {
+	if q.Count == 0 {
+		return 0
+	}
+	return q.TotalTime / q.Count
+}
+
+// Report is a ranking of the queries similar to pt-query-digest profile
+type Report struct {
+	Start         *time.Time    `json:"start,omitempty"`
+	End           *time.Time    `json:"end,omitempty"`
+	UniqueQueries int           `json:"unique_queries"`
+	Count         float64       `json:"count"`
+	TotalTime     float64       `json:"total_time"`
+	SortBy        string        `json:"sort_by"`
+	Queries       []*QueryStats `json:"queries"`
+}
+
+// Aggregator sums QAN metrics rows by queryid and service_name
+type Aggregator struct {
+	index      map[string]int
+	start, end *time.Time
+
+	queries    map[string]*QueryStats
+	first      time.Time
+	last       time.Time
+	hasPeriods bool
+}
+
+// NewAggregator returns aggregator of the rows with the columns. Rows with period_start outside of [start, end) are skipped
+func NewAggregator(columns []dump.ClickHouseColumn, start, end *time.Time) (*Aggregator, error) {
+	index := make(map[string]int, len(columns))
+	for i, c := range columns {
+		index[c.Name] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := index[name]; !ok {
+			return nil, errors.Errorf("column %s is not found", name)
+		}
+	}
+	return &Aggregator{
+		index:   index,
+		start:   start,
+		end:     end,
+		queries: make(map[string]*QueryStats),
+	}, nil
+}
+
+// Add adds a row of the metrics table
+func (a *Aggregator) Add(record []string) error {
+	if len(record) != len(a.index) {
+		return errors.Errorf("expected %d columns, got %d", len(a.index), len(record))
+	}
+
+	periodStart, err := time.Parse(tsv.TimeLayout, record[a.index[columnPeriodStart]])
+	if err != nil {
+		return errors.Wrap(err, "invalid period_start")
+	}
+	if a.start != nil && periodStart.Before(*a.start) || a.end != nil && !periodStart.Before(*a.end) {
+		return nil
+	}
+	if !a.hasPeriods || periodStart.Before(a.first) {
+		a.first = periodStart
+	}
+	if !a.hasPeriods || periodStart.After(a.last) {
+		a.last = periodStart
+	}
+	a.hasPeriods = true
+
+	var values [5]float64
+	for i, name := range []string{columnNumQueries, columnQueryTime, columnLockTime, columnRowsExamined, columnRowsSent} {
+		if values[i], err = a.float(record, name); err != nil {
+			return err
+		}
+	}
+	maxTime, err := a.float(record, columnQueryTimeMax)
+	if err != nil {
+		return err
+	}
+
+	queryID, serviceName := record[a.index[columnQueryID]], record[a.index[columnServiceName]]
+	key := queryID + "\x00" + serviceName
+	q, ok := a.queries[key]
+	if !ok {
+		q = &QueryStats{
+			QueryID:     queryID,
+			ServiceName: serviceName,
+			Fingerprint: record[a.index[columnFingerprint]],
+		}
+		a.queries[key] = q
+	}
+	q.Count += values[0]
+	q.TotalTime += values[1]
+	q.LockTime += values[2]
+	q.RowsExamined += values[3]
+	q.RowsSent += values[4]
+	if maxTime > q.MaxTime {
+		q.MaxTime = maxTime
+	}
+	return nil
+}
+
+// float returns value of the numeric column. It's zero if the column is missing
+func (a *Aggregator) float(record []string, column string) (float64, error) {
+	i, ok := a.index[column]
+	if !ok || record[i] == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(record[i], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", column)
+	}
+	return v, nil
+}
+
+// Report returns top queries ranked by sortBy metric. All the queries are returned if limit is zero
+func (a *Aggregator) Report(sortBy string, limit int) (*Report, error) {
+	var metric func(q *QueryStats) float64
+	switch sortBy {
+	case "time":
+		metric = func(q *QueryStats) float64 { return q.TotalTime }
+	case "count":
+		metric = func(q *QueryStats) float64 { return q.Count }
+	case "rows-examined":
+		metric = func(q *QueryStats) float64 { return q.RowsExamined }
+	case "lock-time":
+		metric = func(q *QueryStats) float64 { return q.LockTime }
+	default:
+		return nil, errors.Errorf("unknown sort key %q, expected one of: %s", sortBy, strings.Join(SortKeys, ", "))
+	}
+
+	report := &Report{
+		Start:         a.start,
+		End:           a.end,
+		UniqueQueries: len(a.queries),
+		SortBy:        sortBy,
+		Queries:       make([]*QueryStats, 0, len(a.queries)),
+	}
+	if a.hasPeriods {
+		if report.Start == nil {
+			report.Start = &a.first
+		}
+		if report.End == nil {
+			report.End = &a.last
+		}
+	}
+	for _, q := range a.queries {
+		report.Count += q.Count
+		report.TotalTime += q.TotalTime
+		report.Queries = append(report.Queries, q)
+	}
+
+	sort.Slice(report.Queries, func(i, j int) bool {
+		qi, qj := report.Queries[i], report.Queries[j]
+		if mi, mj := metric(qi), metric(qj); mi != mj {
+			return mi > mj
+		}
+		if qi.QueryID != qj.QueryID {
+			return qi.QueryID < qj.QueryID
+		}
+		return qi.ServiceName < qj.ServiceName
+	})
+	if limit > 0 && len(report.Queries) > limit {
+		report.Queries = report.Queries[:limit]
+	}
+	return report, nil
+}
@@ -0,0 +1,99 @@
+package qan
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+)
+
+var testColumns = []dump.ClickHouseColumn{
+	{Name: "queryid", Type: "String"},
+	{Name: "service_name", Type: "LowCardinality(String)"},
+	{Name: "fingerprint", Type: "String"},
+	{Name: "period_start", Type: "DateTime"},
+	{Name: "num_queries", Type: "Float32"},
+	{Name: "m_query_time_sum", Type: "Float32"},
+	{Name: "m_query_time_max", Type: "Float32"},
+	{Name: "m_rows_examined_sum", Type: "Float32"},
+}
+
+var testRecords = []string{
+	"q1\tmysql\tSELECT 1\t2022-06-02 10:00:00 +0000 UTC\t10\t1\t0.5\t100",
+	"q1\tmysql\tSELECT 1\t2022-06-02 10:01:00 +0000 UTC\t10\t2\t0.7\t100",
+	"q2\tmysql\tSELECT 2\t2022-06-02 10:00:00 +0000 UTC\t100\t0.5\t0.1\t1000",
+	"q1\tpostgres\tSELECT 1\t2022-06-02 10:02:00 +0000 UTC\t1\t4\t4\t0",
+}
+
+func testAggregator(t *testing.T, start, end *time.Time) *Aggregator {
+	a, err := NewAggregator(testColumns, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range testRecords {
+		if err = a.Add(strings.Split(r, "\t")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		sortBy   string
+		limit    int
+		start    string
+		end      string
+		expected []string
+	}{
+		{name: "by time", sortBy: "time", expected: []string{"q1/postgres", "q1/mysql", "q2/mysql"}},
+		{name: "by count", sortBy: "count", expected: []string{"q2/mysql", "q1/mysql", "q1/postgres"}},
+		{name: "by rows examined", sortBy: "rows-examined", limit: 2, expected: []string{"q2/mysql", "q1/mysql"}},
+		{name: "window", sortBy: "time", start: "2022-06-02T10:01:00Z", end: "2022-06-02T10:02:00Z", expected: []string{"q1/mysql"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var start, end *time.Time
+			if tt.start != "" {
+				s, _ := time.Parse(time.RFC3339, tt.start)
+				e, _ := time.Parse(time.RFC3339, tt.end)
+				start, end = &s, &e
+			}
+			report, err := testAggregator(t, start, end).Report(tt.sortBy, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, q := range report.Queries {
+				got = append(got, q.QueryID+"/"+q.ServiceName)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	report, err := testAggregator(t, nil, nil).Report("time", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := report.Queries[1]
+	if q.Count != 20 || q.TotalTime != 3 || q.MaxTime != 0.7 || q.RowsExamined != 200 || q.LockTime != 0 || q.AvgTime() != 0.15 {
+		t.Fatalf("unexpected stats: %+v", q)
+	}
+	if report.UniqueQueries != 3 || report.Count != 121 || report.TotalTime != 7.5 {
+		t.Fatalf("unexpected totals: %+v", report)
+	}
+	if report.Start.Format(time.RFC3339) != "2022-06-02T10:00:00Z" || report.End.Format(time.RFC3339) != "2022-06-02T10:02:00Z" {
+		t.Fatalf("unexpected window: %v - %v", report.Start, report.End)
+	}
+
+	if _, err = testAggregator(t, nil, nil).Report("unknown", 0); err == nil {
+		t.Fatal("unknown sort key should be rejected")
+	}
+	if _, err = NewAggregator(testColumns[1:], nil, nil); err == nil {
+		t.Fatal("missing queryid column should be rejected")
+	}
+}
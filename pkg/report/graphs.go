@@ -0,0 +1,111 @@
+package report
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/promql"
+)
+
+// Units of the graph values
+const (
+	UnitNone    = ""
+	UnitPercent = "percent"
+	UnitBytes   = "bytes"
+	UnitBytesPS = "bytes/s"
+	UnitPerSec  = "ops/s"
+)
+
+// minStep and maxSteps limit resolution of the graphs: the step is chosen to have at most maxSteps points
+const (
+	minStep  = 60 * 1000
+	maxSteps = 300
+)
+
+// maxGraphSeries is the amount of series with the largest values drawn on the graph
+const maxGraphSeries = 10
+
+// GraphQuery describes a graph of the report
+type GraphQuery struct {
+	Title string
+	Query string
+	Unit  string
+}
+
+// DefaultGraphs are key node and database graphs. Graphs without data in the dump are skipped
+var DefaultGraphs = []GraphQuery{
+	{
+		Title: "CPU usage",
+		Query: `100 * sum by (node_name) (rate(node_cpu_seconds_total{mode!="idle"}[5m])) / count by (node_name) (node_cpu_seconds_total{mode="idle"})`,
+		Unit:  UnitPercent,
+	},
+	{Title: "Load average", Query: `avg by (node_name) (node_load1)`},
+	{Title: "Available memory", Query: `avg by (node_name) (node_memory_MemAvailable_bytes)`, Unit: UnitBytes},
+	{
+		Title: "Disk I/O",
+		Query: `sum by (node_name) (rate(node_disk_read_bytes_total[5m]) + rate(node_disk_written_bytes_total[5m]))`,
+		Unit:  UnitBytesPS,
+	},
+	{Title: "MySQL queries", Query: `sum by (service_name) (rate(mysql_global_status_queries[5m]))`, Unit: UnitPerSec},
+	{Title: "MySQL connections", Query: `max by (service_name) (mysql_global_status_threads_connected)`},
+	{Title: "PostgreSQL connections", Query: `sum by (service_name) (pg_stat_database_numbackends)`},
+	{Title: "MongoDB operations", Query: `sum by (service_name) (rate(mongodb_op_counters_total[5m]))`, Unit: UnitPerSec},
+}
+
+// Graph contains values of the graph series at the same timestamps
+type Graph struct {
+	GraphQuery
+	Timestamps []int64
+	Series     []*promql.Timeseries
+	// Hidden is the amount of series, which are not drawn on the graph
+	Hidden int
+}
+
+// EvalGraphs evaluates the queries over the whole time range of the engine storage. Queries without data are skipped
+func EvalGraphs(engine *promql.Engine, queries []GraphQuery) ([]*Graph, error) {
+	start, end := engine.Storage().TimeRange()
+	if start >= end {
+		return nil, nil
+	}
+	step := (end - start) / maxSteps
+	if step < minStep {
+		step = minStep
+	}
+
+	var graphs []*Graph
+	for _, q := range queries {
+		result, err := engine.Query(q.Query, start, end, step)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to evaluate %s", q.Title)
+		}
+		if len(result.Series) == 0 || result.Scalar {
+			continue
+		}
+
+		series := result.Series
+		sort.SliceStable(series, func(i, j int) bool {
+			return maxValue(series[i].Values) > maxValue(series[j].Values)
+		})
+		g := &Graph{GraphQuery: q, Timestamps: result.Timestamps, Series: series}
+		if len(series) > maxGraphSeries {
+			g.Series, g.Hidden = series[:maxGraphSeries], len(series)-maxGraphSeries
+		}
+		sort.SliceStable(g.Series, func(i, j int) bool {
+			return promql.FormatLabels(g.Series[i].Labels) < promql.FormatLabels(g.Series[j].Labels)
+		})
+		graphs = append(graphs, g)
+	}
+	return graphs, nil
+}
+
+func maxValue(values []float64) float64 {
+	m := math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) && v > m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,130 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"pmm-dump/pkg/qan"
+	"pmm-dump/pkg/transferer"
+)
+
+// Data is the content of the report. Graphs and QAN are optional
+type Data struct {
+	DumpPath  string
+	Generated time.Time
+	Inspect   *transferer.InspectReport
+	Graphs    []*Graph
+	QAN       *qan.Report
+	// Notes explain missing parts of the report, ex. graphs for the dump in native format
+	Notes []string
+}
+
+// Render writes the report as a single HTML file without external resources
+func Render(w io.Writer, data *Data) error {
+	return reportTemplate.Execute(w, data)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"lineChart": lineChart,
+	"timeline":  timeline,
+	"time": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+	"bytes": func(b int64) string {
+		return formatValue(float64(b), UnitBytes)
+	},
+	"seconds": func(v float64) string {
+		return fmt.Sprintf("%.4fs", v)
+	},
+	"percent": func(v, total float64) string {
+		if total == 0 {
+			return "0.0%"
+		}
+		return fmt.Sprintf("%.1f%%", v/total*100)
+	},
+	"number": func(v float64) string {
+		return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.2f", v), "0"), ".")
+	},
+	"inc": func(i int) int {
+		return i + 1
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>pmm-dump report{{with .DumpPath}}: {{.}}{{end}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; color: #222; margin: 20px 40px; }
+h1 { font-size: 22px; }
+h2 { font-size: 18px; margin-top: 32px; border-bottom: 1px solid #ddd; padding-bottom: 4px; }
+h3 { font-size: 15px; margin-bottom: 4px; }
+table { border-collapse: collapse; margin: 8px 0; }
+th, td { text-align: left; padding: 3px 10px; border-bottom: 1px solid #eee; vertical-align: top; }
+th { background: #f5f5f5; }
+td.num { text-align: right; white-space: nowrap; }
+code { font-size: 12px; word-break: break-all; }
+.note { color: #8a6d3b; background: #fcf8e3; padding: 6px 10px; margin: 4px 0; }
+.query { color: #666; font-size: 12px; }
+svg text { font-size: 11px; fill: #555; }
+svg .grid { stroke: #eee; }
+svg .chunk { fill: #7eb26d; }
+svg .gap { fill: #e24d42; }
+</style>
+</head>
+<body>
+<h1>pmm-dump report</h1>
+<table>
+{{with .DumpPath}}<tr><th>Dump</th><td>{{.}}</td></tr>{{end}}
+<tr><th>Generated</th><td>{{time .Generated}}</td></tr>
+{{with .Inspect.Meta}}
+<tr><th>PMM version</th><td>{{.PMMServerVersion}}</td></tr>
+<tr><th>pmm-dump build</th><td>{{.Version.GitCommit}}</td></tr>
+{{with .PMMTimezone}}<tr><th>PMM timezone</th><td>{{.}}</td></tr>{{end}}
+{{with .VMDataFormat}}<tr><th>VictoriaMetrics data format</th><td>{{.}}</td></tr>{{end}}
+<tr><th>Arguments</th><td><code>{{.Arguments}}</code></td></tr>
+{{end}}
+{{if gt .Inspect.Parts 1}}<tr><th>Parts</th><td>{{.Inspect.Parts}}</td></tr>{{end}}
+</table>
+{{range .Notes}}<div class="note">{{.}}</div>
+{{end}}
+{{with .Inspect.Meta}}{{with .PMMServerServices}}
+<h2>Services</h2>
+<table>
+<tr><th>Name</th><th>Node</th><th>Node ID</th><th>Agents</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.NodeName}}</td><td>{{.NodeID}}</td><td>{{range $i, $a := .AgentsIDs}}{{if $i}}, {{end}}{{$a}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+
+<h2>Coverage</h2>
+<table>
+<tr><th>Source</th><th>Chunks</th><th>Size</th><th>Start</th><th>End</th><th>Gaps</th><th>Series</th><th>Samples</th><th>Rows</th></tr>
+{{range .Inspect.Sources}}<tr><td>{{.Source}}</td><td class="num">{{len .Chunks}}</td><td class="num">{{bytes .Size}}</td><td>{{time .Start}}</td><td>{{time .End}}</td><td class="num">{{len .Gaps}}</td><td class="num">{{.Series}}</td><td class="num">{{.Samples}}</td><td class="num">{{.Rows}}</td></tr>
+{{end}}</table>
+{{timeline .Inspect.Sources}}
+
+{{with .Graphs}}
+<h2>Graphs</h2>
+{{range .}}
+<h3>{{.Title}}</h3>
+<div class="query"><code>{{.Query}}</code>{{if .Hidden}} ({{.Hidden}} more series are not shown){{end}}</div>
+{{lineChart .}}
+{{end}}
+{{end}}
+
+{{with .QAN}}
+<h2>Top QAN queries</h2>
+<p>{{time .Start}} - {{time .End}}: {{.UniqueQueries}} unique queries, {{number .Count}} calls, {{seconds .TotalTime}} total time</p>
+<table>
+<tr><th>Rank</th><th>Query ID</th><th>Service</th><th>Time</th><th>Time %</th><th>Calls</th><th>R/Call</th><th>Max</th><th>Rows examined</th><th>Lock time</th><th>Query</th></tr>
+{{$total := .TotalTime}}{{range $i, $q := .Queries}}<tr><td class="num">{{inc $i}}</td><td><code>{{$q.QueryID}}</code></td><td>{{$q.ServiceName}}</td><td class="num">{{seconds $q.TotalTime}}</td><td class="num">{{percent $q.TotalTime $total}}</td><td class="num">{{number $q.Count}}</td><td class="num">{{seconds $q.AvgTime}}</td><td class="num">{{seconds $q.MaxTime}}</td><td class="num">{{number $q.RowsExamined}}</td><td class="num">{{seconds $q.LockTime}}</td><td><code>{{$q.Fingerprint}}</code></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
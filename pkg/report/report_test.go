@@ -0,0 +1,122 @@
+package report
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/promql"
+	"pmm-dump/pkg/qan"
+	"pmm-dump/pkg/transferer"
+)
+
+func TestEvalGraphs(t *testing.T) {
+	s := promql.NewStorage()
+	var timestamps []int64
+	var values []float64
+	for i := 0; i <= 240; i++ {
+		timestamps = append(timestamps, int64(i)*15000)
+		values = append(values, float64(i%10))
+	}
+	for i := 0; i < maxGraphSeries+2; i++ {
+		s.Add(map[string]string{promql.MetricNameLabel: "node_load1", "node_name": string(rune('a' + i))}, timestamps, values)
+	}
+	s.Sort()
+
+	graphs, err := EvalGraphs(promql.NewEngine(s), DefaultGraphs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graphs) != 1 || graphs[0].Title != "Load average" {
+		t.Fatalf("only load average graph is expected, got %+v", graphs)
+	}
+	g := graphs[0]
+	if len(g.Series) != maxGraphSeries || g.Hidden != 2 {
+		t.Fatalf("expected %d series and 2 hidden, got %d and %d", maxGraphSeries, len(g.Series), g.Hidden)
+	}
+	if len(g.Timestamps) > maxSteps+1 || g.Timestamps[1]-g.Timestamps[0] < minStep {
+		t.Fatalf("unexpected resolution: %d points with step %d", len(g.Timestamps), g.Timestamps[1]-g.Timestamps[0])
+	}
+
+	if _, err = EvalGraphs(promql.NewEngine(s), []GraphQuery{{Title: "invalid", Query: "sum("}}); err == nil {
+		t.Fatal("invalid query should be rejected")
+	}
+}
+
+func TestRender(t *testing.T) {
+	start, end := time.Unix(0, 0).UTC(), time.Unix(3600, 0).UTC()
+	gapStart, gapEnd := time.Unix(1200, 0).UTC(), time.Unix(1800, 0).UTC()
+	data := &Data{
+		DumpPath:  "dump.tar.gz",
+		Generated: end,
+		Inspect: &transferer.InspectReport{
+			Meta: &dump.Meta{
+				PMMServerVersion:  "2.38.0",
+				PMMServerServices: []dump.PMMServerService{{Name: "mysql-<1>", NodeName: "node-a"}},
+			},
+			Sources: []*transferer.SourceReport{{
+				Source: "vm",
+				Chunks: []transferer.ChunkReport{
+					{Filename: "vm/0-1200.bin", Start: &start, End: &gapStart},
+					{Filename: "vm/1800-3600.bin", Start: &gapEnd, End: &end},
+				},
+				Start: &start,
+				End:   &end,
+				Gaps:  []transferer.TimeRange{{Start: gapStart, End: gapEnd}},
+			}},
+		},
+		Graphs: []*Graph{{
+			GraphQuery: GraphQuery{Title: "Load average", Query: "node_load1", Unit: UnitNone},
+			Timestamps: []int64{0, 60000, 120000},
+			Series: []*promql.Timeseries{
+				{Labels: map[string]string{"node_name": `"a" & <b>`}, Values: []float64{1, math.NaN(), 3}},
+			},
+		}},
+		QAN: &qan.Report{
+			UniqueQueries: 1,
+			Count:         10,
+			TotalTime:     2,
+			Queries:       []*qan.QueryStats{{QueryID: "Q1", ServiceName: "mysql", Fingerprint: "SELECT * FROM t WHERE a < ?", Count: 10, TotalTime: 2}},
+		},
+		Notes: []string{"note"},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Render(buf, data); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, expected := range []string{
+		"2.38.0", "mysql-&lt;1&gt;", "Load average", "SELECT * FROM t WHERE a &lt; ?", "100.0%", `class="gap"`, "note",
+	} {
+		if !strings.Contains(html, expected) {
+			t.Fatalf("report doesn't contain %q", expected)
+		}
+	}
+
+	// SVG must be well-formed with escaped labels and the line broken at the missing value
+	svgs := regexp.MustCompile(`(?s)<svg.*?</svg>`).FindAllString(html, -1)
+	if len(svgs) != 2 {
+		t.Fatalf("expected timeline and graph, got %d svg", len(svgs))
+	}
+	for _, svg := range svgs {
+		d := xml.NewDecoder(strings.NewReader(svg))
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("invalid svg: %v\n%s", err, svg)
+			}
+		}
+	}
+	path := regexp.MustCompile(`<path d="([^"]*)"`).FindStringSubmatch(svgs[1])
+	if path == nil || strings.Count(path[1], "M") != 2 {
+		t.Fatalf("line should be broken at the missing value: %s", svgs[1])
+	}
+}
@@ -0,0 +1,193 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"pmm-dump/pkg/promql"
+	"pmm-dump/pkg/transferer"
+)
+
+// Size of the charts in pixels
+const (
+	chartWidth   = 900
+	chartHeight  = 220
+	chartLeft    = 70
+	chartRight   = 10
+	chartTop     = 10
+	chartBottom  = 25
+	timelineRow  = 24
+	legendHeight = 18
+)
+
+var palette = []string{
+	"#7eb26d", "#eab839", "#6ed0e0", "#ef843c", "#e24d42",
+	"#1f78c1", "#ba43a9", "#705da0", "#508642", "#cca300",
+}
+
+// svgBuilder accumulates SVG elements. All the texts are escaped by text method
+type svgBuilder struct {
+	strings.Builder
+}
+
+func (b *svgBuilder) text(x, y float64, anchor, class, s string) {
+	fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="%s" class="%s">%s</text>`, x, y, anchor, class, template.HTMLEscapeString(s))
+}
+
+func (b *svgBuilder) line(x1, y1, x2, y2 float64, class string) {
+	fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" class="%s"/>`, x1, y1, x2, y2, class)
+}
+
+// lineChart draws the graph series as lines. Missing values break the lines
+func lineChart(g *Graph) template.HTML {
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, s := range g.Series {
+		for _, v := range s.Values {
+			if !math.IsNaN(v) {
+				minY, maxY = math.Min(minY, v), math.Max(maxY, v)
+			}
+		}
+	}
+	if minY > 0 {
+		minY = 0
+	}
+	if maxY <= minY {
+		maxY = minY + 1
+	}
+	minX, maxX := g.Timestamps[0], g.Timestamps[len(g.Timestamps)-1]
+	if maxX == minX {
+		maxX = minX + 1
+	}
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	x := func(ts int64) float64 {
+		return chartLeft + float64(ts-minX)/float64(maxX-minX)*plotWidth
+	}
+	y := func(v float64) float64 {
+		return chartTop + (1-(v-minY)/(maxY-minY))*plotHeight
+	}
+
+	height := chartHeight + legendHeight*len(g.Series)
+	b := new(svgBuilder)
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, height, chartWidth, height)
+	for i := 0; i <= 4; i++ {
+		v := minY + (maxY-minY)*float64(i)/4
+		b.line(chartLeft, y(v), chartWidth-chartRight, y(v), "grid")
+		b.text(chartLeft-5, y(v)+4, "end", "axis", formatValue(v, g.Unit))
+	}
+	b.text(chartLeft, chartHeight-5, "start", "axis", formatTime(minX))
+	b.text(chartWidth-chartRight, chartHeight-5, "end", "axis", formatTime(maxX))
+
+	for i, s := range g.Series {
+		color := palette[i%len(palette)]
+		var path strings.Builder
+		move := true
+		for j, v := range s.Values {
+			if math.IsNaN(v) {
+				move = true
+				continue
+			}
+			cmd := "L"
+			if move {
+				cmd, move = "M", false
+			}
+			fmt.Fprintf(&path, "%s%.1f %.1f ", cmd, x(g.Timestamps[j]), y(v))
+		}
+		fmt.Fprintf(b, `<path d="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, strings.TrimSpace(path.String()), color)
+
+		ly := float64(chartHeight + legendHeight*i + legendHeight/2)
+		fmt.Fprintf(b, `<rect x="%d" y="%.1f" width="12" height="4" fill="%s"/>`, chartLeft, ly-2, color)
+		b.text(chartLeft+18, ly+4, "start", "legend", promql.FormatLabels(s.Labels))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// timeline draws chunks of every source with a time range as bars over the dump time range and gaps between them
+func timeline(sources []*transferer.SourceReport) template.HTML {
+	var rows []*transferer.SourceReport
+	var minX, maxX time.Time
+	for _, s := range sources {
+		if s.Start == nil || s.End == nil {
+			continue
+		}
+		if len(rows) == 0 || s.Start.Before(minX) {
+			minX = *s.Start
+		}
+		if len(rows) == 0 || s.End.After(maxX) {
+			maxX = *s.End
+		}
+		rows = append(rows, s)
+	}
+	if len(rows) == 0 {
+		return ""
+	}
+	if !maxX.After(minX) {
+		maxX = minX.Add(time.Second)
+	}
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	x := func(t time.Time) float64 {
+		return chartLeft + float64(t.Sub(minX))/float64(maxX.Sub(minX))*plotWidth
+	}
+
+	height := timelineRow*len(rows) + chartBottom
+	b := new(svgBuilder)
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, height, chartWidth, height)
+	for i, s := range rows {
+		top := float64(timelineRow * i)
+		b.text(chartLeft-5, top+timelineRow/2+4, "end", "axis", s.Source)
+		for _, c := range s.Chunks {
+			if c.Start == nil || c.End == nil {
+				continue
+			}
+			fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%d" class="chunk"><title>%s</title></rect>`,
+				x(*c.Start), top+4, math.Max(x(*c.End)-x(*c.Start), 1), timelineRow-8, template.HTMLEscapeString(c.Filename))
+		}
+		for _, g := range s.Gaps {
+			fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%d" class="gap"><title>gap %s - %s</title></rect>`,
+				x(g.Start), top+4, math.Max(x(g.End)-x(g.Start), 1), timelineRow-8,
+				formatTime(g.Start.UnixMilli()), formatTime(g.End.UnixMilli()))
+		}
+	}
+	b.text(chartLeft, float64(height-5), "start", "axis", formatTime(minX.UnixMilli()))
+	b.text(chartWidth-chartRight, float64(height-5), "end", "axis", formatTime(maxX.UnixMilli()))
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func formatTime(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04 MST")
+}
+
+// formatValue formats value of the axis with SI prefixes (binary for bytes)
+func formatValue(v float64, unit string) string {
+	switch unit {
+	case UnitPercent:
+		return strconv.FormatFloat(v, 'f', 1, 64) + "%"
+	case UnitBytes, UnitBytesPS:
+		suffix := "B"
+		if unit == UnitBytesPS {
+			suffix = "B/s"
+		}
+		return scale(v, 1024, []string{"", "Ki", "Mi", "Gi", "Ti", "Pi"}) + " " + suffix
+	case UnitPerSec:
+		return scale(v, 1000, []string{"", "k", "M", "G", "T", "P"}) + "/s"
+	default:
+		return scale(v, 1000, []string{"", "k", "M", "G", "T", "P"})
+	}
+}
+
+func scale(v, unit float64, prefixes []string) string {
+	i := 0
+	for math.Abs(v) >= unit && i < len(prefixes)-1 {
+		v /= unit
+		i++
+	}
+	return fmt.Sprintf("%.3g", v) + prefixes[i]
+}
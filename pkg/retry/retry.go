@@ -0,0 +1,184 @@
+// Package retry repeats failed chunk reads and writes with exponential backoff, so a flaky network doesn't abort the whole transfer
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// Defaults of the policy used by export and import
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+	DefaultMaxBackoff  = 30 * time.Second
+	DefaultJitter      = 0.5
+)
+
+// DefaultRetryableStatuses are HTTP statuses of the proxy or server, which is temporarily unavailable
+var DefaultRetryableStatuses = []int{fasthttp.StatusBadGateway, fasthttp.StatusServiceUnavailable, fasthttp.StatusGatewayTimeout}
+
+// retryableClickHouseCodes are codes of ClickHouse exceptions caused by the load or network rather than by the query:
+// TIMEOUT_EXCEEDED, TOO_MANY_SIMULTANEOUS_QUERIES, SOCKET_TIMEOUT, NETWORK_ERROR and ALL_CONNECTION_TRIES_FAILED
+var retryableClickHouseCodes = map[int32]bool{159: true, 202: true, 209: true, 210: true, 279: true}
+
+// StatusError is returned by sources for non-OK HTTP response, so the policy could check if its status is retryable
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Body)
+}
+
+// Policy defines how many times and how long after failure the operation is repeated
+type Policy struct {
+	// MaxAttempts is the number of attempts including the first one. Operation is done once if it's less than 2
+	MaxAttempts int
+	// Backoff is the delay after the first failed attempt, it's doubled after each next one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the share of the delay, which is randomly subtracted from it, so workers don't retry at the same time
+	Jitter float64
+	// RetryableStatuses are HTTP statuses of StatusError to retry. Connection errors are always retried
+	RetryableStatuses []int
+}
+
+// DefaultPolicy returns the policy with default settings
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:       DefaultMaxAttempts,
+		Backoff:           DefaultBackoff,
+		MaxBackoff:        DefaultMaxBackoff,
+		Jitter:            DefaultJitter,
+		RetryableStatuses: DefaultRetryableStatuses,
+	}
+}
+
+// Retryable returns true if the error is a connection error, transient ClickHouse exception or StatusError with retryable status
+func (p Policy) Retryable(err error) bool {
+	var chErr *clickhouse.Exception
+	if errors.As(err, &chErr) {
+		return retryableClickHouseCodes[chErr.Code]
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range p.RetryableStatuses {
+			if statusErr.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	return isConnectionError(err)
+}
+
+// delay returns the delay after the failed attempt, attempts are numbered from 1
+func (p Policy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+func isConnectionError(err error) bool {
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, fasthttp.ErrConnectionClosed), errors.Is(err, fasthttp.ErrTimeout),
+		errors.Is(err, fasthttp.ErrDialTimeout), errors.Is(err, driver.ErrBadConn):
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// Stats contains counters of the retried operations
+type Stats struct {
+	// Retries is the number of repeated attempts
+	Retries int64 `json:"retries"`
+	// Recovered and Failed are the numbers of retried operations, which eventually succeeded or failed
+	Recovered int64 `json:"recovered"`
+	Failed    int64 `json:"failed"`
+}
+
+// Retrier repeats operations with the policy and counts retries. It's safe for concurrent use
+type Retrier struct {
+	policy Policy
+
+	retries, recovered, failed int64
+}
+
+// NewRetrier creates retrier with the policy
+func NewRetrier(p Policy) *Retrier {
+	return &Retrier{policy: p}
+}
+
+// Do calls fn till it succeeds, fails with not retryable error or attempts are over. The name is used in the log.
+// Nil retrier calls fn once
+func (r *Retrier) Do(ctx context.Context, name string, fn func() error) error {
+	err := fn()
+	if r == nil || err == nil {
+		return err
+	}
+	attempt := 1
+	for ; attempt < r.policy.MaxAttempts && r.policy.Retryable(err); attempt++ {
+		d := r.policy.delay(attempt)
+		log.Warn().Msgf("Attempt %d of %d for %s failed: %v. Retrying in %v", attempt, r.policy.MaxAttempts, name, err, d.Round(time.Millisecond))
+
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddInt64(&r.retries, 1)
+		if err = fn(); err == nil {
+			atomic.AddInt64(&r.recovered, 1)
+			log.Info().Msgf("Attempt %d for %s succeeded", attempt+1, name)
+			return nil
+		}
+	}
+	if attempt > 1 {
+		atomic.AddInt64(&r.failed, 1)
+		return errors.Wrapf(err, "failed after %d attempts", attempt)
+	}
+	return err
+}
+
+// Stats returns counters of the retried operations
+func (r *Retrier) Stats() Stats {
+	if r == nil {
+		return Stats{}
+	}
+	return Stats{
+		Retries:   atomic.LoadInt64(&r.retries),
+		Recovered: atomic.LoadInt64(&r.recovered),
+		Failed:    atomic.LoadInt64(&r.failed),
+	}
+}
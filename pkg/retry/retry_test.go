@@ -0,0 +1,110 @@
+package retry
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/pkg/errors"
+)
+
+func TestRetryable(t *testing.T) {
+	p := DefaultPolicy()
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"connection reset", errors.Wrap(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, "failed to send request"), true},
+		{"connection refused", errors.Wrap(syscall.ECONNREFUSED, "failed to connect"), true},
+		{"service unavailable", errors.Wrap(&StatusError{Code: 503, Body: "unavailable"}, "non-OK response"), true},
+		{"bad request", errors.Wrap(&StatusError{Code: 400, Body: "bad request"}, "non-OK response"), false},
+		{"query error", errors.New("code: 62, message: Syntax error"), false},
+		{"unexpected EOF", errors.Wrap(io.ErrUnexpectedEOF, "failed to read response"), true},
+		{"truncated body", errors.Wrap(io.EOF, "failed to parse response"), false},
+		{"clickhouse timeout", &clickhouse.Exception{Code: 159, Name: "DB::Exception", Message: "Timeout exceeded"}, true},
+		{"clickhouse too many queries", errors.Wrap(&clickhouse.Exception{Code: 202, Message: "Too many simultaneous queries"}, "failed to read chunk"), true},
+		{"clickhouse network error", &clickhouse.Exception{Code: 210, Message: "Connection refused"}, true},
+		{"clickhouse syntax error", &clickhouse.Exception{Code: 62, Message: "Syntax error"}, false},
+		{"clickhouse unknown table", &clickhouse.Exception{Code: 60, Message: "Table doesn't exist"}, false},
+	}
+	for _, tt := range tests {
+		if actual := p.Retryable(tt.err); actual != tt.retryable {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.retryable, actual)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if actual := p.delay(attempt + 1); actual != expected {
+			t.Fatalf("attempt %d: expected %v, got %v", attempt+1, expected, actual)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(2); d > 2*time.Second || d < time.Second {
+			t.Fatalf("delay with jitter is out of range: %v", d)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	r := NewRetrier(Policy{MaxAttempts: 3, Backoff: time.Millisecond, RetryableStatuses: DefaultRetryableStatuses})
+
+	calls := 0
+	err := r.Do(ctx, "flaky", func() error {
+		calls++
+		if calls < 3 {
+			return &StatusError{Code: 502}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success after 3 calls, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	if err = r.Do(ctx, "broken", func() error {
+		calls++
+		return syscall.ECONNRESET
+	}); err == nil || calls != 3 {
+		t.Fatalf("expected failure after 3 calls, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	if err = r.Do(ctx, "invalid", func() error {
+		calls++
+		return &StatusError{Code: 400}
+	}); err == nil || calls != 1 {
+		t.Fatalf("expected failure without retries, got %d calls and %v", calls, err)
+	}
+
+	expected := Stats{Retries: 4, Recovered: 1, Failed: 1}
+	if stats := r.Stats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	var nilRetrier *Retrier
+	calls = 0
+	if err = nilRetrier.Do(ctx, "once", func() error {
+		calls++
+		return syscall.ECONNRESET
+	}); err == nil || calls != 1 {
+		t.Fatalf("nil retrier should call once, got %d calls and %v", calls, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	slow := NewRetrier(Policy{MaxAttempts: 3, Backoff: time.Hour})
+	if err = slow.Do(cancelled, "cancelled", func() error { return syscall.ECONNRESET }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+}
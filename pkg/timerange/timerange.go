@@ -0,0 +1,137 @@
+// Package timerange resolves the time range of export from absolute, relative and epoch time options
+package timerange
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDuration is the duration of the time range if its start isn't set
+const DefaultDuration = 4 * time.Hour
+
+// epochMillisThreshold separates epoch seconds from milliseconds: seconds don't reach it until year 33658
+const epochMillisThreshold = 1e12
+
+// zonedLayouts contain timezone, localLayouts are parsed in the location of the options
+var (
+	zonedLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00"}
+	localLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+)
+
+// Options are the time range options of export. Empty or zero options aren't set
+type Options struct {
+	Start string
+	End   string
+	// Last is the duration of the range ending at End or now
+	Last time.Duration
+	// Around is the middle of the range of the Window duration
+	Around string
+	Window time.Duration
+}
+
+// Range is the resolved time range. StartSet is false if the default start was used
+type Range struct {
+	Start    time.Time
+	End      time.Time
+	StartSet bool
+}
+
+// Resolve returns the time range of the options. The time without timezone is in the location, relative options count from now.
+// Range is returned in UTC
+func (o Options) Resolve(now time.Time, loc *time.Location) (Range, error) {
+	switch {
+	case o.Around != "" && (o.Start != "" || o.End != "" || o.Last != 0):
+		return Range{}, errors.New("`--around` can't be used with `--start-ts`, `--end-ts` or `--last`")
+	case o.Around != "" && o.Window <= 0:
+		return Range{}, errors.New("`--around` requires positive `--window`")
+	case o.Around == "" && o.Window != 0:
+		return Range{}, errors.New("`--window` requires `--around`")
+	case o.Last != 0 && o.Start != "":
+		return Range{}, errors.New("`--last` can't be used with `--start-ts`")
+	case o.Last < 0:
+		return Range{}, errors.New("`--last` should be positive")
+	}
+
+	if o.Around != "" {
+		around, err := ParseTime(o.Around, loc)
+		if err != nil {
+			return Range{}, errors.Wrap(err, "invalid `--around`")
+		}
+		return Range{
+			Start:    around.Add(-o.Window / 2).UTC(),
+			End:      around.Add(o.Window - o.Window/2).UTC(),
+			StartSet: true,
+		}, nil
+	}
+
+	r := Range{End: now}
+	if o.End != "" {
+		end, err := ParseTime(o.End, loc)
+		if err != nil {
+			return Range{}, errors.Wrap(err, "invalid end date-time")
+		}
+		r.End = end
+	}
+	switch {
+	case o.Start != "":
+		start, err := ParseTime(o.Start, loc)
+		if err != nil {
+			return Range{}, errors.Wrap(err, "invalid start date-time")
+		}
+		r.Start, r.StartSet = start, true
+	case o.Last != 0:
+		r.Start, r.StartSet = r.End.Add(-o.Last), true
+	default:
+		r.Start = r.End.Add(-DefaultDuration)
+	}
+	if r.Start.After(r.End) {
+		return Range{}, errors.New("invalid time range: start > end")
+	}
+	r.Start, r.End = r.Start.UTC(), r.End.UTC()
+	return r, nil
+}
+
+// ParseTime parses RFC3339 time with optional seconds, the same time or date without timezone in the location,
+// or Unix epoch in seconds or milliseconds
+func ParseTime(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if epoch >= epochMillisThreshold {
+			return time.UnixMilli(epoch), nil
+		}
+		return time.Unix(epoch, 0), nil
+	}
+
+	for _, layout := range zonedLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range localLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("unknown date-time format %q, expected RFC3339 (%s), date-time without timezone or Unix epoch", value, time.RFC3339)
+}
+
+// LoadLocation returns location of the timezone name stored in PMM preferences. Empty name and "browser" timezone of PMM are UTC
+func LoadLocation(name string) (*time.Location, error) {
+	switch {
+	case name == "" || name == "browser":
+		return time.UTC, nil
+	case strings.EqualFold(name, "utc"):
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown timezone %q", name)
+	}
+	return loc, nil
+}
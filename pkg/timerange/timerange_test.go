@@ -0,0 +1,96 @@
+package timerange
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	berlin, err := LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2024-05-01T10:00:00Z", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01T10:00Z", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01T12:00:00+02:00", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01T12:00:00", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01 12:30", time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"2024-05-01", time.Date(2024, 4, 30, 22, 0, 0, 0, time.UTC)},
+		{"1714557600", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"1714557600500", time.Date(2024, 5, 1, 10, 0, 0, 5e8, time.UTC)},
+	}
+	for _, tt := range tests {
+		actual, err := ParseTime(tt.value, berlin)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.value, err)
+		}
+		if !actual.Equal(tt.expected) {
+			t.Fatalf("%s: expected %v, got %v", tt.value, tt.expected, actual.UTC())
+		}
+	}
+
+	if _, err = ParseTime("yesterday", berlin); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		opts     Options
+		expected Range
+		invalid  bool
+	}{
+		{
+			name:     "default",
+			expected: Range{Start: now.Add(-DefaultDuration), End: now},
+		},
+		{
+			name:     "start and end",
+			opts:     Options{Start: "2024-05-01T06:00:00Z", End: "2024-05-01T07:00:00Z"},
+			expected: Range{Start: time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC), StartSet: true},
+		},
+		{
+			name:     "last",
+			opts:     Options{Last: 6 * time.Hour},
+			expected: Range{Start: now.Add(-6 * time.Hour), End: now, StartSet: true},
+		},
+		{
+			name:     "last before end",
+			opts:     Options{Last: time.Hour, End: "1714557600"},
+			expected: Range{Start: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), StartSet: true},
+		},
+		{
+			name:     "around",
+			opts:     Options{Around: "2024-05-01T10:00Z", Window: 2 * time.Hour},
+			expected: Range{Start: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), StartSet: true},
+		},
+		{name: "around without window", opts: Options{Around: "2024-05-01T10:00Z"}, invalid: true},
+		{name: "window without around", opts: Options{Window: time.Hour}, invalid: true},
+		{name: "around with start", opts: Options{Around: "2024-05-01T10:00Z", Window: time.Hour, Start: "1714557600"}, invalid: true},
+		{name: "last with start", opts: Options{Last: time.Hour, Start: "1714557600"}, invalid: true},
+		{name: "start after end", opts: Options{Start: "2024-05-01T08:00:00Z", End: "2024-05-01T07:00:00Z"}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := tt.opts.Resolve(now, time.UTC)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !actual.Start.Equal(tt.expected.Start) || !actual.End.Equal(tt.expected.End) || actual.StartSet != tt.expected.StartSet {
+				t.Fatalf("expected %+v, got %+v", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package transferer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// DiffReport describes differences between two dumps, A and B. Only the series, metrics and services which differ are listed
+type DiffReport struct {
+	SeriesA  int `json:"series-a"`
+	SeriesB  int `json:"series-b"`
+	SamplesA int `json:"samples-a"`
+	SamplesB int `json:"samples-b"`
+
+	SeriesOnlyInA []string     `json:"series-only-in-a,omitempty"`
+	SeriesOnlyInB []string     `json:"series-only-in-b,omitempty"`
+	Metrics       []MetricDiff `json:"metrics,omitempty"`
+
+	// MissingSamples is the difference of samples count summed over all the series, Loss is its share of all the samples
+	MissingSamples int     `json:"missing-samples"`
+	Loss           float64 `json:"loss"`
+
+	// CoverageA and CoverageB are the time ranges covered by VictoriaMetrics chunks of the dumps
+	CoverageA       []TimeRange `json:"coverage-a,omitempty"`
+	CoverageB       []TimeRange `json:"coverage-b,omitempty"`
+	CoverageOnlyInA []TimeRange `json:"coverage-only-in-a,omitempty"`
+	CoverageOnlyInB []TimeRange `json:"coverage-only-in-b,omitempty"`
+
+	RowsA    int           `json:"rows-a"`
+	RowsB    int           `json:"rows-b"`
+	Services []ServiceDiff `json:"services,omitempty"`
+}
+
+// MetricDiff contains totals of a single metric name in both dumps
+type MetricDiff struct {
+	Name     string `json:"name"`
+	SeriesA  int    `json:"series-a"`
+	SeriesB  int    `json:"series-b"`
+	SamplesA int    `json:"samples-a"`
+	SamplesB int    `json:"samples-b"`
+}
+
+// ServiceDiff contains QAN rows count of a single service in both dumps.
+// Service is empty if the dump doesn't store ClickHouse columns in meta
+type ServiceDiff struct {
+	Service string `json:"service"`
+	RowsA   int    `json:"rows-a"`
+	RowsB   int    `json:"rows-b"`
+}
+
+// Equal returns true if no differences were found
+func (r *DiffReport) Equal() bool {
+	return len(r.SeriesOnlyInA) == 0 && len(r.SeriesOnlyInB) == 0 && len(r.Metrics) == 0 && r.MissingSamples == 0 &&
+		len(r.CoverageOnlyInA) == 0 && len(r.CoverageOnlyInB) == 0 && len(r.Services) == 0
+}
+
+// diffSide contains contents of one of the compared dumps
+type diffSide struct {
+	series   map[string]*diffSeries
+	coverage []TimeRange
+	rows     map[string]int
+}
+
+type diffSeries struct {
+	labels  map[string]string
+	samples int
+}
+
+// Diff compares the dumps given as lists of their parts without connecting to PMM. Only samples count of the series
+// are compared, not the values. Encrypted dumps are decrypted with the identities
+func Diff(a, b []string, identities ...age.Identity) (*DiffReport, error) {
+	sideA, err := readDiffSide(a, identities)
+	if err != nil {
+		return nil, err
+	}
+	sideB, err := readDiffSide(b, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DiffReport{
+		CoverageA: unionRanges(sideA.coverage),
+		CoverageB: unionRanges(sideB.coverage),
+	}
+	report.CoverageOnlyInA = subtractRanges(report.CoverageA, report.CoverageB)
+	report.CoverageOnlyInB = subtractRanges(report.CoverageB, report.CoverageA)
+
+	metrics := make(map[string]*MetricDiff)
+	metric := func(labels map[string]string) *MetricDiff {
+		name := labels[native.MetricNameLabel]
+		m, ok := metrics[name]
+		if !ok {
+			m = &MetricDiff{Name: name}
+			metrics[name] = m
+		}
+		return m
+	}
+	total := 0
+	for key, s := range sideA.series {
+		m := metric(s.labels)
+		m.SeriesA++
+		m.SamplesA += s.samples
+		report.SeriesA++
+		report.SamplesA += s.samples
+
+		other, ok := sideB.series[key]
+		if !ok {
+			report.SeriesOnlyInA = append(report.SeriesOnlyInA, seriesString(s.labels))
+			report.MissingSamples += s.samples
+			total += s.samples
+			continue
+		}
+		if s.samples > other.samples {
+			report.MissingSamples += s.samples - other.samples
+			total += s.samples
+		} else {
+			report.MissingSamples += other.samples - s.samples
+			total += other.samples
+		}
+	}
+	for key, s := range sideB.series {
+		m := metric(s.labels)
+		m.SeriesB++
+		m.SamplesB += s.samples
+		report.SeriesB++
+		report.SamplesB += s.samples
+
+		if _, ok := sideA.series[key]; !ok {
+			report.SeriesOnlyInB = append(report.SeriesOnlyInB, seriesString(s.labels))
+			report.MissingSamples += s.samples
+			total += s.samples
+		}
+	}
+	if total != 0 {
+		report.Loss = float64(report.MissingSamples) / float64(total)
+	}
+	sort.Strings(report.SeriesOnlyInA)
+	sort.Strings(report.SeriesOnlyInB)
+
+	for _, m := range metrics {
+		if m.SeriesA != m.SeriesB || m.SamplesA != m.SamplesB {
+			report.Metrics = append(report.Metrics, *m)
+		}
+	}
+	sort.Slice(report.Metrics, func(i, j int) bool {
+		return report.Metrics[i].Name < report.Metrics[j].Name
+	})
+
+	services := make(map[string]struct{})
+	for service, rows := range sideA.rows {
+		services[service] = struct{}{}
+		report.RowsA += rows
+	}
+	for service, rows := range sideB.rows {
+		services[service] = struct{}{}
+		report.RowsB += rows
+	}
+	for service := range services {
+		if sideA.rows[service] != sideB.rows[service] {
+			report.Services = append(report.Services, ServiceDiff{
+				Service: service,
+				RowsA:   sideA.rows[service],
+				RowsB:   sideB.rows[service],
+			})
+		}
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		return report.Services[i].Service < report.Services[j].Service
+	})
+	return report, nil
+}
+
+// readDiffSide reads series, chunk time ranges and QAN rows per service of all the dump parts
+func readDiffSide(dumpParts []string, identities []age.Identity) (*diffSide, error) {
+	side := &diffSide{
+		series: make(map[string]*diffSeries),
+		rows:   make(map[string]int),
+	}
+	for _, dumpPart := range dumpParts {
+		meta, err := ReadMetaFromDump(dumpPart, false, identities...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read meta of %s", dumpPart)
+		}
+		serviceColumn := -1
+		for i, c := range meta.ClickHouseColumns {
+			if c.Name == "service_name" {
+				serviceColumn = i
+			}
+		}
+
+		err = ReadDumpChunks(dumpPart, func(c *dump.Chunk) error {
+			switch c.Source {
+			case dump.VictoriaMetrics:
+				if c.Start != nil && c.End != nil {
+					side.coverage = append(side.coverage, TimeRange{Start: *c.Start, End: *c.End})
+				}
+				_, _, err := readVMChunk(c.Content, func(labels map[string]string, samples int) {
+					key := labelsKey(labels)
+					s, ok := side.series[key]
+					if !ok {
+						s = &diffSeries{labels: labels}
+						side.series[key] = s
+					}
+					s.samples += samples
+				})
+				return errors.Wrapf(err, "failed to parse chunk vm/%s", c.Filename)
+			case dump.ClickHouse:
+				return errors.Wrapf(countServiceRows(c.Content, serviceColumn, side.rows), "failed to parse chunk ch/%s", c.Filename)
+			}
+			return nil
+		}, identities...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", dumpPart)
+		}
+	}
+	return side, nil
+}
+
+// countServiceRows adds rows count of every service in the ClickHouse chunk to rows.
+// All the rows are counted for the empty service if the column is unknown
+func countServiceRows(content []byte, column int, rows map[string]int) error {
+	r := csv.NewReader(bytes.NewReader(content))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		service := ""
+		if column >= 0 && column < len(record) {
+			service = record[column]
+		}
+		rows[service]++
+	}
+}
+
+// seriesString returns the series in PromQL notation: metric name followed by the other labels
+func seriesString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != native.MetricNameLabel {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(labels[native.MetricNameLabel])
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// unionRanges returns sorted non-overlapping ranges covering the same time as the ranges
+func unionRanges(ranges []TimeRange) []TimeRange {
+	sorted := append([]TimeRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+	var result []TimeRange
+	for _, r := range sorted {
+		if n := len(result); n > 0 && !r.Start.After(result[n-1].End) {
+			if r.End.After(result[n-1].End) {
+				result[n-1].End = r.End
+			}
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// subtractRanges returns parts of the sorted non-overlapping ranges not covered by the other ones
+func subtractRanges(ranges, other []TimeRange) []TimeRange {
+	var result []TimeRange
+	for _, r := range ranges {
+		start := r.Start
+		for _, o := range other {
+			if !o.End.After(start) {
+				continue
+			}
+			if !o.Start.Before(r.End) {
+				break
+			}
+			if o.Start.After(start) {
+				result = append(result, TimeRange{Start: start, End: o.Start})
+			}
+			start = o.End
+			if !start.Before(r.End) {
+				break
+			}
+		}
+		if start.Before(r.End) {
+			result = append(result, TimeRange{Start: start, End: r.End})
+		}
+	}
+	return result
+}
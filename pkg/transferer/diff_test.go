@@ -0,0 +1,102 @@
+package transferer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestDiff(t *testing.T) {
+	columns := []dump.ClickHouseColumn{{Name: "queryid", Type: "String"}, {Name: "service_name", Type: "LowCardinality(String)"}}
+	dir := t.TempDir()
+	writeDump := func(name string, files []fakeEntry) []string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, fakeDump(t, files), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return []string{path}
+	}
+
+	a := writeDump("a.tar.gz", []fakeEntry{
+		{"vm/1600000000-1600000300.bin", gzipData(t, []byte(
+			`{"metric":{"__name__":"up","instance":"a"},"values":[1,1],"timestamps":[1,2]}`+"\n"+
+				`{"metric":{"__name__":"up","instance":"b"},"values":[1],"timestamps":[1]}`+"\n"))},
+		{"vm/1600000300-1600000600.bin", gzipData(t, []byte(
+			`{"metric":{"__name__":"node_load1","instance":"a"},"values":[0.5,0.7],"timestamps":[3,4]}`+"\n"))},
+		{"ch/0.tsv", []byte("q1\tmysql-1\nq2\tmysql-1\nq3\tpg-1\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{ClickHouseColumns: columns})},
+	})
+	b := writeDump("b.tar.gz", []fakeEntry{
+		{"vm/1600000000-1600000300.bin", gzipData(t, []byte(
+			`{"metric":{"__name__":"up","instance":"a"},"values":[1],"timestamps":[1]}`+"\n"+
+				`{"metric":{"__name__":"up","instance":"c"},"values":[1],"timestamps":[1]}`+"\n"))},
+		{"vm/1600000300-1600000600.bin", gzipData(t, []byte(
+			`{"metric":{"__name__":"node_load1","instance":"a"},"values":[0.5,0.7],"timestamps":[3,4]}`+"\n"))},
+		{"vm/1600000900-1600001200.bin", gzipData(t, []byte(
+			`{"metric":{"__name__":"node_load1","instance":"a"},"values":[0.1],"timestamps":[5]}`+"\n"))},
+		{"ch/0.tsv", []byte("q1\tmysql-1\nq3\tpg-1\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{ClickHouseColumns: columns})},
+	})
+
+	report, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Equal() {
+		t.Fatal("expected differences")
+	}
+	if report.SeriesA != 3 || report.SeriesB != 3 || report.SamplesA != 5 || report.SamplesB != 5 {
+		t.Fatalf("unexpected totals: %+v", report)
+	}
+	if !reflect.DeepEqual(report.SeriesOnlyInA, []string{`up{instance="b"}`}) || !reflect.DeepEqual(report.SeriesOnlyInB, []string{`up{instance="c"}`}) {
+		t.Fatalf("unexpected series: %v, %v", report.SeriesOnlyInA, report.SeriesOnlyInB)
+	}
+	expectedMetrics := []MetricDiff{
+		{Name: "node_load1", SeriesA: 1, SeriesB: 1, SamplesA: 2, SamplesB: 3},
+		{Name: "up", SeriesA: 2, SeriesB: 2, SamplesA: 3, SamplesB: 2},
+	}
+	if !reflect.DeepEqual(report.Metrics, expectedMetrics) {
+		t.Fatalf("unexpected metrics: %+v", report.Metrics)
+	}
+	// up{instance="a"} misses 1 sample, node_load1 has 1 extra, up{instance="b"} and up{instance="c"} have 1 each out of 7
+	if report.MissingSamples != 4 || report.Loss != 4.0/7 {
+		t.Fatalf("unexpected loss: %d, %f", report.MissingSamples, report.Loss)
+	}
+
+	if len(report.CoverageOnlyInA) != 0 {
+		t.Fatalf("unexpected coverage only in a: %+v", report.CoverageOnlyInA)
+	}
+	expectedCoverage := []TimeRange{{Start: time.Unix(1600000900, 0), End: time.Unix(1600001200, 0)}}
+	if len(report.CoverageOnlyInB) != 1 || !report.CoverageOnlyInB[0].Start.Equal(expectedCoverage[0].Start) || !report.CoverageOnlyInB[0].End.Equal(expectedCoverage[0].End) {
+		t.Fatalf("unexpected coverage only in b: %+v", report.CoverageOnlyInB)
+	}
+
+	if report.RowsA != 3 || report.RowsB != 2 || !reflect.DeepEqual(report.Services, []ServiceDiff{{Service: "mysql-1", RowsA: 2, RowsB: 1}}) {
+		t.Fatalf("unexpected services: %+v", report.Services)
+	}
+
+	report, err = Diff(a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Equal() || report.Loss != 0 {
+		t.Fatalf("expected no differences: %+v", report)
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	ranges := unionRanges([]TimeRange{{at(20), at(30)}, {at(0), at(10)}, {at(5), at(15)}})
+	if !reflect.DeepEqual(ranges, []TimeRange{{at(0), at(15)}, {at(20), at(30)}}) {
+		t.Fatalf("unexpected union: %+v", ranges)
+	}
+	result := subtractRanges(ranges, []TimeRange{{at(2), at(4)}, {at(10), at(22)}, {at(25), at(40)}})
+	expected := []TimeRange{{at(0), at(2)}, {at(4), at(10)}, {at(22), at(25)}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+}
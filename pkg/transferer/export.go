@@ -2,10 +2,9 @@ package transferer
 
 import (
 	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"path"
 	"pmm-dump/pkg/dump"
 	"sync"
@@ -16,10 +15,12 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.Meta, pool ChunkPool, logBuffer *bytes.Buffer) error {
+// Export reads chunks from the pool and writes them to the dump file. If the journal is provided,
+// chunks recorded in it are skipped and the new ones are appended to the file after the journal's offset.
+func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.Meta, pool ChunkPool, logBuffer *dump.LogBuffer, journal *Journal) error {
 	log.Info().Msg("Exporting metrics...")
 
-	chunksCh := make(chan *dump.Chunk, maxChunksInMem)
+	chunksCh := make(chan *exportChunk, maxChunksInMem)
 	log.Debug().
 		Int("size", maxChunksInMem).
 		Msg("Created chunks channel")
@@ -34,7 +35,7 @@ func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.M
 			defer log.Debug().Msgf("Exiting from read chunks goroutine")
 			defer readWG.Done()
 
-			if err := t.readChunksFromSource(gCtx, lc, pool, chunksCh); err != nil {
+			if err := t.readChunksFromSource(gCtx, lc, pool, chunksCh, journal); err != nil {
 				return errors.Wrap(err, "failed to read chunks from source")
 			}
 			return nil
@@ -44,6 +45,7 @@ func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.M
 	log.Debug().Msgf("Starting goroutine to close channel after read finish...")
 	go func() {
 		readWG.Wait()
+		t.logRetries()
 		close(chunksCh)
 		log.Debug().Msgf("Exiting from goroutine waiting for read to finish")
 	}()
@@ -51,7 +53,7 @@ func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.M
 	log.Debug().Msg("Starting single goroutine for writing chunks to the dump...")
 	g.Go(func() error {
 		defer log.Debug().Msgf("Exiting from write chunks goroutine")
-		if err := t.writeChunksToFile(meta, chunksCh, logBuffer); err != nil {
+		if err := t.writeChunksToFile(meta, chunksCh, logBuffer, journal); err != nil {
 			return errors.Wrap(err, "failed to write chunks to the dump")
 		}
 		return nil
@@ -62,12 +64,25 @@ func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.M
 		return err
 	}
 
+	if journal != nil {
+		if err := journal.Remove(); err != nil {
+			return errors.Wrap(err, "failed to remove journal")
+		}
+	}
+
 	log.Info().Msg("Successfully exported!")
 
 	return nil
 }
 
-func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGetter, p ChunkPool, chunkC chan<- *dump.Chunk) error {
+// exportChunk is a chunk read from the source together with its manifest entry,
+// which is calculated by the reading goroutines to offload the single writing one
+type exportChunk struct {
+	*dump.Chunk
+	manifest dump.ManifestChunk
+}
+
+func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGetter, p ChunkPool, chunkC chan<- *exportChunk, journal *Journal) error {
 	for {
 		log.Debug().Msg("New chunks reading loop iteration has been started")
 
@@ -100,86 +115,341 @@ func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGette
 				return nil
 			}
 
+			if journal != nil && journal.Done(chMeta) {
+				log.Debug().Msgf("Chunk %s was already exported: skipping", chMeta)
+				continue
+			}
+
 			s, ok := t.sourceByType(chMeta.Source)
 			if !ok {
 				return errors.New("failed to find source to read chunk")
 			}
 
-			c, err := s.ReadChunk(chMeta)
+			adaptive, _ := p.(AdaptiveChunkPool)
+			var c *dump.Chunk
+			var replanned bool
+			err := t.retrier.Do(ctx, fmt.Sprintf("reading chunk %s/%s", chMeta.Source, chMeta), func() error {
+				var err error
+				start := time.Now()
+				c, err = s.ReadChunk(chMeta)
+				if adaptive != nil && adaptive.Feedback(chMeta, c, time.Since(start), err) {
+					replanned = true
+					return nil
+				}
+				return err
+			})
 			if err != nil {
 				return errors.Wrap(err, "failed to read chunk")
 			}
+			if replanned {
+				log.Debug().Msgf("Chunk %s was replanned: skipping", chMeta)
+				continue
+			}
 
 			log.Debug().
 				Stringer("source", c.Source).
 				Str("filename", c.Filename).
 				Msg("Successfully read chunk. Sending to chunks channel...")
 
-			chunkC <- c
+			select {
+			case chunkC <- &exportChunk{
+				Chunk:    c,
+				manifest: newManifestChunk(c),
+			}:
+			case <-ctx.Done():
+				log.Debug().Msg("Context is done, stopping chunks reading")
+				return ctx.Err()
+			}
 		}
 	}
 }
 
-func (t Transferer) writeChunksToFile(meta dump.Meta, chunkC <-chan *dump.Chunk, logBuffer *bytes.Buffer) error {
-	gzw, err := gzip.NewWriterLevel(t.file, gzip.BestCompression)
-	if err != nil {
-		return errors.Wrap(err, "failed to create gzip writer")
+func (t Transferer) writeChunksToFile(meta dump.Meta, chunkC <-chan *exportChunk, logBuffer *dump.LogBuffer, journal *Journal) error {
+	if journal != nil && len(t.recipients) > 0 {
+		return errors.New("resume is not supported for encrypted dump")
+	}
+	if journal != nil && t.splitSize > 0 {
+		return errors.New("resume is not supported for split dump")
 	}
-	defer gzw.Close()
 
-	tw := tar.NewWriter(gzw)
-	defer tw.Close()
+	part, err := t.openPart(1, meta, journal)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		part.discard()
+	}()
 
 	for {
 		log.Debug().Msg("New chunks writing loop iteration has been started")
 
 		c, ok := <-chunkC
 		if !ok {
-			if err := writeMetafile(tw, meta); err != nil {
-				return err
-			}
-
-			if err = writeLog(tw, logBuffer); err != nil {
+			meta.Retries = t.retryStats()
+			if err := part.close(meta, logBuffer); err != nil {
 				return err
 			}
-
 			log.Debug().Msg("Chunks channel is closed: stopping chunks writing")
 			return nil
 		}
 
-		s, _ := t.sourceByType(c.Source) // there is no need to check for error as incoming chunk always has correct source
+		if t.splitSize > 0 {
+			// Log keeps growing while the chunks are written, so the part gets only the log measured here
+			logLen := logBuffer.Len()
+			if len(part.manifest.Chunks) > 0 && !part.fits(c, logLen, t.splitSize) {
+				meta.Retries = t.retryStats()
+				if err := part.close(meta, logBuffer); err != nil {
+					return err
+				}
+				if part, err = t.openPart(part.number+1, meta, nil); err != nil {
+					return err
+				}
+			}
+			part.logLen = logLen
+		}
 
 		log.Info().
 			Stringer("source", c.Source).
 			Str("filename", c.Filename).
 			Msg("Writing chunk to the dump...")
 
-		chunkSize := int64(len(c.Content))
-		if chunkSize > meta.MaxChunkSize {
-			meta.MaxChunkSize = chunkSize
+		if err = part.writeChunk(c); err != nil {
+			return err
 		}
 
-		err = tw.WriteHeader(&tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     path.Join(s.Type().String(), c.Filename),
-			Size:     chunkSize,
-			Mode:     0600,
-			ModTime:  time.Now(),
-		})
+		switch {
+		case journal != nil:
+			if err = t.checkpoint(c, part, journal); err != nil {
+				return errors.Wrap(err, "failed to checkpoint chunk")
+			}
+		case t.splitSize > 0:
+			// Compressed size of the part must be known before the next chunk is written
+			if err = part.flush(); err != nil {
+				return err
+			}
+			if size := part.cw.n; size > t.splitSize {
+				log.Warn().Msgf("Chunk %s doesn't fit into the split size: dump part %d has %d bytes", c.Filename, part.number, size)
+			}
+		}
+	}
+}
+
+// checkpoint finishes current gzip member (or zstd frame), so the dump file could be truncated to the current offset
+// and continued with a new one. Multi-member gzip and multi-frame zstd streams are read by import as a single one.
+func (t Transferer) checkpoint(c *exportChunk, part *archiveWriter, journal *Journal) error {
+	if err := part.flush(); err != nil {
+		return err
+	}
+
+	if f, ok := part.file.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			return errors.Wrap(err, "failed to sync dump file")
+		}
+	}
+
+	return journal.Add(c.Chunk, c.manifest, part.cw.n)
+}
+
+// openPart starts writing of the dump archive. The whole dump is written as a single part to the transferer file,
+// unless the split size is set: then every part is written to the new file
+func (t Transferer) openPart(number int, meta dump.Meta, journal *Journal) (*archiveWriter, error) {
+	a := &archiveWriter{
+		number: number,
+		file:   t.file,
+	}
+
+	if t.splitSize > 0 {
+		file, err := t.createPart(number)
 		if err != nil {
-			return errors.Wrap(err, "failed to write file header")
+			return nil, errors.Wrapf(err, "failed to create dump part %d", number)
 		}
+		a.file = file
+		a.closeFile = file.Close
+		a.reserve = splitPartReserve
+	}
 
-		if _, err = tw.Write(c.Content); err != nil {
-			return errors.Wrap(err, "failed to write chunk content")
+	a.cw = &countingWriter{w: a.file}
+	if journal != nil {
+		a.cw.n = journal.Offset()
+		a.manifest.Chunks = journal.ManifestChunks()
+		a.maxChunkSize = journal.MaxChunkSize()
+	}
+
+	a.w = a.cw
+	if len(t.recipients) > 0 {
+		var clearMeta *dump.Meta
+		if t.keepMetaInClear {
+			clearMeta = &meta
+			if t.splitSize > 0 {
+				clearMeta.Part = number
+			}
 		}
+		ew, err := dump.NewEncryptWriter(a.cw, t.recipients, clearMeta)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create encryption writer")
+		}
+		a.ew = ew
+		a.w = ew
+		a.reserve += encryptionReserve
+	}
+
+	var err error
+	if a.cmw, err = dump.NewCompressWriter(a.w, t.compression, t.compressionLevel, t.workersCount); err != nil {
+		return nil, errors.Wrap(err, "failed to create compression writer")
+	}
+
+	a.tw = tar.NewWriter(a.cmw)
+
+	if t.splitSize > 0 {
+		log.Info().Msgf("Writing dump part %d...", number)
 	}
+
+	return a, nil
 }
 
-func writeLog(tw *tar.Writer, logBuffer *bytes.Buffer) error {
-	log.Debug().Msg("Writing dump log")
+const (
+	// splitPartReserve is reserved in the dump part for tar headers and compression overhead
+	splitPartReserve = 64 * 1024
+	// encryptionReserve is reserved in the dump part for the data buffered by encryption
+	encryptionReserve = 128 * 1024
+	// manifestEntryReserve is reserved in the dump part for every manifest entry
+	manifestEntryReserve = 512
+)
+
+// archiveWriter writes a single dump archive: tar stream, which is compressed and optionally encrypted
+type archiveWriter struct {
+	number    int
+	file      io.Writer
+	closeFile func() error
+
+	cw  *countingWriter
+	w   io.Writer // writer of the compressed stream: encryption writer or the file itself
+	ew  io.WriteCloser
+	cmw dump.CompressWriter
+	tw  *tar.Writer
+
+	manifest     dump.Manifest
+	maxChunkSize int64
+	reserve      int64
+	closed       bool
+	// logLen is the size of the log counted by the size check of the dump part, the log is cut to it
+	logLen int
+}
+
+func (a *archiveWriter) writeChunk(c *exportChunk) error {
+	chunkSize := int64(len(c.Content))
+	if chunkSize > a.maxChunkSize {
+		a.maxChunkSize = chunkSize
+	}
+
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(c.Source.String(), c.Filename),
+		Size:     chunkSize,
+		Mode:     0600,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to write file header")
+	}
+
+	if _, err = a.tw.Write(c.Content); err != nil {
+		return errors.Wrap(err, "failed to write chunk content")
+	}
+
+	a.manifest.Chunks = append(a.manifest.Chunks, c.manifest)
+	return nil
+}
+
+// fits reports whether the chunk and all the files written at the end of the archive fit into the size.
+// Chunk size is used as an upper bound of its compressed size, so the archive must be flushed after every chunk
+func (a *archiveWriter) fits(c *exportChunk, logLen int, size int64) bool {
+	expected := a.cw.n + int64(len(c.Content)) + a.reserve + int64(logLen) +
+		int64(len(a.manifest.Chunks)+1)*manifestEntryReserve
+	return expected <= size
+}
+
+// flush writes all the buffered data to the file, finishing current gzip member or zstd frame
+func (a *archiveWriter) flush() error {
+	if err := a.tw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush tar writer")
+	}
+	if err := a.cmw.Close(); err != nil {
+		return errors.Wrap(err, "failed to close compression frame")
+	}
+	a.cmw.Reset(a.w)
+	return nil
+}
+
+// close writes manifest, meta and log of the archive and closes all the writers
+func (a *archiveWriter) close(meta dump.Meta, logBuffer *dump.LogBuffer) error {
+	a.closed = true
+
+	meta.MaxChunkSize = a.maxChunkSize
+	if a.closeFile != nil {
+		meta.Part = a.number
+	}
+
+	if err := writeManifest(a.tw, a.manifest); err != nil {
+		return err
+	}
+	if err := writeMetafile(a.tw, meta); err != nil {
+		return err
+	}
+	logContent := logBuffer.Snapshot()
+	if a.closeFile != nil && a.logLen < len(logContent) {
+		logContent = logContent[:a.logLen]
+	}
+	if err := writeLog(a.tw, logContent); err != nil {
+		return err
+	}
+
+	if err := a.tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to close tar writer")
+	}
+	if err := a.cmw.Close(); err != nil {
+		return errors.Wrap(err, "failed to close compression writer")
+	}
+	if a.ew != nil {
+		if err := a.ew.Close(); err != nil {
+			return errors.Wrap(err, "failed to close encryption writer")
+		}
+	}
+	if a.closeFile != nil {
+		if err := a.closeFile(); err != nil {
+			return errors.Wrapf(err, "failed to close dump part %d", a.number)
+		}
+	}
+	return nil
+}
+
+// discard releases resources of the archive, which was not closed because of an error
+func (a *archiveWriter) discard() {
+	if a.closed {
+		return
+	}
+	_ = a.cmw.Close()
+	if a.ew != nil {
+		_ = a.ew.Close()
+	}
+	if a.closeFile != nil {
+		_ = a.closeFile()
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	byteLog := logBuffer.Bytes()
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func writeLog(tw *tar.Writer, byteLog []byte) error {
+	log.Debug().Msg("Writing dump log")
 
 	err := tw.WriteHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
@@ -1,12 +1,25 @@
 package transferer
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
 	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/retry"
 )
 
 func TestExport(t *testing.T) {
@@ -127,7 +140,7 @@ func TestExport(t *testing.T) {
 				if err != nil {
 					t.Fatal(err, "failed to create new chunk pool")
 				}
-				err = tr.Export(ctx, fakeStatusGetter{status: tt.loadStatus.status, waitCount: tt.loadStatus.waitCount, statusAfterWait: tt.loadStatus.statusAfterWait, count: new(int)}, meta, pool, &bytes.Buffer{})
+				err = tr.Export(ctx, fakeStatusGetter{status: tt.loadStatus.status, waitCount: tt.loadStatus.waitCount, statusAfterWait: tt.loadStatus.statusAfterWait, count: new(int)}, meta, pool, new(dump.LogBuffer), nil)
 				if err != nil {
 					if tt.shouldErr {
 						return
@@ -141,6 +154,500 @@ func TestExport(t *testing.T) {
 	}
 }
 
+func TestExportResume(t *testing.T) {
+	for _, c := range []dump.Compression{dump.GzipCompression, dump.ZstdCompression, dump.NoCompression} {
+		t.Run(c.String(), func(t *testing.T) {
+			testExportResume(t, c)
+		})
+	}
+}
+
+func testExportResume(t *testing.T, compression dump.Compression) {
+	ctx := context.Background()
+
+	dumpPath := filepath.Join(t.TempDir(), "dump.tar.gz")
+	end := time.Now().UTC().Truncate(time.Minute)
+	start := end.Add(-time.Hour)
+	chunks := prepareFakeChunks(start, end, time.Minute, dump.VictoriaMetrics)
+
+	export := func(source dump.Source) error {
+		journal, err := OpenJournal(dumpPath, "export", start, end)
+		if err != nil {
+			t.Fatal(err, "failed to open journal")
+		}
+
+		file, err := os.OpenFile(dumpPath, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err, "failed to open dump file")
+		}
+		defer file.Close()
+		if err = file.Truncate(journal.Offset()); err != nil {
+			t.Fatal(err, "failed to truncate dump file")
+		}
+		if _, err = file.Seek(journal.Offset(), io.SeekStart); err != nil {
+			t.Fatal(err, "failed to seek dump file")
+		}
+
+		tr := Transferer{
+			sources:      []dump.Source{source},
+			workersCount: 1,
+			file:         file,
+		}
+		tr.SetCompression(compression, 0)
+		pool, err := dump.NewChunkPool(chunks)
+		if err != nil {
+			t.Fatal(err, "failed to create new chunk pool")
+		}
+		err = tr.Export(ctx, fakeStatusGetter{status: LoadStatusOK, count: new(int)}, dump.Meta{}, pool, new(dump.LogBuffer), journal)
+		if err != nil {
+			// Successful export closes and removes the journal by itself
+			_ = journal.Close()
+		}
+		return err
+	}
+
+	if err := export(&failingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}, failAfter: len(chunks) / 2}); err == nil {
+		t.Fatal("interrupted export should fail")
+	}
+	if _, err := os.Stat(dumpPath + JournalSuffix); err != nil {
+		t.Fatal(err, "journal should be kept after failed export")
+	}
+
+	if err := export(&fakeSource{sourceType: dump.VictoriaMetrics}); err != nil {
+		t.Fatal(err, "failed to resume export")
+	}
+	if _, err := os.Stat(dumpPath + JournalSuffix); !os.IsNotExist(err) {
+		t.Fatal("journal should be removed after successful export")
+	}
+
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dr, err := dump.NewDecompressReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(dr)
+	files := make(map[string]int)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err, "failed to read resumed dump")
+		}
+		files[header.Name]++
+	}
+	for _, c := range chunks {
+		name := "vm/" + c.String() + ".bin"
+		if files[name] != 1 {
+			t.Fatalf("chunk %s is found %d times in the dump", name, files[name])
+		}
+	}
+	if files[dump.MetaFilename] != 1 {
+		t.Fatal("meta file is not found in the dump")
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	_, manifest, err := ReadMetaAndCheckManifest(f)
+	if err != nil {
+		t.Fatal(err, "failed to check manifest of resumed dump")
+	}
+	if manifest == nil || len(manifest.Chunks) != len(chunks) {
+		t.Fatalf("manifest should list all %d chunks, got %v", len(chunks), manifest)
+	}
+}
+
+func TestJournalKeyset(t *testing.T) {
+	end := time.Now().UTC().Truncate(time.Minute)
+	start := end.Add(-time.Hour)
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "dump.tar.gz"), "export", start, end)
+	if err != nil {
+		t.Fatal(err, "failed to open journal")
+	}
+	defer journal.Close()
+
+	period := start.Add(time.Minute)
+	first := dump.ChunkMeta{Source: dump.ClickHouse, Start: &period, End: &period, StartKey: "A", EndKey: "M", Index: 1}
+	second := dump.ChunkMeta{Source: dump.ClickHouse, Start: &period, End: &period, StartKey: "M", EndKey: "Z", Index: 1}
+	if err = journal.Add(&dump.Chunk{ChunkMeta: first, Filename: "1.tsv"}, dump.ManifestChunk{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !journal.Done(first) {
+		t.Fatal("recorded chunk should be done")
+	}
+	if journal.Done(second) {
+		t.Fatal("chunk with other keyset bounds shouldn't be done")
+	}
+}
+
+func TestJournalQANChunks(t *testing.T) {
+	end := time.Now().UTC().Truncate(time.Minute)
+	start := end.Add(-time.Hour)
+	dumpPath := filepath.Join(t.TempDir(), "dump.tar.gz")
+	journal, err := OpenJournal(dumpPath, "export", start, end)
+	if err != nil {
+		t.Fatal(err, "failed to open journal")
+	}
+	if _, planned := journal.QANChunks(); planned {
+		t.Fatal("new journal shouldn't have planned chunks")
+	}
+
+	period := start.Add(time.Minute)
+	chunks := []dump.ChunkMeta{
+		{Source: dump.ClickHouse, Start: &start, End: &period, EndKey: "M", Index: 0, RowsLen: 10},
+		{Source: dump.ClickHouse, Start: &period, End: &end, StartKey: "M", Index: 1, RowsLen: 7},
+	}
+	if err = journal.SetQANChunks(chunks); err != nil {
+		t.Fatal(err, "failed to set planned chunks")
+	}
+	if err = journal.Add(&dump.Chunk{ChunkMeta: chunks[0], Filename: "0.tsv"}, dump.ManifestChunk{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = journal.SetQANChunks(chunks); err == nil {
+		t.Fatal("planned chunks shouldn't be replaced after export started")
+	}
+	if err = journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resumed export gets the same plan even if the rows count has changed since then
+	journal, err = OpenJournal(dumpPath, "export", start, end)
+	if err != nil {
+		t.Fatal(err, "failed to reopen journal")
+	}
+	defer journal.Close()
+	resumed, planned := journal.QANChunks()
+	if !planned || len(resumed) != len(chunks) {
+		t.Fatalf("expected %d planned chunks, got %v", len(chunks), resumed)
+	}
+	for i, c := range resumed {
+		if journalKey(c) != journalKey(chunks[i]) || c.RowsLen != chunks[i].RowsLen {
+			t.Fatalf("expected chunk %+v, got %+v", chunks[i], c)
+		}
+	}
+	if !journal.Done(resumed[0]) || journal.Done(resumed[1]) {
+		t.Fatal("only the first planned chunk should be done")
+	}
+}
+
+func TestExportCompression(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		compression dump.Compression
+		level       int
+		shouldErr   bool
+	}{
+		{name: "gzip", compression: dump.GzipCompression},
+		{name: "gzip best speed", compression: dump.GzipCompression, level: 1},
+		{name: "zstd", compression: dump.ZstdCompression},
+		{name: "zstd best compression", compression: dump.ZstdCompression, level: 19},
+		{name: "none", compression: dump.NoCompression},
+		{name: "invalid level", compression: dump.GzipCompression, level: 10, shouldErr: true},
+		{name: "level without compression", compression: dump.NoCompression, level: 1, shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.shouldErr {
+				if err := tt.compression.ValidateLevel(tt.level); err == nil {
+					t.Fatal("error is empty")
+				}
+				return
+			}
+
+			chunks := prepareFakeChunks(time.Now().Add(-time.Hour), time.Now(), time.Minute, dump.VictoriaMetrics)
+			pool, err := dump.NewChunkPool(chunks)
+			if err != nil {
+				t.Fatal(err, "failed to create new chunk pool")
+			}
+
+			buf := new(bytes.Buffer)
+			tr := Transferer{
+				sources:      []dump.Source{&fakeSource{sourceType: dump.VictoriaMetrics}},
+				workersCount: 2,
+				file:         buf,
+			}
+			tr.SetCompression(tt.compression, tt.level)
+			err = tr.Export(ctx, fakeStatusGetter{status: LoadStatusOK, count: new(int)}, dump.Meta{}, pool, new(dump.LogBuffer), nil)
+			if err != nil {
+				t.Fatal(err, "failed to export")
+			}
+
+			detected, err := dump.DetectCompression(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+			if err != nil {
+				t.Fatal(err, "failed to detect compression")
+			}
+			if detected != tt.compression {
+				t.Fatalf("expected %s compression, got %s", tt.compression, detected)
+			}
+
+			source := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+			tr = Transferer{
+				sources:      []dump.Source{source},
+				workersCount: 1,
+				file:         buf,
+			}
+			if err = tr.Import(ctx, dump.Meta{}, nil); err != nil {
+				t.Fatal(err, "failed to import")
+			}
+			if len(source.written) != len(chunks) {
+				t.Fatalf("expected %d imported chunks, got %d", len(chunks), len(source.written))
+			}
+		})
+	}
+}
+
+func TestExportEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := prepareFakeChunks(time.Now().Add(-time.Hour), time.Now(), time.Minute, dump.VictoriaMetrics)
+	pool, err := dump.NewChunkPool(chunks)
+	if err != nil {
+		t.Fatal(err, "failed to create new chunk pool")
+	}
+
+	buf := new(bytes.Buffer)
+	tr := Transferer{
+		sources:      []dump.Source{&fakeSource{sourceType: dump.VictoriaMetrics}},
+		workersCount: 2,
+		file:         buf,
+	}
+	tr.SetEncryption([]age.Recipient{identity.Recipient()}, true)
+	err = tr.Export(ctx, fakeStatusGetter{status: LoadStatusOK, count: new(int)}, dump.Meta{PMMServerVersion: "2.38.0"}, pool, new(dump.LogBuffer), nil)
+	if err != nil {
+		t.Fatal(err, "failed to export")
+	}
+
+	meta, err := dump.ReadClearMeta(bytes.NewReader(buf.Bytes()))
+	if err != nil || meta.PMMServerVersion != "2.38.0" {
+		t.Fatalf("failed to read meta in clear: %v, %v", meta, err)
+	}
+
+	if _, _, err = ReadMetaAndCheckManifest(bytes.NewReader(buf.Bytes())); !errors.Is(err, dump.ErrEncrypted) {
+		t.Fatalf("reading encrypted dump without identity should fail with ErrEncrypted, got %v", err)
+	}
+
+	source := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+	tr = Transferer{
+		sources:      []dump.Source{source},
+		workersCount: 1,
+		file:         buf,
+	}
+	tr.SetIdentities([]age.Identity{identity})
+	if err = tr.Import(ctx, dump.Meta{}, nil); err != nil {
+		t.Fatal(err, "failed to import")
+	}
+	if len(source.written) != len(chunks) {
+		t.Fatalf("expected %d imported chunks, got %d", len(chunks), len(source.written))
+	}
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestExportSplit(t *testing.T) {
+	ctx := context.Background()
+
+	chunks := prepareFakeChunks(time.Now().Add(-5*time.Hour), time.Now(), time.Minute, dump.VictoriaMetrics)
+	pool, err := dump.NewChunkPool(chunks)
+	if err != nil {
+		t.Fatal(err, "failed to create new chunk pool")
+	}
+
+	const splitSize = 128 * 1024
+	var parts []*bytes.Buffer
+	tr := Transferer{
+		sources:      []dump.Source{&fakeSource{sourceType: dump.VictoriaMetrics}},
+		workersCount: 2,
+	}
+	tr.SetCompression(dump.NoCompression, 0)
+	tr.SetSplit(splitSize, func(number int) (io.WriteCloser, error) {
+		if number != len(parts)+1 {
+			t.Fatalf("expected part %d, got %d", len(parts)+1, number)
+		}
+		buf := new(bytes.Buffer)
+		parts = append(parts, buf)
+		return nopCloser{buf}, nil
+	})
+
+	// Readers keep logging to the dump log, while the writer measures it to split the dump.
+	// Log is sampled, so it's much less than the split size
+	logBuffer := new(dump.LogBuffer)
+	logger := log.Logger
+	log.Logger = log.Logger.Level(zerolog.DebugLevel).Sample(&zerolog.BasicSampler{N: 50}).Output(logBuffer)
+	defer func() {
+		log.Logger = logger
+	}()
+
+	err = tr.Export(ctx, fakeStatusGetter{status: LoadStatusOK, count: new(int)}, dump.Meta{}, pool, logBuffer, nil)
+	if err != nil {
+		t.Fatal(err, "failed to export")
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %d", len(parts))
+	}
+
+	source := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+	for i, part := range parts {
+		if part.Len() > splitSize {
+			t.Fatalf("part %d exceeds split size: %d bytes", i+1, part.Len())
+		}
+		meta, _, err := ReadMetaAndCheckManifest(bytes.NewReader(part.Bytes()))
+		if err != nil {
+			t.Fatal(err, "failed to check part")
+		}
+		if meta.Part != i+1 {
+			t.Fatalf("expected part %d in meta, got %d", i+1, meta.Part)
+		}
+
+		tr = Transferer{
+			sources:      []dump.Source{source},
+			workersCount: 1,
+			file:         part,
+		}
+		if err = tr.Import(ctx, dump.Meta{}, nil); err != nil {
+			t.Fatal(err, "failed to import")
+		}
+	}
+	if len(source.written) != len(chunks) {
+		t.Fatalf("expected %d imported chunks, got %d", len(chunks), len(source.written))
+	}
+}
+
+func TestExportRetry(t *testing.T) {
+	end := time.Now().UTC().Truncate(time.Minute)
+	chunks := prepareFakeChunks(end.Add(-10*time.Minute), end, time.Minute, dump.VictoriaMetrics)
+	pool, err := dump.NewChunkPool(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &flakySource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+	file := new(bytes.Buffer)
+	tr := Transferer{
+		sources:      []dump.Source{source},
+		workersCount: 1,
+		file:         file,
+	}
+	tr.SetRetryPolicy(retry.Policy{MaxAttempts: 2, Backoff: time.Millisecond})
+	if err = tr.Export(context.Background(), fakeStatusGetter{status: LoadStatusOK, count: new(int)}, dump.Meta{}, pool, new(dump.LogBuffer), nil); err != nil {
+		t.Fatal(err, "export should succeed after retries")
+	}
+	expected := retry.Stats{Retries: int64(len(chunks)), Recovered: int64(len(chunks))}
+	if stats := tr.retrier.Stats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	meta, _, err := ReadMetaAndCheckManifest(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err, "failed to read meta")
+	}
+	if meta.Retries == nil || *meta.Retries != (dump.RetryStats{Retries: expected.Retries, Recovered: expected.Recovered, Failed: expected.Failed}) {
+		t.Fatalf("expected %+v in meta, got %+v", expected, meta.Retries)
+	}
+}
+
+func TestExportAdaptive(t *testing.T) {
+	ctx := context.Background()
+	end := time.Now().UTC().Truncate(time.Minute)
+	chunks := prepareFakeChunks(end.Add(-8*time.Minute), end.Add(-time.Minute), 4*time.Minute, dump.VictoriaMetrics)
+	pool, err := dump.NewChunkPool(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := new(bytes.Buffer)
+	tr := Transferer{
+		sources:      []dump.Source{&fakeSource{sourceType: dump.VictoriaMetrics}},
+		workersCount: 2,
+		file:         file,
+	}
+	adaptive := &splittingPool{ChunkPool: pool, maxRange: time.Minute}
+	if err = tr.Export(ctx, fakeStatusGetter{status: LoadStatusOK, count: new(int)}, dump.Meta{}, adaptive, new(dump.LogBuffer), nil); err != nil {
+		t.Fatal(err, "failed to export")
+	}
+
+	source := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+	tr = Transferer{
+		sources:      []dump.Source{source},
+		workersCount: 1,
+		file:         file,
+	}
+	if err = tr.Import(ctx, dump.Meta{}, nil); err != nil {
+		t.Fatal(err, "failed to import")
+	}
+	expected := prepareFakeChunks(end.Add(-8*time.Minute), end.Add(-time.Minute), time.Minute, dump.VictoriaMetrics)
+	if len(source.written) != len(expected) {
+		t.Fatalf("expected %d chunks, got %d: %v", len(expected), len(source.written), source.written)
+	}
+	for _, m := range expected {
+		if _, ok := source.written[m.String()+".bin"]; !ok {
+			t.Fatalf("chunk %s is missing", m)
+		}
+	}
+}
+
+// splittingPool replaces chunks longer than maxRange by their halves
+type splittingPool struct {
+	*dump.ChunkPool
+	maxRange time.Duration
+}
+
+func (p *splittingPool) Feedback(m dump.ChunkMeta, _ *dump.Chunk, _ time.Duration, _ error) bool {
+	if m.End.Sub(*m.Start) <= p.maxRange {
+		return false
+	}
+	mid := m.Start.Add(m.End.Sub(*m.Start) / 2)
+	p.Insert(dump.ChunkMeta{Source: m.Source, Start: m.Start, End: &mid}, dump.ChunkMeta{Source: m.Source, Start: &mid, End: m.End})
+	return true
+}
+
+// flakySource fails the first read of every chunk with connection reset
+type flakySource struct {
+	fakeSource
+	failed map[string]bool
+}
+
+func (s *flakySource) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
+	if s.failed == nil {
+		s.failed = make(map[string]bool)
+	}
+	if !s.failed[m.String()] {
+		s.failed[m.String()] = true
+		return nil, errors.Wrap(syscall.ECONNRESET, "failed to send HTTP request")
+	}
+	return s.fakeSource.ReadChunk(m)
+}
+
+type failingSource struct {
+	fakeSource
+	failAfter int
+	read      int
+}
+
+func (s *failingSource) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
+	if s.read >= s.failAfter {
+		return nil, errors.New("connection reset")
+	}
+	s.read++
+	return s.fakeSource.ReadChunk(m)
+}
+
 type fakeStatusGetter struct {
 	status          LoadStatus
 	count           *int
@@ -148,7 +655,12 @@ type fakeStatusGetter struct {
 	statusAfterWait LoadStatus
 }
 
+// fakeStatusMu guards counters of fakeStatusGetter shared by the reading goroutines
+var fakeStatusMu sync.Mutex
+
 func (g fakeStatusGetter) GetLatestStatus() (LoadStatus, int) {
+	fakeStatusMu.Lock()
+	defer fakeStatusMu.Unlock()
 	defer func() {
 		*g.count++
 	}()
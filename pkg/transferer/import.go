@@ -3,8 +3,8 @@ package transferer
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"path"
 
@@ -13,19 +13,40 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics/native"
 )
 
-func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
+// ErrIncompatibleNativeRevision is returned by import if native blocks of the dump can't be read by VictoriaMetrics of PMM
+var ErrIncompatibleNativeRevision = errors.New("incompatible VictoriaMetrics native format revision")
+
+// CheckNativeRevision returns ErrIncompatibleNativeRevision if native blocks of the revision can't be read by VictoriaMetrics accepting the target one.
+// Unknown revisions always pass
+func CheckNativeRevision(rev, target native.Revision) error {
+	if rev == native.RevisionUnknown || target == native.RevisionUnknown || rev == target {
+		return nil
+	}
+	return errors.Wrapf(ErrIncompatibleNativeRevision, "dump has %s blocks, but VictoriaMetrics of PMM accepts %s blocks", rev, target)
+}
+
+// Import reads chunks from the dump file and writes them to the sources. If the import state is provided,
+// chunks recorded in it are skipped and every successfully written chunk is added to it.
+// Chunks are checked against the dump manifest, import fails if any chunk is missing or modified. Chunks are checked
+// before they are written if the manifest is set by SetManifest, otherwise only after the manifest at the end of the dump is read.
+// If the native revision is set, import fails before writing VictoriaMetrics chunks of another revision, but chunks of other sources
+// could be already written by then, so the dump file should be checked with ReadDumpInfo and CheckNativeRevision beforehand.
+func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta, state *ImportState) error {
 	log.Info().Msg("Importing metrics...")
-	gzr, err := gzip.NewReader(t.file)
+	dr, err := dump.NewDecompressReader(t.file, t.identities...)
 	if err != nil {
-		return errors.Wrap(err, "failed to open as gzip")
+		return errors.Wrap(err, "failed to open dump")
 	}
-	defer gzr.Close()
+	defer dr.Close()
 
-	tr := tar.NewReader(gzr)
+	tr := tar.NewReader(dr)
 
-	var metafileExists bool
+	var metafileExists, revisionChecked bool
+	mc := newManifestChecker()
+	mc.useManifest(t.manifest)
 
 	chunksC := make(chan *dump.Chunk, maxChunksInMem)
 
@@ -33,7 +54,7 @@ func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
 	for i := 0; i < t.workersCount; i++ {
 		g.Go(func() error {
 			defer log.Debug().Msgf("Exiting from write chunks goroutine")
-			if err := t.writeChunksToSource(gCtx, chunksC); err != nil {
+			if err := t.writeChunksToSource(gCtx, chunksC, state); err != nil {
 				return errors.Wrap(err, "failed to write chunks to source")
 			}
 			return nil
@@ -66,12 +87,20 @@ func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
 			continue
 		}
 
+		if len(dir) == 0 && filename == dump.ManifestFilename {
+			if t.manifest != nil {
+				continue
+			}
+			if err := mc.setManifest(tr); err != nil {
+				return errors.Wrap(err, "corrupted dump")
+			}
+			continue
+		}
+
 		if len(dir) == 0 {
 			return errors.Errorf("corrupted dump: found unknown file %s", filename)
 		}
 
-		log.Info().Msgf("Processing chunk '%s'...", header.Name)
-
 		st := dump.ParseSourceType(dir[:len(dir)-1])
 		if st == dump.UndefinedSource {
 			return errors.Errorf("corrupted dump: found undefined source: %s", dir)
@@ -81,12 +110,37 @@ func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
 		if err != nil {
 			return errors.Wrap(err, "failed to read chunk content")
 		}
+		mc.addChunk(header.Name, content)
+		if err := mc.checkChunk(header.Name, content); err != nil {
+			return errors.Wrap(err, "corrupted dump")
+		}
+
+		if state != nil && state.Done(header.Name) {
+			log.Info().Msgf("Chunk '%s' was already imported, skipping", header.Name)
+			continue
+		}
+
+		log.Info().Msgf("Processing chunk '%s'...", header.Name)
 
 		if len(content) == 0 {
 			log.Warn().Msgf("Chunk '%s' is empty, skipping", header.Name)
 			continue
 		}
 
+		if st == dump.VictoriaMetrics && !revisionChecked && t.nativeRevision != native.RevisionUnknown {
+			rev, err := vmChunkRevision(content)
+			if err != nil {
+				return errors.Wrapf(err, "failed to detect native format revision of chunk %s", header.Name)
+			}
+			if rev != native.RevisionUnknown {
+				if err := CheckNativeRevision(rev, t.nativeRevision); err != nil {
+					return err
+				}
+				log.Debug().Msgf("Native format revision of the dump is %s", rev)
+				revisionChecked = true
+			}
+		}
+
 		ch := &dump.Chunk{
 			ChunkMeta: dump.ChunkMeta{
 				Source: st,
@@ -108,7 +162,9 @@ func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
 	}
 
 	close(chunksC)
-	if err := g.Wait(); err != nil {
+	err = g.Wait()
+	t.logRetries()
+	if err != nil {
 		log.Debug().Msg("Got error, finishing import")
 		return err
 	}
@@ -117,6 +173,14 @@ func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
 		log.Error().Msg("No meta file found in dump. No version checks performed")
 	}
 
+	if mc.hasManifest() {
+		if err = mc.check(); err != nil {
+			return err
+		}
+	} else {
+		log.Warn().Msg("No manifest found in dump. Chunks checksums weren't verified")
+	}
+
 	log.Debug().Msg("Finalizing writes...")
 
 	for _, s := range t.sources {
@@ -125,12 +189,18 @@ func (t Transferer) Import(ctx context.Context, runtimeMeta dump.Meta) error {
 		}
 	}
 
+	if state != nil {
+		if err = state.Remove(); err != nil {
+			return errors.Wrap(err, "failed to remove import state")
+		}
+	}
+
 	log.Info().Msg("Successfully imported!")
 
 	return nil
 }
 
-func (t Transferer) writeChunksToSource(ctx context.Context, chunkC <-chan *dump.Chunk) error {
+func (t Transferer) writeChunksToSource(ctx context.Context, chunkC <-chan *dump.Chunk, state *ImportState) error {
 	for {
 		log.Debug().Msg("New chunks writing loop iteration has been started")
 
@@ -151,10 +221,39 @@ func (t Transferer) writeChunksToSource(ctx context.Context, chunkC <-chan *dump
 				continue
 			}
 
+			name := path.Join(c.Source.String(), c.Filename)
+			reconciler, _ := s.(ChunkReconciler)
+			// Chunk is reconciled if its previous attempt could be written despite the error
+			unsure := state != nil && state.Pending(name)
+			if state != nil {
+				if err := state.Begin(name); err != nil {
+					return errors.Wrap(err, "failed to update import state")
+				}
+			}
+
 			log.Debug().Msgf("Writing chunk '%v' to the source...", c.Filename)
-			if err := s.WriteChunk(c.Filename, bytes.NewBuffer(c.Content)); err != nil {
+			err := t.retrier.Do(ctx, fmt.Sprintf("writing chunk %s", name), func() error {
+				if unsure && reconciler != nil {
+					written, err := reconciler.ChunkWritten(bytes.NewReader(c.Content))
+					if err != nil {
+						return errors.Wrapf(err, "failed to check if chunk %s was written", name)
+					}
+					if written {
+						log.Info().Msgf("Chunk '%s' was written by the previous attempt, skipping", name)
+						return nil
+					}
+				}
+				unsure = true
+				return s.WriteChunk(c.Filename, bytes.NewBuffer(c.Content))
+			})
+			if err != nil {
 				return errors.Wrap(err, "failed to write chunk")
 			}
+			if state != nil {
+				if err := state.Add(name); err != nil {
+					return errors.Wrap(err, "failed to update import state")
+				}
+			}
 			log.Info().Msgf("Successfully processed '%v'", c.Filename)
 		}
 	}
@@ -8,11 +8,16 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics/native"
 )
 
 func TestImport(t *testing.T) {
@@ -115,7 +120,7 @@ func TestImport(t *testing.T) {
 					file:         buf,
 				}
 				meta := dump.Meta{}
-				err := tr.Import(ctx, meta)
+				err := tr.Import(ctx, meta, nil)
 				if err != nil {
 					if tt.shouldErr {
 						return
@@ -130,6 +135,299 @@ func TestImport(t *testing.T) {
 	}
 }
 
+func TestImportResume(t *testing.T) {
+	ctx := context.Background()
+
+	dumpPath := filepath.Join(t.TempDir(), "dump.tar.gz")
+	if err := os.WriteFile(dumpPath, fakeFileData(t, fakeFileOpts{}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, manifest, err := ReadMetaAndManifest(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := DumpChecksum(meta, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importDump := func(source dump.Source) error {
+		state, err := OpenImportState(dumpPath, "http://pmm", checksum)
+		if err != nil {
+			t.Fatal(err, "failed to open import state")
+		}
+		defer state.Close()
+
+		file, err := os.Open(dumpPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		tr := Transferer{
+			sources:      []dump.Source{source},
+			workersCount: 1,
+			file:         file,
+		}
+		return tr.Import(ctx, dump.Meta{}, state)
+	}
+
+	first := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}, failAfter: 4}
+	if err := importDump(first); err == nil {
+		t.Fatal("interrupted import should fail")
+	}
+
+	if _, err := OpenImportState(dumpPath, "http://another-pmm", checksum); err == nil {
+		t.Fatal("import state should be bound to PMM URL")
+	}
+
+	second := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+	if err := importDump(second); err != nil {
+		t.Fatal(err, "failed to resume import")
+	}
+	if _, err := os.Stat(dumpPath + ImportStateSuffix); !os.IsNotExist(err) {
+		t.Fatal("import state should be removed after successful import")
+	}
+
+	for filename := range first.written {
+		if _, ok := second.written[filename]; ok {
+			t.Fatalf("chunk %s was imported twice", filename)
+		}
+	}
+	if total := len(first.written) + len(second.written); total != 10 {
+		t.Fatalf("expected 10 imported chunks, got %d", total)
+	}
+}
+
+func TestImportStateReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	dumpPath := filepath.Join(t.TempDir(), "dump.tar.gz")
+	content := fakeDump(t, []fakeEntry{
+		{"ch/0.tsv", []byte("1\ta\n")},
+		{"ch/1.tsv", []byte("2\tb\n")},
+	})
+	if err := os.WriteFile(dumpPath, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := OpenImportState(dumpPath, "http://pmm", "another-checksum")
+	if err != nil {
+		t.Fatal(err, "failed to open import state")
+	}
+	if err = state.Add("ch/0.tsv"); err != nil {
+		t.Fatal(err)
+	}
+	if err = state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous import was killed after ch/0.tsv was inserted, but before it was recorded as done,
+	// and while ch/1.tsv was being inserted
+	if state, err = OpenImportState(dumpPath, "http://pmm", "checksum"); err != nil {
+		t.Fatal(err, "failed to open import state")
+	}
+	if state.Done("ch/0.tsv") {
+		t.Fatal("state of another dump should be discarded")
+	}
+	for _, name := range []string{"ch/0.tsv", "ch/1.tsv"} {
+		if err = state.Begin(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err = OpenImportState(dumpPath, "http://pmm", "checksum"); err != nil {
+		t.Fatal(err, "failed to reopen import state")
+	}
+	if !state.Pending("ch/0.tsv") || !state.Pending("ch/1.tsv") || state.Done("ch/0.tsv") {
+		t.Fatal("interrupted chunks should be pending")
+	}
+
+	source := &reconcilingSource{
+		recordingSource: recordingSource{fakeSource: fakeSource{sourceType: dump.ClickHouse}},
+		inserted:        map[string]bool{"1\ta\n": true},
+	}
+	tr := Transferer{
+		sources:      []dump.Source{source},
+		workersCount: 1,
+		file:         bytes.NewBuffer(content),
+	}
+	if err = tr.Import(ctx, dump.Meta{}, state); err != nil {
+		t.Fatal(err, "failed to resume import")
+	}
+	if _, ok := source.written["0.tsv"]; ok {
+		t.Fatal("chunk written by the interrupted import was inserted twice")
+	}
+	if _, ok := source.written["1.tsv"]; !ok {
+		t.Fatal("pending chunk, which wasn't written, should be imported")
+	}
+}
+
+func TestImportManifest(t *testing.T) {
+	ctx := context.Background()
+
+	chunk := []byte("1\ta\n")
+	tampered := []byte("1\tb\n")
+	valid := dump.ManifestChunk{Filename: "ch/0.tsv", Source: "ch", Size: int64(len(chunk)), SHA256: checksum(chunk)}
+	missing := dump.ManifestChunk{Filename: "ch/1.tsv", Source: "ch", Size: int64(len(chunk)), SHA256: checksum(chunk)}
+
+	tests := []struct {
+		name      string
+		files     []fakeEntry
+		shouldErr bool
+	}{
+		{
+			name: "valid",
+			files: []fakeEntry{
+				{"ch/0.tsv", chunk},
+				{dump.ManifestFilename, manifestContent(t, valid)},
+			},
+		},
+		{
+			name: "without manifest",
+			files: []fakeEntry{
+				{"ch/0.tsv", chunk},
+			},
+		},
+		{
+			name: "tampered chunk",
+			files: []fakeEntry{
+				{"ch/0.tsv", tampered},
+				{dump.ManifestFilename, manifestContent(t, valid)},
+			},
+			shouldErr: true,
+		},
+		{
+			name: "missing chunk",
+			files: []fakeEntry{
+				{"ch/0.tsv", chunk},
+				{dump.ManifestFilename, manifestContent(t, valid, missing)},
+			},
+			shouldErr: true,
+		},
+		{
+			name: "unlisted chunk",
+			files: []fakeEntry{
+				{"ch/0.tsv", chunk},
+				{"ch/1.tsv", chunk},
+				{dump.ManifestFilename, manifestContent(t, valid)},
+			},
+			shouldErr: true,
+		},
+		{
+			name: "invalid manifest",
+			files: []fakeEntry{
+				{"ch/0.tsv", chunk},
+				{dump.ManifestFilename, []byte("invalid")},
+			},
+			shouldErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := Transferer{
+				sources:      []dump.Source{&fakeSource{sourceType: dump.ClickHouse}},
+				workersCount: 1,
+				file:         bytes.NewBuffer(fakeDump(t, tt.files)),
+			}
+			err := tr.Import(ctx, dump.Meta{}, nil)
+			if tt.shouldErr && err == nil {
+				t.Fatal("there was no err")
+			}
+			if !tt.shouldErr && err != nil {
+				t.Fatal(err, "failed to import")
+			}
+		})
+	}
+}
+
+func TestImportPreReadManifest(t *testing.T) {
+	ctx := context.Background()
+
+	chunk := []byte("1\ta\n")
+	tampered := []byte("1\tb\n")
+	first := dump.ManifestChunk{Filename: "ch/0.tsv", Source: "ch", Size: int64(len(chunk)), SHA256: checksum(chunk)}
+	second := dump.ManifestChunk{Filename: "ch/1.tsv", Source: "ch", Size: int64(len(chunk)), SHA256: checksum(chunk)}
+
+	content := fakeDump(t, []fakeEntry{
+		{"ch/0.tsv", tampered},
+		{"ch/1.tsv", chunk},
+		{dump.ManifestFilename, manifestContent(t, first, second)},
+	})
+	meta, manifest, err := ReadMetaAndManifest(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err, "chunks of the same size should pass pre-read")
+	}
+	if meta != nil || manifest == nil || len(manifest.Chunks) != 2 {
+		t.Fatalf("expected manifest of 2 chunks without meta, got %+v and %+v", meta, manifest)
+	}
+
+	source := &recordingSource{fakeSource: fakeSource{sourceType: dump.ClickHouse}}
+	tr := Transferer{
+		sources:      []dump.Source{source},
+		workersCount: 1,
+		file:         bytes.NewBuffer(content),
+	}
+	tr.SetManifest(manifest)
+	if err = tr.Import(ctx, dump.Meta{}, nil); err == nil {
+		t.Fatal("import of tampered chunk should fail")
+	}
+	if len(source.written) != 0 {
+		t.Fatalf("tampered chunk was written before the check: %v", source.written)
+	}
+
+	missing := fakeDump(t, []fakeEntry{
+		{"ch/0.tsv", chunk},
+		{dump.ManifestFilename, manifestContent(t, first, second)},
+	})
+	if _, _, err = ReadMetaAndManifest(bytes.NewReader(missing)); err == nil {
+		t.Fatal("pre-read should find missing chunk")
+	}
+}
+
+type recordingSource struct {
+	fakeSource
+	failAfter int
+	written   map[string]struct{}
+}
+
+func (s *recordingSource) WriteChunk(filename string, r io.Reader) error {
+	if s.written == nil {
+		s.written = make(map[string]struct{})
+	}
+	if s.failAfter > 0 && len(s.written) >= s.failAfter {
+		return errors.New("connection reset")
+	}
+	if err := s.fakeSource.WriteChunk(filename, r); err != nil {
+		return err
+	}
+	s.written[filename] = struct{}{}
+	return nil
+}
+
+// reconcilingSource reports chunks with the inserted content as written
+type reconcilingSource struct {
+	recordingSource
+	inserted map[string]bool
+}
+
+func (s *reconcilingSource) ChunkWritten(r io.Reader) (bool, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	return s.inserted[string(content)], nil
+}
+
 func fakeFileData(t *testing.T, opts fakeFileOpts) []byte {
 	buf := new(bytes.Buffer)
 	writeFakeFile(t, buf, opts)
@@ -184,7 +482,7 @@ func writeFakeFile(t *testing.T, w io.Writer, opts fakeFileOpts) {
 		}
 	}
 
-	if err = writeLog(tw, bytes.NewBuffer([]byte("logs"))); err != nil {
+	if err = writeLog(tw, []byte("logs")); err != nil {
 		t.Fatal(err)
 	}
 
@@ -265,3 +563,96 @@ type fakeFileOpts struct {
 	withUndefinedSource bool
 	withoutMetafile     bool
 }
+
+func TestReadDumpInfoNativeRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []fakeEntry
+		expected native.Revision
+	}{
+		{
+			name: "after clickhouse chunk",
+			entries: []fakeEntry{
+				{"ch/0.tsv", []byte("1\ta\n")},
+				{"vm/1-2.bin", nativeChunk(t, native.RevisionV1)},
+			},
+			expected: native.RevisionV1,
+		},
+		{
+			name: "after empty chunk",
+			entries: []fakeEntry{
+				{"vm/1-2.bin", gzipData(t, nil)},
+				{"vm/2-3.bin", nativeChunk(t, native.RevisionV2)},
+			},
+			expected: native.RevisionV2,
+		},
+		{
+			name: "json",
+			entries: []fakeEntry{
+				{"vm/1-2.json", gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}`))},
+			},
+			expected: native.RevisionUnknown,
+		},
+		{
+			name:     "without vm chunks",
+			entries:  []fakeEntry{{"ch/0.tsv", []byte("1\ta\n")}},
+			expected: native.RevisionUnknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ReadDumpInfo(bytes.NewReader(fakeDump(t, tt.entries)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.NativeRevision != tt.expected {
+				t.Fatalf("expected revision %s, got %s", tt.expected, info.NativeRevision)
+			}
+		})
+	}
+}
+
+func TestImportNativeRevision(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunk     []byte
+		target    native.Revision
+		shouldErr bool
+	}{
+		{name: "same revision", chunk: nativeChunk(t, native.RevisionV2), target: native.RevisionV2},
+		{name: "older revision", chunk: nativeChunk(t, native.RevisionV1), target: native.RevisionV2, shouldErr: true},
+		{name: "newer revision", chunk: nativeChunk(t, native.RevisionV2), target: native.RevisionV1, shouldErr: true},
+		{name: "unknown target", chunk: nativeChunk(t, native.RevisionV1)},
+		{name: "json", chunk: gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}`)), target: native.RevisionV1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &recordingSource{fakeSource: fakeSource{sourceType: dump.VictoriaMetrics}}
+			tr := Transferer{
+				sources:      []dump.Source{source},
+				workersCount: 1,
+				file: bytes.NewBuffer(fakeDump(t, []fakeEntry{
+					{"vm/1-2.bin", tt.chunk},
+					{"vm/2-3.bin", tt.chunk},
+				})),
+			}
+			tr.SetNativeRevision(tt.target)
+			err := tr.Import(context.Background(), dump.Meta{}, nil)
+			if tt.shouldErr {
+				if !errors.Is(err, ErrIncompatibleNativeRevision) {
+					t.Fatalf("expected ErrIncompatibleNativeRevision, got %v", err)
+				}
+				if len(source.written) != 0 {
+					t.Fatalf("no chunks should be written, got %v", source.written)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(source.written) != 2 {
+				t.Fatalf("expected 2 written chunks, got %v", source.written)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package transferer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+)
+
+const ImportStateSuffix = ".import-state"
+
+// ImportState is a sidecar file of the dump, which records chunks that were successfully written to the sources,
+// so the interrupted import could be resumed without sending the same chunks again. Chunk is also recorded as pending
+// before it's written, so the chunk interrupted in the middle of writing could be reconciled with the source on resume.
+type ImportState struct {
+	mu sync.Mutex
+
+	file    *os.File
+	header  importStateHeader
+	done    map[string]struct{}
+	pending map[string]struct{}
+}
+
+type importStateHeader struct {
+	Checksum string `json:"checksum"`
+	PMMURL   string `json:"pmm-url"`
+}
+
+type importStateEntry struct {
+	Filename string `json:"filename"`
+	Pending  bool   `json:"pending,omitempty"`
+}
+
+// DumpChecksum identifies the dump by its manifest, which lists checksums of all the chunks, or by meta of the older dump without it.
+// It's calculated without reading the chunks again
+func DumpChecksum(meta *dump.Meta, manifest *dump.Manifest) (string, error) {
+	var v interface{}
+	switch {
+	case manifest != nil:
+		v = manifest
+	case meta != nil:
+		v = meta
+	default:
+		return "", errors.New("dump has neither manifest nor meta")
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal dump manifest or meta")
+	}
+	return checksum(content), nil
+}
+
+// OpenImportState opens import state of the dump or creates a new one. The state is bound to the dump checksum:
+// state of the changed dump is discarded. Importing the dump into another PMM is refused until the state is removed.
+func OpenImportState(dumpPath, pmmURL, checksum string) (*ImportState, error) {
+	path := dumpPath + ImportStateSuffix
+
+	s := &ImportState{
+		header: importStateHeader{
+			Checksum: checksum,
+			PMMURL:   pmmURL,
+		},
+		done:    make(map[string]struct{}),
+		pending: make(map[string]struct{}),
+	}
+
+	content, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, s.create(path)
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to read import state")
+	}
+
+	header, err := s.parse(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse import state %s", path)
+	}
+
+	if header.Checksum != checksum {
+		log.Warn().Msgf("Import state %s belongs to another dump (checksum %s). Starting import from the beginning", path, header.Checksum)
+		s.done = make(map[string]struct{})
+		s.pending = make(map[string]struct{})
+		return s, s.create(path)
+	}
+
+	if header.PMMURL != pmmURL {
+		return nil, errors.Errorf("import state %s was recorded for import into %s. Remove it to import the dump into %s",
+			path, header.PMMURL, pmmURL)
+	}
+
+	if s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, errors.Wrap(err, "failed to open import state")
+	}
+
+	log.Info().Msgf("Found import state %s: %d chunks were already imported", path, len(s.done))
+
+	return s, nil
+}
+
+func (s *ImportState) create(path string) error {
+	log.Debug().Msgf("Creating new import state %s", path)
+
+	var err error
+	if s.file, err = os.Create(path); err != nil {
+		return errors.Wrap(err, "failed to create import state")
+	}
+	if err = s.writeLine(s.header); err != nil {
+		return errors.Wrap(err, "failed to write import state header")
+	}
+	return nil
+}
+
+func (s *ImportState) parse(content []byte) (importStateHeader, error) {
+	var header importStateHeader
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	if !scanner.Scan() {
+		return header, errors.New("import state is empty")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, errors.Wrap(err, "failed to unmarshal header")
+	}
+
+	for scanner.Scan() {
+		var e importStateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line could be partially written if the import was killed
+			log.Warn().Msgf("Skipping corrupted import state line: %v", err)
+			break
+		}
+		if e.Pending {
+			s.pending[e.Filename] = struct{}{}
+			continue
+		}
+		s.done[e.Filename] = struct{}{}
+		delete(s.pending, e.Filename)
+	}
+	return header, scanner.Err()
+}
+
+func (s *ImportState) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal import state line")
+	}
+	if _, err = s.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write import state line")
+	}
+	return s.file.Sync()
+}
+
+// Done reports whether the chunk with the given path in the dump was already imported
+func (s *ImportState) Done(filename string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.done[filename]
+	return ok
+}
+
+// Pending reports whether writing of the chunk with the given path in the dump was started, but not finished
+func (s *ImportState) Pending(filename string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.pending[filename]
+	return ok
+}
+
+// Begin records the chunk with the given path in the dump as pending. It must be called before the chunk is written
+func (s *ImportState) Begin(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeLine(importStateEntry{Filename: filename, Pending: true}); err != nil {
+		return err
+	}
+	s.pending[filename] = struct{}{}
+	return nil
+}
+
+// Add records the chunk with the given path in the dump as imported
+func (s *ImportState) Add(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeLine(importStateEntry{Filename: filename}); err != nil {
+		return err
+	}
+	s.done[filename] = struct{}{}
+	delete(s.pending, filename)
+	return nil
+}
+
+// Remove deletes the import state. It should be called after successful import
+func (s *ImportState) Remove() error {
+	if err := s.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close import state")
+	}
+	if err := os.Remove(s.file.Name()); err != nil {
+		return errors.Wrap(err, "failed to remove import state")
+	}
+	return nil
+}
+
+func (s *ImportState) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,98 @@
+package transferer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"time"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/clickhouse/tsv"
+	"pmm-dump/pkg/dump"
+)
+
+const periodStartColumn = "period_start"
+
+// ReadParentDump returns the time up to which every source of the dump parts is exported, so the next incremental
+// export starts after it. VictoriaMetrics data ends with the latest chunk, but not after the end of the export time range,
+// QAN data ends with the latest period_start of its rows. Encrypted dump is decrypted with the identities
+func ReadParentDump(dumpParts []string, identities ...age.Identity) (*dump.ParentDump, error) {
+	if len(dumpParts) == 0 {
+		return nil, errors.New("no dump parts")
+	}
+	meta, err := ReadMetaFromDump(dumpParts[0], false, identities...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read meta")
+	}
+	periodIdx := -1
+	for i, c := range meta.ClickHouseColumns {
+		if c.Name == periodStartColumn {
+			periodIdx = i
+		}
+	}
+
+	parent := new(dump.ParentDump)
+	for _, dumpPart := range dumpParts {
+		err := ReadDumpChunks(dumpPart, func(c *dump.Chunk) error {
+			switch c.Source {
+			case dump.VictoriaMetrics:
+				if c.End != nil && (parent.VMEnd == nil || c.End.After(*parent.VMEnd)) {
+					end := *c.End
+					parent.VMEnd = &end
+				}
+			case dump.ClickHouse:
+				if len(c.Content) == 0 {
+					return nil
+				}
+				if periodIdx < 0 {
+					return errors.Wrap(ErrNoClickHouseColumns, "QAN rows can't be skipped")
+				}
+				latest, err := latestPeriodStart(c.Content, periodIdx)
+				if err != nil {
+					return errors.Wrapf(err, "invalid chunk ch/%s", c.Filename)
+				}
+				if latest != nil && (parent.QANEnd == nil || latest.After(*parent.QANEnd)) {
+					parent.QANEnd = latest
+				}
+			}
+			return nil
+		}, identities...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", dumpPart)
+		}
+	}
+	if parent.VMEnd != nil && meta.End != nil && parent.VMEnd.After(*meta.End) {
+		end := *meta.End
+		parent.VMEnd = &end
+	}
+	return parent, nil
+}
+
+// latestPeriodStart returns the latest period_start of the ClickHouse chunk rows or nil if there are no rows
+func latestPeriodStart(content []byte, periodIdx int) (*time.Time, error) {
+	r := csv.NewReader(bytes.NewReader(content))
+	r.Comma = '\t'
+	r.FieldsPerRecord = -1
+	var latest *time.Time
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return latest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if periodIdx >= len(record) {
+			return nil, errors.Errorf("row has %d values, %s is expected at %d", len(record), periodStartColumn, periodIdx)
+		}
+		periodStart, err := time.Parse(tsv.TimeLayout, record[periodIdx])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", periodStartColumn)
+		}
+		if latest == nil || periodStart.After(*latest) {
+			latest = &periodStart
+		}
+	}
+}
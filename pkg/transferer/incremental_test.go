@@ -0,0 +1,64 @@
+package transferer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestReadParentDump(t *testing.T) {
+	columns := []dump.ClickHouseColumn{{Name: "queryid", Type: "String"}, {Name: "period_start", Type: "DateTime"}}
+	exportEnd := time.Unix(1600000500, 0)
+	dir := t.TempDir()
+	writeDump := func(name string, files []fakeEntry) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, fakeDump(t, files), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	parentPath := writeDump("parent.tar.gz", []fakeEntry{
+		{"vm/1600000000-1600000300.bin", nil},
+		{"vm/1600000300-1600000600.bin", nil},
+		{"ch/0.tsv", []byte("q1\t2020-09-13 12:30:00 +0000 UTC\nq2\t2020-09-13 12:32:00 +0000 UTC\n")},
+		{"ch/1.tsv", []byte("q3\t2020-09-13 12:31:00 +0000 UTC\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{ClickHouseColumns: columns})},
+	})
+	parent, err := ReadParentDump([]string{parentPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.VMEnd == nil || !parent.VMEnd.Equal(time.Unix(1600000600, 0)) {
+		t.Fatalf("unexpected VictoriaMetrics end: %v", parent.VMEnd)
+	}
+	if parent.QANEnd == nil || !parent.QANEnd.Equal(time.Date(2020, 9, 13, 12, 32, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected QAN end: %v", parent.QANEnd)
+	}
+
+	// The last chunk ends after the end of the export, which was in the future at the time
+	cappedPath := writeDump("capped.tar.gz", []fakeEntry{
+		{"vm/1600000300-1600000600.bin", nil},
+		{dump.MetaFilename, metaContent(t, dump.Meta{End: &exportEnd})},
+	})
+	parent, err = ReadParentDump([]string{cappedPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.VMEnd == nil || !parent.VMEnd.Equal(exportEnd) || parent.QANEnd != nil {
+		t.Fatalf("unexpected parent: %+v", parent)
+	}
+
+	noColumnsPath := writeDump("no-columns.tar.gz", []fakeEntry{
+		{"ch/0.tsv", []byte("q1\t2020-09-13 12:30:00 +0000 UTC\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{})},
+	})
+	if _, err = ReadParentDump([]string{noColumnsPath}); !errors.Is(err, ErrNoClickHouseColumns) {
+		t.Fatalf("expected no columns error, got %v", err)
+	}
+}
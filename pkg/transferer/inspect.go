@@ -0,0 +1,291 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// InspectReport describes contents of the dump
+type InspectReport struct {
+	Meta    *dump.Meta      `json:"meta,omitempty"`
+	Parts   int             `json:"parts,omitempty"`
+	Sources []*SourceReport `json:"sources"`
+}
+
+// SourceReport describes chunks of a single source in the dump
+type SourceReport struct {
+	Source string        `json:"source"`
+	Chunks []ChunkReport `json:"chunks"`
+	Size   int64         `json:"size"`
+
+	// Start and End is the time range covered by the chunks, Gaps are the ranges between them not covered by any chunk
+	Start *time.Time  `json:"start,omitempty"`
+	End   *time.Time  `json:"end,omitempty"`
+	Gaps  []TimeRange `json:"gaps,omitempty"`
+
+	Format         string         `json:"format,omitempty"`
+	NativeRevision string         `json:"native-revision,omitempty"`
+	Series         int            `json:"series,omitempty"`
+	Samples        int            `json:"samples,omitempty"`
+	Metrics        []MetricReport `json:"metrics,omitempty"`
+
+	Rows    int `json:"rows,omitempty"`
+	Columns int `json:"columns,omitempty"`
+}
+
+// ChunkReport describes a single chunk of the dump
+type ChunkReport struct {
+	Filename string     `json:"filename"`
+	Part     int        `json:"part,omitempty"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Size     int64      `json:"size"`
+	Series   int        `json:"series,omitempty"`
+	Samples  int        `json:"samples,omitempty"`
+	Rows     int        `json:"rows,omitempty"`
+
+	index int
+}
+
+// MetricReport contains totals of a single metric name across all the chunks
+type MetricReport struct {
+	Name    string `json:"name"`
+	Series  int    `json:"series"`
+	Samples int    `json:"samples"`
+}
+
+type TimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Inspector collects contents of the dump without connecting to PMM. Parts of the split dump are added one by one
+type Inspector struct {
+	identities []age.Identity
+
+	meta    *dump.Meta
+	parts   int
+	sources map[dump.SourceType]*SourceReport
+
+	// series contains unique series labels for every metric name, samples contains samples count for every metric name
+	series  map[string]map[string]struct{}
+	samples map[string]int
+}
+
+// NewInspector creates inspector. Encrypted dump is decrypted with the identities
+func NewInspector(identities ...age.Identity) *Inspector {
+	return &Inspector{
+		identities: identities,
+		sources:    make(map[dump.SourceType]*SourceReport),
+		series:     make(map[string]map[string]struct{}),
+		samples:    make(map[string]int),
+	}
+}
+
+// Add reads the whole dump or the dump part and collects its chunks
+func (i *Inspector) Add(r io.Reader) error {
+	dr, err := dump.NewDecompressReader(r, i.identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dump")
+	}
+	defer dr.Close()
+
+	i.parts++
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file from dump")
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", header.Name)
+		}
+
+		dir, filename := path.Split(header.Name)
+		if dir == "" {
+			if filename == dump.MetaFilename {
+				if err := i.addMeta(content); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		source := dump.ParseSourceType(dir[:len(dir)-1])
+		if source == dump.UndefinedSource {
+			log.Warn().Msgf("Skipping chunk %s of undefined source", header.Name)
+			continue
+		}
+		i.addChunk(source, header.Name, filename, content)
+	}
+}
+
+func (i *Inspector) addMeta(content []byte) error {
+	meta, err := readMetafile(bytes.NewReader(content))
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s", dump.MetaFilename)
+	}
+	if i.meta == nil {
+		i.meta = meta
+		return nil
+	}
+	if meta.MaxChunkSize > i.meta.MaxChunkSize {
+		i.meta.MaxChunkSize = meta.MaxChunkSize
+	}
+	return nil
+}
+
+func (i *Inspector) addChunk(source dump.SourceType, name, filename string, content []byte) {
+	sr, ok := i.sources[source]
+	if !ok {
+		sr = &SourceReport{Source: source.String()}
+		i.sources[source] = sr
+	}
+
+	chunk := ChunkReport{
+		Filename: name,
+		Part:     i.parts,
+		Size:     int64(len(content)),
+	}
+	if m, err := dump.ParseChunkMeta(source, filename); err != nil {
+		log.Warn().Msgf("Failed to decode chunk filename: %v", err)
+	} else {
+		chunk.Start, chunk.End, chunk.index = m.Start, m.End, m.Index
+	}
+
+	switch source {
+	case dump.VictoriaMetrics:
+		series := make(map[string]struct{})
+		format, rev, err := readVMChunk(content, func(labels map[string]string, samples int) {
+			key := labelsKey(labels)
+			series[key] = struct{}{}
+			chunk.Samples += samples
+
+			name := labels[native.MetricNameLabel]
+			if i.series[name] == nil {
+				i.series[name] = make(map[string]struct{})
+			}
+			i.series[name][key] = struct{}{}
+			i.samples[name] += samples
+		})
+		if err != nil {
+			log.Warn().Msgf("Failed to parse chunk %s: %v", name, err)
+		}
+		chunk.Series = len(series)
+		if format != "" {
+			sr.Format = format
+		}
+		if rev != native.RevisionUnknown {
+			sr.NativeRevision = rev.String()
+		}
+		sr.Samples += chunk.Samples
+	case dump.ClickHouse:
+		columns, rows, err := parseCHChunk(content)
+		if err != nil {
+			log.Warn().Msgf("Failed to parse chunk %s: %v", name, err)
+		}
+		chunk.Rows = rows
+		if columns != 0 {
+			sr.Columns = columns
+		}
+		sr.Rows += rows
+	}
+
+	sr.Size += chunk.Size
+	sr.Chunks = append(sr.Chunks, chunk)
+}
+
+// Report returns contents of all the added dumps or dump parts
+func (i *Inspector) Report() *InspectReport {
+	report := &InspectReport{
+		Meta: i.meta,
+	}
+	if i.parts > 1 {
+		report.Parts = i.parts
+	}
+
+	for _, source := range []dump.SourceType{dump.VictoriaMetrics, dump.ClickHouse} {
+		sr, ok := i.sources[source]
+		if !ok {
+			continue
+		}
+		if i.parts <= 1 {
+			for n := range sr.Chunks {
+				sr.Chunks[n].Part = 0
+			}
+		}
+
+		switch source {
+		case dump.VictoriaMetrics:
+			sort.SliceStable(sr.Chunks, func(a, b int) bool {
+				return chunkStart(sr.Chunks[a]).Before(chunkStart(sr.Chunks[b]))
+			})
+			sr.Start, sr.End, sr.Gaps = coverage(sr.Chunks)
+
+			for name, series := range i.series {
+				sr.Metrics = append(sr.Metrics, MetricReport{
+					Name:    name,
+					Series:  len(series),
+					Samples: i.samples[name],
+				})
+				sr.Series += len(series)
+			}
+			sort.Slice(sr.Metrics, func(a, b int) bool {
+				return sr.Metrics[a].Name < sr.Metrics[b].Name
+			})
+		case dump.ClickHouse:
+			sort.SliceStable(sr.Chunks, func(a, b int) bool {
+				return sr.Chunks[a].index < sr.Chunks[b].index
+			})
+		}
+		report.Sources = append(report.Sources, sr)
+	}
+	return report
+}
+
+func chunkStart(c ChunkReport) time.Time {
+	if c.Start == nil {
+		return time.Time{}
+	}
+	return *c.Start
+}
+
+// coverage returns time range covered by the chunks sorted by start and gaps between them
+func coverage(chunks []ChunkReport) (*time.Time, *time.Time, []TimeRange) {
+	var start, end *time.Time
+	var gaps []TimeRange
+	for _, c := range chunks {
+		if c.Start == nil || c.End == nil {
+			continue
+		}
+		if start == nil {
+			s, e := *c.Start, *c.End
+			start, end = &s, &e
+			continue
+		}
+		if c.Start.After(*end) {
+			gaps = append(gaps, TimeRange{Start: *end, End: *c.Start})
+		}
+		if c.End.After(*end) {
+			e := *c.End
+			end = &e
+		}
+	}
+	return start, end, gaps
+}
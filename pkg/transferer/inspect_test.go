@@ -0,0 +1,81 @@
+package transferer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestInspect(t *testing.T) {
+	vmChunk := gzipData(t, []byte(
+		`{"metric":{"__name__":"up","instance":"a"},"values":[1,1],"timestamps":[1,2]}`+"\n"+
+			`{"metric":{"__name__":"up","instance":"b"},"values":[1],"timestamps":[1]}`+"\n"+
+			`{"metric":{"__name__":"node_load1","instance":"a"},"values":[0.5,0.7,0.1],"timestamps":[1,2,3]}`+"\n"))
+	secondVMChunk := gzipData(t, []byte(`{"metric":{"__name__":"up","instance":"a"},"values":[1],"timestamps":[3]}`+"\n"))
+
+	first := fakeDump(t, []fakeEntry{
+		{"vm/1600000300-1600000600.bin", secondVMChunk},
+		{"vm/1600000000-1600000300.bin", vmChunk},
+		{"ch/1.tsv", []byte("1\ta\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{PMMServerVersion: "2.38.0", MaxChunkSize: 10})},
+	})
+	second := fakeDump(t, []fakeEntry{
+		{"vm/1600001200-1600001500.bin", secondVMChunk},
+		{"ch/0.tsv", []byte("1\ta\n2\tb\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{PMMServerVersion: "2.38.0", MaxChunkSize: 20})},
+	})
+
+	inspector := NewInspector()
+	for _, part := range [][]byte{first, second} {
+		if err := inspector.Add(bytes.NewReader(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := inspector.Report()
+
+	if report.Parts != 2 || report.Meta == nil || report.Meta.MaxChunkSize != 20 {
+		t.Fatalf("unexpected parts or meta: %d, %+v", report.Parts, report.Meta)
+	}
+	if len(report.Sources) != 2 {
+		t.Fatalf("expected 2 sources, got %d", len(report.Sources))
+	}
+
+	vm := report.Sources[0]
+	if vm.Source != "vm" || len(vm.Chunks) != 3 || vm.Format != "json" {
+		t.Fatalf("unexpected vm report: %+v", vm)
+	}
+	if vm.Chunks[0].Filename != "vm/1600000000-1600000300.bin" || vm.Chunks[0].Series != 3 || vm.Chunks[0].Samples != 6 {
+		t.Fatalf("unexpected first chunk: %+v", vm.Chunks[0])
+	}
+	if !vm.Start.Equal(time.Unix(1600000000, 0)) || !vm.End.Equal(time.Unix(1600001500, 0)) {
+		t.Fatalf("unexpected time range: %v - %v", vm.Start, vm.End)
+	}
+	if len(vm.Gaps) != 1 || !vm.Gaps[0].Start.Equal(time.Unix(1600000600, 0)) || !vm.Gaps[0].End.Equal(time.Unix(1600001200, 0)) {
+		t.Fatalf("unexpected gaps: %+v", vm.Gaps)
+	}
+	expectedMetrics := []MetricReport{
+		{Name: "node_load1", Series: 1, Samples: 3},
+		{Name: "up", Series: 2, Samples: 5},
+	}
+	if len(vm.Metrics) != len(expectedMetrics) {
+		t.Fatalf("unexpected metrics: %+v", vm.Metrics)
+	}
+	for i, m := range expectedMetrics {
+		if vm.Metrics[i] != m {
+			t.Fatalf("expected metric %+v, got %+v", m, vm.Metrics[i])
+		}
+	}
+	if vm.Series != 3 || vm.Samples != 8 {
+		t.Fatalf("unexpected totals: %d series, %d samples", vm.Series, vm.Samples)
+	}
+
+	ch := report.Sources[1]
+	if ch.Source != "ch" || ch.Rows != 3 || ch.Columns != 2 {
+		t.Fatalf("unexpected ch report: %+v", ch)
+	}
+	if ch.Chunks[0].Filename != "ch/0.tsv" || ch.Chunks[0].Rows != 2 || ch.Chunks[0].Part != 2 {
+		t.Fatalf("unexpected first ch chunk: %+v", ch.Chunks[0])
+	}
+}
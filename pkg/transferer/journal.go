@@ -0,0 +1,322 @@
+package transferer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+)
+
+const JournalSuffix = ".journal"
+
+// Journal is a sidecar file of the dump, which records chunks that are completely written to the dump,
+// so the interrupted export could be resumed from the last written chunk.
+type Journal struct {
+	mu sync.Mutex
+
+	path    string
+	file    *os.File
+	header  journalHeader
+	entries map[string]journalEntry
+
+	// manifest keeps manifest entries of the journaled chunks in the order they were written
+	manifest []dump.ManifestChunk
+
+	offset       int64
+	maxChunkSize int64
+}
+
+type journalHeader struct {
+	Arguments string    `json:"arguments"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+
+	// QANChunks is the plan of ClickHouse chunks recorded once QANPlanned is set. Their keyset bounds depend on the rows count at the moment of planning,
+	// so they are reused on resume instead of planning them again
+	QANPlanned bool           `json:"qan-planned,omitempty"`
+	QANChunks  []journalChunk `json:"qan-chunks,omitempty"`
+}
+
+type journalChunk struct {
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	StartKey string     `json:"start-key,omitempty"`
+	EndKey   string     `json:"end-key,omitempty"`
+	Index    int        `json:"index"`
+	RowsLen  int        `json:"rows-len"`
+}
+
+type journalEntry struct {
+	Source   string     `json:"source"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	StartKey string     `json:"start-key,omitempty"`
+	EndKey   string     `json:"end-key,omitempty"`
+	Index    int        `json:"index"`
+	RowsLen  int        `json:"rows-len"`
+	Filename string     `json:"filename"`
+	Size     int64      `json:"size"`
+	Offset   int64      `json:"offset"`
+
+	Manifest dump.ManifestChunk `json:"manifest"`
+}
+
+// OpenJournal opens journal of the dump or creates a new one, if it doesn't exist.
+// Existing journal is accepted only if it was created with the same arguments.
+func OpenJournal(dumpPath string, arguments string, start, end time.Time) (*Journal, error) {
+	path := dumpPath + JournalSuffix
+
+	j := &Journal{
+		path: path,
+		header: journalHeader{
+			Arguments: arguments,
+			Start:     start,
+			End:       end,
+		},
+		entries: make(map[string]journalEntry),
+	}
+
+	content, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		log.Debug().Msgf("Creating new journal %s", path)
+
+		if j.file, err = os.Create(path); err != nil {
+			return nil, errors.Wrap(err, "failed to create journal")
+		}
+		if err = j.writeLine(j.header); err != nil {
+			return nil, errors.Wrap(err, "failed to write journal header")
+		}
+		return j, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to read journal")
+	}
+
+	log.Info().Msgf("Found journal %s, resuming export", path)
+
+	if err = j.parse(content); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse journal %s", path)
+	}
+
+	if j.header.Arguments != arguments {
+		return nil, errors.Errorf("journal %s was created with different arguments:\nJournal:\t%s\nCurrent:\t%s",
+			path, j.header.Arguments, arguments)
+	}
+
+	if j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, errors.Wrap(err, "failed to open journal")
+	}
+
+	log.Info().Msgf("%d chunks were already exported", len(j.entries))
+
+	return j, nil
+}
+
+func (j *Journal) parse(content []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	// Header holds the plan of QAN chunks, so it could be much longer than entries
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+
+	if !scanner.Scan() {
+		return errors.New("journal is empty")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &j.header); err != nil {
+		return errors.Wrap(err, "failed to unmarshal header")
+	}
+
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line could be partially written if the export was killed
+			log.Warn().Msgf("Skipping corrupted journal line: %v", err)
+			break
+		}
+		j.addEntry(e)
+	}
+	return scanner.Err()
+}
+
+func (j *Journal) addEntry(e journalEntry) {
+	j.entries[journalKey(dump.ChunkMeta{
+		Source:   dump.ParseSourceType(e.Source),
+		Start:    e.Start,
+		End:      e.End,
+		StartKey: e.StartKey,
+		EndKey:   e.EndKey,
+		Index:    e.Index,
+	})] = e
+	j.manifest = append(j.manifest, e.Manifest)
+	if e.Offset > j.offset {
+		j.offset = e.Offset
+	}
+	if e.Size > j.maxChunkSize {
+		j.maxChunkSize = e.Size
+	}
+}
+
+func (j *Journal) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal journal line")
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write journal line")
+	}
+	return j.file.Sync()
+}
+
+// Start returns start of the exported time range. It's taken from the existing journal on resume.
+func (j *Journal) Start() time.Time {
+	return j.header.Start
+}
+
+// End returns end of the exported time range. It's taken from the existing journal on resume.
+func (j *Journal) End() time.Time {
+	return j.header.End
+}
+
+// QANChunks returns ClickHouse chunks planned by the journaled export or false if they weren't planned yet
+func (j *Journal) QANChunks() ([]dump.ChunkMeta, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.header.QANPlanned {
+		return nil, false
+	}
+	chunks := make([]dump.ChunkMeta, 0, len(j.header.QANChunks))
+	for _, c := range j.header.QANChunks {
+		chunks = append(chunks, dump.ChunkMeta{
+			Source:   dump.ClickHouse,
+			Start:    c.Start,
+			End:      c.End,
+			StartKey: c.StartKey,
+			EndKey:   c.EndKey,
+			Index:    c.Index,
+			RowsLen:  c.RowsLen,
+		})
+	}
+	return chunks, true
+}
+
+// SetQANChunks records the plan of ClickHouse chunks in the journal header. It should be called before any chunk is added
+func (j *Journal) SetQANChunks(chunks []dump.ChunkMeta) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.entries) != 0 {
+		return errors.New("journal already has exported chunks")
+	}
+
+	j.header.QANPlanned = true
+	j.header.QANChunks = make([]journalChunk, 0, len(chunks))
+	for _, c := range chunks {
+		j.header.QANChunks = append(j.header.QANChunks, journalChunk{
+			Start:    c.Start,
+			End:      c.End,
+			StartKey: c.StartKey,
+			EndKey:   c.EndKey,
+			Index:    c.Index,
+			RowsLen:  c.RowsLen,
+		})
+	}
+
+	// Header is replaced by renaming the new journal, so the interrupted export never leaves an empty journal
+	tmpPath := j.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create journal")
+	}
+	old := j.file
+	j.file = file
+	if err = j.writeLine(j.header); err != nil {
+		_ = file.Close()
+		j.file = old
+		return errors.Wrap(err, "failed to write journal header")
+	}
+	if err = os.Rename(tmpPath, j.path); err != nil {
+		_ = file.Close()
+		j.file = old
+		return errors.Wrap(err, "failed to replace journal")
+	}
+	_ = old.Close()
+	return nil
+}
+
+// Offset returns size of the dump file with all the journaled chunks
+func (j *Journal) Offset() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.offset
+}
+
+func (j *Journal) MaxChunkSize() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.maxChunkSize
+}
+
+// ManifestChunks returns manifest entries of the journaled chunks
+func (j *Journal) ManifestChunks() []dump.ManifestChunk {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]dump.ManifestChunk(nil), j.manifest...)
+}
+
+// Done reports whether the chunk was already written to the dump
+func (j *Journal) Done(c dump.ChunkMeta) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.entries[journalKey(c)]
+	return ok
+}
+
+// Add records the chunk as written. Offset must point to the end of the chunk in the dump file
+func (j *Journal) Add(c *dump.Chunk, mc dump.ManifestChunk, offset int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e := journalEntry{
+		Source:   c.Source.String(),
+		Start:    c.Start,
+		End:      c.End,
+		StartKey: c.StartKey,
+		EndKey:   c.EndKey,
+		Index:    c.Index,
+		RowsLen:  c.RowsLen,
+		Filename: c.Filename,
+		Size:     int64(len(c.Content)),
+		Offset:   offset,
+		Manifest: mc,
+	}
+	if err := j.writeLine(e); err != nil {
+		return err
+	}
+	j.addEntry(e)
+	return nil
+}
+
+// Remove deletes the journal. It should be called after successful export
+func (j *Journal) Remove() error {
+	if err := j.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close journal")
+	}
+	if err := os.Remove(j.path); err != nil {
+		return errors.Wrap(err, "failed to remove journal")
+	}
+	return nil
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// journalKey identifies the chunk by its range, ClickHouse keyset bounds and index
+func journalKey(c dump.ChunkMeta) string {
+	return fmt.Sprintf("%s/%s/%q-%q/%d", c.Source, c, c.StartKey, c.EndKey, c.Index)
+}
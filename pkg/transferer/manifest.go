@@ -0,0 +1,209 @@
+package transferer
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+)
+
+// newManifestChunk calculates checksum of the chunk and counts its series or rows.
+// Chunk that can't be parsed is still added to the manifest, but without the counts.
+func newManifestChunk(c *dump.Chunk) dump.ManifestChunk {
+	mc := dump.ManifestChunk{
+		Filename: path.Join(c.Source.String(), c.Filename),
+		Source:   c.Source.String(),
+		Start:    c.Start,
+		End:      c.End,
+		Size:     int64(len(c.Content)),
+		SHA256:   checksum(c.Content),
+	}
+
+	var err error
+	switch c.Source {
+	case dump.VictoriaMetrics:
+		_, mc.Series, err = parseVMChunk(c.Content)
+	case dump.ClickHouse:
+		_, mc.Rows, err = parseCHChunk(c.Content)
+	}
+	if err != nil {
+		log.Warn().Msgf("Failed to count data in chunk %s: %v", mc.Filename, err)
+	}
+
+	return mc
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeManifest(tw *tar.Writer, manifest dump.Manifest) error {
+	log.Debug().Msg("Writing dump manifest")
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal dump manifest")
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     dump.ManifestFilename,
+		Size:     int64(len(content)),
+		Mode:     0600,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to write dump manifest header")
+	}
+
+	if _, err = tw.Write(content); err != nil {
+		return errors.Wrap(err, "failed to write dump manifest content")
+	}
+
+	return nil
+}
+
+func readManifest(r io.Reader) (*dump.Manifest, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read bytes")
+	}
+
+	manifest := new(dump.Manifest)
+	if err = json.Unmarshal(content, manifest); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal")
+	}
+
+	return manifest, nil
+}
+
+// manifestChecker collects checksums of the chunks found in the dump and compares them with the manifest
+type manifestChecker struct {
+	manifest *dump.Manifest
+	// listed indexes chunks of the manifest by their paths
+	listed map[string]dump.ManifestChunk
+	chunks map[string]dump.ManifestChunk
+}
+
+func newManifestChecker() *manifestChecker {
+	return &manifestChecker{
+		chunks: make(map[string]dump.ManifestChunk),
+	}
+}
+
+// addChunk records the chunk with the given path in the dump
+func (c *manifestChecker) addChunk(name string, content []byte) {
+	c.chunks[name] = dump.ManifestChunk{
+		Filename: name,
+		Size:     int64(len(content)),
+		SHA256:   checksum(content),
+	}
+}
+
+// addChunkSize records the chunk with the given path and size in the dump without its checksum,
+// so only its presence and size are checked
+func (c *manifestChecker) addChunkSize(name string, size int64) {
+	c.chunks[name] = dump.ManifestChunk{
+		Filename: name,
+		Size:     size,
+	}
+}
+
+// checkChunk compares the chunk with its manifest entry. It's called before the chunk is imported,
+// so tampered or unlisted chunk isn't written to the source. Any chunk passes if there is no manifest yet
+func (c *manifestChecker) checkChunk(name string, content []byte) error {
+	if c.manifest == nil {
+		return nil
+	}
+	mc, ok := c.listed[name]
+	if !ok {
+		return errors.Errorf("chunk %s is not listed in manifest", name)
+	}
+	if size := int64(len(content)); size != mc.Size {
+		return errors.Errorf("chunk %s has size %d, but manifest expects %d", name, size, mc.Size)
+	}
+	if sum := checksum(content); sum != mc.SHA256 {
+		return errors.Errorf("chunk %s has checksum %s, but manifest expects %s", name, sum, mc.SHA256)
+	}
+	return nil
+}
+
+func (c *manifestChecker) setManifest(r io.Reader) error {
+	manifest, err := readManifest(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to read manifest")
+	}
+	c.useManifest(manifest)
+	return nil
+}
+
+// useManifest sets the manifest to check the chunks against. Nil manifest is ignored
+func (c *manifestChecker) useManifest(manifest *dump.Manifest) {
+	if manifest == nil {
+		return
+	}
+	c.manifest = manifest
+	c.listed = make(map[string]dump.ManifestChunk, len(manifest.Chunks))
+	for _, mc := range manifest.Chunks {
+		c.listed[mc.Filename] = mc
+	}
+}
+
+// hasManifest reports whether manifest was found in the dump. Dumps created by older versions don't have it
+func (c *manifestChecker) hasManifest() bool {
+	return c.manifest != nil
+}
+
+// problems returns all the differences between the manifest and the chunks found in the dump
+func (c *manifestChecker) problems() []string {
+	if c.manifest == nil {
+		return nil
+	}
+
+	var problems []string
+	for _, mc := range c.manifest.Chunks {
+		actual, ok := c.chunks[mc.Filename]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("chunk %s is listed in manifest, but missing in dump", mc.Filename))
+		case actual.Size != mc.Size:
+			problems = append(problems, fmt.Sprintf("chunk %s has size %d, but manifest expects %d", mc.Filename, actual.Size, mc.Size))
+		case actual.SHA256 != "" && actual.SHA256 != mc.SHA256:
+			problems = append(problems, fmt.Sprintf("chunk %s has checksum %s, but manifest expects %s", mc.Filename, actual.SHA256, mc.SHA256))
+		}
+	}
+
+	var unlisted []string
+	for name := range c.chunks {
+		if _, ok := c.listed[name]; !ok {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		problems = append(problems, fmt.Sprintf("chunk %s is not listed in manifest", name))
+	}
+
+	return problems
+}
+
+// check returns error describing all the differences between the manifest and the chunks found in the dump
+func (c *manifestChecker) check() error {
+	problems := c.problems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.Errorf("corrupted dump: manifest check failed:\n\t%s", strings.Join(problems, "\n\t"))
+}
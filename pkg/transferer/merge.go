@@ -0,0 +1,359 @@
+package transferer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// ErrMixedVMDataFormat is returned by merge for the dumps with VictoriaMetrics data in different formats
+var ErrMixedVMDataFormat = errors.New("dumps have VictoriaMetrics data in different formats")
+
+// MergeMeta reconciles meta of the merged dumps: services are united, the lowest PMM version is kept and provenance of every dump
+// is recorded. VictoriaMetrics data of the dumps should be in the same format, unless format to convert them to is set
+func MergeMeta(metas []dump.Meta, filenames []string, format string) (dump.Meta, error) {
+	if len(metas) == 0 {
+		return dump.Meta{}, errors.New("no dumps to merge")
+	}
+	if len(metas) != len(filenames) {
+		return dump.Meta{}, errors.New("number of filenames doesn't match number of dumps")
+	}
+
+	result := dump.Meta{
+		PMMServerVersion: metas[0].PMMServerVersion,
+		PMMTimezone:      metas[0].PMMTimezone,
+		VMDataFormat:     format,
+	}
+	services := make(map[string]struct{})
+	for i, m := range metas {
+		if format == "" {
+			if result.VMDataFormat == "" {
+				result.VMDataFormat = m.VMDataFormat
+			} else if m.VMDataFormat != "" && m.VMDataFormat != result.VMDataFormat {
+				return dump.Meta{}, errors.Wrapf(ErrMixedVMDataFormat, "%s has %s data, but %s is expected", filenames[i], m.VMDataFormat, result.VMDataFormat)
+			}
+		}
+
+		if m.PMMServerVersion != result.PMMServerVersion {
+			log.Warn().Msgf("Dumps are exported from different PMM versions: %s and %s", result.PMMServerVersion, m.PMMServerVersion)
+			if cmp, err := native.CompareVersions(m.PMMServerVersion, result.PMMServerVersion); err == nil && cmp < 0 {
+				result.PMMServerVersion = m.PMMServerVersion
+			}
+		}
+		if !equalTimezones(m.PMMTimezone, result.PMMTimezone) && result.PMMTimezone != nil {
+			log.Warn().Msgf("Dumps are exported from PMM with different timezones, timezone is not kept")
+			result.PMMTimezone = nil
+		}
+		if m.MaxChunkSize > result.MaxChunkSize {
+			result.MaxChunkSize = m.MaxChunkSize
+		}
+
+		for _, s := range m.PMMServerServices {
+			key := s.Name + "/" + s.NodeID
+			if _, ok := services[key]; !ok {
+				services[key] = struct{}{}
+				result.PMMServerServices = append(result.PMMServerServices, s)
+			}
+		}
+
+		if len(m.ClickHouseColumns) != 0 {
+			if len(result.ClickHouseColumns) == 0 {
+				result.ClickHouseColumns = m.ClickHouseColumns
+			} else if !equalColumns(m.ClickHouseColumns, result.ClickHouseColumns) {
+				return dump.Meta{}, errors.Errorf("%s has different ClickHouse columns", filenames[i])
+			}
+		}
+
+		// Provenance of the merged dump is kept as is, so it isn't lost when merging again
+		if len(m.MergedDumps) != 0 {
+			result.MergedDumps = append(result.MergedDumps, m.MergedDumps...)
+			continue
+		}
+		merged := dump.MergedDump{
+			Filename:         path.Base(filenames[i]),
+			PMMServerVersion: m.PMMServerVersion,
+			Arguments:        m.Arguments,
+			VMDataFormat:     m.VMDataFormat,
+		}
+		if m.Parent != nil {
+			merged.Parent = m.Parent.Filename
+		}
+		result.MergedDumps = append(result.MergedDumps, merged)
+	}
+	result.Start, result.End = mergeTimeRanges(metas)
+	if result.VMDataFormat == "" {
+		result.VMDataFormat = victoriametrics.FormatJSON
+	}
+	return result, nil
+}
+
+// mergeTimeRanges returns time range covering export time ranges of all the dumps. It's unknown if any of them is unknown
+func mergeTimeRanges(metas []dump.Meta) (*time.Time, *time.Time) {
+	var start, end *time.Time
+	for _, m := range metas {
+		if m.Start == nil || m.End == nil {
+			return nil, nil
+		}
+		if start == nil || m.Start.Before(*start) {
+			start = m.Start
+		}
+		if end == nil || m.End.After(*end) {
+			end = m.End
+		}
+	}
+	return start, end
+}
+
+func equalTimezones(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalColumns(a, b []dump.ClickHouseColumn) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge writes union of the chunks of the dumps into the new dump. Every dump is given by the list of its parts.
+// VictoriaMetrics chunks of the same time range and content are written once, while chunks of the same time range with different content
+// are merged into a single chunk. Duplicate QAN chunks are skipped and the rest are renumbered.
+// If format is set, VictoriaMetrics chunks are converted to it, otherwise chunks of all the dumps should have the same format.
+// Dumps are read twice, so piped dumps are not supported. Chunks to be merged are kept in a temporary directory
+// until their last copy is read, so only the chunks being merged are kept in memory
+func (t Transferer) Merge(ctx context.Context, dumps [][]string, meta dump.Meta, logBuffer *dump.LogBuffer, format string) error {
+	spoolDir, err := os.MkdirTemp("", "pmm-dump-merge-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
+	}
+	defer func() {
+		if err := os.RemoveAll(spoolDir); err != nil {
+			log.Warn().Msgf("Failed to remove temporary directory %s: %v", spoolDir, err)
+		}
+	}()
+
+	m := &chunkMerger{
+		format:    format,
+		revision:  t.nativeRevision,
+		vmCount:   make(map[string]int),
+		written:   make(map[string]struct{}),
+		spoolDir:  spoolDir,
+		vmPending: make(map[string][]string),
+	}
+
+	// Meta of older dumps doesn't contain data format, so formats of the chunks are checked as well
+	var parts []string
+	vmContents := make(map[string]struct{})
+	chunkFormat := ""
+	for _, dumpParts := range dumps {
+		for _, part := range dumpParts {
+			log.Info().Msgf("Scanning chunks of %s...", part)
+			err := ReadDumpChunks(part, func(c *dump.Chunk) error {
+				if c.Source != dump.VictoriaMetrics {
+					return nil
+				}
+				key := c.Filename + "/" + checksum(c.Content)
+				if _, ok := vmContents[key]; ok {
+					return nil
+				}
+				vmContents[key] = struct{}{}
+				m.vmCount[c.Filename]++
+
+				_, f, err := openVMChunk(c.Content)
+				if err != nil {
+					return errors.Wrapf(err, "failed to read chunk %s", c.Filename)
+				}
+				if format == "" && f != "" && chunkFormat != "" && f != chunkFormat {
+					return errors.Wrapf(ErrMixedVMDataFormat, "chunk %s has %s data, but previous chunks have %s data", c.Filename, f, chunkFormat)
+				}
+				if f != "" {
+					chunkFormat = f
+				}
+				return nil
+			}, t.identities...)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", part)
+			}
+			parts = append(parts, part)
+		}
+	}
+	if format == "" && chunkFormat != "" {
+		meta.VMDataFormat = chunkFormat
+	}
+
+	if err := t.Rewrite(ctx, parts, meta, logBuffer, m.merge); err != nil {
+		return err
+	}
+	log.Info().Msgf("Merged %d dumps: %d duplicate chunks skipped, %d chunks with the same time range merged", len(dumps), m.duplicates, m.merged)
+	return nil
+}
+
+// chunkMerger de-duplicates chunks of the merged dumps. It's called by rewrite workers concurrently
+type chunkMerger struct {
+	format   string
+	revision native.Revision
+
+	mu sync.Mutex
+	// vmCount is the number of different contents of VictoriaMetrics chunks with the filename
+	vmCount map[string]int
+	written map[string]struct{}
+	// vmPending keeps paths of the spooled contents of VictoriaMetrics chunks with the filename, which aren't all read yet
+	spoolDir  string
+	spooled   int
+	vmPending map[string][]string
+	chIndex   int
+
+	duplicates int
+	merged     int
+}
+
+func (m *chunkMerger) merge(c *dump.Chunk) (*dump.Chunk, error) {
+	key := path.Join(c.Source.String(), c.Filename) + "/" + checksum(c.Content)
+	if c.Source == dump.ClickHouse {
+		key = path.Join(c.Source.String(), checksum(c.Content))
+	}
+
+	m.mu.Lock()
+	if _, ok := m.written[key]; ok {
+		m.duplicates++
+		m.mu.Unlock()
+		log.Debug().Msgf("Skipping duplicate chunk %s", path.Join(c.Source.String(), c.Filename))
+		return nil, nil
+	}
+	m.written[key] = struct{}{}
+
+	switch c.Source {
+	case dump.ClickHouse:
+		c.Index = m.chIndex
+		c.Filename = fmt.Sprintf("%d.tsv", c.Index)
+		m.chIndex++
+		m.mu.Unlock()
+		return c, nil
+	case dump.VictoriaMetrics:
+		if m.vmCount[c.Filename] <= 1 {
+			m.mu.Unlock()
+			return m.convert(c)
+		}
+		m.spooled++
+		spoolPath := filepath.Join(m.spoolDir, fmt.Sprintf("%d.bin", m.spooled))
+		m.mu.Unlock()
+		return m.spool(c, spoolPath)
+	default:
+		m.mu.Unlock()
+		return c, nil
+	}
+}
+
+// spool writes content of the VictoriaMetrics chunk to the temporary file. When the last copy of the chunk is spooled,
+// all of them are read back and merged
+func (m *chunkMerger) spool(c *dump.Chunk, spoolPath string) (*dump.Chunk, error) {
+	if err := os.WriteFile(spoolPath, c.Content, 0o600); err != nil {
+		return nil, errors.Wrap(err, "failed to write chunk to temporary file")
+	}
+
+	m.mu.Lock()
+	m.vmPending[c.Filename] = append(m.vmPending[c.Filename], spoolPath)
+	paths := m.vmPending[c.Filename]
+	if len(paths) < m.vmCount[c.Filename] {
+		m.mu.Unlock()
+		return nil, nil
+	}
+	delete(m.vmPending, c.Filename)
+	m.merged++
+	m.mu.Unlock()
+
+	contents := make([][]byte, 0, len(paths))
+	for _, p := range paths {
+		content := c.Content
+		if p != spoolPath {
+			var err error
+			if content, err = os.ReadFile(p); err != nil {
+				return nil, errors.Wrap(err, "failed to read chunk from temporary file")
+			}
+		}
+		if err := os.Remove(p); err != nil {
+			return nil, errors.Wrap(err, "failed to remove temporary file")
+		}
+		contents = append(contents, content)
+	}
+	return m.mergeVM(c, contents)
+}
+
+// convert converts VictoriaMetrics chunk to the format of the merged dump if it's set
+func (m *chunkMerger) convert(c *dump.Chunk) (*dump.Chunk, error) {
+	if m.format == "" {
+		return c, nil
+	}
+	_, format, err := openVMChunk(c.Content)
+	if err != nil {
+		return nil, err
+	}
+	if format == m.format && format == victoriametrics.FormatJSON {
+		return c, nil
+	}
+	if format == m.format {
+		rev, err := vmChunkRevision(c.Content)
+		if err != nil {
+			return nil, err
+		}
+		if m.revision == native.RevisionUnknown || rev == m.revision {
+			return c, nil
+		}
+	}
+	return m.mergeVM(c, [][]byte{c.Content})
+}
+
+// mergeVM writes union of the series of the chunk contents into the chunk
+func (m *chunkMerger) mergeVM(c *dump.Chunk, contents [][]byte) (*dump.Chunk, error) {
+	lists := make([][]victoriametrics.Metric, 0, len(contents))
+	format, rev := m.format, m.revision
+	for _, content := range contents {
+		metrics, chunkFormat, err := victoriametrics.DecodeChunk(content)
+		if err != nil {
+			return nil, err
+		}
+		if format == "" {
+			format = chunkFormat
+		}
+		if chunkFormat == victoriametrics.FormatNative && rev == native.RevisionUnknown {
+			if rev, err = vmChunkRevision(content); err != nil {
+				return nil, err
+			}
+		}
+		lists = append(lists, metrics)
+	}
+	if format == "" {
+		return c, nil
+	}
+	if rev == native.RevisionUnknown {
+		rev = native.RevisionV2
+	}
+	if len(contents) > 1 {
+		log.Debug().Msgf("Merging %d chunks %s", len(contents), c.Filename)
+	}
+
+	content, err := victoriametrics.EncodeChunk(victoriametrics.MergeMetrics(lists...), format, rev)
+	if err != nil {
+		return nil, err
+	}
+	return &dump.Chunk{ChunkMeta: c.ChunkMeta, Content: content, Filename: c.Filename}, nil
+}
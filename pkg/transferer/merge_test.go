@@ -0,0 +1,200 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+func TestMergeMeta(t *testing.T) {
+	utc, moscow := "UTC", "Europe/Moscow"
+	columns := []dump.ClickHouseColumn{{Name: "queryid", Type: "String"}}
+	a := dump.Meta{
+		PMMServerVersion:  "2.39.0",
+		PMMTimezone:       &utc,
+		Arguments:         "export --start-ts=a",
+		VMDataFormat:      "json",
+		MaxChunkSize:      100,
+		PMMServerServices: []dump.PMMServerService{{Name: "mysql", NodeID: "n1"}},
+		ClickHouseColumns: columns,
+	}
+	b := dump.Meta{
+		PMMServerVersion:  "2.38.1",
+		PMMTimezone:       &utc,
+		Arguments:         "export --start-ts=b",
+		VMDataFormat:      "json",
+		MaxChunkSize:      200,
+		PMMServerServices: []dump.PMMServerService{{Name: "mysql", NodeID: "n1"}, {Name: "pg", NodeID: "n2"}},
+		Parent:            &dump.ParentDump{Filename: "a.tar.gz"},
+	}
+	day, nextDay, lastDay := time.Unix(1600000000, 0), time.Unix(1600086400, 0), time.Unix(1600172800, 0)
+	a.Start, a.End = &day, &nextDay
+	b.Start, b.End = &nextDay, &lastDay
+
+	meta, err := MergeMeta([]dump.Meta{a, b}, []string{"/tmp/a.tar.gz", "b.tar.gz"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.PMMServerVersion != "2.38.1" || meta.MaxChunkSize != 200 || meta.VMDataFormat != "json" {
+		t.Fatalf("unexpected meta: %+v", meta)
+	}
+	if meta.PMMTimezone == nil || *meta.PMMTimezone != utc {
+		t.Fatal("same timezone should be kept")
+	}
+	if len(meta.PMMServerServices) != 2 || len(meta.ClickHouseColumns) != 1 {
+		t.Fatalf("unexpected services or columns: %+v", meta)
+	}
+	if len(meta.MergedDumps) != 2 || meta.MergedDumps[0].Filename != "a.tar.gz" || meta.MergedDumps[1].Arguments != b.Arguments {
+		t.Fatalf("unexpected provenance: %+v", meta.MergedDumps)
+	}
+	if meta.MergedDumps[0].Parent != "" || meta.MergedDumps[1].Parent != "a.tar.gz" {
+		t.Fatalf("unexpected parents: %+v", meta.MergedDumps)
+	}
+	if meta.Start == nil || !meta.Start.Equal(day) || meta.End == nil || !meta.End.Equal(lastDay) {
+		t.Fatalf("unexpected time range: %v - %v", meta.Start, meta.End)
+	}
+
+	// Provenance of the merged dump is kept when merging again
+	c := dump.Meta{PMMServerVersion: "2.39.0", PMMTimezone: &moscow, VMDataFormat: "native"}
+	remerged, err := MergeMeta([]dump.Meta{meta, c}, []string{"ab.tar.gz", "c.tar.gz"}, "native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remerged.MergedDumps) != 3 || remerged.VMDataFormat != "native" || remerged.PMMTimezone != nil || remerged.Start != nil {
+		t.Fatalf("unexpected meta: %+v", remerged)
+	}
+
+	if _, err = MergeMeta([]dump.Meta{a, c}, []string{"a.tar.gz", "c.tar.gz"}, ""); !errors.Is(err, ErrMixedVMDataFormat) {
+		t.Fatalf("expected mixed format error, got %v", err)
+	}
+	b.ClickHouseColumns = []dump.ClickHouseColumn{{Name: "fingerprint", Type: "String"}}
+	if _, err = MergeMeta([]dump.Meta{a, b}, []string{"a.tar.gz", "b.tar.gz"}, ""); err == nil {
+		t.Fatal("different ClickHouse columns should be rejected")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	up := gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}`+"\n"))
+	load := gzipData(t, []byte(`{"metric":{"__name__":"node_load1"},"values":[0.5],"timestamps":[1000]}`+"\n"))
+	later := gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[2000]}`+"\n"))
+	latest := gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[0],"timestamps":[3000]}`+"\n"))
+
+	dir := t.TempDir()
+	var dumps [][]string
+	for i, files := range [][]fakeEntry{
+		{
+			{"vm/1-2.bin", up},
+			{"vm/2-3.bin", later},
+			{"ch/0.tsv", []byte("a\t1\n")},
+			{dump.MetaFilename, metaContent(t, dump.Meta{VMDataFormat: "json"})},
+		},
+		{
+			{"vm/1-2.bin", load},
+			{"vm/2-3.bin", later},
+			{"vm/3-4.bin", latest},
+			{"ch/0.tsv", []byte("b\t2\n")},
+			{"ch/1.tsv", []byte("a\t1\n")},
+			{dump.MetaFilename, metaContent(t, dump.Meta{VMDataFormat: "json"})},
+		},
+	} {
+		part := filepath.Join(dir, dump.PartPath("dump.tar.gz", i+1))
+		if err := os.WriteFile(part, fakeDump(t, files), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		dumps = append(dumps, []string{part})
+	}
+
+	// Chunks to be merged are spooled to the temporary directory, which is removed after merge
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	buf := new(bytes.Buffer)
+	tr := NewRewriter(buf, 1)
+	if err := tr.Merge(context.Background(), dumps, dump.Meta{VMDataFormat: "json"}, new(dump.LogBuffer), ""); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(tmpDir); err != nil || len(entries) != 0 {
+		t.Fatalf("temporary files should be removed, got %v: %v", entries, err)
+	}
+
+	report := Verify(bytes.NewReader(buf.Bytes()))
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report.VMChunks != 3 || report.CHChunks != 2 {
+		t.Fatalf("unexpected chunks: %+v", report)
+	}
+
+	contents := make(map[string][]byte)
+	dr, err := dump.NewDecompressReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(dr)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents[header.Name], err = io.ReadAll(archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(contents["vm/2-3.bin"], later) || !bytes.Equal(contents["vm/3-4.bin"], latest) {
+		t.Fatal("unique chunks should be copied as is")
+	}
+	if string(contents["ch/0.tsv"]) != "a\t1\n" || string(contents["ch/1.tsv"]) != "b\t2\n" {
+		t.Fatalf("unexpected QAN chunks: %q %q", contents["ch/0.tsv"], contents["ch/1.tsv"])
+	}
+	merged, _, err := victoriametrics.DecodeChunk(contents["vm/1-2.bin"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 || merged[0].Metric["__name__"] != "up" || merged[1].Metric["__name__"] != "node_load1" {
+		t.Fatalf("chunks of the same time range should be merged, got %v", merged)
+	}
+}
+
+func TestMergeMixedFormats(t *testing.T) {
+	dir := t.TempDir()
+	var dumps [][]string
+	for i, content := range [][]byte{
+		gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}`+"\n")),
+		nativeChunk(t, native.RevisionV2),
+	} {
+		part := filepath.Join(dir, dump.PartPath("dump.tar.gz", i+1))
+		files := []fakeEntry{{"vm/1-2.bin", content}, {dump.MetaFilename, metaContent(t, dump.Meta{})}}
+		if err := os.WriteFile(part, fakeDump(t, files), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		dumps = append(dumps, []string{part})
+	}
+
+	err := NewRewriter(new(bytes.Buffer), 1).Merge(context.Background(), dumps, dump.Meta{}, new(dump.LogBuffer), "")
+	if !errors.Is(err, ErrMixedVMDataFormat) {
+		t.Fatalf("expected mixed format error, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = NewRewriter(buf, 1).Merge(context.Background(), dumps, dump.Meta{VMDataFormat: "json"}, new(dump.LogBuffer), "json"); err != nil {
+		t.Fatal(err)
+	}
+	report := Verify(bytes.NewReader(buf.Bytes()))
+	if len(report.Problems) != 0 || report.VMDataFormat != "json" || report.VMChunks != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
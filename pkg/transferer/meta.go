@@ -2,8 +2,8 @@ package transferer
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"encoding/json"
+	"filippo.io/age"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -12,29 +12,35 @@ import (
 	"os"
 	"path"
 	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics/native"
 	"time"
 )
 
-func ReadMetaFromDump(dumpPath string, piped bool) (*dump.Meta, error) {
-	var file *os.File
+func openDumpFile(dumpPath string, piped bool) (*os.File, error) {
 	if piped {
-		file = os.Stdin
-	} else {
-		var err error
-		file, err = os.Open(dumpPath)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to open file")
-		}
+		return os.Stdin, nil
+	}
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	return file, nil
+}
+
+func ReadMetaFromDump(dumpPath string, piped bool, identities ...age.Identity) (*dump.Meta, error) {
+	file, err := openDumpFile(dumpPath, piped)
+	if err != nil {
+		return nil, err
 	}
 	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
+	dr, err := dump.NewDecompressReader(file, identities...)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open as gzip")
+		return nil, errors.Wrap(err, "failed to open dump")
 	}
-	defer gzr.Close()
+	defer dr.Close()
 
-	tr := tar.NewReader(gzr)
+	tr := tar.NewReader(dr)
 
 	for {
 		log.Debug().Msg("Reading files from dump...")
@@ -67,6 +73,147 @@ func ReadMetaFromDump(dumpPath string, piped bool) (*dump.Meta, error) {
 	}
 }
 
+// ReadMetaAndCheckManifest reads the whole dump and returns its meta and manifest.
+// Chunks are checked against the manifest. Nil manifest is returned for the dump without it
+func ReadMetaAndCheckManifest(r io.Reader, identities ...age.Identity) (*dump.Meta, *dump.Manifest, error) {
+	dr, err := dump.NewDecompressReader(r, identities...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open dump")
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	mc := newManifestChecker()
+
+	var meta *dump.Meta
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read a file from dump")
+		}
+
+		dir, filename := path.Split(header.Name)
+		switch {
+		case dir == "" && filename == dump.MetaFilename:
+			if meta, err = readMetafile(tr); err != nil {
+				return nil, nil, errors.Wrap(err, "failed to read meta file")
+			}
+		case dir == "" && filename == dump.ManifestFilename:
+			if err = mc.setManifest(tr); err != nil {
+				return nil, nil, err
+			}
+		case dir != "":
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to read %s", header.Name)
+			}
+			mc.addChunk(header.Name, content)
+		}
+	}
+
+	if meta == nil {
+		return nil, nil, errors.New("no meta file found in dump")
+	}
+
+	if err = mc.check(); err != nil {
+		return nil, nil, err
+	}
+
+	return meta, mc.manifest, nil
+}
+
+// ReadMetaAndManifest reads meta and manifest of the dump skipping the content of the chunks.
+// Chunks are checked against the manifest only by their presence and size, checksums are checked by ReadMetaAndCheckManifest
+// or by import before the chunk is written. Nil meta or manifest is returned if the dump doesn't have it
+func ReadMetaAndManifest(r io.Reader, identities ...age.Identity) (*dump.Meta, *dump.Manifest, error) {
+	info, err := readDumpInfo(r, false, identities...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info.Meta, info.Manifest, nil
+}
+
+// DumpInfo is meta, manifest and native format revision of the dump read before import
+type DumpInfo struct {
+	Meta     *dump.Meta
+	Manifest *dump.Manifest
+
+	// NativeRevision is revision of the first VictoriaMetrics chunk with native blocks. It's unknown for the dump without native data
+	NativeRevision native.Revision
+}
+
+// ReadDumpInfo reads the dump like ReadMetaAndManifest and detects revision of its native blocks,
+// so incompatible dump is refused before any chunk is imported. Only the first non-empty VictoriaMetrics chunk is read for it
+func ReadDumpInfo(r io.Reader, identities ...age.Identity) (*DumpInfo, error) {
+	return readDumpInfo(r, true, identities...)
+}
+
+func readDumpInfo(r io.Reader, detectRevision bool, identities ...age.Identity) (*DumpInfo, error) {
+	dr, err := dump.NewDecompressReader(r, identities...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open dump")
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	mc := newManifestChecker()
+
+	info := &DumpInfo{NativeRevision: native.RevisionUnknown}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read a file from dump")
+		}
+
+		dir, filename := path.Split(header.Name)
+		switch {
+		case dir == "" && filename == dump.MetaFilename:
+			if info.Meta, err = readMetafile(tr); err != nil {
+				return nil, errors.Wrap(err, "failed to read meta file")
+			}
+		case dir == "" && filename == dump.ManifestFilename:
+			if err = mc.setManifest(tr); err != nil {
+				return nil, err
+			}
+		case detectRevision && dump.ParseSourceType(path.Clean(dir)) == dump.VictoriaMetrics && header.Size > 0:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s", header.Name)
+			}
+			mc.addChunk(header.Name, content)
+
+			br, format, err := openVMChunk(content)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s", header.Name)
+			}
+			switch format {
+			case "":
+				continue
+			case "native":
+				if info.NativeRevision, err = native.DetectRevision(br); err != nil {
+					return nil, errors.Wrapf(err, "failed to detect native format revision of chunk %s", header.Name)
+				}
+			}
+			detectRevision = info.NativeRevision == native.RevisionUnknown && format == "native"
+		case dir != "":
+			mc.addChunkSize(header.Name, header.Size)
+		}
+	}
+
+	if err = mc.check(); err != nil {
+		return nil, err
+	}
+
+	info.Manifest = mc.manifest
+	return info, nil
+}
+
 func writeMetafile(tw *tar.Writer, meta dump.Meta) error {
 	log.Debug().Msg("Writing dump meta")
 
@@ -0,0 +1,64 @@
+package transferer
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics"
+)
+
+// ErrNativeFormat is returned when VictoriaMetrics chunks are in native format, which could be read only by VictoriaMetrics
+var ErrNativeFormat = errors.New("VictoriaMetrics data is in native format: only JSON format is supported, export the dump without --vm-native-data")
+
+// ReadVMMetrics reads VictoriaMetrics chunks of the dump in JSON format and calls fn for every metric.
+// Encrypted dump is decrypted with the identities
+func ReadVMMetrics(r io.Reader, fn func(m victoriametrics.Metric), identities ...age.Identity) error {
+	dr, err := dump.NewDecompressReader(r, identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dump")
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file from dump")
+		}
+
+		dir, _ := path.Split(header.Name)
+		if dir == "" || dump.ParseSourceType(dir[:len(dir)-1]) != dump.VictoriaMetrics {
+			continue
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", header.Name)
+		}
+		br, format, err := openVMChunk(content)
+		switch {
+		case err != nil:
+			return errors.Wrapf(err, "invalid chunk %s", header.Name)
+		case format == "":
+			continue
+		case format != "json":
+			return ErrNativeFormat
+		}
+
+		metrics, err := victoriametrics.ParseMetrics(br)
+		if err != nil {
+			return errors.Wrapf(err, "invalid chunk %s", header.Name)
+		}
+		for _, m := range metrics {
+			fn(m)
+		}
+	}
+}
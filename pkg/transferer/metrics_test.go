@@ -0,0 +1,40 @@
+package transferer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics"
+)
+
+func TestReadVMMetrics(t *testing.T) {
+	jsonChunk := gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1,1],"timestamps":[1,2]}`+"\n"+
+		`{"metric":{"__name__":"up","instance":"a"},"values":[1],"timestamps":[1]}`+"\n"))
+
+	data := fakeDump(t, []fakeEntry{
+		{"vm/1-2.bin", jsonChunk},
+		{"vm/2-3.bin", nil},
+		{"ch/0.tsv", []byte("1\ta\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{})},
+	})
+	var metrics []victoriametrics.Metric
+	err := ReadVMMetrics(bytes.NewReader(data), func(m victoriametrics.Metric) {
+		metrics = append(metrics, m)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 || len(metrics[0].Values) != 2 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	native := fakeDump(t, []fakeEntry{
+		{"vm/1-2.bin", gzipData(t, []byte{0, 0, 0, 1})},
+	})
+	err = ReadVMMetrics(bytes.NewReader(native), func(victoriametrics.Metric) {})
+	if !errors.Is(err, ErrNativeFormat) {
+		t.Fatalf("expected ErrNativeFormat, got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"path"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/dump"
+)
+
+// ErrNoClickHouseColumns is returned for the dump exported by older pmm-dump, which doesn't store ClickHouse columns in meta
+var ErrNoClickHouseColumns = errors.New("meta doesn't contain ClickHouse columns: the dump should be exported by a newer pmm-dump version")
+
+// ReadClickHouseRecords reads ClickHouse chunks of the dump and calls fn for every row with columns of the metrics table.
+// Meta is written after the chunks, so the chunks are kept in memory till the meta is read.
+// Encrypted dump is decrypted with the identities
+func ReadClickHouseRecords(r io.Reader, fn func(columns []dump.ClickHouseColumn, record []string) error, identities ...age.Identity) error {
+	dr, err := dump.NewDecompressReader(r, identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dump")
+	}
+	defer dr.Close()
+
+	type chunk struct {
+		name    string
+		content []byte
+	}
+	var chunks []chunk
+	var meta *dump.Meta
+
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file from dump")
+		}
+
+		dir, filename := path.Split(header.Name)
+		switch {
+		case dir == "" && filename == dump.MetaFilename:
+			if meta, err = readMetafile(tr); err != nil {
+				return errors.Wrap(err, "failed to read meta file")
+			}
+		case dir != "" && dump.ParseSourceType(dir[:len(dir)-1]) == dump.ClickHouse:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", header.Name)
+			}
+			chunks = append(chunks, chunk{name: header.Name, content: content})
+		}
+	}
+
+	if len(chunks) == 0 {
+		return nil
+	}
+	if meta == nil {
+		return errors.New("no meta file found in dump")
+	}
+	if len(meta.ClickHouseColumns) == 0 {
+		return ErrNoClickHouseColumns
+	}
+
+	for _, c := range chunks {
+		cr := csv.NewReader(bytes.NewReader(c.content))
+		cr.Comma = '\t'
+		cr.FieldsPerRecord = len(meta.ClickHouseColumns)
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrapf(err, "invalid chunk %s", c.name)
+			}
+			if err = fn(meta.ClickHouseColumns, record); err != nil {
+				return errors.Wrapf(err, "invalid chunk %s", c.name)
+			}
+		}
+	}
+	return nil
+}
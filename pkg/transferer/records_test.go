@@ -0,0 +1,52 @@
+package transferer
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestReadClickHouseRecords(t *testing.T) {
+	columns := []dump.ClickHouseColumn{{Name: "queryid", Type: "String"}, {Name: "num_queries", Type: "Float32"}}
+	data := fakeDump(t, []fakeEntry{
+		{"vm/1-2.bin", nil},
+		{"ch/0.tsv", []byte("a\t1\nb\t2\n")},
+		{"ch/1.tsv", []byte("c\t3\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{ClickHouseColumns: columns})},
+	})
+	var records [][]string
+	err := ReadClickHouseRecords(bytes.NewReader(data), func(c []dump.ClickHouseColumn, record []string) error {
+		if !reflect.DeepEqual(c, columns) {
+			t.Fatalf("unexpected columns: %+v", c)
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected %v, got %v", expected, records)
+	}
+
+	invalid := fakeDump(t, []fakeEntry{
+		{"ch/0.tsv", []byte("a\t1\t2\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{ClickHouseColumns: columns})},
+	})
+	if err = ReadClickHouseRecords(bytes.NewReader(invalid), func([]dump.ClickHouseColumn, []string) error { return nil }); err == nil {
+		t.Fatal("rows with wrong amount of columns should be rejected")
+	}
+
+	old := fakeDump(t, []fakeEntry{
+		{"ch/0.tsv", []byte("a\t1\n")},
+		{dump.MetaFilename, metaContent(t, dump.Meta{})},
+	})
+	err = ReadClickHouseRecords(bytes.NewReader(old), func([]dump.ClickHouseColumn, []string) error { return nil })
+	if !errors.Is(err, ErrNoClickHouseColumns) {
+		t.Fatalf("expected ErrNoClickHouseColumns, got %v", err)
+	}
+}
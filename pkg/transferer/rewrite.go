@@ -0,0 +1,145 @@
+package transferer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"runtime"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+
+	"pmm-dump/pkg/dump"
+)
+
+// ChunkConverter converts a chunk of the dump being rewritten. The chunk is dropped if nil is returned
+type ChunkConverter func(c *dump.Chunk) (*dump.Chunk, error)
+
+// NewRewriter creates transferer, which writes the dump into the file from the chunks of other dumps without any sources
+func NewRewriter(file io.ReadWriter, workersCount int) *Transferer {
+	if workersCount <= 0 {
+		workersCount = runtime.NumCPU()
+	}
+	return &Transferer{
+		workersCount: workersCount,
+		file:         file,
+	}
+}
+
+// Rewrite reads chunks of the dump parts one by one, converts them by workers and writes them into the new dump
+// with the transferer compression, encryption and split settings. Manifest is calculated again for the new chunks
+func (t Transferer) Rewrite(ctx context.Context, dumpParts []string, meta dump.Meta, logBuffer *dump.LogBuffer, convert ChunkConverter) error {
+	rawCh := make(chan *dump.Chunk, maxChunksInMem)
+	chunksCh := make(chan *exportChunk, maxChunksInMem)
+	g, gCtx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		defer close(rawCh)
+		for _, dumpPart := range dumpParts {
+			err := ReadDumpChunks(dumpPart, func(c *dump.Chunk) error {
+				select {
+				case rawCh <- c:
+					return nil
+				case <-gCtx.Done():
+					return gCtx.Err()
+				}
+			}, t.identities...)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", dumpPart)
+			}
+		}
+		return nil
+	})
+
+	convertG, convertCtx := errgroup.WithContext(gCtx)
+	for i := 0; i < t.workersCount; i++ {
+		convertG.Go(func() error {
+			for c := range rawCh {
+				converted, err := convert(c)
+				if err != nil {
+					return errors.Wrapf(err, "failed to convert chunk %s", path.Join(c.Source.String(), c.Filename))
+				}
+				if converted == nil {
+					continue
+				}
+				select {
+				case chunksCh <- &exportChunk{Chunk: converted, manifest: newManifestChunk(converted)}:
+				case <-convertCtx.Done():
+					return convertCtx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(chunksCh)
+		return convertG.Wait()
+	})
+
+	g.Go(func() error {
+		if err := t.writeChunksToFile(meta, chunksCh, logBuffer, nil); err != nil {
+			return errors.Wrap(err, "failed to write chunks to the dump")
+		}
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	log.Info().Msg("Successfully rewritten!")
+	return nil
+}
+
+// ReadDumpChunks reads chunks of the dump file one by one and calls fn for every chunk. Meta, manifest and log are skipped.
+// Encrypted dump is decrypted with the identities
+func ReadDumpChunks(dumpPath string, fn func(c *dump.Chunk) error, identities ...age.Identity) error {
+	file, err := openDumpFile(dumpPath, false)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dr, err := dump.NewDecompressReader(file, identities...)
+	if err != nil {
+		return errors.Wrap(err, "failed to open dump")
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file from dump")
+		}
+
+		dir, filename := path.Split(header.Name)
+		if dir == "" || filename == "" {
+			continue
+		}
+		source := dump.ParseSourceType(dir[:len(dir)-1])
+		if source == dump.UndefinedSource {
+			log.Warn().Msgf("Skipping chunk %s of undefined source", header.Name)
+			continue
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", header.Name)
+		}
+		chunkMeta, err := dump.ParseChunkMeta(source, filename)
+		if err != nil {
+			log.Warn().Msgf("Failed to decode chunk filename %s: %v", header.Name, err)
+			chunkMeta = dump.ChunkMeta{Source: source}
+		}
+
+		if err = fn(&dump.Chunk{ChunkMeta: chunkMeta, Content: content, Filename: filename}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestRewrite(t *testing.T) {
+	dir := t.TempDir()
+	var parts []string
+	for i, files := range [][]fakeEntry{
+		{
+			{"vm/1-2.bin", gzipData(t, []byte("first"))},
+			{"ch/0.tsv", []byte("a\t1\n")},
+			{dump.MetaFilename, metaContent(t, dump.Meta{VMDataFormat: "native"})},
+		},
+		{
+			{"vm/2-3.bin", gzipData(t, []byte("second"))},
+			{"vm/3-4.bin", gzipData(t, []byte("dropped"))},
+			{dump.ManifestFilename, manifestContent(t)},
+			{dump.MetaFilename, metaContent(t, dump.Meta{VMDataFormat: "native"})},
+			{dump.LogFilename, []byte("old log")},
+		},
+	} {
+		part := filepath.Join(dir, dump.PartPath("dump.tar.gz", i+1))
+		if err := os.WriteFile(part, fakeDump(t, files), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+	}
+
+	converted := map[string][]byte{
+		"1-2.bin": gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}`+"\n")),
+		"2-3.bin": gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[2000]}`+"\n")),
+	}
+	buf := new(bytes.Buffer)
+	tr := NewRewriter(buf, 2)
+	logBuffer := new(dump.LogBuffer)
+	_, _ = logBuffer.Write([]byte("new log"))
+	err := tr.Rewrite(context.Background(), parts, dump.Meta{VMDataFormat: "json", PMMServerVersion: "2.38.0"}, logBuffer, func(c *dump.Chunk) (*dump.Chunk, error) {
+		if c.Source != dump.VictoriaMetrics {
+			return c, nil
+		}
+		content, ok := converted[c.Filename]
+		if !ok {
+			return nil, nil
+		}
+		c.Content = content
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := Verify(bytes.NewReader(buf.Bytes()))
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report.VMChunks != 2 || report.CHChunks != 1 || report.ManifestChunks != 3 {
+		t.Fatalf("unexpected chunks: %+v", report)
+	}
+	if report.Meta == nil || report.Meta.PMMServerVersion != "2.38.0" {
+		t.Fatalf("unexpected meta: %+v", report.Meta)
+	}
+
+	contents := make(map[string]string)
+	dr, err := dump.NewDecompressReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(dr)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[header.Name] = string(content)
+	}
+	for name, expected := range map[string]string{"vm/1-2.bin": string(converted["1-2.bin"]), "vm/2-3.bin": string(converted["2-3.bin"]), "ch/0.tsv": "a\t1\n", dump.LogFilename: "new log"} {
+		if contents[name] != expected {
+			t.Fatalf("expected %s to be %q, got %q", name, expected, contents[name])
+		}
+	}
+
+	if err = tr.Rewrite(context.Background(), []string{filepath.Join(dir, "missing.tar.gz")}, dump.Meta{}, new(dump.LogBuffer),
+		func(c *dump.Chunk) (*dump.Chunk, error) { return c, nil }); err == nil {
+		t.Fatal("missing dump should be rejected")
+	}
+}
@@ -3,17 +3,41 @@ package transferer
 import (
 	"io"
 	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/retry"
+	"pmm-dump/pkg/victoriametrics/native"
 	"runtime"
+	"time"
 
+	"filippo.io/age"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 type Transferer struct {
 	sources      []dump.Source
 	workersCount int
 	file         io.ReadWriter
+
+	compression      dump.Compression
+	compressionLevel int
+
+	recipients      []age.Recipient
+	keepMetaInClear bool
+	identities      []age.Identity
+
+	splitSize  int64
+	createPart PartCreator
+
+	nativeRevision native.Revision
+
+	retrier *retry.Retrier
+
+	manifest *dump.Manifest
 }
 
+// PartCreator creates file for the dump part with the given number. Parts are numbered from 1
+type PartCreator func(number int) (io.WriteCloser, error)
+
 func New(file io.ReadWriter, s []dump.Source, workersCount int) (*Transferer, error) {
 	if len(s) == 0 {
 		return nil, errors.New("no sources provided")
@@ -30,10 +54,94 @@ func New(file io.ReadWriter, s []dump.Source, workersCount int) (*Transferer, er
 	}, nil
 }
 
+// SetCompression sets compression of the dump written by export. Import detects compression of the dump by itself
+func (t *Transferer) SetCompression(c dump.Compression, level int) {
+	t.compression = c
+	t.compressionLevel = level
+}
+
+// SetEncryption makes export encrypt the dump for the recipients. If keepMetaInClear is set,
+// meta is also written in clear, so it could be read without the key
+func (t *Transferer) SetEncryption(recipients []age.Recipient, keepMetaInClear bool) {
+	t.recipients = recipients
+	t.keepMetaInClear = keepMetaInClear
+}
+
+// SetSplit makes export split the dump into parts of the given size. Every part is a complete dump archive
+// with its own manifest and meta. Transferer file is not used in this case: parts are created by the creator
+func (t *Transferer) SetSplit(size int64, create PartCreator) {
+	t.splitSize = size
+	t.createPart = create
+}
+
+// SetNativeRevision sets revision of the native format accepted by VictoriaMetrics, so import refuses dumps of another revision.
+// Merge writes converted native chunks in this revision
+func (t *Transferer) SetNativeRevision(rev native.Revision) {
+	t.nativeRevision = rev
+}
+
+// SetRetryPolicy makes export and import repeat failed reads and writes of every chunk with the policy
+func (t *Transferer) SetRetryPolicy(p retry.Policy) {
+	t.retrier = retry.NewRetrier(p)
+}
+
+// logRetries writes counters of the retried chunks to the log
+func (t Transferer) logRetries() {
+	stats := t.retryStats()
+	if stats == nil {
+		return
+	}
+	log.Info().
+		Interface("retries", stats).
+		Msgf("Chunk retries: %d, recovered chunks: %d, failed chunks: %d", stats.Retries, stats.Recovered, stats.Failed)
+}
+
+// retryStats returns counters of the retried chunks or nil if chunks aren't retried
+func (t Transferer) retryStats() *dump.RetryStats {
+	if t.retrier == nil {
+		return nil
+	}
+	stats := t.retrier.Stats()
+	return &dump.RetryStats{
+		Retries:   stats.Retries,
+		Recovered: stats.Recovered,
+		Failed:    stats.Failed,
+	}
+}
+
+// WorkersCount returns the number of goroutines reading chunks
+func (t *Transferer) WorkersCount() int {
+	return t.workersCount
+}
+
+// SetManifest sets the manifest read from the dump before import, so every chunk is checked against it
+// before it's written to the source. Otherwise chunks are checked only after the manifest at the end of the dump is read
+func (t *Transferer) SetManifest(m *dump.Manifest) {
+	t.manifest = m
+}
+
+// SetIdentities sets identities to decrypt encrypted dump on import
+func (t *Transferer) SetIdentities(identities []age.Identity) {
+	t.identities = identities
+}
+
 type ChunkPool interface {
 	Next() (dump.ChunkMeta, bool)
 }
 
+// AdaptiveChunkPool is the pool, which plans chunks depending on the results of reading the previous ones.
+// Feedback returns true if the chunk is replaced by other chunks of the pool, so it must not be written to the dump
+type AdaptiveChunkPool interface {
+	ChunkPool
+	Feedback(m dump.ChunkMeta, c *dump.Chunk, elapsed time.Duration, err error) bool
+}
+
+// ChunkReconciler is implemented by sources, which duplicate data if the same chunk is written twice.
+// ChunkWritten reports whether the chunk, which writing was interrupted or failed, was actually written
+type ChunkReconciler interface {
+	ChunkWritten(r io.Reader) (bool, error)
+}
+
 type LoadStatusGetter interface {
 	GetLatestStatus() (LoadStatus, int)
 }
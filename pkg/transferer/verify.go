@@ -0,0 +1,301 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// VerifyReport contains results of the offline dump verification
+type VerifyReport struct {
+	Meta *dump.Meta
+
+	VMChunks         int
+	VMDataFormat     string
+	VMNativeRevision native.Revision
+	CHChunks         int
+	CHColumns        int
+
+	MaxChunkSize int64
+
+	// ManifestChunks is the number of chunks listed in the manifest. It's zero for the dumps without manifest
+	ManifestChunks int
+
+	Problems []string
+}
+
+func (r *VerifyReport) addProblem(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	log.Debug().Msgf("Found problem: %s", problem)
+	r.Problems = append(r.Problems, problem)
+}
+
+// Verify reads the whole dump and validates its structure and chunks content without connecting to PMM.
+// Encrypted dump is decrypted with the identities
+func Verify(r io.Reader, identities ...age.Identity) *VerifyReport {
+	report := new(VerifyReport)
+
+	dr, err := dump.NewDecompressReader(r, identities...)
+	if err != nil {
+		report.addProblem("failed to open dump: %v", err)
+		return report
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	mc := newManifestChecker()
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.addProblem("failed to read file from dump: %v", err)
+			return report
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			report.addProblem("failed to read %s: %v", header.Name, err)
+			return report
+		}
+
+		dir, filename := path.Split(header.Name)
+
+		switch {
+		case dir == "" && filename == dump.MetaFilename:
+			meta, err := readMetafile(bytes.NewReader(content))
+			if err != nil {
+				report.addProblem("failed to parse %s: %v", dump.MetaFilename, err)
+				continue
+			}
+			report.Meta = meta
+			continue
+		case dir == "" && filename == dump.ManifestFilename:
+			if err := mc.setManifest(bytes.NewReader(content)); err != nil {
+				report.addProblem("failed to parse %s: %v", dump.ManifestFilename, err)
+				continue
+			}
+			report.ManifestChunks = len(mc.manifest.Chunks)
+			continue
+		case dir == "" && filename == dump.LogFilename:
+			continue
+		case dir == "":
+			report.addProblem("found unknown file %s", header.Name)
+			continue
+		}
+
+		log.Debug().Msgf("Verifying chunk %s", header.Name)
+
+		mc.addChunk(header.Name, content)
+
+		if size := int64(len(content)); size > report.MaxChunkSize {
+			report.MaxChunkSize = size
+		}
+
+		switch dump.ParseSourceType(dir[:len(dir)-1]) {
+		case dump.VictoriaMetrics:
+			report.VMChunks++
+			format, rev, err := readVMChunk(content, func(map[string]string, int) {})
+			if err != nil {
+				report.addProblem("invalid chunk %s: %v", header.Name, err)
+				continue
+			}
+			switch {
+			case format == "":
+			case report.VMDataFormat == "":
+				report.VMDataFormat = format
+			case report.VMDataFormat != format:
+				report.addProblem("chunk %s has %s format, but previous chunks have %s format", header.Name, format, report.VMDataFormat)
+			}
+			switch {
+			case rev == native.RevisionUnknown:
+			case report.VMNativeRevision == native.RevisionUnknown:
+				report.VMNativeRevision = rev
+			case report.VMNativeRevision != rev:
+				report.addProblem("chunk %s has native blocks of revision %s, but previous chunks have revision %s", header.Name, rev, report.VMNativeRevision)
+			}
+		case dump.ClickHouse:
+			report.CHChunks++
+			columns, _, err := parseCHChunk(content)
+			if err != nil {
+				report.addProblem("invalid chunk %s: %v", header.Name, err)
+				continue
+			}
+			switch {
+			case columns == 0:
+			case report.CHColumns == 0:
+				report.CHColumns = columns
+			case report.CHColumns != columns:
+				report.addProblem("chunk %s has %d columns, but previous chunks have %d columns", header.Name, columns, report.CHColumns)
+			}
+		default:
+			report.addProblem("found chunk %s of undefined source", header.Name)
+		}
+	}
+
+	if mc.hasManifest() {
+		for _, problem := range mc.problems() {
+			report.addProblem("%s", problem)
+		}
+	} else {
+		log.Warn().Msgf("No %s found in dump: chunks checksums can't be verified", dump.ManifestFilename)
+	}
+
+	if report.Meta == nil {
+		report.addProblem("no %s found in dump", dump.MetaFilename)
+		return report
+	}
+
+	if report.Meta.MaxChunkSize != report.MaxChunkSize {
+		report.addProblem("max chunk size in meta is %d, but the biggest chunk has %d bytes", report.Meta.MaxChunkSize, report.MaxChunkSize)
+	}
+
+	if report.VMDataFormat != "" && report.Meta.VMDataFormat != "" && report.Meta.VMDataFormat != report.VMDataFormat {
+		report.addProblem("meta has %s VictoriaMetrics data format, but chunks have %s format", report.Meta.VMDataFormat, report.VMDataFormat)
+	}
+
+	return report
+}
+
+// parseVMChunk parses chunk content and returns its data format and series count.
+// Empty format is returned for the chunk without data
+func parseVMChunk(content []byte) (string, int, error) {
+	// Series could be split into several blocks, so they are counted by unique labels
+	series := make(map[string]struct{})
+	format, _, err := readVMChunk(content, func(labels map[string]string, _ int) {
+		series[labelsKey(labels)] = struct{}{}
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return format, len(series), nil
+}
+
+// readVMChunk calls fn for every series block of the chunk with its labels and samples count.
+// It returns data format of the chunk or empty format for the chunk without data and revision of the native blocks
+func readVMChunk(content []byte, fn func(labels map[string]string, samples int)) (string, native.Revision, error) {
+	br, format, err := openVMChunk(content)
+	if err != nil || format == "" {
+		return "", native.RevisionUnknown, err
+	}
+
+	if format == "json" {
+		metrics, err := victoriametrics.ParseMetrics(br)
+		if err != nil {
+			return "", native.RevisionUnknown, err
+		}
+		for _, m := range metrics {
+			fn(m.Metric, len(m.Values))
+		}
+		return format, native.RevisionUnknown, nil
+	}
+
+	nr, err := native.NewReader(br)
+	if err != nil {
+		return "", native.RevisionUnknown, err
+	}
+	rev := native.RevisionUnknown
+	for {
+		b, err := nr.Next()
+		if err == io.EOF {
+			return format, rev, nil
+		}
+		if err != nil {
+			return "", native.RevisionUnknown, err
+		}
+		if rev == native.RevisionUnknown {
+			rev = b.Revision
+		}
+		fn(b.Labels, int(b.Header.RowsCount))
+	}
+}
+
+// vmChunkRevision returns revision of the first native block of the chunk. It's unknown for JSON chunk or chunk without data
+func vmChunkRevision(content []byte) (native.Revision, error) {
+	br, format, err := openVMChunk(content)
+	if err != nil || format != "native" {
+		return native.RevisionUnknown, err
+	}
+	return native.DetectRevision(br)
+}
+
+// openVMChunk returns reader of the decompressed chunk and its data format: json or native.
+// Empty format is returned for the chunk without data
+func openVMChunk(content []byte) (*bufio.Reader, string, error) {
+	if len(content) == 0 {
+		return nil, "", nil
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to open as gzip")
+	}
+
+	br := bufio.NewReader(gzr)
+	first, err := br.Peek(1)
+	if err == io.EOF {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to decompress")
+	}
+	if first[0] == '{' {
+		return br, "json", nil
+	}
+	return br, "native", nil
+}
+
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(strconv.Quote(k))
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// parseCHChunk parses TSV chunk and returns its columns and rows count
+func parseCHChunk(content []byte) (int, int, error) {
+	r := csv.NewReader(bytes.NewReader(content))
+	r.Comma = '\t'
+	r.FieldsPerRecord = 0
+
+	columns, rows := 0, 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return columns, rows, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		columns = len(record)
+		rows++
+	}
+}
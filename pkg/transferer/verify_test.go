@@ -0,0 +1,193 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"pmm-dump/pkg/dump"
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+func TestVerify(t *testing.T) {
+	vmChunk := gzipData(t, []byte(`{"metric":{"__name__":"up"},"values":[1,1],"timestamps":[1,2]}`+"\n"))
+	truncatedVMChunk := gzipData(t, []byte(`{"metric":`))
+	chChunk := []byte("1\ta\t2\n3\tb\t4\n")
+	maxSize := int64(len(vmChunk))
+	if int64(len(chChunk)) > maxSize {
+		maxSize = int64(len(chChunk))
+	}
+
+	tests := []struct {
+		name     string
+		files    []fakeEntry
+		problems int
+	}{
+		{
+			name: "valid",
+			files: []fakeEntry{
+				{"vm/1-2.bin", vmChunk},
+				{"ch/0.tsv", chChunk},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: maxSize, VMDataFormat: "json"})},
+				{dump.LogFilename, []byte("log")},
+			},
+		},
+		{
+			name: "no meta",
+			files: []fakeEntry{
+				{"vm/1-2.bin", vmChunk},
+			},
+			problems: 1,
+		},
+		{
+			name: "wrong max chunk size",
+			files: []fakeEntry{
+				{"vm/1-2.bin", vmChunk},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: 1, VMDataFormat: "json"})},
+			},
+			problems: 1,
+		},
+		{
+			name: "wrong vm data format",
+			files: []fakeEntry{
+				{"vm/1-2.bin", vmChunk},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: int64(len(vmChunk)), VMDataFormat: "native"})},
+			},
+			problems: 1,
+		},
+		{
+			name: "mixed native revisions",
+			files: []fakeEntry{
+				{"vm/1-2.bin", nativeChunk(t, native.RevisionV1)},
+				{"vm/2-3.bin", nativeChunk(t, native.RevisionV2)},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: int64(len(nativeChunk(t, native.RevisionV2))), VMDataFormat: "native"})},
+			},
+			problems: 1,
+		},
+		{
+			name: "corrupted chunks",
+			files: []fakeEntry{
+				{"vm/1-2.bin", []byte("invalid")},
+				{"vm/2-3.bin", truncatedVMChunk},
+				{"ch/0.tsv", []byte("1\t2\n3\n")},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: int64(len(truncatedVMChunk))})},
+			},
+			problems: 3,
+		},
+		{
+			name: "manifest mismatch",
+			files: []fakeEntry{
+				{"vm/1-2.bin", vmChunk},
+				{"ch/0.tsv", chChunk},
+				{dump.ManifestFilename, manifestContent(t,
+					dump.ManifestChunk{Filename: "vm/1-2.bin", Size: int64(len(vmChunk)), SHA256: checksum(chChunk)},
+					dump.ManifestChunk{Filename: "vm/2-3.bin", Size: int64(len(vmChunk)), SHA256: checksum(vmChunk)},
+				)},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: maxSize, VMDataFormat: "json"})},
+			},
+			problems: 3,
+		},
+		{
+			name: "unknown files",
+			files: []fakeEntry{
+				{"unknown.bin", []byte("data")},
+				{"xx/1-2.bin", []byte("data")},
+				{dump.MetaFilename, metaContent(t, dump.Meta{MaxChunkSize: 4})},
+			},
+			problems: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := Verify(bytes.NewReader(fakeDump(t, tt.files)))
+			if len(report.Problems) != tt.problems {
+				t.Fatalf("expected %d problems, got %d: %v", tt.problems, len(report.Problems), report.Problems)
+			}
+		})
+	}
+
+	t.Run("invalid gzip", func(t *testing.T) {
+		report := Verify(bytes.NewReader([]byte("invalid data")))
+		if len(report.Problems) != 1 {
+			t.Fatalf("expected 1 problem, got %v", report.Problems)
+		}
+	})
+}
+
+type fakeEntry struct {
+	name    string
+	content []byte
+}
+
+func fakeDump(t *testing.T, files []fakeEntry) []byte {
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Size:     int64(len(f.content)),
+			Mode:     0600,
+			ModTime:  time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err, "failed to write file header")
+		}
+		if _, err = tw.Write(f.content); err != nil {
+			t.Fatal(err, "failed to write file content")
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// nativeChunk returns gzipped native chunk with a single series of the revision
+func nativeChunk(t *testing.T, rev native.Revision) []byte {
+	buf := new(bytes.Buffer)
+	w, err := native.NewWriter(buf, rev, 1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteSeries(map[string]string{native.MetricNameLabel: "up"}, []int64{1000, 2000}, []float64{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	return gzipData(t, buf.Bytes())
+}
+
+func metaContent(t *testing.T, meta dump.Meta) []byte {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func manifestContent(t *testing.T, chunks ...dump.ManifestChunk) []byte {
+	data, err := json.Marshal(dump.Manifest{Chunks: chunks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
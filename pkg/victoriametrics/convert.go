@@ -0,0 +1,203 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+// Data formats of VictoriaMetrics chunks
+const (
+	FormatJSON   = "json"
+	FormatNative = "native"
+	// FormatOpenMetrics is the text format with timestamps for the tools other than PMM. It's not used in chunks
+	FormatOpenMetrics = "openmetrics"
+)
+
+// DecodeChunk returns metrics and format of the gzipped chunk in JSON or native format.
+// Blocks of the same series in the native chunk are merged into a single metric
+func DecodeChunk(content []byte) ([]Metric, string, error) {
+	if len(content) == 0 {
+		return nil, "", nil
+	}
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to create gzip reader")
+	}
+	defer gzr.Close()
+
+	br := bufio.NewReader(gzr)
+	first, err := br.Peek(1)
+	if err == io.EOF {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to decompress")
+	}
+	if first[0] == '{' {
+		metrics, err := ParseMetrics(br)
+		return metrics, FormatJSON, err
+	}
+
+	nr, err := native.NewReader(br)
+	if err != nil {
+		return nil, "", err
+	}
+	var metrics []Metric
+	byName := make(map[string]int)
+	for {
+		b, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		timestamps, values, err := b.Decode()
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to decode block of %v", b.Labels)
+		}
+		name := string(native.MarshalMetricName(b.Labels))
+		i, ok := byName[name]
+		if !ok {
+			i = len(metrics)
+			byName[name] = i
+			metrics = append(metrics, Metric{Metric: b.Labels})
+		}
+		metrics[i].Timestamps = append(metrics[i].Timestamps, timestamps...)
+		metrics[i].Values = append(metrics[i].Values, values...)
+	}
+	for i := range metrics {
+		sortSamples(&metrics[i])
+	}
+	return metrics, FormatNative, nil
+}
+
+// EncodeChunk returns gzipped chunk with the metrics in the format. Native chunk is written in the revision.
+// NaN and infinite values can't be represented in JSON, so they are dropped
+func EncodeChunk(metrics []Metric, format string, rev native.Revision) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(gzw)
+		for _, m := range metrics {
+			m = finiteSamples(m)
+			if len(m.Values) == 0 {
+				continue
+			}
+			if err := enc.Encode(m); err != nil {
+				return nil, errors.Wrap(err, "failed to marshal metric")
+			}
+		}
+	case FormatNative:
+		minTimestamp, maxTimestamp := int64(math.MaxInt64), int64(math.MinInt64)
+		for _, m := range metrics {
+			for _, ts := range m.Timestamps {
+				if ts < minTimestamp {
+					minTimestamp = ts
+				}
+				if ts > maxTimestamp {
+					maxTimestamp = ts
+				}
+			}
+		}
+		if minTimestamp > maxTimestamp {
+			minTimestamp, maxTimestamp = 0, 0
+		}
+
+		nw, err := native.NewWriter(gzw, rev, minTimestamp, maxTimestamp)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metrics {
+			sortSamples(&m)
+			if len(m.Values) == 0 {
+				continue
+			}
+			if err = nw.WriteSeries(m.Metric, m.Timestamps, m.Values); err != nil {
+				return nil, errors.Wrapf(err, "failed to write series %v", m.Metric)
+			}
+		}
+	default:
+		return nil, errors.Errorf("unknown format %q", format)
+	}
+
+	if err := gzw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to close gzip writer")
+	}
+	return buf.Bytes(), nil
+}
+
+// MergeMetrics returns union of the metrics lists. Samples of the same series are merged and sorted by timestamp.
+// If several samples have the same timestamp, the first one is kept
+func MergeMetrics(lists ...[]Metric) []Metric {
+	var result []Metric
+	byName := make(map[string]int)
+	for _, metrics := range lists {
+		for _, m := range metrics {
+			name := string(native.MarshalMetricName(m.Metric))
+			i, ok := byName[name]
+			if !ok {
+				i = len(result)
+				byName[name] = i
+				result = append(result, Metric{Metric: m.Metric})
+			}
+			result[i].Timestamps = append(result[i].Timestamps, m.Timestamps...)
+			result[i].Values = append(result[i].Values, m.Values...)
+		}
+	}
+	for i := range result {
+		m := &result[i]
+		sortSamples(m)
+		n := 0
+		for j := range m.Timestamps {
+			if j > 0 && m.Timestamps[j] == m.Timestamps[n-1] {
+				continue
+			}
+			m.Timestamps[n], m.Values[n] = m.Timestamps[j], m.Values[j]
+			n++
+		}
+		m.Timestamps, m.Values = m.Timestamps[:n], m.Values[:n]
+	}
+	return result
+}
+
+// sortSamples sorts samples of the metric by timestamp. Metric is modified in place only if samples are unsorted
+func sortSamples(m *Metric) {
+	if sort.SliceIsSorted(m.Timestamps, func(i, j int) bool { return m.Timestamps[i] < m.Timestamps[j] }) {
+		return
+	}
+	timestamps := append([]int64(nil), m.Timestamps...)
+	values := append([]float64(nil), m.Values...)
+	idx := make([]int, len(timestamps))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return timestamps[idx[i]] < timestamps[idx[j]] })
+	m.Timestamps = make([]int64, len(idx))
+	m.Values = make([]float64, len(idx))
+	for i, j := range idx {
+		m.Timestamps[i], m.Values[i] = timestamps[j], values[j]
+	}
+}
+
+func finiteSamples(m Metric) Metric {
+	result := Metric{Metric: m.Metric}
+	for i, v := range m.Values {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			result.Timestamps = append(result.Timestamps, m.Timestamps[i])
+			result.Values = append(result.Values, v)
+		}
+	}
+	return result
+}
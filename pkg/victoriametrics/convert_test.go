@@ -0,0 +1,104 @@
+package victoriametrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"pmm-dump/pkg/victoriametrics/native"
+)
+
+func TestConvertChunk(t *testing.T) {
+	metrics := []Metric{
+		{
+			Metric:     map[string]string{"__name__": "up", "job": "node"},
+			Values:     []float64{1, 1, 0},
+			Timestamps: []int64{1000, 2000, 3000},
+		},
+		{
+			Metric:     map[string]string{"__name__": "requests_total", "job": "node"},
+			Values:     []float64{10.5, 12, 20.25},
+			Timestamps: []int64{3000, 1000, 2000},
+		},
+	}
+	expected := []Metric{
+		metrics[0],
+		{
+			Metric:     metrics[1].Metric,
+			Values:     []float64{12, 20.25, 10.5},
+			Timestamps: []int64{1000, 2000, 3000},
+		},
+	}
+
+	for _, rev := range []native.Revision{native.RevisionV1, native.RevisionV2} {
+		t.Run(rev.String(), func(t *testing.T) {
+			nativeChunk, err := EncodeChunk(metrics, FormatNative, rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, format, err := DecodeChunk(nativeChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != FormatNative || !reflect.DeepEqual(decoded, expected) {
+				t.Fatalf("expected %s %v, got %s %v", FormatNative, expected, format, decoded)
+			}
+
+			jsonChunk, err := EncodeChunk(decoded, FormatJSON, rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, format, err = DecodeChunk(jsonChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != FormatJSON || !reflect.DeepEqual(decoded, expected) {
+				t.Fatalf("expected %s %v, got %s %v", FormatJSON, expected, format, decoded)
+			}
+		})
+	}
+
+	special := []Metric{{
+		Metric:     map[string]string{"__name__": "up"},
+		Values:     []float64{math.NaN(), 1, math.Inf(1)},
+		Timestamps: []int64{1000, 2000, 3000},
+	}}
+	jsonChunk, err := EncodeChunk(special, FormatJSON, native.RevisionV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := DecodeChunk(jsonChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || !reflect.DeepEqual(decoded[0].Values, []float64{1}) {
+		t.Fatalf("non-finite values should be dropped from JSON, got %v", decoded)
+	}
+
+	if _, err = EncodeChunk(metrics, "csv", native.RevisionV2); err == nil {
+		t.Fatal("unknown format should be rejected")
+	}
+}
+
+func TestMergeMetrics(t *testing.T) {
+	a := []Metric{
+		{Metric: map[string]string{"__name__": "up", "job": "node"}, Timestamps: []int64{1000, 3000}, Values: []float64{1, 1}},
+		{Metric: map[string]string{"__name__": "up", "job": "mysql"}, Timestamps: []int64{1000}, Values: []float64{0}},
+	}
+	b := []Metric{
+		{Metric: map[string]string{"__name__": "up", "job": "node"}, Timestamps: []int64{2000, 3000}, Values: []float64{0, 5}},
+		{Metric: map[string]string{"__name__": "node_load1"}, Timestamps: []int64{1000}, Values: []float64{0.5}},
+	}
+	expected := []Metric{
+		{Metric: map[string]string{"__name__": "up", "job": "node"}, Timestamps: []int64{1000, 2000, 3000}, Values: []float64{1, 0, 1}},
+		{Metric: map[string]string{"__name__": "up", "job": "mysql"}, Timestamps: []int64{1000}, Values: []float64{0}},
+		{Metric: map[string]string{"__name__": "node_load1"}, Timestamps: []int64{1000}, Values: []float64{0.5}},
+	}
+	merged := MergeMetrics(a, b)
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("expected %v, got %v", expected, merged)
+	}
+	if !reflect.DeepEqual(a[0].Timestamps, []int64{1000, 3000}) {
+		t.Fatal("merged metrics should not be modified")
+	}
+}
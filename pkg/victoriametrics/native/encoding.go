@@ -0,0 +1,334 @@
+package native
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Marshal types of timestamps and values data in the block
+const (
+	marshalTypeZSTDNearestDelta2 = 1
+	marshalTypeDeltaConst        = 2
+	marshalTypeConst             = 3
+	marshalTypeZSTDNearestDelta  = 4
+	marshalTypeNearestDelta2     = 5
+	marshalTypeNearestDelta      = 6
+)
+
+// minCompressibleSize is the minimal size of the data, which is compressed with zstd
+const minCompressibleSize = 128
+
+// Special values of the decimal mantissa
+const (
+	vInfPos   int64 = 1<<63 - 1
+	vInfNeg   int64 = -1 << 63
+	vStaleNaN int64 = 1<<63 - 2
+	vMax      int64 = 1<<63 - 3
+)
+
+// staleNaN is the staleness marker of VictoriaMetrics
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+var (
+	zstdOnce    sync.Once
+	zstdDecoder *zstd.Decoder
+	zstdEncoder *zstd.Encoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+}
+
+// unmarshalInt64Array decodes itemsCount values of the block data
+func unmarshalInt64Array(src []byte, mt byte, firstValue int64, itemsCount int) ([]int64, error) {
+	switch mt {
+	case marshalTypeZSTDNearestDelta, marshalTypeZSTDNearestDelta2:
+		initZstd()
+		data, err := zstdDecoder.DecodeAll(src, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress zstd data")
+		}
+		if mt == marshalTypeZSTDNearestDelta {
+			return unmarshalNearestDelta(data, firstValue, itemsCount)
+		}
+		return unmarshalNearestDelta2(data, firstValue, itemsCount)
+	case marshalTypeNearestDelta:
+		return unmarshalNearestDelta(src, firstValue, itemsCount)
+	case marshalTypeNearestDelta2:
+		return unmarshalNearestDelta2(src, firstValue, itemsCount)
+	case marshalTypeConst:
+		if len(src) > 0 {
+			return nil, errors.Errorf("unexpected data for const marshal type: %d bytes", len(src))
+		}
+		result := make([]int64, itemsCount)
+		for i := range result {
+			result[i] = firstValue
+		}
+		return result, nil
+	case marshalTypeDeltaConst:
+		tail, d, err := unmarshalVarInt64(src)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal delta")
+		}
+		if len(tail) > 0 {
+			return nil, errors.Errorf("unexpected tail of %d bytes after delta", len(tail))
+		}
+		result := make([]int64, itemsCount)
+		v := firstValue
+		for i := range result {
+			result[i] = v
+			v += d
+		}
+		return result, nil
+	default:
+		return nil, errors.Errorf("unknown marshal type: %d", mt)
+	}
+}
+
+func unmarshalVarInt64s(src []byte, count int) ([]int64, error) {
+	result := make([]int64, count)
+	for i := range result {
+		var err error
+		if src, result[i], err = unmarshalVarInt64(src); err != nil {
+			return nil, err
+		}
+	}
+	if len(src) > 0 {
+		return nil, errors.Errorf("unexpected tail of %d bytes", len(src))
+	}
+	return result, nil
+}
+
+func unmarshalNearestDelta(src []byte, firstValue int64, itemsCount int) ([]int64, error) {
+	deltas, err := unmarshalVarInt64s(src, itemsCount-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal deltas")
+	}
+	result := make([]int64, 0, itemsCount)
+	v := firstValue
+	result = append(result, v)
+	for _, d := range deltas {
+		v += d
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func unmarshalNearestDelta2(src []byte, firstValue int64, itemsCount int) ([]int64, error) {
+	if itemsCount < 2 {
+		return nil, errors.Errorf("delta2 encoding requires at least 2 items, got %d", itemsCount)
+	}
+	deltas, err := unmarshalVarInt64s(src, itemsCount-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal deltas")
+	}
+	result := make([]int64, 0, itemsCount)
+	v, d1 := firstValue, deltas[0]
+	result = append(result, v)
+	v += d1
+	result = append(result, v)
+	for _, d2 := range deltas[1:] {
+		d1 += d2
+		v += d1
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// marshalInt64Array encodes values losslessly and returns the data, its marshal type and the first value
+func marshalInt64Array(dst []byte, a []int64) ([]byte, byte, int64) {
+	firstValue := a[0]
+	if isConst(a) {
+		return dst, marshalTypeConst, firstValue
+	}
+	if isDeltaConst(a) {
+		return binary.AppendVarint(dst, a[1]-a[0]), marshalTypeDeltaConst, firstValue
+	}
+
+	// Counters are better compressed with delta2 encoding and gauges with delta encoding
+	var data []byte
+	var mt byte = marshalTypeZSTDNearestDelta2
+	if isGauge(a) {
+		mt = marshalTypeZSTDNearestDelta
+		for i := 1; i < len(a); i++ {
+			data = binary.AppendVarint(data, a[i]-a[i-1])
+		}
+	} else {
+		d1 := a[1] - a[0]
+		data = binary.AppendVarint(data, d1)
+		for i := 2; i < len(a); i++ {
+			d := a[i] - a[i-1]
+			data = binary.AppendVarint(data, d-d1)
+			d1 = d
+		}
+	}
+
+	if len(data) >= minCompressibleSize {
+		initZstd()
+		compressed := zstdEncoder.EncodeAll(data, nil)
+		if float64(len(compressed)) <= 0.9*float64(len(data)) {
+			return append(dst, compressed...), mt, firstValue
+		}
+	}
+	if mt == marshalTypeZSTDNearestDelta {
+		mt = marshalTypeNearestDelta
+	} else {
+		mt = marshalTypeNearestDelta2
+	}
+	return append(dst, data...), mt, firstValue
+}
+
+func isConst(a []int64) bool {
+	for _, v := range a[1:] {
+		if v != a[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func isDeltaConst(a []int64) bool {
+	if len(a) < 2 {
+		return false
+	}
+	d := a[1] - a[0]
+	for i := 2; i < len(a); i++ {
+		if a[i]-a[i-1] != d {
+			return false
+		}
+	}
+	return true
+}
+
+// isGauge reports whether the values go down more often than it happens to counters with resets
+func isGauge(a []int64) bool {
+	resets := 0
+	for i := 1; i < len(a); i++ {
+		if a[i] < a[i-1] {
+			resets++
+		}
+	}
+	return resets > len(a)/8
+}
+
+// decimalToFloat converts decimal mantissas with the common exponent to float values
+func decimalToFloat(va []int64, scale int16) []float64 {
+	result := make([]float64, len(va))
+	for i, v := range va {
+		switch v {
+		case vInfPos:
+			result[i] = math.Inf(1)
+		case vInfNeg:
+			result[i] = math.Inf(-1)
+		case vStaleNaN:
+			result[i] = staleNaN
+		default:
+			if scale < 0 {
+				// Division is more precise than multiplication by the negative power of 10
+				result[i] = float64(v) / math.Pow10(int(-scale))
+			} else {
+				result[i] = float64(v) * math.Pow10(int(scale))
+			}
+		}
+	}
+	return result
+}
+
+// floatToDecimal converts float values to decimal mantissas with the common exponent. The values are kept exactly
+// unless their magnitudes differ so much, that the smallest ones don't fit into int64 with the common exponent
+func floatToDecimal(fa []float64) ([]int64, int16) {
+	mantissas := make([]int64, len(fa))
+	exps := make([]int16, len(fa))
+	minExp, found := int16(0), false
+	for i, f := range fa {
+		mantissas[i], exps[i] = fromFloat(f)
+		if mantissas[i] == 0 || isSpecial(mantissas[i]) {
+			continue
+		}
+		if !found || exps[i] < minExp {
+			minExp, found = exps[i], true
+		}
+	}
+
+	result := make([]int64, len(fa))
+	for scale := minExp; ; scale++ {
+		if scaleDecimals(result, mantissas, exps, scale) {
+			return result, scale
+		}
+	}
+}
+
+func scaleDecimals(dst, mantissas []int64, exps []int16, scale int16) bool {
+	for i, m := range mantissas {
+		if m == 0 || isSpecial(m) {
+			dst[i] = m
+			continue
+		}
+		d := int(exps[i]) - int(scale)
+		for ; d > 0; d-- {
+			if m > vMax/10 || m < -vMax/10 {
+				return false
+			}
+			m *= 10
+		}
+		if d < 0 {
+			if d < -18 {
+				m = 0
+			} else {
+				p := int64(math.Pow10(-d))
+				m = (m + sign(m)*p/2) / p
+			}
+		}
+		dst[i] = m
+	}
+	return true
+}
+
+func sign(v int64) int64 {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+func isSpecial(v int64) bool {
+	return v == vInfPos || v == vInfNeg || v == vStaleNaN
+}
+
+// fromFloat returns the shortest decimal mantissa and exponent representing the value
+func fromFloat(f float64) (int64, int16) {
+	switch {
+	case f == 0:
+		return 0, 0
+	case math.IsInf(f, 1):
+		return vInfPos, 0
+	case math.IsInf(f, -1):
+		return vInfNeg, 0
+	case math.IsNaN(f):
+		return vStaleNaN, 0
+	}
+
+	s := strconv.FormatFloat(math.Abs(f), 'e', -1, 64)
+	digits, expStr, _ := strings.Cut(s, "e")
+	digits = strings.Replace(digits, ".", "", 1)
+	exp, _ := strconv.Atoi(expStr)
+	exp -= len(digits) - 1
+	for len(digits) > 1 && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+	m, _ := strconv.ParseInt(digits, 10, 64)
+	if f < 0 {
+		m = -m
+	}
+	return m, int16(exp)
+}
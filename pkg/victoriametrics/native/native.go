@@ -0,0 +1,327 @@
+package native
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Revision is a revision of the VictoriaMetrics native block format
+type Revision int
+
+const (
+	RevisionUnknown Revision = iota
+	// RevisionV1 is produced by VictoriaMetrics before 1.82.0
+	RevisionV1
+	// RevisionV2 is produced by VictoriaMetrics 1.82.0 and later. Block header contains max timestamp and precision bits
+	RevisionV2
+)
+
+func (r Revision) String() string {
+	switch r {
+	case RevisionV1:
+		return "v1 (VictoriaMetrics < 1.82.0)"
+	case RevisionV2:
+		return "v2 (VictoriaMetrics >= 1.82.0)"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	maxMetricNameSize = 1024 * 1024
+	maxBlockSize      = 1024 * 1024
+	maxRowsPerBlock   = 8 * 1024
+)
+
+const (
+	escapeChar       = 0
+	tagSeparatorChar = 1
+	kvSeparatorChar  = 2
+)
+
+const MetricNameLabel = "__name__"
+
+// BlockHeader is a header of the block in the portable (native export) format
+type BlockHeader struct {
+	MinTimestamp          int64
+	MaxTimestamp          int64
+	FirstValue            int64
+	RowsCount             uint32
+	Scale                 int16
+	TimestampsMarshalType byte
+	ValuesMarshalType     byte
+	PrecisionBits         uint8
+}
+
+// Block is a single time series block from the native export
+type Block struct {
+	Labels         map[string]string
+	Header         BlockHeader
+	Revision       Revision
+	TimestampsData []byte
+	ValuesData     []byte
+}
+
+// Reader reads blocks from the VictoriaMetrics native export stream. The stream must be already decompressed
+type Reader struct {
+	r *bufio.Reader
+
+	// MinTimestamp and MaxTimestamp is the time range of the export in milliseconds
+	MinTimestamp int64
+	MaxTimestamp int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	trBuf := make([]byte, 16)
+	if _, err := io.ReadFull(br, trBuf); err != nil {
+		return nil, errors.Wrap(err, "failed to read time range")
+	}
+
+	return &Reader{
+		r:            br,
+		MinTimestamp: unmarshalInt64(trBuf),
+		MaxTimestamp: unmarshalInt64(trBuf[8:]),
+	}, nil
+}
+
+// Next returns the next block from the stream. It returns io.EOF if there are no more blocks
+func (r *Reader) Next() (*Block, error) {
+	metricName, err := r.readSized(maxMetricNameSize, true)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.Wrap(err, "failed to read metric name")
+	}
+
+	blockData, err := r.readSized(maxBlockSize, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read block")
+	}
+
+	labels, err := UnmarshalMetricName(metricName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal metric name")
+	}
+
+	b, err := UnmarshalBlock(blockData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal block of %v", labels)
+	}
+	b.Labels = labels
+
+	return b, nil
+}
+
+func (r *Reader) readSized(limit uint32, allowEOF bool) ([]byte, error) {
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, sizeBuf); err != nil {
+		if err == io.EOF && allowEOF {
+			return nil, io.EOF
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "failed to read size")
+	}
+	size := binary.BigEndian.Uint32(sizeBuf)
+	if size > limit {
+		return nil, errors.Errorf("too big size: got %d, shouldn't exceed %d", size, limit)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrapf(err, "failed to read %d bytes", size)
+	}
+	return buf, nil
+}
+
+// UnmarshalBlock parses block in any known revision of the format
+func UnmarshalBlock(src []byte) (*Block, error) {
+	var errs []error
+	for _, rev := range []Revision{RevisionV2, RevisionV1} {
+		b, err := unmarshalBlock(src, rev)
+		if err == nil {
+			return b, nil
+		}
+		errs = append(errs, errors.Wrapf(err, "revision %s", rev))
+	}
+	return nil, errors.Errorf("block doesn't match any known revision: %v", errs)
+}
+
+func unmarshalBlock(src []byte, rev Revision) (*Block, error) {
+	b := &Block{Revision: rev}
+	h := &b.Header
+
+	var err error
+	if src, h.MinTimestamp, err = unmarshalVarInt64(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal min timestamp")
+	}
+	if rev == RevisionV2 {
+		if src, h.MaxTimestamp, err = unmarshalVarInt64(src); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal max timestamp")
+		}
+	}
+	if src, h.FirstValue, err = unmarshalVarInt64(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal first value")
+	}
+	var rowsCount uint64
+	if src, rowsCount, err = unmarshalVarUint64(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal rows count")
+	}
+	if rowsCount == 0 || rowsCount > maxRowsPerBlock {
+		return nil, errors.Errorf("invalid rows count: %d", rowsCount)
+	}
+	h.RowsCount = uint32(rowsCount)
+	var scale int64
+	if src, scale, err = unmarshalVarInt64(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal scale")
+	}
+	if scale < math.MinInt16 || scale > math.MaxInt16 {
+		return nil, errors.Errorf("invalid scale: %d", scale)
+	}
+	h.Scale = int16(scale)
+
+	headerLen := 2
+	if rev == RevisionV2 {
+		headerLen = 3
+	}
+	if len(src) < headerLen {
+		return nil, errors.New("failed to unmarshal marshal types: unexpected end of block")
+	}
+	h.TimestampsMarshalType, h.ValuesMarshalType = src[0], src[1]
+	h.PrecisionBits = 64
+	if rev == RevisionV2 {
+		h.PrecisionBits = src[2]
+	}
+	src = src[headerLen:]
+
+	if !validMarshalType(h.TimestampsMarshalType) {
+		return nil, errors.Errorf("invalid timestamps marshal type: %d", h.TimestampsMarshalType)
+	}
+	if !validMarshalType(h.ValuesMarshalType) {
+		return nil, errors.Errorf("invalid values marshal type: %d", h.ValuesMarshalType)
+	}
+	if h.PrecisionBits < 1 || h.PrecisionBits > 64 {
+		return nil, errors.Errorf("invalid precision bits: %d", h.PrecisionBits)
+	}
+	if rev == RevisionV2 && h.MaxTimestamp < h.MinTimestamp {
+		return nil, errors.Errorf("max timestamp %d is smaller than min timestamp %d", h.MaxTimestamp, h.MinTimestamp)
+	}
+
+	if src, b.TimestampsData, err = unmarshalBytes(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal timestamps data")
+	}
+	if src, b.ValuesData, err = unmarshalBytes(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal values data")
+	}
+	if len(src) > 0 {
+		return nil, errors.Errorf("unexpected tail of %d bytes", len(src))
+	}
+	return b, nil
+}
+
+// UnmarshalMetricName parses marshaled VictoriaMetrics metric name into labels
+func UnmarshalMetricName(src []byte) (map[string]string, error) {
+	labels := make(map[string]string)
+
+	src, name, err := unmarshalTagValue(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal metric group")
+	}
+	if len(name) > 0 {
+		labels[MetricNameLabel] = string(name)
+	}
+
+	for len(src) > 0 {
+		var key, value []byte
+		if src, key, err = unmarshalTagValue(src); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal tag key")
+		}
+		if src, value, err = unmarshalTagValue(src); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal tag value")
+		}
+		labels[string(key)] = string(value)
+	}
+	return labels, nil
+}
+
+func unmarshalTagValue(src []byte) ([]byte, []byte, error) {
+	n := bytes.IndexByte(src, tagSeparatorChar)
+	if n < 0 {
+		return src, nil, errors.New("cannot find the end of tag value")
+	}
+	b := src[:n]
+	src = src[n+1:]
+
+	var dst []byte
+	for {
+		n := bytes.IndexByte(b, escapeChar)
+		if n < 0 {
+			return src, append(dst, b...), nil
+		}
+		dst = append(dst, b[:n]...)
+		b = b[n+1:]
+		if len(b) == 0 {
+			return src, nil, errors.New("missing escaped char")
+		}
+		switch b[0] {
+		case '0':
+			dst = append(dst, escapeChar)
+		case '1':
+			dst = append(dst, tagSeparatorChar)
+		case '2':
+			dst = append(dst, kvSeparatorChar)
+		default:
+			return src, nil, fmt.Errorf("unsupported escaped char: %c", b[0])
+		}
+		b = b[1:]
+	}
+}
+
+func validMarshalType(t byte) bool {
+	return t >= 1 && t <= 6
+}
+
+// unmarshalInt64 decodes zig-zag encoded big-endian int64
+func unmarshalInt64(src []byte) int64 {
+	u := binary.BigEndian.Uint64(src[:8])
+	return int64(u>>1) ^ (int64(u<<63) >> 63)
+}
+
+func unmarshalVarInt64(src []byte) ([]byte, int64, error) {
+	v, n := binary.Varint(src)
+	if n <= 0 {
+		return src, 0, errors.New("failed to unmarshal varint")
+	}
+	return src[n:], v, nil
+}
+
+func unmarshalVarUint64(src []byte) ([]byte, uint64, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 {
+		return src, 0, errors.New("failed to unmarshal varuint")
+	}
+	return src[n:], v, nil
+}
+
+func unmarshalBytes(src []byte) ([]byte, []byte, error) {
+	src, n, err := unmarshalVarUint64(src)
+	if err != nil {
+		return src, nil, err
+	}
+	if uint64(len(src)) < n {
+		return src, nil, errors.Errorf("unexpected end of data: need %d bytes, got %d", n, len(src))
+	}
+	return src[n:], src[:n], nil
+}
@@ -0,0 +1,286 @@
+package native
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		revision Revision
+	}{
+		{
+			name:     "revision v1",
+			revision: RevisionV1,
+		},
+		{
+			name:     "revision v2",
+			revision: RevisionV2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := map[string]string{
+				MetricNameLabel: "node_load1",
+				"instance":      "pmm\x01server",
+			}
+
+			buf := new(bytes.Buffer)
+			buf.Write(marshalInt64(nil, 1000))
+			buf.Write(marshalInt64(nil, 2000))
+			for i := 0; i < 3; i++ {
+				writeSized(buf, []byte("node_load1\x01instance\x01pmm\x001server\x01"))
+				writeSized(buf, fakeBlock(tt.revision))
+			}
+
+			r, err := NewReader(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.MinTimestamp != 1000 || r.MaxTimestamp != 2000 {
+				t.Fatalf("unexpected time range: %d-%d", r.MinTimestamp, r.MaxTimestamp)
+			}
+
+			blocks := 0
+			for {
+				b, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b.Revision != tt.revision {
+					t.Fatalf("expected revision %s, got %s", tt.revision, b.Revision)
+				}
+				if !reflect.DeepEqual(b.Labels, labels) {
+					t.Fatalf("expected labels %v, got %v", labels, b.Labels)
+				}
+				if b.Header.RowsCount != 2 {
+					t.Fatalf("expected 2 rows, got %d", b.Header.RowsCount)
+				}
+				blocks++
+			}
+			if blocks != 3 {
+				t.Fatalf("expected 3 blocks, got %d", blocks)
+			}
+		})
+	}
+
+	t.Run("truncated block", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		buf.Write(make([]byte, 16))
+		writeSized(buf, []byte("up\x01"))
+		block := fakeBlock(RevisionV2)
+		writeSized(buf, block[:len(block)-1])
+
+		r, err := NewReader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.Next(); err == nil {
+			t.Fatal("expected error for truncated block")
+		}
+	})
+}
+
+func fakeBlock(rev Revision) []byte {
+	var dst []byte
+	dst = binary.AppendVarint(dst, 1000)
+	if rev == RevisionV2 {
+		dst = binary.AppendVarint(dst, 2000)
+	}
+	dst = binary.AppendVarint(dst, 5)
+	dst = binary.AppendUvarint(dst, 2)
+	dst = binary.AppendVarint(dst, 0)
+	dst = append(dst, 2, 2)
+	if rev == RevisionV2 {
+		dst = append(dst, 64)
+	}
+	dst = binary.AppendUvarint(dst, 1)
+	dst = append(dst, 2)
+	dst = binary.AppendUvarint(dst, 1)
+	dst = append(dst, 0)
+	return dst
+}
+
+func writeSized(buf *bytes.Buffer, data []byte) {
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data))))
+	buf.Write(data)
+}
+
+func TestWriter(t *testing.T) {
+	series := []struct {
+		name   string
+		values func(i int) float64
+		rows   int
+	}{
+		{name: "const", values: func(int) float64 { return 1 }, rows: 10},
+		{name: "counter", values: func(i int) float64 { return float64(i*i) * 1.5 }, rows: 1000},
+		{name: "gauge", values: func(i int) float64 { return math.Sin(float64(i)) * 1e6 }, rows: 1000},
+		{name: "fractions", values: func(i int) float64 { return 0.1 * float64(i%7) }, rows: 300},
+		{name: "big", values: func(i int) float64 { return 1e300 * float64(i) }, rows: 3},
+		{name: "special", values: func(i int) float64 { return []float64{math.Inf(1), 0.25, math.Inf(-1)}[i] }, rows: 3},
+		{name: "many blocks", values: func(i int) float64 { return float64(i) }, rows: maxRowsPerBlock*2 + 1},
+		{name: "single", values: func(int) float64 { return -42 }, rows: 1},
+	}
+
+	for _, rev := range []Revision{RevisionV1, RevisionV2} {
+		t.Run(rev.String(), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w, err := NewWriter(buf, rev, 1000, 2000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			type samples struct {
+				timestamps []int64
+				values     []float64
+			}
+			expected := make(map[string]*samples)
+			for _, s := range series {
+				e := &samples{}
+				for i := 0; i < s.rows; i++ {
+					e.timestamps = append(e.timestamps, 1000+int64(i)*15000+int64(i%3))
+					e.values = append(e.values, s.values(i))
+				}
+				expected[s.name] = e
+				labels := map[string]string{MetricNameLabel: "test", "series": s.name, "escaped": "a\x00b\x02"}
+				if err = w.WriteSeries(labels, e.timestamps, e.values); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, err := NewReader(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]*samples)
+			for {
+				b, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b.Revision != rev {
+					t.Fatalf("expected revision %s, got %s", rev, b.Revision)
+				}
+				if b.Labels["escaped"] != "a\x00b\x02" {
+					t.Fatalf("unexpected labels: %q", b.Labels)
+				}
+				timestamps, values, err := b.Decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				g, ok := got[b.Labels["series"]]
+				if !ok {
+					g = &samples{}
+					got[b.Labels["series"]] = g
+				}
+				g.timestamps = append(g.timestamps, timestamps...)
+				g.values = append(g.values, values...)
+			}
+
+			// Values of the block share the exponent, so precision is relative to the largest value
+			for name, e := range expected {
+				g := got[name]
+				if g == nil || !reflect.DeepEqual(g.timestamps, e.timestamps) {
+					t.Fatalf("%s: unexpected timestamps", name)
+				}
+				maxAbs := 0.0
+				for _, v := range e.values {
+					if !math.IsInf(v, 0) {
+						maxAbs = math.Max(maxAbs, math.Abs(v))
+					}
+				}
+				for i, v := range e.values {
+					if g.values[i] != v && math.Abs(g.values[i]-v) > maxAbs*1e-15 {
+						t.Fatalf("%s: expected %v at %d, got %v", name, v, i, g.values[i])
+					}
+				}
+			}
+		})
+	}
+
+	b, err := UnmarshalBlock(fakeBlock(RevisionV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps, values, err := b.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(timestamps, []int64{1000, 1001}) || !reflect.DeepEqual(values, []float64{5, 5}) {
+		t.Fatalf("unexpected samples of the delta const block: %v %v", timestamps, values)
+	}
+}
+
+func TestRevisionForVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		expected  Revision
+		shouldErr bool
+	}{
+		{version: "v1.77.2", expected: RevisionV1},
+		{version: "1.81.99", expected: RevisionV1},
+		{version: "v1.82.0", expected: RevisionV2},
+		{version: "v1.82.1-cluster", expected: RevisionV2},
+		{version: "1.93", expected: RevisionV2},
+		{version: "v2.0.0", expected: RevisionV2},
+		{version: "v0.99.0", expected: RevisionV1},
+		{version: "latest", shouldErr: true},
+		{version: "1", shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			rev, err := RevisionForVersion(tt.version)
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatal("there was no err")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, rev)
+			}
+		})
+	}
+}
+
+func TestDetectRevision(t *testing.T) {
+	for _, rev := range []Revision{RevisionV1, RevisionV2} {
+		buf := new(bytes.Buffer)
+		w, err := NewWriter(buf, rev, 1000, 2000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.WriteSeries(map[string]string{MetricNameLabel: "up"}, []int64{1000, 2000}, []float64{0.5, 1}); err != nil {
+			t.Fatal(err)
+		}
+		detected, err := DetectRevision(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detected != rev {
+			t.Fatalf("expected %s, got %s", rev, detected)
+		}
+	}
+
+	empty := new(bytes.Buffer)
+	if _, err := NewWriter(empty, RevisionV2, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if detected, err := DetectRevision(empty); err != nil || detected != RevisionUnknown {
+		t.Fatalf("expected unknown revision of empty stream, got %s: %v", detected, err)
+	}
+}
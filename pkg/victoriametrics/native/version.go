@@ -0,0 +1,86 @@
+package native
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// minRevisionV2Version is the first VictoriaMetrics version, which produces and accepts RevisionV2 blocks
+var minRevisionV2Version = [3]int{1, 82, 0}
+
+// RevisionForVersion returns revision of the native format used by VictoriaMetrics of the version, ex. v1.82.1 or 1.77.2
+func RevisionForVersion(version string) (Revision, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return RevisionUnknown, err
+	}
+	if compareVersions(v, minRevisionV2Version) < 0 {
+		return RevisionV1, nil
+	}
+	return RevisionV2, nil
+}
+
+// CompareVersions returns -1, 0 or 1 if version a is lower, equal or greater than version b
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	return compareVersions(va, vb), nil
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseVersion parses major, minor and patch numbers of the version. Suffixes like -rc1 are ignored
+func parseVersion(version string) ([3]int, error) {
+	var v [3]int
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return v, errors.Errorf("invalid version %q", version)
+	}
+	for i, p := range parts {
+		if end := strings.IndexFunc(p, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+			p = p[:end]
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return v, errors.Errorf("invalid version %q", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// DetectRevision returns revision of the first block of the decompressed native export stream.
+// RevisionUnknown is returned for the stream without blocks
+func DetectRevision(r io.Reader) (Revision, error) {
+	nr, err := NewReader(r)
+	if err != nil {
+		return RevisionUnknown, err
+	}
+	b, err := nr.Next()
+	if err == io.EOF {
+		return RevisionUnknown, nil
+	}
+	if err != nil {
+		return RevisionUnknown, err
+	}
+	return b.Revision, nil
+}
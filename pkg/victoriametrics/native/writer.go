@@ -0,0 +1,134 @@
+package native
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Decode returns timestamps in milliseconds and values of the block
+func (b *Block) Decode() ([]int64, []float64, error) {
+	h := b.Header
+	timestamps, err := unmarshalInt64Array(b.TimestampsData, h.TimestampsMarshalType, h.MinTimestamp, int(h.RowsCount))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode timestamps")
+	}
+	mantissas, err := unmarshalInt64Array(b.ValuesData, h.ValuesMarshalType, h.FirstValue, int(h.RowsCount))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode values")
+	}
+	return timestamps, decimalToFloat(mantissas, h.Scale), nil
+}
+
+// Writer writes time series in the VictoriaMetrics native export format of the given revision
+type Writer struct {
+	w        io.Writer
+	revision Revision
+}
+
+// NewWriter writes the header with the time range of the export in milliseconds
+func NewWriter(w io.Writer, revision Revision, minTimestamp, maxTimestamp int64) (*Writer, error) {
+	if revision != RevisionV1 && revision != RevisionV2 {
+		return nil, errors.Errorf("unsupported revision %s", revision)
+	}
+	header := marshalInt64(nil, minTimestamp)
+	header = marshalInt64(header, maxTimestamp)
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "failed to write time range")
+	}
+	return &Writer{w: w, revision: revision}, nil
+}
+
+// WriteSeries writes samples of the series sorted by timestamp. Samples are split into blocks of the max allowed size
+func (w *Writer) WriteSeries(labels map[string]string, timestamps []int64, values []float64) error {
+	if len(timestamps) != len(values) {
+		return errors.Errorf("got %d timestamps and %d values", len(timestamps), len(values))
+	}
+	name := MarshalMetricName(labels)
+	for start := 0; start < len(timestamps); start += maxRowsPerBlock {
+		end := start + maxRowsPerBlock
+		if end > len(timestamps) {
+			end = len(timestamps)
+		}
+		if err := w.writeSized(name); err != nil {
+			return errors.Wrap(err, "failed to write metric name")
+		}
+		if err := w.writeSized(MarshalBlock(timestamps[start:end], values[start:end], w.revision)); err != nil {
+			return errors.Wrap(err, "failed to write block")
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeSized(data []byte) error {
+	if _, err := w.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data)))); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+// MarshalBlock encodes non-empty samples sorted by timestamp into the block of the revision
+func MarshalBlock(timestamps []int64, values []float64, rev Revision) []byte {
+	timestampsData, timestampsType, minTimestamp := marshalInt64Array(nil, timestamps)
+	mantissas, scale := floatToDecimal(values)
+	valuesData, valuesType, firstValue := marshalInt64Array(nil, mantissas)
+
+	var dst []byte
+	dst = binary.AppendVarint(dst, minTimestamp)
+	if rev == RevisionV2 {
+		dst = binary.AppendVarint(dst, timestamps[len(timestamps)-1])
+	}
+	dst = binary.AppendVarint(dst, firstValue)
+	dst = binary.AppendUvarint(dst, uint64(len(timestamps)))
+	dst = binary.AppendVarint(dst, int64(scale))
+	dst = append(dst, timestampsType, valuesType)
+	if rev == RevisionV2 {
+		dst = append(dst, 64)
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(timestampsData)))
+	dst = append(dst, timestampsData...)
+	dst = binary.AppendUvarint(dst, uint64(len(valuesData)))
+	dst = append(dst, valuesData...)
+	return dst
+}
+
+// MarshalMetricName encodes labels as VictoriaMetrics metric name: metric group followed by the sorted tags
+func MarshalMetricName(labels map[string]string) []byte {
+	dst := marshalTagValue(nil, labels[MetricNameLabel])
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != MetricNameLabel {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		dst = marshalTagValue(dst, k)
+		dst = marshalTagValue(dst, labels[k])
+	}
+	return dst
+}
+
+func marshalTagValue(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case escapeChar:
+			dst = append(dst, escapeChar, '0')
+		case tagSeparatorChar:
+			dst = append(dst, escapeChar, '1')
+		case kvSeparatorChar:
+			dst = append(dst, escapeChar, '2')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, tagSeparatorChar)
+}
+
+// marshalInt64 encodes int64 as zig-zag big-endian
+func marshalInt64(dst []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(dst, uint64((v<<1)^(v>>63)))
+}
@@ -0,0 +1,111 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// OpenMetricsWriter writes metrics in OpenMetrics text format. Every sample is written with its timestamp,
+// so samples of the same series could be written by several calls
+type OpenMetricsWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func NewOpenMetricsWriter(w io.Writer) *OpenMetricsWriter {
+	return &OpenMetricsWriter{w: bufio.NewWriterSize(w, 64*1024)}
+}
+
+// Write writes all the samples of the metric. Metric without name can't be represented in OpenMetrics, so it's skipped
+func (w *OpenMetricsWriter) Write(m Metric) error {
+	name := m.Metric["__name__"]
+	if name == "" {
+		log.Warn().Msgf("Skipping metric without name: %v", m.Metric)
+		return nil
+	}
+	if len(m.Values) != len(m.Timestamps) {
+		return errors.Errorf("metric %s has %d values, but %d timestamps", name, len(m.Values), len(m.Timestamps))
+	}
+
+	series := openMetricsSeries(name, m.Metric)
+	for i, v := range m.Values {
+		w.buf = append(w.buf[:0], series...)
+		w.buf = append(w.buf, ' ')
+		w.buf = appendOpenMetricsValue(w.buf, v)
+		w.buf = append(w.buf, ' ')
+		w.buf = appendOpenMetricsTimestamp(w.buf, m.Timestamps[i])
+		w.buf = append(w.buf, '\n')
+		if _, err := w.w.Write(w.buf); err != nil {
+			return errors.Wrap(err, "failed to write sample")
+		}
+	}
+	return nil
+}
+
+// Close writes the terminating `# EOF` line and flushes the buffered data. The underlying writer isn't closed
+func (w *OpenMetricsWriter) Close() error {
+	if _, err := w.w.WriteString("# EOF\n"); err != nil {
+		return errors.Wrap(err, "failed to write EOF")
+	}
+	return w.w.Flush()
+}
+
+// openMetricsSeries returns name of the series with labels sorted by name, ex. up{instance="a",job="node"}
+func openMetricsSeries(name string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		if l != "__name__" {
+			names = append(names, l)
+		}
+	}
+	if len(names) == 0 {
+		return name
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i, l := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(labels[l]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func appendOpenMetricsValue(dst []byte, v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(dst, "NaN"...)
+	case math.IsInf(v, 1):
+		return append(dst, "+Inf"...)
+	case math.IsInf(v, -1):
+		return append(dst, "-Inf"...)
+	default:
+		return strconv.AppendFloat(dst, v, 'g', -1, 64)
+	}
+}
+
+// appendOpenMetricsTimestamp appends timestamp in milliseconds as seconds, ex. 1600000000.5
+func appendOpenMetricsTimestamp(dst []byte, ts int64) []byte {
+	return strconv.AppendFloat(dst, float64(ts)/1000, 'f', -1, 64)
+}
@@ -0,0 +1,54 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestOpenMetricsWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewOpenMetricsWriter(buf)
+	metrics := []Metric{
+		{
+			Metric:     map[string]string{"__name__": "up", "job": "node", "instance": "a"},
+			Values:     []float64{1, 0},
+			Timestamps: []int64{1600000000000, 1600000015500},
+		},
+		{
+			Metric:     map[string]string{"__name__": "node_info", "version": "say \"hi\"\n\\"},
+			Values:     []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e300, 0.25},
+			Timestamps: []int64{1000, 2000, 3000, 4000, 5000},
+		},
+		{
+			Metric:     map[string]string{"job": "nameless"},
+			Values:     []float64{1},
+			Timestamps: []int64{1000},
+		},
+	}
+	for _, m := range metrics {
+		if err := w.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `up{instance="a",job="node"} 1 1600000000
+up{instance="a",job="node"} 0 1600000015.5
+node_info{version="say \"hi\"\n\\"} NaN 1
+node_info{version="say \"hi\"\n\\"} +Inf 2
+node_info{version="say \"hi\"\n\\"} -Inf 3
+node_info{version="say \"hi\"\n\\"} 1e+300 4
+node_info{version="say \"hi\"\n\\"} 0.25 5
+# EOF
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	if err := NewOpenMetricsWriter(buf).Write(Metric{Metric: map[string]string{"__name__": "up"}, Values: []float64{1}}); err == nil {
+		t.Fatal("metric with different amount of values and timestamps should be rejected")
+	}
+}
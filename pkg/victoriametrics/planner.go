@@ -0,0 +1,174 @@
+package victoriametrics
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+
+	"pmm-dump/pkg/dump"
+)
+
+// Limits of the chunk duration used by the planner unless the initial duration is out of them
+// and the latency of reading the chunk, which is considered fast enough to grow the duration
+const (
+	MinAdaptiveChunkTimeRange   = 30 * time.Second
+	MaxAdaptiveChunkTimeRange   = 6 * time.Hour
+	DefaultAdaptiveChunkLatency = 10 * time.Second
+)
+
+// PlannerConfig configures adaptive planning of the chunks
+type PlannerConfig struct {
+	// TimeRange is the initial duration of the chunk, it's changed within MinTimeRange and MaxTimeRange
+	TimeRange    time.Duration
+	MinTimeRange time.Duration
+	MaxTimeRange time.Duration
+	// TargetSize is the max size of the chunk content, larger chunks are split. Chunks are grown if they are
+	// less than half of the size and are read faster than half of the TargetLatency
+	TargetSize    int64
+	TargetLatency time.Duration
+	// InFlight is the number of chunks planned ahead, it should be the number of reading workers
+	InFlight int
+}
+
+// ChunkPlanner is the chunk pool, which plans VictoriaMetrics chunks of the time range one by one adapting their duration
+// to the size and latency of the read chunks. Chunk, which times out or exceeds the target size, is split in half and read again.
+// Chunks of other sources are returned as is
+type ChunkPlanner struct {
+	pool *dump.ChunkPool
+	cfg  PlannerConfig
+
+	mu        sync.Mutex
+	next, end time.Time
+	timeRange time.Duration
+}
+
+// NewChunkPlanner creates planner of the chunks from start to end. Other chunks are added to the pool after the first planned ones
+func NewChunkPlanner(start, end time.Time, cfg PlannerConfig, other []dump.ChunkMeta) (*ChunkPlanner, error) {
+	if cfg.TimeRange <= 0 {
+		return nil, errors.Errorf("invalid chunk time range: %v", cfg.TimeRange)
+	}
+	if cfg.MinTimeRange <= 0 || cfg.MinTimeRange > cfg.TimeRange {
+		cfg.MinTimeRange = cfg.TimeRange
+	}
+	if cfg.MaxTimeRange < cfg.TimeRange {
+		cfg.MaxTimeRange = cfg.TimeRange
+	}
+	if cfg.InFlight <= 0 {
+		cfg.InFlight = 1
+	}
+
+	p := &ChunkPlanner{
+		cfg:       cfg,
+		next:      start,
+		end:       end,
+		timeRange: cfg.TimeRange,
+	}
+	var chunks []dump.ChunkMeta
+	for i := 0; i < cfg.InFlight; i++ {
+		c, ok := p.plan()
+		if !ok {
+			break
+		}
+		chunks = append(chunks, c)
+	}
+	pool, err := dump.NewChunkPool(append(chunks, other...))
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+	return p, nil
+}
+
+// Next returns the next chunk to read
+func (p *ChunkPlanner) Next() (dump.ChunkMeta, bool) {
+	return p.pool.Next()
+}
+
+// Feedback adapts the chunk duration to the result of reading the chunk and plans the next one.
+// It returns true if the chunk is replaced by its halves, so its content or error should be dropped
+func (p *ChunkPlanner) Feedback(m dump.ChunkMeta, c *dump.Chunk, elapsed time.Duration, err error) bool {
+	if m.Source != dump.VictoriaMetrics || m.Start == nil || m.End == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timeRange := m.End.Sub(*m.Start)
+	var size int64
+	if c != nil {
+		size = int64(len(c.Content))
+	}
+	tooLarge := err == nil && p.cfg.TargetSize > 0 && size > p.cfg.TargetSize
+	if isTimeout(err) || tooLarge {
+		if halves, ok := p.split(m); ok {
+			reason := "timed out"
+			if tooLarge {
+				reason = "is too large"
+			}
+			log.Info().Msgf("Chunk %s %s, splitting it into %s and %s", m, reason, halves[0], halves[1])
+			if half := timeRange / 2; half < p.timeRange {
+				p.timeRange = half
+			}
+			p.pool.Insert(halves...)
+			return true
+		}
+	}
+	if err != nil {
+		return false
+	}
+
+	small := p.cfg.TargetSize <= 0 || size < p.cfg.TargetSize/2
+	fast := p.cfg.TargetLatency <= 0 || elapsed < p.cfg.TargetLatency/2
+	if small && fast && timeRange >= p.timeRange && p.timeRange < p.cfg.MaxTimeRange {
+		p.timeRange *= 2
+		if p.timeRange > p.cfg.MaxTimeRange {
+			p.timeRange = p.cfg.MaxTimeRange
+		}
+		log.Debug().Msgf("Chunk %s is small, growing chunk time range to %v", m, p.timeRange)
+	}
+	if next, ok := p.plan(); ok {
+		p.pool.Insert(next)
+	}
+	return false
+}
+
+// plan returns the next chunk of the current duration or false if the whole time range is planned
+func (p *ChunkPlanner) plan() (dump.ChunkMeta, bool) {
+	if !p.next.Before(p.end) {
+		return dump.ChunkMeta{}, false
+	}
+	s, e := p.next, p.next.Add(p.timeRange)
+	if e.After(p.end) {
+		e = p.end
+	}
+	p.next = e
+	return dump.ChunkMeta{Source: dump.VictoriaMetrics, Start: &s, End: &e}, true
+}
+
+// split returns halves of the chunk aligned to seconds or false if they would be shorter than the min duration
+func (p *ChunkPlanner) split(m dump.ChunkMeta) ([]dump.ChunkMeta, bool) {
+	half := (m.End.Sub(*m.Start) / 2).Truncate(time.Second)
+	if half < p.cfg.MinTimeRange {
+		return nil, false
+	}
+	s, mid, e := *m.Start, m.Start.Add(half), *m.End
+	return []dump.ChunkMeta{
+		{Source: dump.VictoriaMetrics, Start: &s, End: &mid},
+		{Source: dump.VictoriaMetrics, Start: &mid, End: &e},
+	}, true
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, fasthttp.ErrTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,117 @@
+package victoriametrics
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"pmm-dump/pkg/dump"
+)
+
+func TestChunkPlanner(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+	busyStart, busyEnd := start.Add(time.Hour), start.Add(2*time.Hour)
+
+	// Every minute of the busy hour is 1000 bytes, other minutes are 10 bytes. Chunks of the busy hour longer than 20 minutes time out
+	read := func(m dump.ChunkMeta) (*dump.Chunk, error) {
+		var size int
+		busy := time.Duration(0)
+		for ts := *m.Start; ts.Before(*m.End); ts = ts.Add(time.Minute) {
+			if !ts.Before(busyStart) && ts.Before(busyEnd) {
+				size += 1000
+				busy += time.Minute
+			} else {
+				size += 10
+			}
+		}
+		if busy > 20*time.Minute {
+			return nil, fasthttp.ErrTimeout
+		}
+		return &dump.Chunk{ChunkMeta: m, Content: make([]byte, size)}, nil
+	}
+
+	p, err := NewChunkPlanner(start, end, PlannerConfig{
+		TimeRange:    15 * time.Minute,
+		MinTimeRange: time.Minute,
+		MaxTimeRange: time.Hour,
+		TargetSize:   5000,
+		InFlight:     1,
+	}, []dump.ChunkMeta{{Source: dump.ClickHouse, Index: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written []dump.ChunkMeta
+	var chChunks, splits int
+	var maxRange time.Duration
+	for {
+		m, ok := p.Next()
+		if !ok {
+			break
+		}
+		if m.Source == dump.ClickHouse {
+			chChunks++
+			continue
+		}
+		c, err := read(m)
+		if p.Feedback(m, c, time.Millisecond, err) {
+			splits++
+			continue
+		}
+		if err != nil {
+			t.Fatalf("chunk %s failed: %v", m, err)
+		}
+		if len(c.Content) > 5000 {
+			t.Fatalf("chunk %s of %d bytes exceeds target size", m, len(c.Content))
+		}
+		if r := m.End.Sub(*m.Start); r > maxRange {
+			maxRange = r
+		}
+		written = append(written, m)
+	}
+
+	if chChunks != 1 {
+		t.Fatalf("expected 1 clickhouse chunk, got %d", chChunks)
+	}
+	if splits == 0 {
+		t.Fatal("expected chunks of the busy hour to be split")
+	}
+	if maxRange <= 15*time.Minute || maxRange > time.Hour {
+		t.Fatalf("expected chunks to grow up to 1h, max chunk is %v", maxRange)
+	}
+	sort.Slice(written, func(i, j int) bool { return written[i].Start.Before(*written[j].Start) })
+	next := start
+	for _, m := range written {
+		if !m.Start.Equal(next) {
+			t.Fatalf("chunk %s doesn't start at the end of the previous one %d", m, next.Unix())
+		}
+		next = *m.End
+	}
+	if !next.Equal(end) {
+		t.Fatalf("chunks end at %v, expected %v", next, end)
+	}
+}
+
+func TestChunkPlannerMinTimeRange(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	p, err := NewChunkPlanner(start, start.Add(time.Minute), PlannerConfig{TimeRange: time.Minute, MinTimeRange: time.Minute, TargetSize: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := p.Next()
+	if !ok {
+		t.Fatal("expected chunk")
+	}
+	if p.Feedback(m, &dump.Chunk{ChunkMeta: m, Content: []byte("large")}, time.Millisecond, nil) {
+		t.Fatal("chunk of the min time range shouldn't be split")
+	}
+	if p.Feedback(m, nil, time.Millisecond, fasthttp.ErrTimeout) {
+		t.Fatal("timed out chunk of the min time range shouldn't be split")
+	}
+	if _, ok = p.Next(); ok {
+		t.Fatal("expected no more chunks")
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"pmm-dump/pkg/dump"
 	"pmm-dump/pkg/grafana"
+	"pmm-dump/pkg/retry"
+	"regexp"
 	"strconv"
 	"time"
 
@@ -81,7 +83,7 @@ func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
 	body := copyBytesArr(resp.Body())
 
 	if status := resp.StatusCode(); status != fasthttp.StatusOK {
-		return nil, errors.Errorf("non-OK response from victoria metrics: %d: %s", status, gzipDecode(body))
+		return nil, errors.Wrap(&retry.StatusError{Code: status, Body: gzipDecode(body)}, "non-OK response from victoria metrics")
 	}
 
 	log.Debug().Msg("Got successful response from Victoria Metrics")
@@ -273,7 +275,7 @@ func (s *Source) sendChunk(content []byte) error {
 		if s == http.StatusRequestEntityTooLarge {
 			return errors.New(errRequestEntityTooLarge)
 		}
-		return errors.Errorf("non-OK response from victoria metrics: %d: %s", s, gzipDecode(resp.Body()))
+		return errors.Wrap(&retry.StatusError{Code: s, Body: gzipDecode(resp.Body())}, "non-OK response from victoria metrics")
 	}
 
 	log.Debug().Msg("Got successful response from Victoria Metrics")
@@ -333,3 +335,62 @@ func SplitTimeRangeIntoChunks(start, end time.Time, delta time.Duration) (chunks
 
 	return
 }
+
+// appVersionRegexp matches version of VictoriaMetrics in the vm_app_version metric, ex. victoria-metrics-20220909-090855-tags-v1.81.2-0-g2d8a5bfe5
+var appVersionRegexp = regexp.MustCompile(`vm_app_version\{[^}]*version="[^"]*-(v\d+\.\d+\.\d+)[^"]*"`)
+
+// buildInfoVersionRegexp matches version of VictoriaMetrics in the buildinfo response, ex. v1.82.1 or victoria-metrics-20221005-102420-tags-v1.82.1-0-g2a8dbe6a0.
+// Prometheus-compatible version without `v` prefix, ex. 2.24.0, isn't matched
+var buildInfoVersionRegexp = regexp.MustCompile(`(?:^|-)(v\d+\.\d+\.\d+)`)
+
+// Version returns version of VictoriaMetrics, ex. v1.82.1. It's taken from /api/v1/status/buildinfo if it reports version of VictoriaMetrics
+// or from its own metrics otherwise
+func (s Source) Version() (string, error) {
+	version, err := s.buildInfoVersion()
+	if err == nil {
+		return version, nil
+	}
+	log.Debug().Msgf("Failed to get VictoriaMetrics version from buildinfo: %v", err)
+
+	url := fmt.Sprintf("%s/metrics", s.cfg.ConnectionURL)
+	log.Debug().Str("url", url).Msg("Requesting VictoriaMetrics version")
+
+	status, body, err := s.c.GetWithTimeout(url, requestTimeout)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+	if status != fasthttp.StatusOK {
+		return "", errors.Errorf("non-OK response from victoria metrics: %d", status)
+	}
+	m := appVersionRegexp.FindSubmatch(body)
+	if m == nil {
+		return "", errors.New("vm_app_version metric is not found")
+	}
+	return string(m[1]), nil
+}
+
+func (s Source) buildInfoVersion() (string, error) {
+	url := fmt.Sprintf("%s/api/v1/status/buildinfo", s.cfg.ConnectionURL)
+	log.Debug().Str("url", url).Msg("Requesting VictoriaMetrics build info")
+
+	status, body, err := s.c.GetWithTimeout(url, requestTimeout)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+	if status != fasthttp.StatusOK {
+		return "", errors.Errorf("non-OK response from victoria metrics: %d", status)
+	}
+	var resp struct {
+		Data struct {
+			Version string `json:"version"`
+		} `json:"data"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return "", errors.Wrap(err, "failed to unmarshal build info")
+	}
+	m := buildInfoVersionRegexp.FindStringSubmatch(resp.Data.Version)
+	if m == nil {
+		return "", errors.Errorf("build info doesn't contain version of VictoriaMetrics: %q", resp.Data.Version)
+	}
+	return m[1], nil
+}
@@ -103,6 +103,74 @@ func TestWriteChunk(t *testing.T) {
 	}
 }
 
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		buildInfo string
+		metrics   string
+		expected  string
+		shouldErr bool
+	}{
+		{
+			name:      "build info",
+			buildInfo: `{"status":"success","data":{"version":"v1.82.1"}}`,
+			metrics:   "vm_app_version{version=\"victoria-metrics-20220909-090855-tags-v1.81.2-0-g2d8a5bfe5\"} 1\n",
+			expected:  "v1.82.1",
+		},
+		{
+			name:      "prometheus-compatible build info",
+			buildInfo: `{"status":"success","data":{"version":"2.24.0"}}`,
+			metrics:   "vm_app_version{version=\"victoria-metrics-20220909-090855-tags-v1.81.2-0-g2d8a5bfe5\"} 1\n",
+			expected:  "v1.81.2",
+		},
+		{
+			name:     "single node",
+			metrics:  "vm_app_uptime_seconds 10\nvm_app_version{version=\"victoria-metrics-20220909-090855-tags-v1.81.2-0-g2d8a5bfe5\", short_version=\"v1.81.2\"} 1\n",
+			expected: "v1.81.2",
+		},
+		{
+			name:     "without short version",
+			metrics:  "vm_app_version{version=\"victoria-metrics-20221005-102420-tags-v1.82.1-0-g2a8dbe6a0\"} 1\n",
+			expected: "v1.82.1",
+		},
+		{
+			name:      "no version",
+			metrics:   "vm_app_uptime_seconds 10\n",
+			shouldErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				switch {
+				case req.URL.Path == "/api/v1/status/buildinfo" && tt.buildInfo != "":
+					_, _ = io.WriteString(rw, tt.buildInfo)
+				case req.URL.Path == "/metrics":
+					_, _ = io.WriteString(rw, tt.metrics)
+				default:
+					rw.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			s := NewSource(grafana.NewClient(&fasthttp.Client{}), Config{ConnectionURL: server.URL})
+			version, err := s.Version()
+			if tt.shouldErr {
+				if err == nil {
+					t.Fatal("there was no err")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, version)
+			}
+		})
+	}
+}
+
 func generateFakeChunk(size int) ([]byte, error) {
 	metricsData, err := json.Marshal(Metric{
 		Metric: map[string]string{